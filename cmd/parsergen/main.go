@@ -0,0 +1,346 @@
+// Command parsergen generates C JSON parsers outside of the program that
+// defines the structs, so generation can run as a standalone build step.
+//
+// Usage:
+//
+//	parsergen generate -dir ./models -type Student -out c_output
+//	parsergen generate -schema student.schema.json -out c_output
+//	parsergen generate -cstruct student.cstruct.json -out c_output
+//	parsergen generate -header legacy/student.h -type Student -out c_output
+//	parsergen generate -dir ./models -type Student -keep id,home.zip -reorder -dump-ir
+//	parsergen cstruct -dir ./models -type Student -o student.cstruct.json
+//	parsergen schema -dir ./models -type Student > student.schema.json
+//	parsergen compat -mode backward old.cstruct.json new.cstruct.json
+//	parsergen infer -type Student -pkg models samples/*.json > student.go
+//	parsergen toolchain -cc clang
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/cheader"
+	"github.com/arifali123/152compiler2/packages/compat"
+	"github.com/arifali123/152compiler2/packages/compiler"
+	"github.com/arifali123/152compiler2/packages/infer"
+	"github.com/arifali123/152compiler2/packages/ir"
+	"github.com/arifali123/152compiler2/packages/jsonschema"
+	"github.com/arifali123/152compiler2/packages/schema"
+)
+
+const usage = `Usage: parsergen <command> [flags]
+
+Commands:
+  generate   Generate C parser sources for a struct declared in Go source
+             or a C header (-header), or described by a JSON Schema
+             (-schema) or schema file (-cstruct)
+  schema     Export the JSON Schema of a struct declared in Go source
+  cstruct    Save a struct declared in Go source, a C header or a JSON
+             Schema as a schema file
+  compat     Report compatibility breaks between two versions of a struct;
+             exits 1 when the selected direction breaks
+  infer      Infer a Go struct from sample JSON documents or NDJSON
+  toolchain  Report the C compiler parsers would be built with
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = runGenerate(os.Args[2:])
+	case "schema":
+		err = runSchema(os.Args[2:])
+	case "cstruct":
+		err = runCStruct(os.Args[2:])
+	case "compat":
+		err = runCompat(os.Args[2:])
+	case "infer":
+		err = runInfer(os.Args[2:])
+	case "toolchain":
+		err = runToolchain(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "parsergen: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsergen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runGenerate analyzes a struct from Go source, a C header, a JSON Schema or a
+// schema file and writes its .h and .c files.
+func runGenerate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	dir := fs.String("dir", ".", "package directory containing the struct")
+	typeName := fs.String("type", "", "name of the struct type (required unless -schema has a title)")
+	schemaPath := fs.String("schema", "", "JSON Schema file to generate from instead of Go source")
+	cStructPath := fs.String("cstruct", "", "schema file to generate from instead of Go source")
+	headerPath := fs.String("header", "", "C header to generate from instead of Go source; -type defaults to its last struct")
+	outDir := fs.String("out", "c_output", "directory for the generated C files")
+	keep := fs.String("keep", "", "comma-separated key paths to keep, e.g. id,home.zip; other fields are eliminated")
+	reorder := fs.Bool("reorder", false, "order C members by alignment to minimize padding")
+	profile := fs.String("profile", "", "comma-separated sample JSON files; the parser expects keys in the order they use")
+	rejectUnknown := fs.Bool("reject-unknown", false, "reject keys the struct has no field for, rather than skipping them")
+	lenient := fs.Bool("lenient", false, "accept repeated and trailing commas, and anything after the root object")
+	replaceUTF8 := fs.Bool("replace-invalid-utf8", false, "decode invalid UTF-8 in strings as U+FFFD rather than rejecting it")
+	dumpIR := fs.Bool("dump-ir", false, "print the optimized IR to stderr")
+	fs.Parse(args)
+
+	var cStruct analyzer.CStruct
+	var err error
+	switch {
+	case *cStructPath != "":
+		cStruct, err = schema.Load(*cStructPath)
+	case *headerPath != "":
+		cStruct, err = cheader.ImportFile(*headerPath, *typeName)
+	case *schemaPath != "":
+		cStruct, err = jsonschema.ImportFile(*schemaPath, *typeName)
+	case *typeName == "":
+		fs.Usage()
+		return fmt.Errorf("generate: -type is required")
+	default:
+		cStruct, err = analyzer.AnalyzeSource(*dir, *typeName)
+	}
+	if err != nil {
+		return err
+	}
+
+	schema, err := compiler.LowerStruct(cStruct)
+	if err != nil {
+		return err
+	}
+	var passes []ir.Pass
+	if *keep != "" {
+		passes = append(passes, ir.EliminateDeadFields(strings.Split(*keep, ",")))
+	}
+	if *reorder {
+		passes = append(passes, ir.ReorderFields)
+	}
+	if *rejectUnknown {
+		passes = append(passes, ir.RejectUnknownKeys)
+	}
+	if *lenient {
+		passes = append(passes, ir.LenientSyntax)
+	}
+	if *replaceUTF8 {
+		passes = append(passes, ir.ReplaceInvalidUTF8)
+	}
+	if *profile != "" {
+		var samples []string
+		for _, path := range strings.Split(*profile, ",") {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, string(data))
+		}
+		passes = append(passes, ir.ProfileKeyOrder(samples))
+	}
+	if err := ir.Optimize(schema, append(passes, ir.DefaultPasses...)...); err != nil {
+		return err
+	}
+	if *dumpIR {
+		if err := schema.Dump(os.Stderr); err != nil {
+			return err
+		}
+	}
+	if err := compiler.CompileSchema(schema, *outDir); err != nil {
+		return err
+	}
+
+	fmt.Printf("Generated %s.h, %s.c and the jsonrt runtime in %s\n", cStruct.Name, cStruct.Name, *outDir)
+	return nil
+}
+
+// runSchema writes the JSON Schema for a struct declared in Go source.
+func runSchema(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	dir := fs.String("dir", ".", "package directory containing the struct")
+	typeName := fs.String("type", "", "name of the struct type (required)")
+	outPath := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	if *typeName == "" {
+		fs.Usage()
+		return fmt.Errorf("schema: -type is required")
+	}
+
+	cStruct, err := analyzer.AnalyzeSource(*dir, *typeName)
+	if err != nil {
+		return err
+	}
+	data, err := jsonschema.ExportJSON(cStruct)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *outPath == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*outPath, data, 0644)
+}
+
+// runCStruct saves the struct analyzed from Go source or imported from a JSON
+// Schema in the portable schema file format.
+func runCStruct(args []string) error {
+	fs := flag.NewFlagSet("cstruct", flag.ExitOnError)
+	dir := fs.String("dir", ".", "package directory containing the struct")
+	typeName := fs.String("type", "", "name of the struct type (required unless -schema has a title)")
+	schemaPath := fs.String("schema", "", "JSON Schema file to read instead of Go source")
+	headerPath := fs.String("header", "", "C header to read instead of Go source; -type defaults to its last struct")
+	outPath := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	var cStruct analyzer.CStruct
+	var err error
+	switch {
+	case *headerPath != "":
+		cStruct, err = cheader.ImportFile(*headerPath, *typeName)
+	case *schemaPath != "":
+		cStruct, err = jsonschema.ImportFile(*schemaPath, *typeName)
+	case *typeName == "":
+		fs.Usage()
+		return fmt.Errorf("cstruct: -type is required")
+	default:
+		cStruct, err = analyzer.AnalyzeSource(*dir, *typeName)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *outPath == "" {
+		data, err := schema.Marshal(cStruct)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return schema.Save(*outPath, cStruct)
+}
+
+// runCompat compares two versions of a struct, stored as schema files or JSON
+// Schemas, prints every change and fails if any breaks the selected mode.
+func runCompat(args []string) error {
+	fs := flag.NewFlagSet("compat", flag.ExitOnError)
+	mode := fs.String("mode", "full", "directions to enforce: backward, forward or full")
+	format := fs.String("format", "cstruct", "format of both files: cstruct or jsonschema")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: parsergen compat [flags] <old> <new>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("compat: expected the old and new files")
+	}
+	direction, err := compat.ParseDirection(*mode)
+	if err != nil {
+		return err
+	}
+
+	var structs [2]analyzer.CStruct
+	for i, path := range fs.Args() {
+		switch *format {
+		case "cstruct":
+			structs[i], err = schema.Load(path)
+		case "jsonschema":
+			structs[i], err = jsonschema.ImportFile(path, "")
+		default:
+			return fmt.Errorf("compat: unknown format %q", *format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	report := compat.Compare(structs[0], structs[1])
+	for _, change := range report.Changes {
+		fmt.Println(change)
+	}
+	if breaking := report.Breaking(direction); len(breaking) > 0 {
+		return fmt.Errorf("%d change(s) break %s compatibility", len(breaking), direction)
+	}
+	return nil
+}
+
+// runInfer prints Go struct source inferred from sample documents, read from
+// the named files or stdin, and optionally per-key statistics on stderr.
+func runInfer(args []string) error {
+	fs := flag.NewFlagSet("infer", flag.ExitOnError)
+	typeName := fs.String("type", "Root", "name of the inferred struct type")
+	pkg := fs.String("pkg", "main", "package clause of the generated source")
+	stats := fs.Bool("stats", false, "print per-key frequency statistics to stderr")
+	fs.Parse(args)
+
+	inf := infer.New()
+	if fs.NArg() == 0 {
+		if err := inf.AddReader(os.Stdin); err != nil {
+			return fmt.Errorf("stdin: %v", err)
+		}
+	}
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := inf.Add(string(data)); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if *stats {
+		w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tPRESENT\tFREQUENCY\tTYPES")
+		for _, s := range inf.Stats() {
+			var types []string
+			for typ, count := range s.Types {
+				types = append(types, fmt.Sprintf("%s:%d", typ, count))
+			}
+			sort.Strings(types)
+			fmt.Fprintf(w, "%s\t%d/%d\t%.0f%%\t%s\n", s.Path, s.Present, s.Total, s.Frequency()*100, strings.Join(types, " "))
+		}
+		w.Flush()
+	}
+
+	source, err := inf.GoSource(*pkg, *typeName)
+	if err != nil {
+		return err
+	}
+	fmt.Print(source)
+	return nil
+}
+
+// runToolchain prints the family, version and path of the C compiler, as
+// CompileAndBuild would find it.
+func runToolchain(args []string) error {
+	fs := flag.NewFlagSet("toolchain", flag.ExitOnError)
+	cc := fs.String("cc", "", "C compiler to report on (default $CC, then gcc, clang or cc)")
+	fs.Parse(args)
+
+	toolchain, err := compiler.DetectToolchain(*cc)
+	if err != nil {
+		return err
+	}
+	fmt.Println(toolchain)
+	fmt.Println(toolchain.Banner)
+	return nil
+}
@@ -1,7 +1,10 @@
 package analyzer
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -51,6 +54,22 @@ func TestAnalyzeStruct_SpecialCases(t *testing.T) {
 		}
 	})
 
+	// Test nested types the parser cannot hold
+	t.Run("recursive and anonymous structs", func(t *testing.T) {
+		type Node struct {
+			Kids []Node `json:"kids"`
+		}
+		if _, err := AnalyzeStruct(reflect.TypeOf(Node{})); err == nil || !strings.Contains(err.Error(), "struct Node contains itself") {
+			t.Errorf("expected a recursive struct rejected, got %v", err)
+		}
+		anonymous := reflect.TypeOf(struct {
+			Inner struct{ A int }
+		}{})
+		if _, err := AnalyzeStruct(anonymous); err == nil || !strings.Contains(err.Error(), "anonymous struct types") {
+			t.Errorf("expected an anonymous struct rejected, got %v", err)
+		}
+	})
+
 	// Test struct with field missing json tag
 	t.Run("missing json tag", func(t *testing.T) {
 		type NoJsonTag struct {
@@ -123,3 +142,399 @@ func TestAnalyzeStruct(t *testing.T) {
 		}
 	}
 }
+
+type Timestamps struct {
+	Created int64 `json:"created"`
+	Updated int64 `json:"updated,omitempty"`
+}
+
+type Tagged struct {
+	Timestamps
+	Internal  string `json:"-"`
+	Dash      string `json:"-,"`
+	FirstName string `json:"first-name,omitempty"`
+	Nickname  string `json:",omitempty"`
+}
+
+func TestAnalyzeStruct_JSONTags(t *testing.T) {
+	fieldInfos, err := AnalyzeStruct(reflect.TypeOf(Tagged{}))
+	if err != nil {
+		t.Fatalf("AnalyzeStruct failed: %v", err)
+	}
+
+	typ := reflect.TypeOf(Tagged{})
+	dash, _ := typ.FieldByName("Dash")
+	expected := []FieldInfo{
+		{Name: "created", GoName: "Created", Offset: 0},
+		{Name: "updated", GoName: "Updated", Offset: 8},
+		{Name: "-", GoName: "Dash", CName: "field", Offset: dash.Offset},
+		{Name: "first-name", GoName: "FirstName", CName: "first_name", Offset: dash.Offset + 16},
+		{Name: "Nickname", GoName: "Nickname", Offset: dash.Offset + 32},
+	}
+	if len(fieldInfos) != len(expected) {
+		t.Fatalf("expected %d fields, got %+v", len(expected), fieldInfos)
+	}
+	for i, fi := range fieldInfos {
+		exp := expected[i]
+		if fi.Name != exp.Name || fi.GoName != exp.GoName || fi.CName != exp.CName || fi.Offset != exp.Offset {
+			t.Errorf("field %d - expected (%s, %s, %s, %d), got (%s, %s, %s, %d)",
+				i, exp.Name, exp.GoName, exp.CName, exp.Offset, fi.Name, fi.GoName, fi.CName, fi.Offset)
+		}
+	}
+}
+
+func TestAnalyzeStruct_Bytes(t *testing.T) {
+	type Blob struct {
+		Data []byte `json:"data"`
+		IDs  []int  `json:"ids"`
+	}
+
+	t.Run("byte slice", func(t *testing.T) {
+		typ := reflect.TypeOf(struct {
+			Data []byte `json:"data"`
+		}{})
+		fieldInfos, err := AnalyzeStruct(typ)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(fieldInfos) != 1 {
+			t.Fatalf("expected 1 field, got %d", len(fieldInfos))
+		}
+		if fieldInfos[0].CType != BytesCType {
+			t.Errorf("expected C type %q, got %q", BytesCType, fieldInfos[0].CType)
+		}
+	})
+
+	t.Run("other slices", func(t *testing.T) {
+		fieldInfos, err := AnalyzeStruct(reflect.TypeOf(Blob{}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids := fieldInfos[1]
+		if ids.Kind != "slice" || ids.CType != "int*" || ids.Elem == nil || ids.Elem.CType != "int" || ids.Elem.Name != "ids" {
+			t.Errorf("expected ids as a slice of int, got %+v", ids)
+		}
+	})
+}
+
+func TestAnalyzeStruct_MaxLen(t *testing.T) {
+	type Inline struct {
+		Code  string `json:"code" maxlen:"8"`
+		Label string `json:"label" maxlen:"4,truncate"`
+		Note  string `json:"note"`
+	}
+
+	fieldInfos, err := AnalyzeStruct(reflect.TypeOf(Inline{}))
+	if err != nil {
+		t.Fatalf("AnalyzeStruct failed: %v", err)
+	}
+
+	expected := []struct {
+		maxLen   int
+		truncate bool
+	}{
+		{8, false},
+		{4, true},
+		{0, false},
+	}
+	for i, exp := range expected {
+		fi := fieldInfos[i]
+		if fi.MaxLen != exp.maxLen || fi.Truncate != exp.truncate {
+			t.Errorf("field %s - expected (%d, %v), got (%d, %v)",
+				fi.Name, exp.maxLen, exp.truncate, fi.MaxLen, fi.Truncate)
+		}
+	}
+
+	invalid := []struct {
+		name  string
+		value interface{}
+	}{
+		{"non-numeric", struct {
+			S string `maxlen:"abc"`
+		}{}},
+		{"zero", struct {
+			S string `maxlen:"0"`
+		}{}},
+		{"unknown policy", struct {
+			S string `maxlen:"4,wrap"`
+		}{}},
+		{"non-string field", struct {
+			N int `maxlen:"4"`
+		}{}},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := AnalyzeStruct(reflect.TypeOf(tc.value)); err == nil {
+				t.Errorf("expected error for %s maxlen tag", tc.name)
+			}
+		})
+	}
+}
+
+// sourceFixture is written to disk for AnalyzeSource and mirrored below by
+// real types so both frontends can be compared.
+const sourceFixture = `package fixture
+
+type UserID int64
+
+type Audit struct {
+	CreatedBy string ` + "`json:\"created_by\"`" + `
+	revision  int
+}
+
+type hidden struct {
+	Note string ` + "`json:\"note\"`" + `
+}
+
+type Account struct {
+	Audit
+	hidden
+	ID      UserID ` + "`json:\"id\"`" + `
+	Name    string ` + "`json:\"name\" maxlen:\"16,truncate\"`" + `
+	flags   [3]uint16
+	Avatar  []byte ` + "`json:\"avatar\"`" + `
+	Active  bool
+	Balance float64 ` + "`json:\"balance,omitempty\"`" + `
+	Secret  string  ` + "`json:\"-\"`" + `
+	Display string  ` + "`json:\"display-name\"`" + `
+}
+
+type Tags []string
+
+type Place struct {
+	City string ` + "`json:\"city\" required:\"true\"`" + `
+}
+
+type Home Place
+
+type Profile struct {
+	Home   Home     ` + "`json:\"home\" nullable:\"true\"`" + `
+	Visits [2]Place ` + "`json:\"visits\"`" + `
+	Tags   Tags     ` + "`json:\"tags\"`" + `
+	Grid   [2][3]uint8
+	Kids   []Profile ` + "`json:\"-\"`" + `
+}
+
+type Anonymous struct {
+	Inner struct{ A int }
+}
+
+type Sized struct {
+	Cells [size]int
+}
+
+type External struct {
+	When time.Time ` + "`json:\"when\"`" + `
+}
+
+type Page[T any] struct {
+	Items []T
+}
+`
+
+type UserID int64
+
+type Audit struct {
+	CreatedBy string `json:"created_by"`
+	revision  int
+}
+
+type hidden struct {
+	Note string `json:"note"`
+}
+
+type Account struct {
+	Audit
+	hidden
+	ID      UserID `json:"id"`
+	Name    string `json:"name" maxlen:"16,truncate"`
+	flags   [3]uint16
+	Avatar  []byte `json:"avatar"`
+	Active  bool
+	Balance float64 `json:"balance,omitempty"`
+	Secret  string  `json:"-"`
+	Display string  `json:"display-name"`
+}
+
+type Tags []string
+
+type Place struct {
+	City string `json:"city" required:"true"`
+}
+
+type Home Place
+
+type Profile struct {
+	Home   Home     `json:"home" nullable:"true"`
+	Visits [2]Place `json:"visits"`
+	Tags   Tags     `json:"tags"`
+	Grid   [2][3]uint8
+	Kids   []Profile `json:"-"`
+}
+
+func TestAnalyzeSource(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"fixture.go":      sourceFixture,
+		"fixture_test.go": "package fixture_test\n",
+		"ignored.go":      "//go:build ignore\n\npackage other\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	t.Run("matches reflection", func(t *testing.T) {
+		cStruct, err := AnalyzeSource(dir, "Account")
+		if err != nil {
+			t.Fatalf("AnalyzeSource failed: %v", err)
+		}
+		if cStruct.Name != "Account" {
+			t.Errorf("expected struct name Account, got %q", cStruct.Name)
+		}
+
+		expected, err := AnalyzeStruct(reflect.TypeOf(Account{}))
+		if err != nil {
+			t.Fatalf("AnalyzeStruct failed: %v", err)
+		}
+		if len(cStruct.Fields) != len(expected) {
+			t.Fatalf("expected %d fields, got %d", len(expected), len(cStruct.Fields))
+		}
+		if last := cStruct.Fields[len(cStruct.Fields)-1]; last.Name != "display-name" || last.CName != "display_name" {
+			t.Errorf("expected display-name stored as display_name, got %+v", last)
+		}
+		for i, fi := range cStruct.Fields {
+			exp := expected[i]
+			if fi.Name != exp.Name || fi.GoName != exp.GoName || fi.CName != exp.CName || fi.CType != exp.CType ||
+				fi.Kind != exp.Kind || fi.Offset != exp.Offset || fi.MaxLen != exp.MaxLen || fi.Truncate != exp.Truncate {
+				t.Errorf("field %d - expected %+v, got %+v", i, exp, fi)
+			}
+		}
+	})
+
+	t.Run("nested structs, arrays and slices", func(t *testing.T) {
+		cStruct, err := AnalyzeSource(dir, "Profile")
+		if err != nil {
+			t.Fatalf("AnalyzeSource failed: %v", err)
+		}
+		fields, err := AnalyzeStruct(reflect.TypeOf(Profile{}))
+		if err != nil {
+			t.Fatalf("AnalyzeStruct failed: %v", err)
+		}
+		clearTypes(cStruct.Fields)
+		clearTypes(fields)
+		if !reflect.DeepEqual(cStruct.Fields, fields) {
+			t.Errorf("source and reflection differ:\n%+v\n%+v", cStruct.Fields, fields)
+		}
+
+		home, visits, tags, grid := fields[0], fields[1], fields[2], fields[3]
+		if home.Kind != "struct" || home.CType != "Home" || home.Struct == nil || !home.Rules.Nullable ||
+			!home.Struct.Fields[0].Rules.Required {
+			t.Errorf("expected home as a nullable Home struct, got %+v", home)
+		}
+		if visits.Kind != "array" || visits.Len != 2 || visits.CType != "Place" || visits.Elem.Struct == nil ||
+			visits.Elem.Struct.Name != "Place" {
+			t.Errorf("expected visits as a Place[2] array, got %+v", visits)
+		}
+		if tags.Kind != "slice" || tags.CType != "char**" || tags.Elem.CType != "char*" {
+			t.Errorf("expected tags as a slice of strings, got %+v", tags)
+		}
+		if grid.Kind != "array" || grid.Len != 2 || grid.Elem.Len != 3 || grid.Elem.Elem.CType != "uint8_t" {
+			t.Errorf("expected grid as a uint8_t[2][3] array, got %+v", grid)
+		}
+		if len(fields) != 4 {
+			t.Errorf("expected the json:\"-\" slice of Profile skipped, got %d fields", len(fields))
+		}
+	})
+
+	errorCases := []struct {
+		typeName    string
+		errContains string
+	}{
+		{"Missing", "type Missing not found"},
+		{"Anonymous", "anonymous struct types are not supported"},
+		{"Sized", "array length of [...]int is not an integer literal"},
+		{"Tags", "provided type is not a struct"},
+		{"External", "unsupported field type: time.Time"},
+		{"Page", "generic type Page is not supported"},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.typeName, func(t *testing.T) {
+			_, err := AnalyzeSource(dir, tc.typeName)
+			if err == nil {
+				t.Fatalf("expected error for %s", tc.typeName)
+			}
+			if !strings.Contains(err.Error(), tc.errContains) {
+				t.Errorf("expected error containing %q, got %q", tc.errContains, err.Error())
+			}
+		})
+	}
+}
+
+// clearTypes clears the Type and Offset of fields, which the source frontend
+// only approximates, and of the fields nested in them.
+func clearTypes(fields []FieldInfo) {
+	for i := range fields {
+		for f := &fields[i]; f != nil; f = f.Elem {
+			f.Type, f.Offset = nil, 0
+			if f.Struct != nil {
+				clearTypes(f.Struct.Fields)
+			}
+		}
+	}
+}
+
+func TestAnalyzeStruct_Rules(t *testing.T) {
+	type Validated struct {
+		Level string  `json:"level" required:"true" enum:"low,high" default:"low" pattern:"^[a-z]+$"`
+		Score float64 `json:"score" nullable:"true" minimum:"0" maximum:"4.5"`
+		Count int     `json:"count" enum:"1,2,3"`
+	}
+
+	fieldInfos, err := AnalyzeStruct(reflect.TypeOf(Validated{}))
+	if err != nil {
+		t.Fatalf("AnalyzeStruct failed: %v", err)
+	}
+
+	level := fieldInfos[0].Rules
+	if !level.Required || !reflect.DeepEqual(level.Enum, []string{`"low"`, `"high"`}) ||
+		level.Default != `"low"` || level.Pattern != "^[a-z]+$" {
+		t.Errorf("unexpected level rules: %+v", level)
+	}
+	score := fieldInfos[1].Rules
+	if !score.Nullable || score.Minimum == nil || *score.Minimum != 0 || score.Maximum == nil || *score.Maximum != 4.5 {
+		t.Errorf("unexpected score rules: %+v", score)
+	}
+	if count := fieldInfos[2].Rules; !reflect.DeepEqual(count.Enum, []string{"1", "2", "3"}) {
+		t.Errorf("unexpected count rules: %+v", count)
+	}
+
+	invalid := []struct {
+		name  string
+		value interface{}
+	}{
+		{"required not bool", struct {
+			S string `required:"yes"`
+		}{}},
+		{"enum not integer", struct {
+			N int `enum:"1,two"`
+		}{}},
+		{"minimum on string", struct {
+			S string `minimum:"1"`
+		}{}},
+		{"invalid pattern", struct {
+			S string `pattern:"("`
+		}{}},
+		{"default on bool", struct {
+			B bool `default:"maybe"`
+		}{}},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := AnalyzeStruct(reflect.TypeOf(tc.value)); err == nil {
+				t.Errorf("expected error for %s", tc.name)
+			}
+		})
+	}
+}
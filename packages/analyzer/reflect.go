@@ -1,44 +1,335 @@
 package analyzer
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // AnalyzeStruct analyzes a Go struct type and returns information about its fields.
+// As in encoding/json, fields tagged json:"-" are skipped, tag options such as
+// omitempty are not part of the key, and the fields of embedded structs
+// without a json name are promoted into the parent. Keys that are not C
+// identifiers are given a member name in CName. Fields of named struct types
+// become nested CStructs of that name, and arrays and slices of supported
+// types become "array" and "slice" fields.
 func AnalyzeStruct(t reflect.Type) ([]FieldInfo, error) {
 	if t.Kind() != reflect.Struct {
 		return nil, errors.New("AnalyzeStruct: provided type is not a struct")
 	}
+	fields, err := analyzeFields(t, 0, map[reflect.Type]*CStruct{t: nil})
+	if err != nil {
+		return nil, err
+	}
+	AssignMembers(fields)
+	return fields, nil
+}
 
+// analyzeFields collects the fields of t, offsetting them by base so that
+// promoted fields report their position within the outermost struct. structs
+// holds the nested structs analyzed so far, and nil for those in progress.
+func analyzeFields(t reflect.Type, base uintptr, structs map[reflect.Type]*CStruct) ([]FieldInfo, error) {
 	var fields []FieldInfo
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
+		name, skip := jsonName(field.Tag)
+		if skip {
+			continue
+		}
+
+		// Promote the fields of untagged embedded structs
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && name == "" {
+			embedded, err := analyzeFields(field.Type, base+field.Offset, structs)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, embedded...)
+			continue
+		}
 
 		// Skip unexported fields
 		if !field.IsExported() {
 			continue
 		}
 
-		jsonTag := field.Tag.Get("json")
-		if jsonTag == "" {
-			jsonTag = field.Name
+		fieldInfo, err := newFieldInfo(field.Name, reflected{field.Type, structs}, base+field.Offset, field.Tag)
+		if err != nil {
+			return nil, err
 		}
+		fields = append(fields, fieldInfo)
+	}
+
+	return fields, nil
+}
+
+// fieldType is the type of a field as a frontend sees it. Reflection has the
+// type itself; the source frontend has one of the same kind and layout, and
+// the names and tags of declared structs, which reflect.StructOf cannot
+// build, beside it.
+type fieldType interface {
+	reflectType() reflect.Type
+	// elem returns the element type of an array or slice.
+	elem() (fieldType, error)
+	// structure returns the CStruct of a struct type, analyzed once however
+	// many fields it is nested in.
+	structure() (*CStruct, error)
+}
+
+// reflected is a fieldType of the reflection frontend.
+type reflected struct {
+	typ     reflect.Type
+	structs map[reflect.Type]*CStruct
+}
+
+func (r reflected) reflectType() reflect.Type { return r.typ }
+
+func (r reflected) elem() (fieldType, error) { return reflected{r.typ.Elem(), r.structs}, nil }
+
+func (r reflected) structure() (*CStruct, error) {
+	if cStruct, ok := r.structs[r.typ]; ok {
+		if cStruct == nil {
+			return nil, fmt.Errorf("struct %s contains itself", r.typ.Name())
+		}
+		return cStruct, nil
+	}
+	if r.typ.Name() == "" {
+		return nil, errors.New("anonymous struct types are not supported; declare a named type")
+	}
+	r.structs[r.typ] = nil
+	fields, err := analyzeFields(r.typ, 0, r.structs)
+	if err != nil {
+		return nil, err
+	}
+	AssignMembers(fields)
+	cStruct := &CStruct{Name: r.typ.Name(), Fields: fields}
+	r.structs[r.typ] = cStruct
+	return cStruct, nil
+}
 
-		cType, ok := TypeMapping[field.Type.Kind()]
+// newFieldInfo maps a single exported Go field to its C representation. It is
+// shared by the reflection and source frontends so both produce the same model.
+func newFieldInfo(goName string, typ fieldType, offset uintptr, tag reflect.StructTag) (FieldInfo, error) {
+	jsonTag, _ := jsonName(tag)
+	if jsonTag == "" {
+		jsonTag = goName
+	}
+
+	field, err := valueInfo(jsonTag, typ)
+	if err != nil {
+		return FieldInfo{}, err
+	}
+	field.GoName, field.Offset = goName, offset
+
+	field.MaxLen, field.Truncate, err = ParseMaxLen(tag.Get("maxlen"))
+	if err != nil {
+		return FieldInfo{}, fmt.Errorf("field %s: %v", goName, err)
+	}
+	if field.MaxLen > 0 && field.Kind != "string" {
+		return FieldInfo{}, fmt.Errorf("field %s: maxlen is only supported on string fields", goName)
+	}
+
+	// The rules of arrays, slices and structs are checked as those of their
+	// kind, which takes none but required and nullable
+	cType := field.CType
+	if field.Elem != nil || field.Struct != nil {
+		cType = field.Kind
+	}
+	if field.Rules, err = ParseRules(tag, cType); err != nil {
+		return FieldInfo{}, fmt.Errorf("field %s: %v", goName, err)
+	}
+	return field, nil
+}
+
+// valueInfo maps a Go type to the FieldInfo of a value with the given key.
+// The elements of arrays and slices take their field's key, as in the other
+// frontends.
+func valueInfo(key string, ft fieldType) (FieldInfo, error) {
+	typ := ft.reflectType()
+	field := FieldInfo{Name: key, Type: typ, Kind: typ.Kind().String()}
+	switch kind := typ.Kind(); {
+	case isByteSlice(typ):
+		// encoding/json carries []byte as a base64 string
+		field.CType = BytesCType
+	case kind == reflect.Struct:
+		cStruct, err := ft.structure()
+		if err != nil {
+			return FieldInfo{}, fmt.Errorf("field %s: %v", key, err)
+		}
+		field.CType, field.Struct = cStruct.Name, cStruct
+	case kind == reflect.Array || kind == reflect.Slice:
+		elemType, err := ft.elem()
+		if err != nil {
+			return FieldInfo{}, err
+		}
+		elem, err := valueInfo(key, elemType)
+		if err != nil {
+			return FieldInfo{}, err
+		}
+		field.Elem = &elem
+		if kind == reflect.Slice {
+			field.CType = elem.CType + "*"
+		} else {
+			field.CType, field.Len = elem.CType, typ.Len()
+		}
+	default:
+		cType, ok := TypeMapping[kind]
 		if !ok {
-			return nil, errors.New("unsupported field type: " + field.Type.Kind().String())
+			return FieldInfo{}, errors.New("unsupported field type: " + kind.String())
 		}
+		field.CType = cType
+	}
+	return field, nil
+}
 
-		fields = append(fields, FieldInfo{
-			Name:   jsonTag,
-			GoName: field.Name,
-			Type:   field.Type,
-			Offset: field.Offset,
-			CType:  cType,
-			Kind:   field.Type.Kind().String(),
-		})
+// jsonName returns the key named by a field's json tag, without its options,
+// or "" if the tag names none. skip reports a field tagged "-", which
+// encoding/json ignores.
+func jsonName(tag reflect.StructTag) (name string, skip bool) {
+	text := tag.Get("json")
+	if text == "-" {
+		return "", true
 	}
+	name, _, _ = strings.Cut(text, ",")
+	return name, false
+}
 
-	return fields, nil
+// isByteSlice reports whether t is a []byte (or a slice of a named byte type).
+func isByteSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+// ParseMaxLen parses a maxlen tag of the form "N" or "N,truncate". An empty
+// tag yields 0, meaning the string is heap allocated with no length limit.
+func ParseMaxLen(tag string) (maxLen int, truncate bool, err error) {
+	if tag == "" {
+		return 0, false, nil
+	}
+
+	value, policy, hasPolicy := strings.Cut(tag, ",")
+	maxLen, err = strconv.Atoi(value)
+	if err != nil || maxLen <= 0 {
+		return 0, false, fmt.Errorf("invalid maxlen %q: must be a positive integer", value)
+	}
+
+	if hasPolicy {
+		switch policy {
+		case "truncate":
+			truncate = true
+		case "reject":
+		default:
+			return 0, false, fmt.Errorf("invalid maxlen policy %q: must be \"truncate\" or \"reject\"", policy)
+		}
+	}
+	return maxLen, truncate, nil
+}
+
+// ParseRules reads the validation tags of a field with the given C type:
+//
+//	required:"true" nullable:"true" enum:"a,b,c" default:"a"
+//	minimum:"0" maximum:"100" pattern:"^[a-z]+$"
+//
+// enum and default values are converted to JSON literals for the field type.
+func ParseRules(tag reflect.StructTag, cType string) (Rules, error) {
+	var rules Rules
+	var err error
+
+	for _, flag := range []struct {
+		key   string
+		value *bool
+	}{{"required", &rules.Required}, {"nullable", &rules.Nullable}} {
+		if text, ok := tag.Lookup(flag.key); ok {
+			if *flag.value, err = strconv.ParseBool(text); err != nil {
+				return Rules{}, fmt.Errorf("invalid %s %q: must be a boolean", flag.key, text)
+			}
+		}
+	}
+
+	if text, ok := tag.Lookup("enum"); ok {
+		for _, value := range strings.Split(text, ",") {
+			literal, err := jsonLiteral(cType, value)
+			if err != nil {
+				return Rules{}, fmt.Errorf("invalid enum value: %v", err)
+			}
+			rules.Enum = append(rules.Enum, literal)
+		}
+	}
+	if text, ok := tag.Lookup("default"); ok {
+		if rules.Default, err = jsonLiteral(cType, text); err != nil {
+			return Rules{}, fmt.Errorf("invalid default: %v", err)
+		}
+	}
+
+	for _, bound := range []struct {
+		key   string
+		value **float64
+	}{{"minimum", &rules.Minimum}, {"maximum", &rules.Maximum}} {
+		text, ok := tag.Lookup(bound.key)
+		if !ok {
+			continue
+		}
+		if !isNumericCType(cType) {
+			return Rules{}, fmt.Errorf("%s is only supported on numeric fields", bound.key)
+		}
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid %s %q: must be a number", bound.key, text)
+		}
+		*bound.value = &n
+	}
+
+	if text, ok := tag.Lookup("pattern"); ok {
+		if cType != "char*" {
+			return Rules{}, errors.New("pattern is only supported on string fields")
+		}
+		if _, err := regexp.Compile(text); err != nil {
+			return Rules{}, fmt.Errorf("invalid pattern: %v", err)
+		}
+		rules.Pattern = text
+	}
+	return rules, nil
+}
+
+// jsonLiteral converts the text of a tag value to a JSON literal of cType.
+func jsonLiteral(cType, text string) (string, error) {
+	switch {
+	case cType == "char*":
+		quoted, err := json.Marshal(text)
+		return string(quoted), err
+	case cType == "bool":
+		if text != "true" && text != "false" {
+			return "", fmt.Errorf("%q is not a boolean", text)
+		}
+		return text, nil
+	case cType == "float" || cType == "double":
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			return "", fmt.Errorf("%q is not a number", text)
+		}
+		return text, nil
+	case isNumericCType(cType):
+		if _, err := strconv.ParseInt(text, 10, 64); err != nil {
+			if _, err := strconv.ParseUint(text, 10, 64); err != nil {
+				return "", fmt.Errorf("%q is not an integer", text)
+			}
+		}
+		return text, nil
+	}
+	return "", fmt.Errorf("values are not supported for %s fields", cType)
+}
+
+// isNumericCType reports whether cType is one of the mapped number types.
+func isNumericCType(cType string) bool {
+	switch cType {
+	case "char*", "bool", BytesCType:
+		return false
+	}
+	for _, mapped := range TypeMapping {
+		if mapped == cType {
+			return true
+		}
+	}
+	return false
 }
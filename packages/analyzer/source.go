@@ -0,0 +1,414 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// basicTypes maps Go's predeclared type names to their reflect types.
+var basicTypes = map[string]reflect.Type{
+	"bool":       reflect.TypeOf(false),
+	"string":     reflect.TypeOf(""),
+	"int":        reflect.TypeOf(int(0)),
+	"int8":       reflect.TypeOf(int8(0)),
+	"int16":      reflect.TypeOf(int16(0)),
+	"int32":      reflect.TypeOf(int32(0)),
+	"int64":      reflect.TypeOf(int64(0)),
+	"uint":       reflect.TypeOf(uint(0)),
+	"uint8":      reflect.TypeOf(uint8(0)),
+	"uint16":     reflect.TypeOf(uint16(0)),
+	"uint32":     reflect.TypeOf(uint32(0)),
+	"uint64":     reflect.TypeOf(uint64(0)),
+	"uintptr":    reflect.TypeOf(uintptr(0)),
+	"byte":       reflect.TypeOf(byte(0)),
+	"rune":       reflect.TypeOf(rune(0)),
+	"float32":    reflect.TypeOf(float32(0)),
+	"float64":    reflect.TypeOf(float64(0)),
+	"complex64":  reflect.TypeOf(complex64(0)),
+	"complex128": reflect.TypeOf(complex128(0)),
+	"error":      reflect.TypeOf((*error)(nil)).Elem(),
+	"any":        reflect.TypeOf((*any)(nil)).Elem(),
+}
+
+// Placeholder types for parts of a declaration whose exact type does not
+// affect the layout or the analysis result.
+var (
+	emptyStructType = reflect.TypeOf(struct{}{})
+	pointerType     = reflect.TypeOf((*struct{})(nil))
+	sliceType       = reflect.TypeOf([]struct{}(nil))
+	mapType         = reflect.TypeOf(map[struct{}]struct{}(nil))
+	chanType        = reflect.TypeOf((chan struct{})(nil))
+	funcType        = reflect.TypeOf(func() {})
+	interfaceType   = basicTypes["any"]
+)
+
+// AnalyzeSource analyzes the struct type typeName declared in the Go package in
+// dir. Unlike AnalyzeStruct it does not need the type linked into the running
+// program: the package's .go files are read with go/parser, so generation can
+// run as a standalone build step.
+//
+// Named types declared in the package are resolved to their underlying types
+// and embedded structs are promoted, producing the same fields as AnalyzeStruct
+// would for the compiled type. FieldInfo.Type is the unnamed underlying type,
+// and Offset is zero for every field when the struct's layout depends on types
+// declared outside the package.
+func AnalyzeSource(dir, typeName string) (CStruct, error) {
+	pkg, err := loadSourcePackage(dir)
+	if err != nil {
+		return CStruct{}, err
+	}
+
+	if _, ok := pkg.decls[typeName]; !ok {
+		return CStruct{}, fmt.Errorf("AnalyzeSource: type %s not found in %s", typeName, dir)
+	}
+	st, err := pkg.resolveNamed(typeName)
+	if err != nil {
+		return CStruct{}, fmt.Errorf("AnalyzeSource: %v", err)
+	}
+	if !st.isStruct {
+		return CStruct{}, errors.New("AnalyzeSource: provided type is not a struct")
+	}
+
+	cStruct, err := st.structure()
+	if err != nil {
+		return CStruct{}, err
+	}
+	return *cStruct, nil
+}
+
+// sourcePackage holds the type declarations of one package directory.
+type sourcePackage struct {
+	decls     map[string]*ast.TypeSpec
+	resolved  map[string]*sourceType
+	resolving map[string]bool
+}
+
+// sourceType is a resolved type expression. typ has the same kind and layout
+// as the declared type; for structs the field names are synthesized and the
+// declared fields are kept in fields.
+type sourceType struct {
+	typ      reflect.Type
+	name     string // Expression text, used in error messages
+	isStruct bool
+	fields   []sourceField
+	declName string      // Name of a struct declared in the package
+	elemType *sourceType // Element type of an array or slice
+	known    bool        // Layout is known exactly
+	// invalid is why a field of the type cannot be analyzed, as for types
+	// declared in another package; the type may still be skipped.
+	invalid error
+	cStruct *CStruct // Set once the struct is analyzed
+}
+
+type sourceField struct {
+	name      string
+	tag       reflect.StructTag
+	anonymous bool
+	typ       *sourceType
+}
+
+// loadSourcePackage parses the non-test .go files in dir that match the
+// current build context.
+func loadSourcePackage(dir string) (*sourcePackage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("AnalyzeSource: %v", err)
+	}
+
+	pkg := &sourcePackage{
+		decls:     make(map[string]*ast.TypeSpec),
+		resolved:  make(map[string]*sourceType),
+		resolving: make(map[string]bool),
+	}
+	fset := token.NewFileSet()
+	pkgName := ""
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, fmt.Errorf("AnalyzeSource: %v", err)
+		}
+		if pkgName != "" && file.Name.Name != pkgName {
+			return nil, fmt.Errorf("AnalyzeSource: multiple packages in %s: %s and %s", dir, pkgName, file.Name.Name)
+		}
+		pkgName = file.Name.Name
+
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				pkg.decls[typeSpec.Name.Name] = typeSpec
+			}
+		}
+	}
+
+	if pkgName == "" {
+		return nil, fmt.Errorf("AnalyzeSource: no Go files in %s", dir)
+	}
+	return pkg, nil
+}
+
+// resolveNamed resolves a type declared in the package to its underlying type.
+func (p *sourcePackage) resolveNamed(name string) (*sourceType, error) {
+	if st, ok := p.resolved[name]; ok {
+		return st, nil
+	}
+	if p.resolving[name] {
+		return nil, fmt.Errorf("recursive type %s", name)
+	}
+
+	typeSpec := p.decls[name]
+	if typeSpec.TypeParams != nil {
+		return nil, fmt.Errorf("generic type %s is not supported", name)
+	}
+
+	p.resolving[name] = true
+	defer delete(p.resolving, name)
+
+	st, err := p.resolve(typeSpec.Type)
+	if err != nil {
+		return nil, err
+	}
+	if st.isStruct {
+		// A struct type declared as another is named after the declaration
+		named := *st
+		named.declName, named.cStruct = name, nil
+		st = &named
+	}
+	p.resolved[name] = st
+	return st, nil
+}
+
+// resolve maps a type expression to a sourceType.
+func (p *sourcePackage) resolve(expr ast.Expr) (*sourceType, error) {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		// Package declarations shadow predeclared names
+		if _, ok := p.decls[e.Name]; ok {
+			return p.resolveNamed(e.Name)
+		}
+		if typ, ok := basicTypes[e.Name]; ok {
+			return &sourceType{typ: typ, name: e.Name, known: true}, nil
+		}
+		return nil, fmt.Errorf("undefined type %s", e.Name)
+
+	case *ast.ParenExpr:
+		return p.resolve(e.X)
+
+	case *ast.SelectorExpr:
+		name := exprString(e)
+		return &sourceType{typ: emptyStructType, name: name, invalid: errors.New("unsupported field type: " + name)}, nil
+
+	case *ast.StructType:
+		return p.resolveStruct(e)
+
+	case *ast.ArrayType:
+		if e.Len == nil {
+			// A slice is a pointer whatever its elements, which may refer
+			// back to the struct being declared, so they fail only if analyzed
+			elem, err := p.resolve(e.Elt)
+			if err != nil {
+				return &sourceType{typ: sliceType, name: exprString(e), known: true, invalid: err}, nil
+			}
+			return &sourceType{typ: reflect.SliceOf(elem.typ), name: exprString(e), elemType: elem, known: true, invalid: elem.invalid}, nil
+		}
+		elem, err := p.resolve(e.Elt)
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := e.Len.(*ast.BasicLit)
+		if !ok || lit.Kind != token.INT {
+			// Constant lengths are not evaluated, so the layout is unknown
+			return &sourceType{typ: reflect.ArrayOf(0, elem.typ), name: exprString(e), elemType: elem,
+				invalid: fmt.Errorf("array length of %s is not an integer literal", exprString(e))}, nil
+		}
+		n, err := strconv.ParseInt(lit.Value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %s", lit.Value)
+		}
+		return &sourceType{typ: reflect.ArrayOf(int(n), elem.typ), name: exprString(e), elemType: elem, known: elem.known, invalid: elem.invalid}, nil
+
+	case *ast.StarExpr:
+		return &sourceType{typ: pointerType, name: exprString(e), known: true}, nil
+	case *ast.MapType:
+		return &sourceType{typ: mapType, name: exprString(e), known: true}, nil
+	case *ast.ChanType:
+		return &sourceType{typ: chanType, name: exprString(e), known: true}, nil
+	case *ast.FuncType:
+		return &sourceType{typ: funcType, name: exprString(e), known: true}, nil
+	case *ast.InterfaceType:
+		return &sourceType{typ: interfaceType, name: exprString(e), known: true}, nil
+
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return nil, fmt.Errorf("generic type %s is not supported", exprString(e))
+	}
+	return nil, fmt.Errorf("unsupported type expression %s", exprString(expr))
+}
+
+// resolveStruct builds a layout-equivalent struct type for a struct literal.
+func (p *sourcePackage) resolveStruct(st *ast.StructType) (*sourceType, error) {
+	result := &sourceType{isStruct: true, name: "struct", known: true}
+	var layout []reflect.StructField
+	for _, field := range st.Fields.List {
+		ft, err := p.resolve(field.Type)
+		if err != nil {
+			return nil, err
+		}
+		result.known = result.known && ft.known
+
+		var tag reflect.StructTag
+		if field.Tag != nil {
+			unquoted, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid struct tag %s", field.Tag.Value)
+			}
+			tag = reflect.StructTag(unquoted)
+		}
+
+		if len(field.Names) == 0 {
+			result.fields = append(result.fields, sourceField{name: embeddedName(field.Type), tag: tag, anonymous: true, typ: ft})
+		}
+		for _, name := range field.Names {
+			result.fields = append(result.fields, sourceField{name: name.Name, tag: tag, typ: ft})
+		}
+	}
+
+	// Synthesized exported names let reflect lay out unexported fields too
+	for i, field := range result.fields {
+		layout = append(layout, reflect.StructField{Name: fmt.Sprintf("F%d", i), Type: field.typ.typ})
+	}
+	result.typ = reflect.StructOf(layout)
+	return result, nil
+}
+
+// fieldInfos mirrors analyzeFields for a struct declared in source.
+func (t *sourceType) fieldInfos(base uintptr) ([]FieldInfo, error) {
+	var fields []FieldInfo
+	for i, field := range t.fields {
+		offset := base + t.typ.Field(i).Offset
+		name, skip := jsonName(field.tag)
+		if skip {
+			continue
+		}
+
+		// Promote the fields of untagged embedded structs
+		if field.anonymous && field.typ.isStruct && name == "" {
+			embedded, err := field.typ.fieldInfos(offset)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, embedded...)
+			continue
+		}
+
+		// Skip unexported fields
+		if !ast.IsExported(field.name) {
+			continue
+		}
+
+		if field.typ.invalid != nil {
+			return nil, field.typ.invalid
+		}
+		fieldInfo, err := newFieldInfo(field.name, field.typ, offset, field.tag)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, fieldInfo)
+	}
+	return fields, nil
+}
+
+func (t *sourceType) reflectType() reflect.Type { return t.typ }
+
+func (t *sourceType) elem() (fieldType, error) { return t.elemType, nil }
+
+func (t *sourceType) structure() (*CStruct, error) {
+	if t.cStruct != nil {
+		return t.cStruct, nil
+	}
+	if t.declName == "" {
+		return nil, errors.New("anonymous struct types are not supported; declare a named type")
+	}
+	fields, err := t.fieldInfos(0)
+	if err != nil {
+		return nil, err
+	}
+	if !t.known {
+		for i := range fields {
+			fields[i].Offset = 0
+		}
+	}
+	AssignMembers(fields)
+	t.cStruct = &CStruct{Name: t.declName, Fields: fields}
+	return t.cStruct, nil
+}
+
+// embeddedName returns the field name Go gives an embedded field.
+func embeddedName(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.StarExpr:
+		return embeddedName(e.X)
+	case *ast.SelectorExpr:
+		return e.Sel.Name
+	case *ast.IndexExpr:
+		return embeddedName(e.X)
+	case *ast.IndexListExpr:
+		return embeddedName(e.X)
+	}
+	return ""
+}
+
+// exprString renders a type expression for error messages.
+func exprString(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		return exprString(e.X) + "." + e.Sel.Name
+	case *ast.StarExpr:
+		return "*" + exprString(e.X)
+	case *ast.ParenExpr:
+		return "(" + exprString(e.X) + ")"
+	case *ast.ArrayType:
+		if e.Len == nil {
+			return "[]" + exprString(e.Elt)
+		}
+		return "[...]" + exprString(e.Elt)
+	case *ast.MapType:
+		return "map[" + exprString(e.Key) + "]" + exprString(e.Value)
+	case *ast.IndexExpr:
+		return exprString(e.X) + "[...]"
+	case *ast.IndexListExpr:
+		return exprString(e.X) + "[...]"
+	case *ast.StructType:
+		return "struct{...}"
+	case *ast.InterfaceType:
+		return "interface{...}"
+	case *ast.FuncType:
+		return "func(...)"
+	case *ast.ChanType:
+		return "chan " + exprString(e.Value)
+	}
+	return fmt.Sprintf("%T", expr)
+}
@@ -1,6 +1,11 @@
 package analyzer
 
-import "reflect"
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+)
 
 // TypeMapping maps Go types to C types.
 var TypeMapping = map[reflect.Kind]string{
@@ -20,13 +25,58 @@ var TypeMapping = map[reflect.Kind]string{
 	reflect.String:  "char*",
 }
 
+// BytesCType is the C type used for []byte fields. The generated struct pairs
+// the pointer with a size_t <name>_len member holding the decoded length.
+const BytesCType = "uint8_t*"
+
 type FieldInfo struct {
 	Name   string // JSON tag or field name
 	GoName string // Original Go field name
+	// CName is the C member name when it differs from the JSON key in Name,
+	// as for annotated members of an imported C header.
+	CName  string
 	Type   reflect.Type
 	Offset uintptr
 	CType  string // Mapped C type
 	Kind   string // Kind as string, e.g., "String", "Int", "Bool"
+
+	// MaxLen, when positive, stores a char* field inline as char[MaxLen+1]
+	// instead of a strdup'd pointer. Longer values are rejected, or cut to
+	// MaxLen bytes when Truncate is set.
+	MaxLen   int
+	Truncate bool
+
+	// Struct describes the nested object of a "struct" field, whose CType is
+	// the nested struct's name.
+	Struct *CStruct
+	// Elem describes the elements of an "array" or "slice" field. A fixed
+	// array has the element's CType and its element count in Len; a slice has
+	// CType "<elem>*" and Len zero.
+	Elem *FieldInfo
+	Len  int
+
+	Rules Rules // Validation constraints
+}
+
+// Member returns the name of the field's member in the generated C struct.
+func (f FieldInfo) Member() string {
+	if f.CName != "" {
+		return f.CName
+	}
+	return f.Name
+}
+
+// Rules holds validation constraints for a field, as declared by a schema or
+// by struct tags.
+type Rules struct {
+	Required  bool     // The key must be present
+	Nullable  bool     // null is accepted as a value
+	Enum      []string // Allowed values as JSON literals, e.g. `"red"` or `3`
+	Default   string   // Default value as a JSON literal, empty for none
+	Minimum   *float64
+	Maximum   *float64
+	MaxLength int    // Maximum string length in characters, 0 for no limit
+	Pattern   string // Regular expression a string value must match
 }
 
 // CStruct represents a C struct with its name and fields
@@ -34,3 +84,118 @@ type CStruct struct {
 	Name   string
 	Fields []FieldInfo
 }
+
+// GoFieldName converts a JSON key such as "first_name" or "first-name" into an
+// exported Go identifier ("FirstName"). Keys without letters or digits become
+// "Field".
+func GoFieldName(key string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range key {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteString("F")
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "Field"
+	}
+	return b.String()
+}
+
+// cKeywords are the C keywords a struct member cannot be named.
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true, "continue": true,
+	"default": true, "do": true, "double": true, "else": true, "enum": true, "extern": true,
+	"float": true, "for": true, "goto": true, "if": true, "inline": true, "int": true,
+	"long": true, "register": true, "restrict": true, "return": true, "short": true,
+	"signed": true, "sizeof": true, "static": true, "struct": true, "switch": true,
+	"typedef": true, "union": true, "unsigned": true, "void": true, "volatile": true,
+	"while": true, "bool": true, "true": true, "false": true,
+}
+
+// CFieldName converts a JSON key such as "first-name" into a C identifier for
+// a struct member ("first_name"). Keys that are already identifiers are kept,
+// other characters become '_', a leading digit gains an "f" prefix and C
+// keywords a '_' suffix. Keys without letters or digits become "field".
+func CFieldName(key string) string {
+	if isCIdentifier(key) && !cKeywords[key] {
+		return key
+	}
+	var b strings.Builder
+	for _, r := range key {
+		switch {
+		case r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'):
+			if b.Len() == 0 && unicode.IsDigit(r) {
+				b.WriteString("f")
+			}
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	name := strings.TrimRight(b.String(), "_")
+	if strings.TrimLeft(name, "_") == "" {
+		return "field"
+	}
+	if cKeywords[name] {
+		name += "_"
+	}
+	return name
+}
+
+// CFieldNames returns a distinct C member name for each of an object's keys,
+// as CFieldName converts them. Keys that are already valid names keep them,
+// and the others are numbered, e.g. "first_name2", where they would clash.
+func CFieldNames(keys []string) []string {
+	taken := make(map[string]bool)
+	for _, key := range keys {
+		if CFieldName(key) == key {
+			taken[key] = true
+		}
+	}
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		name := CFieldName(key)
+		if name != key {
+			for base, n := name, 2; taken[name]; n++ {
+				name = fmt.Sprintf("%s%d", base, n)
+			}
+			taken[name] = true
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// AssignMembers sets the CName of each field whose key is not a valid C
+// member name, as CFieldNames converts the keys.
+func AssignMembers(fields []FieldInfo) {
+	keys := make([]string, len(fields))
+	for i, field := range fields {
+		keys[i] = field.Name
+	}
+	for i, member := range CFieldNames(keys) {
+		if member != fields[i].Name {
+			fields[i].CName = member
+		}
+	}
+}
+
+// isCIdentifier reports whether s is an ASCII C identifier.
+func isCIdentifier(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
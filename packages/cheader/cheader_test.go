@@ -0,0 +1,300 @@
+package cheader
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/compiler"
+)
+
+const legacyHeader = `#ifndef LEGACY_H
+#define LEGACY_H
+
+#include <stdint.h>
+#include <stddef.h>
+#include <stdbool.h>
+
+#define NAME_LEN 16
+#define SCORES 3
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef enum { ACTIVE, RETIRED } status_t;
+
+typedef struct address {
+    char zip[6];      /* json:"zip" required:"true" pattern:"^[0-9]{5}$" */
+    int8_t floor;
+} Address;
+
+/* A student record shared with the registrar. */
+typedef struct {
+    // json:"studentId" required:"true" minimum:"1"
+    long student_id;
+    char name[NAME_LEN];
+    const char *nickname;     // json:"nick,omitempty" nullable:"true"
+    unsigned short year;
+    double gpa;               /* json:"gpa" minimum:"0" maximum:"4" */
+    bool enrolled;
+    status_t status;
+    struct address home;
+    Address campus[2];
+    int scores[SCORES];
+    uint8_t *photo;
+    size_t photo_len;
+    struct {
+        char name[8];
+        uint32_t room;
+    } advisor;
+} Student;
+
+int student_load(const char *path, Student *out);
+extern const Student default_student;
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
+`
+
+func TestImport(t *testing.T) {
+	cStruct, err := Import([]byte(legacyHeader), "")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if cStruct.Name != "Student" {
+		t.Errorf("expected struct name Student, got %q", cStruct.Name)
+	}
+
+	expected := []struct {
+		name   string
+		member string
+		cType  string
+		kind   string
+		maxLen int
+		len    int
+	}{
+		{"studentId", "student_id", "int64_t", "int64", 0, 0},
+		{"name", "name", "char*", "string", 15, 0},
+		{"nick", "nickname", "char*", "string", 0, 0},
+		{"year", "year", "uint16_t", "uint16", 0, 0},
+		{"gpa", "gpa", "double", "float64", 0, 0},
+		{"enrolled", "enrolled", "bool", "bool", 0, 0},
+		{"status", "status", "int", "int", 0, 0},
+		{"home", "home", "Address", "struct", 0, 0},
+		{"campus", "campus", "Address", "array", 0, 2},
+		{"scores", "scores", "int", "array", 0, 3},
+		{"photo", "photo", analyzer.BytesCType, "slice", 0, 0},
+		{"advisor", "advisor", "StudentAdvisor", "struct", 0, 0},
+	}
+	if len(cStruct.Fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d: %+v", len(expected), len(cStruct.Fields), cStruct.Fields)
+	}
+	for i, want := range expected {
+		field := cStruct.Fields[i]
+		if field.Name != want.name || field.Member() != want.member || field.CType != want.cType ||
+			field.Kind != want.kind || field.MaxLen != want.maxLen || field.Len != want.len {
+			t.Errorf("field %d = %+v, want %+v", i, field, want)
+		}
+	}
+
+	studentID := cStruct.Fields[0]
+	if studentID.GoName != "StudentId" || !studentID.Rules.Required || studentID.Rules.Minimum == nil || *studentID.Rules.Minimum != 1 {
+		t.Errorf("studentId annotations not applied: %+v", studentID)
+	}
+	if !cStruct.Fields[2].Rules.Nullable {
+		t.Error("nick should be nullable")
+	}
+	if gpa := cStruct.Fields[4].Rules; gpa.Minimum == nil || gpa.Maximum == nil || *gpa.Maximum != 4 {
+		t.Errorf("gpa bounds not applied: %+v", gpa)
+	}
+	zip := cStruct.Fields[7].Struct.Fields[0]
+	if zip.MaxLen != 5 || !zip.Rules.Required || zip.Rules.Pattern != "^[0-9]{5}$" {
+		t.Errorf("nested annotations not applied: %+v", zip)
+	}
+	if cStruct.Fields[8].Elem.Struct != cStruct.Fields[7].Struct {
+		t.Error("Address should be shared by home and campus")
+	}
+	if advisor := cStruct.Fields[11].Struct; advisor.Fields[0].MaxLen != 7 || advisor.Fields[1].CType != "uint32_t" {
+		t.Errorf("inline struct = %+v", advisor)
+	}
+
+	byTag, err := Import([]byte(legacyHeader), "address")
+	if err != nil {
+		t.Fatalf("Import by tag failed: %v", err)
+	}
+	if byTag.Name != "Address" || len(byTag.Fields) != 2 {
+		t.Errorf("Import by tag = %+v", byTag)
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.h")
+	if err := os.WriteFile(path, []byte(legacyHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cStruct, err := ImportFile(path, "Address")
+	if err != nil {
+		t.Fatalf("ImportFile failed: %v", err)
+	}
+	if cStruct.Name != "Address" {
+		t.Errorf("expected Address, got %q", cStruct.Name)
+	}
+
+	if _, err := ImportFile(filepath.Join(t.TempDir(), "missing.h"), ""); err == nil || !strings.Contains(err.Error(), "failed to read header") {
+		t.Errorf("ImportFile() error = %v, want read error", err)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		typeName    string
+		errContains string
+	}{
+		{"no structs", "int f(void);", "", "declares no structs"},
+		{"not declared", "typedef struct { int a; } A;", "B", "struct B is not declared"},
+		{"plain char", "typedef struct { char c; } A;", "", "plain char"},
+		{"short char array", "typedef struct { char c[1]; } A;", "", "at least one character"},
+		{"int pointer", "typedef struct { int *p; } A;", "", "pointers to int"},
+		{"struct pointer", "typedef struct { int a; } B; typedef struct { B *b; } A;", "", "pointers to structs"},
+		{"double pointer", "typedef struct { char **p; } A;", "", "pointers to pointers"},
+		{"bit-field", "typedef struct { unsigned a : 3; } A;", "", "bit-field"},
+		{"union", "typedef struct { union { int a; float b; } u; } A;", "", "unions"},
+		{"unknown type", "typedef struct { time_t t; } A;", "", "unsupported type time_t"},
+		{"undeclared struct", "typedef struct { struct b x; } A;", "", "struct b is not declared"},
+		{"bad array size", "typedef struct { int a[N]; } A;", "", "positive integer constant"},
+		{"bytes without length", "typedef struct { uint8_t *p; } A;", "", "size_t p_len"},
+		{"maxlen annotation", `typedef struct { char a[4]; /* maxlen:"3" */ } A;`, "", "maxlen"},
+		{"skipped member", `typedef struct { int a; /* json:"-" */ } A;`, "", `json:"-"`},
+		{"ambiguous annotation", `typedef struct { int a, b; /* json:"x" */ } A;`, "", "ambiguous"},
+		{"bad rule", `typedef struct { int a; /* minimum:"x" */ } A;`, "", "minimum"},
+		{"empty struct", "typedef struct { } A;", "", "no members"},
+		{"declared twice", "typedef struct { int a; } A; typedef struct { int b; } A;", "", "declared twice"},
+		{"unterminated", "typedef struct { int a;", "", "unterminated"},
+		{"unterminated comment", "/* typedef", "", "unterminated comment"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Import([]byte(tt.header), tt.typeName)
+			if err == nil {
+				t.Fatalf("Import() error = nil, want error containing %q", tt.errContains)
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Import() error = %v, want error containing %q", err, tt.errContains)
+			}
+		})
+	}
+}
+
+// TestImportLayout checks the imported offsets, and the header generated from
+// the import, against the layout gcc gives the legacy header.
+func TestImportLayout(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	cStruct, err := Import([]byte(legacyHeader), "Student")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "legacy.h"), []byte(legacyHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := compiler.CompileParser(cStruct, dir); err != nil {
+		t.Fatalf("CompileParser failed: %v", err)
+	}
+
+	var expected strings.Builder
+	for _, field := range cStruct.Fields {
+		fmt.Fprintf(&expected, "%d\n", field.Offset)
+	}
+	for _, header := range []string{"legacy.h", "Student.h"} {
+		layout := layoutOf(t, dir, header, cStruct)
+		if !strings.HasPrefix(layout, expected.String()) {
+			t.Errorf("%s offsets:\n%s\nwant:\n%s", header, layout, expected.String())
+		}
+		if header == "Student.h" && layout != layoutOf(t, dir, "legacy.h", cStruct) {
+			t.Errorf("generated header layout differs from the legacy header")
+		}
+	}
+}
+
+// layoutOf compiles a program printing the offset of each member of Student
+// and its size, as declared in header.
+func layoutOf(t *testing.T, dir, header string, cStruct analyzer.CStruct) string {
+	var program strings.Builder
+	fmt.Fprintf(&program, "#include <stdio.h>\n#include <stddef.h>\n#include \"%s\"\nint main(void) {\n", header)
+	for _, field := range cStruct.Fields {
+		fmt.Fprintf(&program, "    printf(\"%%zu\\n\", offsetof(Student, %s));\n", field.Member())
+	}
+	program.WriteString("    printf(\"%zu\\n\", sizeof(Student));\n    return 0;\n}\n")
+
+	source := filepath.Join(dir, "layout.c")
+	binary := filepath.Join(dir, "layout")
+	if err := os.WriteFile(source, []byte(program.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", binary, source).CombinedOutput(); err != nil {
+		t.Fatalf("failed to compile layout program for %s: %v\n%s", header, err, out)
+	}
+	out, err := exec.Command(binary).Output()
+	if err != nil {
+		t.Fatalf("layout program failed: %v", err)
+	}
+	return string(out)
+}
+
+func TestImportParse(t *testing.T) {
+	cStruct, err := Import([]byte(legacyHeader), "")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	parser, err := compiler.CompileAndBuild(cStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	result, err := parser.Parse(`{"studentId": 7, "name": "Ada", "nick": "Countess", "year": 2,
+		"gpa": 3.5, "enrolled": true, "status": 1, "home": {"zip": "95112", "floor": 3},
+		"campus": [{"zip": "00001"}, {"zip": "00002", "floor": -1}], "scores": [90, 85, 77],
+		"photo": "AQID", "advisor": {"name": "Grace", "room": 101}}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if result["studentId"] != "7" || result["name"] != "Ada" || result["gpa"] != "3.5" {
+		t.Errorf("Parse() = %v", result)
+	}
+	if home := result["home"]; !reflect.DeepEqual(home, map[string]interface{}{"zip": "95112", "floor": "3"}) {
+		t.Errorf("home = %v", home)
+	}
+	if scores := result["scores"]; !reflect.DeepEqual(scores, []interface{}{"90", "85", "77"}) {
+		t.Errorf("scores = %v", scores)
+	}
+	if photo := result["photo"]; !reflect.DeepEqual(photo, []byte{1, 2, 3}) {
+		t.Errorf("photo = %v", photo)
+	}
+
+	for _, invalid := range []string{
+		`{"studentId": 1, "name": "a name that is too long"}`,
+		`{"studentId": 1, "home": {"floor": 128}}`,
+		`{"studentId": 1, "scores": [1, 2]}`,
+		`{"studentId": 1, "year": 65536}`,
+	} {
+		if _, err := parser.Parse(invalid); err == nil {
+			t.Errorf("Parse(%s) succeeded, want error", invalid)
+		}
+	}
+}
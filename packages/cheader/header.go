@@ -0,0 +1,775 @@
+// Package cheader imports struct declarations from C headers into the
+// analyzer's CStruct model, so that a parser can be generated for the exact
+// layout existing C code already uses.
+//
+// The supported subset is typedef'd or tagged struct declarations whose
+// members are integer, floating-point and bool scalars, char* strings,
+// fixed-size arrays (char[N] becomes an inline string of up to N-1 bytes),
+// and nested structs declared earlier or inline. A uint8_t* member followed by
+// a size_t member of the same name plus "_len" is a base64 binary field, as in
+// headers written by the compiler package. Array sizes may name object-like
+// #define constants; other preprocessor lines, function prototypes and
+// unrelated declarations are skipped. Integer widths follow the LP64 data
+// model, so long is 64 bits.
+//
+// A comment on the line of a member, or directly above it, may carry
+// annotations in struct tag syntax, the same vocabulary as Go struct tags:
+//
+//	int student_id; /* json:"studentId" required:"true" minimum:"1" */
+//
+// json renames the JSON key while the C member keeps its name.
+package cheader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/schema"
+)
+
+// ImportFile reads a C header and converts one of its structs; see Import.
+func ImportFile(path, name string) (analyzer.CStruct, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("failed to read header: %v", err)
+	}
+	cStruct, err := Import(data, name)
+	if err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return cStruct, nil
+}
+
+// Import converts the struct called name, by typedef name or struct tag, from
+// the C declarations in src. When name is empty the last struct declared is
+// used. Field offsets are those of the C layout.
+func Import(src []byte, name string) (analyzer.CStruct, error) {
+	tokens, defines, err := scan(string(src))
+	if err != nil {
+		return analyzer.CStruct{}, err
+	}
+	p := &parser{
+		tokens:  tokens,
+		defines: defines,
+		types:   make(map[string]*cType),
+	}
+	if err := p.parse(); err != nil {
+		return analyzer.CStruct{}, err
+	}
+
+	if name == "" {
+		if p.last == nil {
+			return analyzer.CStruct{}, errors.New("header declares no structs")
+		}
+		return *p.last.cStruct, nil
+	}
+	for _, key := range []string{name, "struct " + name} {
+		if t, ok := p.types[key]; ok && t.cStruct != nil {
+			return *t.cStruct, nil
+		}
+	}
+	return analyzer.CStruct{}, fmt.Errorf("struct %s is not declared", name)
+}
+
+// cType is a type the parser can resolve by name: a scalar mapped to one of
+// the analyzer's C types, or a declared struct.
+type cType struct {
+	name    string // analyzer C type, or the struct name
+	cStruct *analyzer.CStruct
+	size    uintptr
+	align   uintptr
+}
+
+// scalars maps C type spellings, with qualifiers removed, to the analyzer's
+// C types and their LP64 size.
+var scalars = map[string]cType{
+	"signed char":        {name: "int8_t", size: 1},
+	"unsigned char":      {name: "uint8_t", size: 1},
+	"short":              {name: "int16_t", size: 2},
+	"short int":          {name: "int16_t", size: 2},
+	"unsigned short":     {name: "uint16_t", size: 2},
+	"unsigned short int": {name: "uint16_t", size: 2},
+	"int":                {name: "int", size: 4},
+	"signed":             {name: "int", size: 4},
+	"unsigned":           {name: "unsigned int", size: 4},
+	"unsigned int":       {name: "unsigned int", size: 4},
+	"long":               {name: "int64_t", size: 8},
+	"long int":           {name: "int64_t", size: 8},
+	"long long":          {name: "int64_t", size: 8},
+	"long long int":      {name: "int64_t", size: 8},
+	"unsigned long":      {name: "uint64_t", size: 8},
+	"unsigned long int":  {name: "uint64_t", size: 8},
+	"unsigned long long": {name: "uint64_t", size: 8},
+	"int8_t":             {name: "int8_t", size: 1},
+	"int16_t":            {name: "int16_t", size: 2},
+	"int32_t":            {name: "int32_t", size: 4},
+	"int64_t":            {name: "int64_t", size: 8},
+	"uint8_t":            {name: "uint8_t", size: 1},
+	"uint16_t":           {name: "uint16_t", size: 2},
+	"uint32_t":           {name: "uint32_t", size: 4},
+	"uint64_t":           {name: "uint64_t", size: 8},
+	"size_t":             {name: "uint64_t", size: 8},
+	"float":              {name: "float", size: 4},
+	"double":             {name: "double", size: 8},
+	"bool":               {name: "bool", size: 1},
+	"_Bool":              {name: "bool", size: 1},
+	"char":               {name: "char", size: 1},
+}
+
+const pointerSize = 8
+
+type parser struct {
+	tokens  []token
+	pos     int
+	defines map[string]string
+	// types holds declared structs and enums by typedef name and by
+	// "struct Tag" or "enum Tag".
+	types map[string]*cType
+	last  *cType
+}
+
+func (p *parser) peek() token { return p.lookahead(0) }
+
+// lookahead returns the token n places after the current one.
+func (p *parser) lookahead(n int) token {
+	return p.tokens[min(p.pos+n, len(p.tokens)-1)]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) accept(text string) bool {
+	if tok := p.peek(); tok.kind != tokenString && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if tok := p.next(); tok.kind == tokenString || tok.text != text {
+		return fmt.Errorf("line %d: expected %s, found %s", tok.line, text, describe(tok))
+	}
+	return nil
+}
+
+func (p *parser) ident() (token, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent {
+		return tok, fmt.Errorf("line %d: expected an identifier, found %s", tok.line, describe(tok))
+	}
+	return tok, nil
+}
+
+func describe(tok token) string {
+	if tok.kind == tokenEOF {
+		return "end of file"
+	}
+	return strconv.Quote(tok.text)
+}
+
+// parse reads the top-level declarations.
+func (p *parser) parse() error {
+	for p.peek().kind != tokenEOF {
+		switch {
+		case p.accept("typedef"):
+			if err := p.typedef(); err != nil {
+				return err
+			}
+		case p.peek().text == "struct" && p.isDefinition():
+			p.next()
+			if _, err := p.structSpecifier(""); err != nil {
+				return err
+			}
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case p.peek().text == "extern" && p.lookahead(1).kind == tokenString:
+			// extern "C" { ... } around the declarations
+			p.pos += 2
+			p.accept("{")
+		case p.accept("}"):
+			// The end of an extern "C" block
+		default:
+			p.skipDeclaration()
+		}
+	}
+	return nil
+}
+
+// isDefinition reports whether the struct keyword at the current position
+// starts a struct body, rather than a use of the type.
+func (p *parser) isDefinition() bool {
+	next := p.lookahead(1)
+	if next.text == "{" {
+		return true
+	}
+	return next.kind == tokenIdent && p.lookahead(2).text == "{"
+}
+
+// skipDeclaration skips to the end of a declaration this package does not
+// model, such as a function prototype or a variable.
+func (p *parser) skipDeclaration() {
+	depth := 0
+	for {
+		tok := p.next()
+		switch {
+		case tok.kind == tokenEOF:
+			return
+		case tok.kind == tokenString:
+		case tok.text == "{" || tok.text == "(":
+			depth++
+		case tok.text == "}" || tok.text == ")":
+			depth--
+			if depth == 0 && tok.text == "}" && p.peek().text != ";" && p.peek().kind != tokenIdent {
+				return // Function body
+			}
+		case tok.text == ";" && depth <= 0:
+			return
+		}
+	}
+}
+
+// typedef reads the rest of a typedef declaration.
+func (p *parser) typedef() error {
+	switch {
+	case p.accept("struct"):
+		var t *cType
+		if p.peek().text == "{" || p.lookahead(1).text == "{" {
+			name, err := p.typedefName()
+			if err != nil {
+				return err
+			}
+			if t, err = p.structSpecifier(name); err != nil {
+				return err
+			}
+		} else {
+			// typedef struct Tag Name; for a struct declared before or after
+			tag, err := p.ident()
+			if err != nil {
+				return err
+			}
+			name, err := p.ident()
+			if err != nil {
+				return err
+			}
+			if existing, ok := p.types["struct "+tag.text]; ok {
+				p.types[name.text] = existing
+			} else {
+				p.types[name.text] = &cType{name: tag.text}
+			}
+			return p.expect(";")
+		}
+		return p.typedefNames(t)
+	case p.accept("enum"):
+		tag := ""
+		if p.peek().kind == tokenIdent {
+			tag = p.next().text
+		}
+		if p.accept("{") {
+			for !p.accept("}") {
+				if p.peek().kind == tokenEOF {
+					return errors.New("unterminated enum")
+				}
+				p.next()
+			}
+		}
+		// Enumerations are ints in every mainstream ABI
+		t := &cType{name: "int", size: 4, align: 4}
+		if tag != "" {
+			p.types["enum "+tag] = t
+		}
+		return p.typedefNames(t)
+	}
+	p.skipDeclaration()
+	return nil
+}
+
+// typedefName looks ahead past a struct body to the name the typedef gives
+// it, so the struct can be created with that name.
+func (p *parser) typedefName() (string, error) {
+	start := p.pos
+	defer func() { p.pos = start }()
+	if p.peek().kind == tokenIdent {
+		p.next()
+	}
+	depth := 0
+	for {
+		tok := p.next()
+		switch {
+		case tok.kind == tokenEOF:
+			return "", fmt.Errorf("line %d: unterminated struct", tok.line)
+		case tok.text == "{":
+			depth++
+		case tok.text == "}":
+			depth--
+			if depth == 0 {
+				name, err := p.ident()
+				if err != nil {
+					return "", fmt.Errorf("line %d: typedef struct needs a name", name.line)
+				}
+				return name.text, nil
+			}
+		}
+	}
+}
+
+// typedefNames registers the names after the closing brace of a typedef. A
+// pointer typedef such as *StudentPtr is ignored.
+func (p *parser) typedefNames(t *cType) error {
+	for {
+		pointer := false
+		for p.accept("*") {
+			pointer = true
+		}
+		name, err := p.ident()
+		if err != nil {
+			return err
+		}
+		if !pointer {
+			p.types[name.text] = t
+		}
+		if p.accept(";") {
+			return nil
+		}
+		if err := p.expect(","); err != nil {
+			return err
+		}
+	}
+}
+
+// structSpecifier reads "[Tag] { members }" after the struct keyword and
+// declares the struct. name is the typedef name, if any, and otherwise the
+// tag names the struct.
+func (p *parser) structSpecifier(name string) (*cType, error) {
+	tag := ""
+	if p.peek().kind == tokenIdent {
+		tag = p.next().text
+	}
+	if name == "" {
+		name = tag
+	}
+	if name == "" {
+		tok := p.peek()
+		return nil, fmt.Errorf("line %d: anonymous struct needs a typedef name", tok.line)
+	}
+	if existing, ok := p.types[name]; ok && existing.cStruct != nil {
+		return nil, fmt.Errorf("line %d: struct %s is declared twice", p.peek().line, name)
+	}
+
+	t, err := p.structBody(name)
+	if err != nil {
+		return nil, err
+	}
+	if tag != "" {
+		p.types["struct "+tag] = t
+		// Complete any typedef struct Tag Name; seen before the definition
+		for key, existing := range p.types {
+			if existing.cStruct == nil && existing.name == tag && existing.size == 0 {
+				p.types[key] = t
+			}
+		}
+	}
+	p.types[name] = t
+	p.last = t
+	return t, nil
+}
+
+// member is one declarator of a struct member declaration.
+type member struct {
+	name     token
+	base     cType
+	baseName string // the type as written, e.g. "size_t"
+	pointer  bool
+	dims     []int
+	tag      reflect.StructTag
+}
+
+// structBody reads "{ members }" into a struct called name and computes its
+// C layout.
+func (p *parser) structBody(name string) (*cType, error) {
+	open := p.peek()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var members []member
+	lastCount := 0 // the number of members in the previous declaration
+	prevLine := open.line
+	for {
+		tok := p.next()
+		if tok.kind == tokenEOF {
+			return nil, fmt.Errorf("line %d: unterminated struct %s", open.line, name)
+		}
+
+		// A comment on the line of the previous declaration's semicolon
+		// belongs to that declaration; other comments belong to the next
+		var leading []comment
+		for _, c := range tok.comments {
+			if c.line == prevLine && lastCount > 0 {
+				if err := annotate(members[len(members)-lastCount:], c); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			leading = append(leading, c)
+		}
+		if tok.text == "}" {
+			break
+		}
+		p.pos--
+
+		declared, err := p.memberDeclaration(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range leading {
+			if err := annotate(declared, c); err != nil {
+				return nil, err
+			}
+		}
+		prevLine = p.tokens[p.pos-1].line
+		members = append(members, declared...)
+		lastCount = len(declared)
+	}
+
+	cStruct := &analyzer.CStruct{Name: name}
+	t := &cType{name: name, cStruct: cStruct, align: 1}
+	for i := 0; i < len(members); i++ {
+		m := members[i]
+		field, size, align, err := m.field()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: member %s: %v", m.name.line, m.name.text, err)
+		}
+
+		// uint8_t* name followed by size_t name_len is a binary field
+		if m.pointer && field.CType == "uint8_t*" {
+			if i+1 >= len(members) || members[i+1].name.text != m.name.text+"_len" || members[i+1].baseName != "size_t" || members[i+1].pointer || len(members[i+1].dims) > 0 {
+				return nil, fmt.Errorf("line %d: member %s: uint8_t* must be followed by size_t %s_len", m.name.line, m.name.text, m.name.text)
+			}
+			field.CType, field.Kind = analyzer.BytesCType, "slice"
+			size, align = 2*pointerSize, pointerSize
+			i++
+		}
+
+		t.size = alignUp(t.size, align)
+		field.Offset = t.size
+		t.size += size
+		t.align = max(t.align, align)
+		cStruct.Fields = append(cStruct.Fields, field)
+	}
+	if len(cStruct.Fields) == 0 {
+		return nil, fmt.Errorf("line %d: struct %s has no members", open.line, name)
+	}
+	t.size = alignUp(t.size, t.align)
+	return t, nil
+}
+
+// memberDeclaration reads one member declaration, which may declare several
+// members ("int a, b[2];") or define a nested struct inline.
+func (p *parser) memberDeclaration(parent string) ([]member, error) {
+	first := p.peek()
+	var words []string
+	var base *cType
+	for {
+		tok := p.peek()
+		if tok.kind != tokenIdent {
+			break
+		}
+		switch tok.text {
+		case "const", "volatile", "restrict":
+			p.next()
+			continue
+		case "union":
+			return nil, fmt.Errorf("line %d: unions are not supported", tok.line)
+		case "struct", "enum":
+			p.next()
+			if tok.text == "struct" && (p.peek().text == "{" || p.lookahead(1).text == "{") {
+				// Inline struct definition, named after its member unless tagged
+				tag := ""
+				if p.peek().kind == tokenIdent {
+					tag = p.next().text
+				}
+				structName := tag
+				if structName == "" {
+					structName = parent + analyzer.GoFieldName(p.memberNameAfterBody())
+				}
+				t, err := p.structBody(structName)
+				if err != nil {
+					return nil, err
+				}
+				if tag != "" {
+					p.types["struct "+tag] = t
+				}
+				base = t
+				continue
+			}
+			tag, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			t, ok := p.types[tok.text+" "+tag.text]
+			if !ok || (t.cStruct == nil && t.name != "int") {
+				return nil, fmt.Errorf("line %d: %s %s is not declared before use", tag.line, tok.text, tag.text)
+			}
+			base = t
+			continue
+		}
+		p.next()
+		words = append(words, tok.text)
+	}
+
+	// Without a pointer, the last word is the first member's name
+	var members []member
+	if base == nil && p.peek().text != "*" {
+		if len(words) < 2 {
+			return nil, fmt.Errorf("line %d: expected a member declaration", first.line)
+		}
+		name := p.tokens[p.pos-1]
+		words = words[:len(words)-1]
+		m, err := p.declarator(name, false)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+		if !p.accept(",") {
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			return p.resolve(members, words, base)
+		}
+	} else if base != nil && len(words) == 1 && p.peek().text != "*" {
+		name := p.tokens[p.pos-1]
+		words = nil
+		m, err := p.declarator(name, false)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+		if !p.accept(",") {
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			return p.resolve(members, words, base)
+		}
+	}
+
+	for {
+		pointer := false
+		for p.accept("*") {
+			if pointer {
+				return nil, fmt.Errorf("line %d: pointers to pointers are not supported", p.peek().line)
+			}
+			pointer = true
+		}
+		p.accept("const")
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		m, err := p.declarator(name, pointer)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+		if p.accept(";") {
+			return p.resolve(members, words, base)
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// memberNameAfterBody looks ahead past an inline struct body for the name of
+// the member it declares.
+func (p *parser) memberNameAfterBody() string {
+	start := p.pos
+	defer func() { p.pos = start }()
+	depth := 0
+	for tok := p.next(); tok.kind != tokenEOF; tok = p.next() {
+		switch tok.text {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				for p.accept("*") {
+				}
+				return p.peek().text
+			}
+		}
+	}
+	return ""
+}
+
+// declarator reads the array dimensions after a member name.
+func (p *parser) declarator(name token, pointer bool) (member, error) {
+	m := member{name: name, pointer: pointer}
+	for p.accept("[") {
+		tok := p.next()
+		text := tok.text
+		if value, ok := p.defines[text]; ok {
+			text = value
+		}
+		n, err := strconv.ParseInt(strings.TrimRight(text, "uUlL"), 0, 64)
+		if err != nil || n <= 0 {
+			return m, fmt.Errorf("line %d: array size of %s must be a positive integer constant", tok.line, name.text)
+		}
+		m.dims = append(m.dims, int(n))
+		if err := p.expect("]"); err != nil {
+			return m, err
+		}
+	}
+	if p.peek().text == ":" {
+		return m, fmt.Errorf("line %d: bit-field %s is not supported", name.line, name.text)
+	}
+	return m, nil
+}
+
+// resolve sets the base type of members declared together.
+func (p *parser) resolve(members []member, words []string, base *cType) ([]member, error) {
+	if base == nil {
+		spelling := strings.Join(words, " ")
+		if t, ok := scalars[spelling]; ok {
+			t.align = t.size
+			base = &t
+		} else if t, ok := p.types[spelling]; ok && len(words) == 1 {
+			if t.cStruct == nil && t.name != "int" {
+				return nil, fmt.Errorf("line %d: struct %s is not declared before use", members[0].name.line, spelling)
+			}
+			base = t
+		} else {
+			return nil, fmt.Errorf("line %d: unsupported type %s", members[0].name.line, spelling)
+		}
+		for i := range members {
+			members[i].baseName = spelling
+		}
+	}
+	for i := range members {
+		members[i].base = *base
+	}
+	return members, nil
+}
+
+// annotate applies a comment carrying struct tag annotations to the members
+// of one declaration. Comments without any known key are ignored.
+func annotate(declared []member, c comment) error {
+	tag := reflect.StructTag(strings.TrimSpace(c.text))
+	for _, key := range []string{"json", "required", "nullable", "enum", "default", "minimum", "maximum", "pattern", "maxlen"} {
+		if _, ok := tag.Lookup(key); !ok {
+			continue
+		}
+		m := &declared[0]
+		if len(declared) > 1 {
+			return fmt.Errorf("line %d: annotation is ambiguous for members declared together with %s", c.line, m.name.text)
+		}
+		if m.tag != "" {
+			return fmt.Errorf("line %d: member %s has more than one annotation", c.line, m.name.text)
+		}
+		m.tag = tag
+		return nil
+	}
+	return nil
+}
+
+// field converts the member to a FieldInfo and returns its size and
+// alignment.
+func (m member) field() (analyzer.FieldInfo, uintptr, uintptr, error) {
+	// The innermost value: a char array's last dimension is its capacity
+	dims := m.dims
+	var elem analyzer.FieldInfo
+	size, align := m.base.size, m.base.align
+	switch {
+	case m.base.cStruct != nil:
+		if m.pointer {
+			return elem, 0, 0, errors.New("pointers to structs are not supported")
+		}
+		elem = schema.Nested(m.base.cStruct)
+	case m.pointer:
+		switch m.base.name {
+		case "char":
+			elem = schema.Scalar("char*")
+		case "uint8_t":
+			elem = schema.Scalar("uint8_t*")
+		default:
+			return elem, 0, 0, fmt.Errorf("pointers to %s are not supported; only char* strings and uint8_t* binary data", m.baseName)
+		}
+		size, align = pointerSize, pointerSize
+	case m.base.name == "char":
+		if len(dims) == 0 {
+			return elem, 0, 0, errors.New("plain char is not supported; use char[N] for a string or signed/unsigned char for a number")
+		}
+		capacity := dims[len(dims)-1]
+		if capacity < 2 {
+			return elem, 0, 0, errors.New("a char array needs room for at least one character and the NUL")
+		}
+		dims = dims[:len(dims)-1]
+		elem = schema.Scalar("char*")
+		elem.MaxLen = capacity - 1
+		size = uintptr(capacity)
+	default:
+		elem = schema.Scalar(m.base.name)
+	}
+
+	for i := len(dims) - 1; i >= 0; i-- {
+		inner := elem
+		elem = analyzer.FieldInfo{CType: inner.CType, Kind: "array", Elem: &inner, Len: dims[i]}
+		size *= uintptr(dims[i])
+	}
+
+	field := elem
+	field.Name = m.name.text
+	field.GoName = analyzer.GoFieldName(m.name.text)
+	if err := m.applyTag(&field); err != nil {
+		return field, 0, 0, err
+	}
+	return field, size, align, nil
+}
+
+// applyTag applies the member's annotations to field.
+func (m member) applyTag(field *analyzer.FieldInfo) error {
+	if m.tag == "" {
+		return nil
+	}
+	if _, ok := m.tag.Lookup("maxlen"); ok {
+		return errors.New("maxlen is set by the char array size")
+	}
+	if key, ok := m.tag.Lookup("json"); ok {
+		key, _, _ = strings.Cut(key, ",")
+		switch key {
+		case "-":
+			return errors.New(`json:"-" cannot skip a member of an existing layout`)
+		case "", field.Name:
+		default:
+			field.CName, field.Name = field.Name, key
+		}
+	}
+
+	cType := field.CType
+	if field.Elem != nil {
+		for elem := field.Elem; elem != nil; elem = elem.Elem {
+			cType = elem.CType
+		}
+	}
+	rules, err := analyzer.ParseRules(m.tag, cType)
+	if err != nil {
+		return err
+	}
+	field.Rules = rules
+	return nil
+}
+
+func alignUp(n, align uintptr) uintptr {
+	return (n + align - 1) / align * align
+}
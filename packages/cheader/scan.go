@@ -0,0 +1,135 @@
+package cheader
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenPunct
+	tokenEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+	// comments holds the text of the comments directly before the token.
+	comments []comment
+}
+
+type comment struct {
+	text string
+	line int
+}
+
+// scan splits a header into tokens. Comments are attached to the following
+// token, and object-like #define constants are collected into defines; other
+// preprocessor lines are skipped.
+func scan(src string) ([]token, map[string]string, error) {
+	var tokens []token
+	var pending []comment
+	defines := make(map[string]string)
+	line := 1
+	lineStart := true
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			lineStart = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case c == '#' && lineStart:
+			// Preprocessor directive, including backslash continuations
+			end := i
+			for end < len(src) && (src[end] != '\n' || src[end-1] == '\\') {
+				if src[end] == '\n' {
+					line++
+				}
+				end++
+			}
+			fields := strings.Fields(strings.ReplaceAll(src[i+1:end], "\\\n", " "))
+			if len(fields) == 3 && fields[0] == "define" && !strings.Contains(fields[1], "(") {
+				defines[fields[1]] = fields[2]
+			}
+			i = end
+			continue
+		case strings.HasPrefix(src[i:], "//"):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src) - i
+			}
+			pending = append(pending, comment{text: src[i+2 : i+end], line: line})
+			i += end
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			text := src[i+2 : i+2+end]
+			pending = append(pending, comment{text: text, line: line})
+			line += strings.Count(text, "\n")
+			i += end + 4
+			continue
+		}
+		lineStart = false
+
+		tok := token{line: line, comments: pending}
+		pending = nil
+		switch {
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(src) && (isIdentStart(src[end]) || isDigit(src[end])) {
+				end++
+			}
+			tok.kind, tok.text = tokenIdent, src[i:end]
+			i = end
+		case isDigit(c):
+			end := i + 1
+			for end < len(src) && (isIdentStart(src[end]) || isDigit(src[end])) {
+				end++
+			}
+			tok.kind, tok.text = tokenNumber, src[i:end]
+			i = end
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(src) && src[end] != c && src[end] != '\n' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) || src[end] != c {
+				return nil, nil, fmt.Errorf("line %d: unterminated literal", line)
+			}
+			tok.kind, tok.text = tokenString, src[i:end+1]
+			i = end + 1
+		default:
+			tok.kind, tok.text = tokenPunct, string(c)
+			i++
+		}
+		tokens = append(tokens, tok)
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, line: line, comments: pending})
+	return tokens, defines, nil
+}
+
+func isIdentStart(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,388 @@
+// Package compat compares two versions of a struct and reports the changes
+// that stop documents written for one version from parsing, or from parsing
+// to the same values, with the other.
+//
+// A change breaks backward compatibility when the new parser can no longer
+// read documents written for the old struct, and forward compatibility when
+// parsers built from the old struct can no longer read documents written for
+// the new one. Unknown keys are skipped by the generated parser, so adding an
+// optional key breaks neither.
+package compat
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// Direction is a set of compatibility directions.
+type Direction int
+
+const (
+	// Backward: the new struct reads documents written for the old one.
+	Backward Direction = 1 << iota
+	// Forward: the old struct reads documents written for the new one.
+	Forward
+
+	// Full requires both directions.
+	Full = Backward | Forward
+)
+
+func (d Direction) String() string {
+	switch d {
+	case 0:
+		return "none"
+	case Backward:
+		return "backward"
+	case Forward:
+		return "forward"
+	case Full:
+		return "full"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// ParseDirection parses "backward", "forward" or "full".
+func ParseDirection(s string) (Direction, error) {
+	for _, d := range []Direction{Backward, Forward, Full} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compatibility mode %q (want backward, forward or full)", s)
+}
+
+// Change is one difference between the two structs.
+type Change struct {
+	// Path is the JSON key path of the field, e.g. "home.zip" or "courses[].code".
+	Path    string
+	Message string
+	// Breaks is the set of directions the change breaks; zero for a
+	// compatible change.
+	Breaks Direction
+}
+
+func (c Change) String() string {
+	if c.Breaks == 0 {
+		return fmt.Sprintf("%s: %s", c.Path, c.Message)
+	}
+	return fmt.Sprintf("%s: %s (breaks %s)", c.Path, c.Message, c.Breaks)
+}
+
+// Report lists the changes between two structs in field order.
+type Report struct {
+	Changes []Change
+}
+
+// Breaking returns the changes that break any direction in d.
+func (r *Report) Breaking(d Direction) []Change {
+	var changes []Change
+	for _, c := range r.Changes {
+		if c.Breaks&d != 0 {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// Compatible reports whether no change breaks a direction in d.
+func (r *Report) Compatible(d Direction) bool {
+	return len(r.Breaking(d)) == 0
+}
+
+// Compare reports the changes from old to new.
+func Compare(old, new analyzer.CStruct) *Report {
+	c := &comparer{report: &Report{}}
+	c.fields("", old.Fields, new.Fields)
+	return c.report
+}
+
+type comparer struct {
+	report *Report
+}
+
+func (c *comparer) add(path string, breaks Direction, format string, args ...any) {
+	c.report.Changes = append(c.report.Changes, Change{Path: path, Message: fmt.Sprintf(format, args...), Breaks: breaks})
+}
+
+// fields matches fields by JSON key. A removed key whose Go name reappears
+// under a new key is reported as a rename.
+func (c *comparer) fields(prefix string, old, new []analyzer.FieldInfo) {
+	newByName := make(map[string]analyzer.FieldInfo)
+	for _, fi := range new {
+		newByName[fi.Name] = fi
+	}
+	oldByName := make(map[string]bool)
+	renamed := make(map[string]bool)
+
+	for _, oldField := range old {
+		oldByName[oldField.Name] = true
+		path := prefix + oldField.Name
+		if newField, ok := newByName[oldField.Name]; ok {
+			c.field(path, oldField, newField)
+			continue
+		}
+
+		if newField, ok := findRename(oldField, old, new); ok {
+			renamed[newField.Name] = true
+			c.add(path, Full, "key renamed to %q", newField.Name)
+			continue
+		}
+		breaks := Backward
+		if oldField.Rules.Required {
+			breaks |= Forward
+		}
+		c.add(path, breaks, "key removed")
+	}
+
+	for _, newField := range new {
+		if oldByName[newField.Name] || renamed[newField.Name] {
+			continue
+		}
+		if newField.Rules.Required {
+			c.add(prefix+newField.Name, Backward, "required key added")
+		} else {
+			c.add(prefix+newField.Name, 0, "optional key added")
+		}
+	}
+}
+
+// findRename returns the field of new that carries oldField's Go name under a
+// key that old does not have.
+func findRename(oldField analyzer.FieldInfo, old, new []analyzer.FieldInfo) (analyzer.FieldInfo, bool) {
+	if oldField.GoName == "" {
+		return analyzer.FieldInfo{}, false
+	}
+	for _, newField := range new {
+		if newField.GoName != oldField.GoName {
+			continue
+		}
+		inOld := slices.ContainsFunc(old, func(fi analyzer.FieldInfo) bool { return fi.Name == newField.Name })
+		if !inOld {
+			return newField, true
+		}
+	}
+	return analyzer.FieldInfo{}, false
+}
+
+// field compares two versions of the same key.
+func (c *comparer) field(path string, old, new analyzer.FieldInfo) {
+	if !c.value(path, old, new) {
+		return
+	}
+
+	switch {
+	case new.Rules.Required && !old.Rules.Required:
+		c.add(path, Backward, "key became required")
+	case old.Rules.Required && !new.Rules.Required:
+		c.add(path, Forward, "key is no longer required")
+	}
+	c.rules(path, old.Rules, new.Rules)
+}
+
+// value compares the types of two values and recurses into nested structs and
+// array elements. It reports false when the types are unrelated, in which case
+// no further comparison is meaningful.
+func (c *comparer) value(path string, old, new analyzer.FieldInfo) bool {
+	oldKind, newKind := valueKind(old), valueKind(new)
+	if oldKind != newKind {
+		c.add(path, Full, "type changed from %s to %s", describe(old), describe(new))
+		return false
+	}
+
+	switch oldKind {
+	case "number":
+		c.numeric(path, old.CType, new.CType)
+	case "string":
+		c.maxLen(path, old, new)
+	case "object":
+		if old.Struct != nil && new.Struct != nil {
+			c.fields(path+".", old.Struct.Fields, new.Struct.Fields)
+		}
+	case "array":
+		switch {
+		case old.Kind == "array" && new.Kind == "array" && old.Len != new.Len:
+			c.add(path, Full, "array length changed from %d to %d", old.Len, new.Len)
+		case old.Kind != "array" && new.Kind == "array":
+			c.add(path, Backward, "array fixed at %d elements", new.Len)
+		case old.Kind == "array" && new.Kind != "array":
+			c.add(path, Forward, "array of %d elements became variable-length", old.Len)
+		}
+		if old.Elem != nil && new.Elem != nil {
+			c.value(path+"[]", *old.Elem, *new.Elem)
+			c.rules(path+"[]", old.Elem.Rules, new.Elem.Rules)
+		}
+	}
+	return true
+}
+
+// valueKind groups C types by the JSON value they parse.
+func valueKind(fi analyzer.FieldInfo) string {
+	switch {
+	case fi.CType == analyzer.BytesCType:
+		return "bytes"
+	case fi.Kind == "struct" || fi.Struct != nil:
+		return "object"
+	case fi.Kind == "slice" || fi.Kind == "array" || fi.Elem != nil:
+		return "array"
+	case fi.CType == "char*":
+		return "string"
+	case fi.CType == "bool":
+		return "boolean"
+	}
+	if _, ok := numericRanges[fi.CType]; ok {
+		return "number"
+	}
+	return fi.CType
+}
+
+func describe(fi analyzer.FieldInfo) string {
+	kind := valueKind(fi)
+	if kind == fi.CType {
+		return kind
+	}
+	return fmt.Sprintf("%s (%s)", kind, fi.CType)
+}
+
+// numericRange is the set of JSON numbers a C type holds exactly.
+type numericRange struct {
+	min, max float64
+	// exact is the largest integer magnitude below which every integer is
+	// representable.
+	exact    float64
+	fraction bool
+}
+
+var numericRanges = map[string]numericRange{
+	"int":          {math.MinInt32, math.MaxInt32, math.MaxInt32, false},
+	"int8_t":       {math.MinInt8, math.MaxInt8, math.MaxInt8, false},
+	"int16_t":      {math.MinInt16, math.MaxInt16, math.MaxInt16, false},
+	"int32_t":      {math.MinInt32, math.MaxInt32, math.MaxInt32, false},
+	"int64_t":      {math.MinInt64, math.MaxInt64, math.MaxInt64, false},
+	"unsigned int": {0, math.MaxUint32, math.MaxUint32, false},
+	"uint8_t":      {0, math.MaxUint8, math.MaxUint8, false},
+	"uint16_t":     {0, math.MaxUint16, math.MaxUint16, false},
+	"uint32_t":     {0, math.MaxUint32, math.MaxUint32, false},
+	"uint64_t":     {0, math.MaxUint64, math.MaxUint64, false},
+	"float":        {-math.MaxFloat32, math.MaxFloat32, 1 << 24, true},
+	"double":       {-math.MaxFloat64, math.MaxFloat64, 1 << 53, true},
+}
+
+// holds reports whether every value of b is exactly representable in a.
+func (a numericRange) holds(b numericRange) bool {
+	if a.min > b.min || a.max < b.max || (b.fraction && !a.fraction) {
+		return false
+	}
+	return a.exact >= b.exact
+}
+
+func (c *comparer) numeric(path, oldType, newType string) {
+	if oldType == newType {
+		return
+	}
+	oldRange, newRange := numericRanges[oldType], numericRanges[newType]
+	var breaks Direction
+	if !newRange.holds(oldRange) {
+		breaks |= Backward
+	}
+	if !oldRange.holds(newRange) {
+		breaks |= Forward
+	}
+	verb := "changed"
+	switch breaks {
+	case Backward:
+		verb = "narrowed"
+	case Forward:
+		verb = "widened"
+	}
+	c.add(path, breaks, "numeric type %s from %s to %s", verb, oldType, newType)
+}
+
+// maxLen compares the capacity of inline strings; zero means unbounded.
+func (c *comparer) maxLen(path string, old, new analyzer.FieldInfo) {
+	switch {
+	case old.MaxLen == new.MaxLen:
+	case new.MaxLen > 0 && (old.MaxLen == 0 || new.MaxLen < old.MaxLen):
+		c.add(path, Backward, "string capacity reduced to %d bytes", new.MaxLen)
+	default:
+		c.add(path, Forward, "string capacity raised from %d bytes", old.MaxLen)
+	}
+}
+
+// rules compares the validation constraints of one value.
+func (c *comparer) rules(path string, old, new analyzer.Rules) {
+	switch {
+	case old.Nullable && !new.Nullable:
+		c.add(path, Backward, "null no longer accepted")
+	case new.Nullable && !old.Nullable:
+		c.add(path, Forward, "null now accepted")
+	}
+
+	// An empty enum accepts any value of the type
+	if removed := missing(old.Enum, new.Enum); len(new.Enum) > 0 && (len(old.Enum) == 0 || len(removed) > 0) {
+		if len(old.Enum) == 0 {
+			c.add(path, Backward, "values restricted to enum [%s]", strings.Join(new.Enum, ", "))
+		} else {
+			c.add(path, Backward, "enum values removed: %s", strings.Join(removed, ", "))
+		}
+	}
+	if added := missing(new.Enum, old.Enum); len(old.Enum) > 0 && (len(new.Enum) == 0 || len(added) > 0) {
+		if len(new.Enum) == 0 {
+			c.add(path, Forward, "enum restriction removed")
+		} else {
+			c.add(path, Forward, "enum values added: %s", strings.Join(added, ", "))
+		}
+	}
+
+	c.bound(path, "minimum", old.Minimum, new.Minimum, func(a, b float64) bool { return a > b })
+	c.bound(path, "maximum", old.Maximum, new.Maximum, func(a, b float64) bool { return a < b })
+
+	switch {
+	case old.MaxLength == new.MaxLength:
+	case new.MaxLength > 0 && (old.MaxLength == 0 || new.MaxLength < old.MaxLength):
+		c.add(path, Backward, "maxLength reduced to %d", new.MaxLength)
+	default:
+		c.add(path, Forward, "maxLength raised from %d", old.MaxLength)
+	}
+
+	if old.Pattern != new.Pattern {
+		var breaks Direction
+		if new.Pattern != "" {
+			breaks |= Backward
+		}
+		if old.Pattern != "" {
+			breaks |= Forward
+		}
+		c.add(path, breaks, "pattern changed from %q to %q", old.Pattern, new.Pattern)
+	}
+}
+
+// bound compares an optional minimum or maximum. tighter reports whether the
+// first bound accepts fewer values than the second.
+func (c *comparer) bound(path, name string, old, new *float64, tighter func(a, b float64) bool) {
+	switch {
+	case old == nil && new == nil:
+	case old == nil:
+		c.add(path, Backward, "%s %v added", name, *new)
+	case new == nil:
+		c.add(path, Forward, "%s %v removed", name, *old)
+	case tighter(*new, *old):
+		c.add(path, Backward, "%s tightened from %v to %v", name, *old, *new)
+	case tighter(*old, *new):
+		c.add(path, Forward, "%s relaxed from %v to %v", name, *old, *new)
+	}
+}
+
+// missing returns the elements of a that are not in b.
+func missing(a, b []string) []string {
+	var out []string
+	for _, s := range a {
+		if !slices.Contains(b, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
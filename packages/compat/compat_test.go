@@ -0,0 +1,198 @@
+package compat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/schema"
+)
+
+func build(t *testing.T, b *schema.Builder) analyzer.CStruct {
+	t.Helper()
+	cStruct, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	return cStruct
+}
+
+func TestCompare(t *testing.T) {
+	oldAddress := schema.NewBuilder("Address")
+	oldAddress.String("street")
+	oldAddress.String("zip")
+	oldAddressStruct := build(t, oldAddress)
+
+	old := schema.NewBuilder("Student")
+	old.String("first_name").Required()
+	old.Int64("student_id")
+	old.Int("age")
+	old.String("grade").Enum(`"A"`, `"B"`, `"C"`)
+	old.String("nickname")
+	old.Float("gpa").Min(0).Max(4)
+	old.Object("home", &oldAddressStruct)
+	old.Slice("scores", schema.Scalar("int"))
+	old.Bool("active")
+	old.String("email")
+
+	newAddress := schema.NewBuilder("Address")
+	newAddress.String("street")
+	newAddress.InlineString("zip", 5)
+	newAddressStruct := build(t, newAddress)
+
+	new := schema.NewBuilder("Student")
+	new.String("first_name").Required()
+	new.Int("student_id")
+	new.Int64("age")
+	new.String("grade").Enum(`"A"`, `"B"`, `"D"`)
+	new.String("alias").GoName("Nickname")
+	new.Float("gpa").Min(1).Max(5)
+	new.Object("home", &newAddressStruct)
+	new.Slice("scores", schema.Scalar("double"))
+	new.String("active")
+	new.String("phone").Required()
+	new.String("notes")
+
+	report := Compare(build(t, old), build(t, new))
+	expected := []Change{
+		{"student_id", "numeric type narrowed from int64_t to int", Backward},
+		{"age", "numeric type widened from int to int64_t", Forward},
+		{"grade", `enum values removed: "C"`, Backward},
+		{"grade", `enum values added: "D"`, Forward},
+		{"nickname", `key renamed to "alias"`, Full},
+		{"gpa", "minimum tightened from 0 to 1", Backward},
+		{"gpa", "maximum relaxed from 4 to 5", Forward},
+		{"home.zip", "string capacity reduced to 5 bytes", Backward},
+		{"scores[]", "numeric type widened from int to double", Forward},
+		{"active", "type changed from boolean (bool) to string (char*)", Full},
+		{"email", "key removed", Backward},
+		{"phone", "required key added", Backward},
+		{"notes", "optional key added", 0},
+	}
+	if len(report.Changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d:\n%v", len(expected), len(report.Changes), report.Changes)
+	}
+	for i, change := range report.Changes {
+		if change != expected[i] {
+			t.Errorf("change %d - expected %v, got %v", i, expected[i], change)
+		}
+	}
+
+	if report.Compatible(Backward) || report.Compatible(Forward) {
+		t.Error("expected breaks in both directions")
+	}
+	if n := len(report.Breaking(Forward)); n != 6 {
+		t.Errorf("expected 6 forward breaks, got %d", n)
+	}
+}
+
+func TestCompareCompatible(t *testing.T) {
+	old := schema.NewBuilder("Student")
+	old.String("first_name")
+	old.Int("age").Required()
+	old.Slice("tags", schema.Scalar("char*"))
+
+	new := schema.NewBuilder("Student")
+	new.String("first_name")
+	new.Int("age").Required()
+	new.Slice("tags", schema.Scalar("char*"))
+	new.Bool("active")
+
+	report := Compare(build(t, old), build(t, new))
+	if !report.Compatible(Full) {
+		t.Errorf("expected full compatibility, got %v", report.Breaking(Full))
+	}
+	if len(report.Changes) != 1 {
+		t.Errorf("expected only the added key, got %v", report.Changes)
+	}
+}
+
+func TestCompareRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		old    func(b *schema.Builder)
+		new    func(b *schema.Builder)
+		change string
+		breaks Direction
+	}{
+		{"became required",
+			func(b *schema.Builder) { b.Int("a") },
+			func(b *schema.Builder) { b.Int("a").Required() },
+			"key became required", Backward},
+		{"no longer required",
+			func(b *schema.Builder) { b.Int("a").Required() },
+			func(b *schema.Builder) { b.Int("a") },
+			"key is no longer required", Forward},
+		{"removed required key",
+			func(b *schema.Builder) { b.Int("a").Required() },
+			func(b *schema.Builder) {},
+			"key removed", Full},
+		{"null rejected",
+			func(b *schema.Builder) { b.Int("a").Nullable() },
+			func(b *schema.Builder) { b.Int("a") },
+			"null no longer accepted", Backward},
+		{"enum added",
+			func(b *schema.Builder) { b.String("a") },
+			func(b *schema.Builder) { b.String("a").Enum(`"x"`) },
+			`values restricted to enum ["x"]`, Backward},
+		{"enum dropped",
+			func(b *schema.Builder) { b.String("a").Enum(`"x"`) },
+			func(b *schema.Builder) { b.String("a") },
+			"enum restriction removed", Forward},
+		{"minimum added",
+			func(b *schema.Builder) { b.Int("a") },
+			func(b *schema.Builder) { b.Int("a").Min(3) },
+			"minimum 3 added", Backward},
+		{"max length raised",
+			func(b *schema.Builder) { b.String("a").MaxLength(3) },
+			func(b *schema.Builder) { b.String("a").MaxLength(4) },
+			"maxLength raised from 3", Forward},
+		{"pattern changed",
+			func(b *schema.Builder) { b.String("a").Pattern("^a") },
+			func(b *schema.Builder) { b.String("a").Pattern("^b") },
+			`pattern changed from "^a" to "^b"`, Full},
+		{"int to float",
+			func(b *schema.Builder) { b.Int("a") },
+			func(b *schema.Builder) { b.Field("a", "float") },
+			"numeric type changed from int to float", Full},
+		{"fixed array length",
+			func(b *schema.Builder) { b.Array("a", schema.Scalar("int"), 2) },
+			func(b *schema.Builder) { b.Array("a", schema.Scalar("int"), 3) },
+			"array length changed from 2 to 3", Full},
+		{"slice fixed",
+			func(b *schema.Builder) { b.Slice("a", schema.Scalar("int")) },
+			func(b *schema.Builder) { b.Array("a", schema.Scalar("int"), 3) },
+			"array fixed at 3 elements", Backward},
+		{"bytes to string",
+			func(b *schema.Builder) { b.Bytes("a") },
+			func(b *schema.Builder) { b.String("a") },
+			"type changed from bytes (uint8_t*) to string (char*)", Full},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, new := schema.NewBuilder("S"), schema.NewBuilder("S")
+			tt.old(old)
+			tt.new(new)
+			report := Compare(build(t, old), build(t, new))
+			if len(report.Changes) != 1 {
+				t.Fatalf("expected one change, got %v", report.Changes)
+			}
+			if got := report.Changes[0]; got.Message != tt.change || got.Breaks != tt.breaks {
+				t.Errorf("expected %q (breaks %v), got %v", tt.change, tt.breaks, got)
+			}
+		})
+	}
+}
+
+func TestParseDirection(t *testing.T) {
+	for _, d := range []Direction{Backward, Forward, Full} {
+		parsed, err := ParseDirection(d.String())
+		if err != nil || parsed != d {
+			t.Errorf("ParseDirection(%q) = %v, %v", d.String(), parsed, err)
+		}
+	}
+	if _, err := ParseDirection("sideways"); err == nil || !strings.Contains(err.Error(), "unknown compatibility mode") {
+		t.Errorf("expected error for an unknown mode, got %v", err)
+	}
+}
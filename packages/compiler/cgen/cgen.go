@@ -0,0 +1,368 @@
+// Package cgen builds C source files programmatically and prints them as
+// deterministic, consistently indented C.
+//
+// Expressions are plain strings; statements, blocks, functions and files are
+// values. Every Block is a C scope, and Declare picks a name that no
+// enclosing scope has declared, so emitting the code for several values into
+// one function cannot redeclare a variable.
+package cgen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// File is a C source or header file.
+type File struct {
+	// Guard, when set, wraps the file in #ifndef/#define include guards.
+	Guard string
+	// Includes are written as given, e.g. "<stdio.h>" or `"student.h"`.
+	Includes []string
+	Decls    []Decl
+}
+
+// Decl is a top-level declaration.
+type Decl interface {
+	emitDecl(p *printer)
+}
+
+// Raw is top-level C emitted verbatim, such as a fixed runtime helper.
+type Raw string
+
+func (r Raw) emitDecl(p *printer) {
+	for _, line := range strings.Split(strings.TrimRight(string(r), "\n"), "\n") {
+		p.raw(line)
+	}
+}
+
+// Typedef declares "typedef struct { ... } Name;".
+type Typedef struct {
+	Name    string
+	Members []string // Member declarations without the semicolon
+}
+
+func (t *Typedef) emitDecl(p *printer) {
+	p.line("typedef struct {")
+	p.indent++
+	for _, member := range t.Members {
+		p.line("%s;", member)
+	}
+	p.indent--
+	p.line("} %s;", t.Name)
+}
+
+// Prototype declares a function without defining it.
+type Prototype string
+
+func (s Prototype) emitDecl(p *printer) {
+	p.line("%s;", string(s))
+}
+
+// Func is a function definition.
+type Func struct {
+	Comment   string
+	Signature string // e.g. "static int parse(const char** pp)"
+	Body      *Block
+}
+
+// NewFunc starts a function. params names the parameters, so Declare never
+// reuses them for a local.
+func NewFunc(comment, signature string, params ...string) *Func {
+	body := &Block{names: make(map[string]bool)}
+	for _, param := range params {
+		body.names[param] = true
+	}
+	return &Func{Comment: comment, Signature: signature, Body: body}
+}
+
+func (f *Func) emitDecl(p *printer) {
+	p.comment(f.Comment)
+	p.line("%s {", f.Signature)
+	f.Body.emitBody(p)
+	p.line("}")
+}
+
+// String prints the file.
+func (f *File) String() string {
+	p := &printer{}
+	if f.Guard != "" {
+		p.line("#ifndef %s", f.Guard)
+		p.line("#define %s", f.Guard)
+		p.blank()
+	}
+	for _, include := range f.Includes {
+		p.line("#include %s", include)
+	}
+	for i, decl := range f.Decls {
+		if i > 0 || len(f.Includes) > 0 {
+			p.blank()
+		}
+		decl.emitDecl(p)
+	}
+	if f.Guard != "" {
+		p.blank()
+		p.line("#endif // %s", f.Guard)
+	}
+	return p.buf.String()
+}
+
+// Stmt is a statement inside a Block.
+type Stmt interface {
+	emit(p *printer)
+}
+
+// Block is a sequence of statements forming one C scope.
+type Block struct {
+	parent *Block
+	names  map[string]bool
+	stmts  []Stmt
+}
+
+func (b *Block) child() *Block {
+	return &Block{parent: b, names: make(map[string]bool)}
+}
+
+// Unique returns base, or base followed by a number, such that no variable
+// of that name is declared in this block or any enclosing one, and reserves
+// it in this block.
+func (b *Block) Unique(base string) string {
+	name := base
+	for n := 2; b.declared(name); n++ {
+		name = fmt.Sprintf("%s%d", base, n)
+	}
+	b.names[name] = true
+	return name
+}
+
+func (b *Block) declared(name string) bool {
+	for s := b; s != nil; s = s.parent {
+		if s.names[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Declare declares a variable named after base and returns its name. init is
+// the initializer, or empty for none.
+func (b *Block) Declare(cType, base, init string) string {
+	name := b.Unique(base)
+	if init == "" {
+		b.stmts = append(b.stmts, declaration(fmt.Sprintf("%s %s;", cType, name)))
+	} else {
+		b.stmts = append(b.stmts, declaration(fmt.Sprintf("%s %s = %s;", cType, name, init)))
+	}
+	return name
+}
+
+// DeclareArray declares an array of n elements named after base.
+func (b *Block) DeclareArray(elemType, base string, n int) string {
+	name := b.Unique(base)
+	b.stmts = append(b.stmts, declaration(fmt.Sprintf("%s %s[%d];", elemType, name, n)))
+	return name
+}
+
+// Line adds a simple statement, written with its semicolon.
+func (b *Block) Line(format string, args ...interface{}) {
+	b.stmts = append(b.stmts, line(fmt.Sprintf(format, args...)))
+}
+
+// Comment adds a comment line.
+func (b *Block) Comment(text string) {
+	b.stmts = append(b.stmts, comment(text))
+}
+
+// Return adds a return statement; expr may be empty.
+func (b *Block) Return(expr string) {
+	if expr == "" {
+		b.Line("return;")
+		return
+	}
+	b.Line("return %s;", expr)
+}
+
+// Break adds a break statement.
+func (b *Block) Break() { b.Line("break;") }
+
+// Continue adds a continue statement.
+func (b *Block) Continue() { b.Line("continue;") }
+
+// Scope adds a nested { } block and returns it.
+func (b *Block) Scope() *Block {
+	s := &compound{head: "", body: b.child()}
+	b.stmts = append(b.stmts, s)
+	return s.body
+}
+
+// If adds an if statement and returns its body. A body holding a single
+// simple statement is printed on the same line as the condition.
+func (b *Block) If(cond string) *Block {
+	s := &compound{head: fmt.Sprintf("if (%s)", cond), body: b.child(), inline: true}
+	b.stmts = append(b.stmts, s)
+	return s.body
+}
+
+// IfElse adds an if statement with an else branch and returns both bodies.
+func (b *Block) IfElse(cond string) (then, els *Block) {
+	s := &compound{head: fmt.Sprintf("if (%s)", cond), body: b.child(), els: b.child()}
+	b.stmts = append(b.stmts, s)
+	return s.body, s.els
+}
+
+// While adds a while loop and returns its body.
+func (b *Block) While(cond string) *Block {
+	s := &compound{head: fmt.Sprintf("while (%s)", cond), body: b.child(), inline: true}
+	b.stmts = append(b.stmts, s)
+	return s.body
+}
+
+// For adds a for loop and returns its body. Empty clauses give "for (;;)".
+func (b *Block) For(init, cond, post string) *Block {
+	head := fmt.Sprintf("for (%s; %s; %s)", init, cond, post)
+	if init == "" && cond == "" && post == "" {
+		head = "for (;;)"
+	}
+	s := &compound{head: head, body: b.child()}
+	b.stmts = append(b.stmts, s)
+	return s.body
+}
+
+// ForRange adds "for (size_t i = 0; i < n; i++)" with a unique index
+// variable, and returns the index name and the loop body.
+func (b *Block) ForRange(base string, n int) (string, *Block) {
+	return b.ForEach(base, fmt.Sprint(n))
+}
+
+// ForEach is ForRange with a count that is a C expression, such as the
+// length of a slice.
+func (b *Block) ForEach(base, n string) (string, *Block) {
+	body := b.child()
+	index := body.Unique(base)
+	s := &compound{head: fmt.Sprintf("for (size_t %s = 0; %s < %s; %s++)", index, index, n, index), body: body}
+	b.stmts = append(b.stmts, s)
+	return index, body
+}
+
+// Switch adds a switch statement.
+func (b *Block) Switch(expr string) *Switch {
+	s := &Switch{expr: expr, parent: b, names: make(map[string]bool)}
+	b.stmts = append(b.stmts, s)
+	return s
+}
+
+// Switch is a switch statement. Its cases share one C scope, so a name
+// declared in one case is not reused by another.
+type Switch struct {
+	expr   string
+	parent *Block
+	names  map[string]bool
+	cases  []switchCase
+}
+
+type switchCase struct {
+	label string
+	body  *Block
+}
+
+// Case adds "case label:" and returns its body, which should end with a
+// break or return.
+func (s *Switch) Case(label string) *Block {
+	body := &Block{parent: s.parent, names: s.names}
+	s.cases = append(s.cases, switchCase{label: "case " + label + ":", body: body})
+	return body
+}
+
+// Default adds "default:" and returns its body.
+func (s *Switch) Default() *Block {
+	body := &Block{parent: s.parent, names: s.names}
+	s.cases = append(s.cases, switchCase{label: "default:", body: body})
+	return body
+}
+
+func (s *Switch) emit(p *printer) {
+	p.line("switch (%s) {", s.expr)
+	for _, c := range s.cases {
+		p.line("%s", c.label)
+		c.body.emitBody(p)
+	}
+	p.line("}")
+}
+
+type line string
+
+func (l line) emit(p *printer) { p.line("%s", string(l)) }
+
+// declaration is a variable declaration, which is never printed as the
+// unbraced body of an if or loop.
+type declaration string
+
+func (d declaration) emit(p *printer) { p.line("%s", string(d)) }
+
+type comment string
+
+func (c comment) emit(p *printer) { p.comment(string(c)) }
+
+// compound is a statement with a head, such as an if or a loop, and a body.
+type compound struct {
+	head   string
+	body   *Block
+	els    *Block
+	inline bool // Print a single simple statement on the head's line
+}
+
+func (c *compound) emit(p *printer) {
+	if c.inline && len(c.body.stmts) == 1 {
+		if l, ok := c.body.stmts[0].(line); ok {
+			p.line("%s %s", c.head, string(l))
+			return
+		}
+	}
+	if c.head == "" {
+		p.line("{")
+	} else {
+		p.line("%s {", c.head)
+	}
+	c.body.emitBody(p)
+	if c.els != nil {
+		p.line("} else {")
+		c.els.emitBody(p)
+	}
+	p.line("}")
+}
+
+func (b *Block) emitBody(p *printer) {
+	p.indent++
+	for _, stmt := range b.stmts {
+		stmt.emit(p)
+	}
+	p.indent--
+}
+
+// printer writes lines at the current indentation, four spaces per level.
+type printer struct {
+	buf    bytes.Buffer
+	indent int
+}
+
+func (p *printer) line(format string, args ...interface{}) {
+	p.buf.WriteString(strings.Repeat("    ", p.indent))
+	fmt.Fprintf(&p.buf, format, args...)
+	p.buf.WriteByte('\n')
+}
+
+func (p *printer) raw(text string) {
+	p.buf.WriteString(text)
+	p.buf.WriteByte('\n')
+}
+
+func (p *printer) blank() { p.buf.WriteByte('\n') }
+
+func (p *printer) comment(text string) {
+	if text == "" {
+		return
+	}
+	for _, l := range strings.Split(text, "\n") {
+		p.line("// %s", l)
+	}
+}
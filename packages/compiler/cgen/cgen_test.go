@@ -0,0 +1,118 @@
+package cgen
+
+import (
+	"testing"
+)
+
+func TestUnique(t *testing.T) {
+	fn := NewFunc("", "int f(int n)", "n")
+	body := fn.Body
+	if got := body.Declare("int", "n", "0"); got != "n2" {
+		t.Errorf("Declare shadowing a parameter = %s, want n2", got)
+	}
+	if got := body.Declare("int", "x", ""); got != "x" {
+		t.Errorf("first Declare = %s, want x", got)
+	}
+	if got := body.Declare("int", "x", ""); got != "x2" {
+		t.Errorf("second Declare = %s, want x2", got)
+	}
+
+	// Sibling scopes may reuse a name; nested scopes may not shadow one
+	first := body.Scope()
+	second := body.Scope()
+	if a, b := first.Declare("int", "y", ""), second.Declare("int", "y", ""); a != "y" || b != "y" {
+		t.Errorf("sibling scopes declared %s and %s, want y and y", a, b)
+	}
+	if got := first.If("1").Declare("int", "x", ""); got != "x3" {
+		t.Errorf("nested Declare = %s, want x3", got)
+	}
+
+	// Cases share the scope of their switch
+	s := body.Switch("n")
+	if a, b := s.Case("1").Declare("int", "z", ""), s.Default().Declare("int", "z", ""); a != "z" || b != "z2" {
+		t.Errorf("cases declared %s and %s, want z and z2", a, b)
+	}
+}
+
+func TestFileString(t *testing.T) {
+	fn := NewFunc("Sum the first n squares,\nor return -1.", "static int f(int n)", "n")
+	body := fn.Body
+	body.If("n < 0").Return("-1")
+	sum := body.Declare("int", "sum", "0")
+	i, loop := body.ForRange("i", 3)
+	loop.Line("%s += %s * %s;", sum, i, i)
+	even, odd := body.IfElse("n % 2 == 0")
+	even.Comment("Even")
+	even.Line("%s++;", sum)
+	odd.Return(sum)
+	c := body.Switch("n").Case("0")
+	c.Break()
+	body.While("n-- > 0").Continue()
+	body.Return(sum)
+
+	file := &File{
+		Guard:    "F_H",
+		Includes: []string{"<stdint.h>", `"f.h"`},
+		Decls: []Decl{
+			Raw("#define N 3\n"),
+			&Typedef{Name: "P", Members: []string{"int x", "char name[4]"}},
+			Prototype("int g(void)"),
+			fn,
+		},
+	}
+	want := `#ifndef F_H
+#define F_H
+
+#include <stdint.h>
+#include "f.h"
+
+#define N 3
+
+typedef struct {
+    int x;
+    char name[4];
+} P;
+
+int g(void);
+
+// Sum the first n squares,
+// or return -1.
+static int f(int n) {
+    if (n < 0) return -1;
+    int sum = 0;
+    for (size_t i = 0; i < 3; i++) {
+        sum += i * i;
+    }
+    if (n % 2 == 0) {
+        // Even
+        sum++;
+    } else {
+        return sum;
+    }
+    switch (n) {
+    case 0:
+        break;
+    }
+    while (n-- > 0) continue;
+    return sum;
+}
+
+#endif // F_H
+`
+	if got := file.String(); got != want {
+		t.Errorf("File.String() =\n%s\nwant:\n%s", got, want)
+	}
+	if file.String() != file.String() {
+		t.Error("File.String() is not deterministic")
+	}
+}
+
+func TestIfKeepsDeclarationsBraced(t *testing.T) {
+	fn := NewFunc("", "void f(void)")
+	fn.Body.If("1").Declare("int", "x", "")
+	file := &File{Decls: []Decl{fn}}
+	want := "void f(void) {\n    if (1) {\n        int x;\n    }\n}\n"
+	if got := file.String(); got != want {
+		t.Errorf("File.String() = %q, want %q", got, want)
+	}
+}
@@ -2,14 +2,18 @@ package compiler
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"unsafe"
 
 	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/ir"
 )
 
 var (
@@ -23,11 +27,23 @@ func CompileParser(cStruct analyzer.CStruct, outputDir string) error {
 		return fmt.Errorf("invalid struct: %v", err)
 	}
 
+	schema, err := lower(cStruct)
+	if err != nil {
+		return fmt.Errorf("failed to generate C code: %v", err)
+	}
+	return CompileSchema(schema, outputDir)
+}
+
+// CompileSchema generates C code for a schema, after whatever passes the
+// caller ran, and writes it to files named after the root object, along with
+// the jsonrt runtime they include.
+func CompileSchema(schema *ir.Schema, outputDir string) error {
 	// Generate C code
-	cCode, err := GenerateCCode(cStruct)
+	cCode, err := GenerateFromIR(schema)
 	if err != nil {
 		return fmt.Errorf("failed to generate C code: %v", err)
 	}
+	name := schema.Root.Name
 
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -35,11 +51,11 @@ func CompileParser(cStruct analyzer.CStruct, outputDir string) error {
 	}
 
 	// Write the C code to files
-	cFile := filepath.Join(outputDir, fmt.Sprintf("%s.c", cStruct.Name))
-	headerFile := filepath.Join(outputDir, fmt.Sprintf("%s.h", cStruct.Name))
+	cFile := filepath.Join(outputDir, fmt.Sprintf("%s.c", name))
+	headerFile := filepath.Join(outputDir, fmt.Sprintf("%s.h", name))
 
 	// Split the code into header and implementation
-	headerEnd := fmt.Sprintf("#endif // %s_H\n", cStruct.Name)
+	headerEnd := fmt.Sprintf("#endif // %s_H\n", name)
 	headerEndIndex := len(headerEnd)
 	for i := range cCode {
 		if i+headerEndIndex <= len(cCode) && cCode[i:i+headerEndIndex] == headerEnd {
@@ -55,11 +71,34 @@ func CompileParser(cStruct analyzer.CStruct, outputDir string) error {
 		}
 	}
 
-	return nil
+	return writeRuntime(outputDir)
 }
 
-// validateStruct checks if the CStruct is valid for code generation
+// LowerStruct validates a struct and converts it to the IR without running
+// any passes, for callers that choose their own before CompileSchema.
+func LowerStruct(cStruct analyzer.CStruct) (*ir.Schema, error) {
+	if err := validateStruct(cStruct); err != nil {
+		return nil, fmt.Errorf("invalid struct: %v", err)
+	}
+	return ir.Lower(cStruct)
+}
+
+// validateStruct checks if the CStruct, and every struct nested in it, is
+// valid for code generation
 func validateStruct(cStruct analyzer.CStruct) error {
+	v := &validator{structs: make(map[string]analyzer.CStruct), inProgress: make(map[string]bool)}
+	return v.structure(cStruct)
+}
+
+// validator tracks the structs already checked, by name, so that a struct
+// nested in several places is checked once and two different structs cannot
+// share a C name.
+type validator struct {
+	structs    map[string]analyzer.CStruct
+	inProgress map[string]bool
+}
+
+func (v *validator) structure(cStruct analyzer.CStruct) error {
 	// Check struct name
 	if cStruct.Name == "" {
 		return fmt.Errorf("empty struct name")
@@ -67,6 +106,18 @@ func validateStruct(cStruct analyzer.CStruct) error {
 	if !validIdentifierRegex.MatchString(cStruct.Name) {
 		return fmt.Errorf("invalid struct name: must be a valid C identifier")
 	}
+	if v.inProgress[cStruct.Name] {
+		return fmt.Errorf("struct %s contains itself", cStruct.Name)
+	}
+	if existing, ok := v.structs[cStruct.Name]; ok {
+		if !reflect.DeepEqual(existing, cStruct) {
+			return fmt.Errorf("two different structs are named %s", cStruct.Name)
+		}
+		return nil
+	}
+	v.structs[cStruct.Name] = cStruct
+	v.inProgress[cStruct.Name] = true
+	defer delete(v.inProgress, cStruct.Name)
 
 	// Check fields
 	if len(cStruct.Fields) == 0 {
@@ -75,147 +126,306 @@ func validateStruct(cStruct analyzer.CStruct) error {
 
 	// Check for duplicate field names and validate each field
 	fieldNames := make(map[string]bool)
+	memberNames := make(map[string]bool)
 	for _, field := range cStruct.Fields {
 		// Check field name
 		if field.Name == "" {
 			return fmt.Errorf("empty field name")
 		}
-		if !validIdentifierRegex.MatchString(field.Name) {
+		if field.CName == "" && !validIdentifierRegex.MatchString(field.Name) {
 			return fmt.Errorf("invalid field name: %s (must be a valid C identifier)", field.Name)
 		}
+		if field.CName != "" && !validIdentifierRegex.MatchString(field.CName) {
+			return fmt.Errorf("invalid C member name: %s (must be a valid C identifier)", field.CName)
+		}
+		if strings.ContainsFunc(field.Name, func(r rune) bool { return r == '"' || r == '\\' || r < ' ' }) {
+			return fmt.Errorf("invalid field name: %q (quotes, backslashes and control characters are not supported)", field.Name)
+		}
 		if fieldNames[field.Name] {
 			return fmt.Errorf("duplicate field name: %s", field.Name)
 		}
+		if memberNames[field.Member()] {
+			return fmt.Errorf("duplicate C member name: %s", field.Member())
+		}
 		fieldNames[field.Name] = true
+		memberNames[field.Member()] = true
+
+		if err := v.value(field.Name, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// value validates the type of the field called name, or of an array element.
+func (v *validator) value(name string, field analyzer.FieldInfo) error {
+	if err := validateRules(name, field); err != nil {
+		return err
+	}
+	switch {
+	case field.Kind == "struct" || field.Struct != nil:
+		if field.Struct == nil {
+			return fmt.Errorf("struct field %s has no nested struct", name)
+		}
+		if field.CType != field.Struct.Name {
+			return fmt.Errorf("struct field %s has C type %s, want %s", name, field.CType, field.Struct.Name)
+		}
+		return v.structure(*field.Struct)
+	case field.Kind == "array":
+		if field.Elem == nil || field.Len <= 0 {
+			return fmt.Errorf("array field %s needs an element type and a positive length", name)
+		}
+		if field.Elem.CType == analyzer.BytesCType {
+			return fmt.Errorf("arrays of binary values are not supported: %s", name)
+		}
+		if field.Elem.Kind == "slice" {
+			return fmt.Errorf("arrays of slices are not supported: %s", name)
+		}
+		return v.value(name, *field.Elem)
+	case field.Kind == "slice" && field.CType != analyzer.BytesCType:
+		if field.Elem == nil {
+			return fmt.Errorf("slice field %s needs an element type", name)
+		}
+		if field.Elem.Kind == "slice" || field.Elem.CType == analyzer.BytesCType {
+			return fmt.Errorf("slices of slices and of binary values are not supported: %s", name)
+		}
+		return v.value(name, *field.Elem)
+	}
 
-		// Validate CType
-		switch field.CType {
-		case "char*", "int", "bool":
-			// These are the supported types
-		case "":
-			return fmt.Errorf("empty C type for field: %s", field.Name)
-		default:
+	// Validate CType
+	switch field.CType {
+	case "char*", "bool", "float", "double", analyzer.BytesCType:
+		// These are the supported types
+	case "":
+		return fmt.Errorf("empty C type for field: %s", name)
+	default:
+		if _, ok := cTypeRanges[field.CType]; !ok {
 			return fmt.Errorf("unsupported C type: %s", field.CType)
 		}
 	}
 
+	// Inline storage only applies to strings
+	if field.MaxLen < 0 {
+		return fmt.Errorf("invalid maxlen for field %s: %d", name, field.MaxLen)
+	}
+	if field.MaxLen > 0 && field.CType != "char*" {
+		return fmt.Errorf("maxlen is only supported on char* fields: %s", name)
+	}
+	if field.Truncate && field.MaxLen == 0 {
+		return fmt.Errorf("truncate requires maxlen: %s", name)
+	}
 	return nil
 }
 
-// CompiledParser represents a compiled JSON parser
+// CompiledParser represents a compiled JSON parser. It calls the generated
+// code in-process when cgo is available, and sends documents to long-lived
+// worker processes otherwise, or when obtained from Isolated.
 type CompiledParser struct {
-	execPath string
-	cleanup  func()
-	fields   []analyzer.FieldInfo // Store field information for parsing
+	pool      *workerPool
+	typeName  string // The struct the module's workers parse
+	cleanup   func()
+	root      *ir.Object // The parsed object, describing the parser output
+	toolchain Toolchain  // The C compiler the parser was built with
+	dir       string     // The directory the parser was built in
+
+	// lib and parse, the address of parse_and_serialize_json_<Name> in it,
+	// are set when the parser runs in-process
+	lib   *library
+	parse unsafe.Pointer
+
+	mu       sync.Mutex
+	keyOrder KeyOrderStats
+}
+
+// KeyOrderStats counts the keys the generated parser found in the order it
+// expected, with one comparison, and the keys it had to dispatch in full.
+type KeyOrderStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate returns the fraction of keys the fast path found, or 0 before any
+// key was parsed.
+func (s KeyOrderStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// addKeyOrder adds the counts of one Parse call to the totals.
+func (p *CompiledParser) addKeyOrder(stats KeyOrderStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keyOrder.Hits += stats.Hits
+	p.keyOrder.Misses += stats.Misses
+}
+
+// KeyOrderStats returns the key-order counts of every Parse call so far.
+func (p *CompiledParser) KeyOrderStats() KeyOrderStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keyOrder
 }
 
 // CompileAndBuild generates C code, compiles it into an executable, and returns a parser instance
 func CompileAndBuild(cStruct analyzer.CStruct) (*CompiledParser, error) {
-	// Create c_output directory in root if it doesn't exist
-	outputDir := "c_output"
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	return CompileAndBuildWith(cStruct, Options{})
+}
+
+// CompileAndBuildWith is CompileAndBuild, built as opts says, e.g. with
+// optimizations for release or debug symbols for development.
+func CompileAndBuildWith(cStruct analyzer.CStruct, opts Options) (*CompiledParser, error) {
+	if err := validateStruct(cStruct); err != nil {
+		return nil, fmt.Errorf("invalid struct: %v", err)
 	}
+	schema, err := lower(cStruct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate C code: %v", err)
+	}
+	return CompileAndBuildSchemaWith(schema, opts)
+}
 
-	// Generate and write C code
-	if err := CompileParser(cStruct, outputDir); err != nil {
+// CompileAndBuildSchema is CompileAndBuild for a schema the caller has
+// already run passes over. It builds a module of one struct.
+func CompileAndBuildSchema(schema *ir.Schema) (*CompiledParser, error) {
+	return CompileAndBuildSchemaWith(schema, Options{})
+}
+
+// CompileAndBuildSchemaWith is CompileAndBuildSchema, built as opts says.
+func CompileAndBuildSchemaWith(schema *ir.Schema, opts Options) (*CompiledParser, error) {
+	m, err := BuildModuleSchemasWith([]*ir.Schema{schema}, opts)
+	if err != nil {
 		return nil, err
 	}
+	p := m.parsers[schema.Root.Name]
+	p.cleanup = m.Close
+	return p, nil
+}
 
-	// Create main file using struct name
-	mainFile := filepath.Join(outputDir, fmt.Sprintf("main_%s.c", cStruct.Name))
-	mainCode := fmt.Sprintf(`
-#include <stdio.h>
-#include <stdlib.h>
-#include "%s.h"
-
-extern char* parse_and_serialize_json(const char* input);
-extern void free_serialized(char* str);
-
-int main(int argc, char *argv[]) {
-    if (argc != 2) {
-        fprintf(stderr, "Usage: %%s <json_string>\\n", argv[0]);
-        return 1;
-    }
-
-    char* result = parse_and_serialize_json(argv[1]);
-    if (result == NULL) {
-        printf("ERROR|Failed to parse JSON\\n");
-        return 1;
-    }
-
-    printf("%%s", result);  // No newline in output
-    free_serialized(result);
-    return 0;
-}`, cStruct.Name)
-
-	if err := os.WriteFile(mainFile, []byte(mainCode), 0644); err != nil {
-		return nil, fmt.Errorf("failed to write main_%s.c: %v", cStruct.Name, err)
-	}
-
-	// Compile the program with struct-specific names
-	outPath := filepath.Join(outputDir, fmt.Sprintf("parser_%s", cStruct.Name))
-	cmd := exec.Command("gcc", "-o", outPath, mainFile, filepath.Join(outputDir, fmt.Sprintf("%s.c", cStruct.Name)))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("compilation failed: %v\nOutput: %s", err, out)
-	}
-
-	return &CompiledParser{
-		execPath: outPath,
-		cleanup: func() {
-			// Only remove the files specific to this struct
-			slog.Info("Removing File", slog.String("file", mainFile))
-			os.Remove(mainFile)
-			slog.Info("Removing File", slog.String("file", filepath.Join(outputDir, fmt.Sprintf("%s.c", cStruct.Name))))
-			os.Remove(filepath.Join(outputDir, fmt.Sprintf("%s.c", cStruct.Name)))
-			slog.Info("Removing File", slog.String("file", filepath.Join(outputDir, fmt.Sprintf("%s.h", cStruct.Name))))
-			os.Remove(filepath.Join(outputDir, fmt.Sprintf("%s.h", cStruct.Name)))
-			slog.Info("Removing File", slog.String("file", outPath))
-			os.Remove(outPath)
-		},
-		fields: cStruct.Fields,
-	}, nil
-}
-
-// Parse parses a JSON string and returns the values as a map
+// Parse parses a JSON string and returns the values as a map. Fields whose
+// key is absent hold their zero value; ParseWithPresence tells them apart.
 func (p *CompiledParser) Parse(jsonStr string) (map[string]interface{}, error) {
-	cmd := exec.Command(p.execPath, jsonStr)
-	out, err := cmd.CombinedOutput()
+	result, _, err := p.decode(requestDocument, jsonStr, false)
+	return result, err
+}
+
+// ParseWithPresence is Parse, also returning the fields whose key was in the
+// input, by path: a nested field's path is its object's and its key joined
+// with '.', and an array element's its array's and "[i]", e.g.
+// "campus[1].zip".
+func (p *CompiledParser) ParseWithPresence(jsonStr string) (map[string]interface{}, map[string]bool, error) {
+	return p.decode(requestDocument, jsonStr, true)
+}
+
+// ParseFile parses the JSON document in the file at path. The file is
+// memory-mapped, in the process or in a worker, and parsed in place, so
+// documents of any size are read without a copy. It must not be truncated
+// while it is parsed.
+func (p *CompiledParser) ParseFile(path string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return nil, err
+	}
+	result, _, err := p.decode(requestFile, abs, false)
+	return result, err
+}
+
+// ParseReader parses the JSON document read from r, up to its end. The
+// document is copied to a temporary file, which is parsed as ParseFile
+// parses files and then removed, so it is never held in memory whole.
+func (p *CompiledParser) ParseReader(r io.Reader) (map[string]interface{}, error) {
+	f, err := os.CreateTemp("", "jsonparser-*.json")
 	if err != nil {
-		return nil, fmt.Errorf("parser execution failed: %v\nOutput: %s", err, out)
+		return nil, fmt.Errorf("failed to spool JSON: %v", err)
 	}
-	slog.Info("C Parser Output", slog.String("output", string(out)))
-	// Parse the pipe-delimited output and trim any whitespace/newlines
-	parts := strings.Split(strings.TrimSpace(string(out)), "|")
-	for i := range parts {
-		parts[i] = strings.TrimSpace(parts[i])
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		return nil, fmt.Errorf("failed to spool JSON: %v", closeErr)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JSON: %v", err)
+	}
+	result, _, err := p.decode(requestFile, f.Name(), false)
+	return result, err
+}
 
-	if parts[0] != "SUCCESS" {
-		return nil, fmt.Errorf("parsing failed: %s", string(out))
+// decode parses input, a document or a file path as kind says, and decodes
+// the result. A rejected document returns a *ParseError.
+func (p *CompiledParser) decode(kind byte, input string, withPresence bool) (map[string]interface{}, map[string]bool, error) {
+	var out []byte
+	var ok bool
+	var err error
+	if p.lib != nil {
+		out, ok, err = p.callParser(kind, input)
+	} else {
+		out, ok, err = p.runParser(kind, input)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, parseError(kind, input, out)
 	}
+	slog.Info("C Parser Output", slog.Int("bytes", len(out)))
 
-	// Convert to map using field information
-	result := make(map[string]interface{})
-	for i, field := range p.fields {
-		if i+1 >= len(parts) {
-			break
-		}
-		value := parts[i+1]
+	var present map[string]bool
+	if withPresence {
+		present = make(map[string]bool)
+	}
+	result, err := decodeResult(out, p.root, present)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, present, nil
+}
 
-		// Convert value based on field type
-		switch field.CType {
-		case "int":
-			// Keep as string for now, as the caller can parse it if needed
-			result[field.Name] = value
-		case "bool":
-			result[field.Name] = value == "true"
-		case "char*":
-			result[field.Name] = value
-		}
+// callParser parses input with the parser loaded in-process. If it is
+// rejected, ok is false and out holds the encoded error.
+func (p *CompiledParser) callParser(kind byte, input string) (out []byte, ok bool, err error) {
+	call := p.lib.call
+	if kind == requestFile {
+		call = p.lib.callFile
+	}
+	out, ok, stats, err := call(p.parse, input)
+	if err != nil {
+		return nil, false, err
+	}
+	p.addKeyOrder(stats)
+	return out, ok, nil
+}
+
+// runParser is callParser on one of the module's worker processes.
+func (p *CompiledParser) runParser(kind byte, input string) (out []byte, ok bool, err error) {
+	out, ok, stats, err := p.pool.parse(kind, p.typeName, input)
+	if err != nil {
+		return nil, false, err
 	}
+	p.addKeyOrder(stats)
+	return out, ok, nil
+}
+
+// Isolated returns a handle on the same parser that runs every document in a
+// worker process, so a crash in the generated code cannot take down the
+// caller. It counts key order separately, and is valid until p is closed.
+func (p *CompiledParser) Isolated() *CompiledParser {
+	return &CompiledParser{pool: p.pool, typeName: p.typeName, root: p.root, toolchain: p.toolchain, dir: p.dir}
+}
+
+// Toolchain returns the C compiler the parser was built with.
+func (p *CompiledParser) Toolchain() Toolchain {
+	return p.toolchain
+}
 
-	return result, nil
+// Dir returns the directory the parser was built in, which holds its
+// generated sources and binaries until it is closed, or after, if kept.
+func (p *CompiledParser) Dir() string {
+	return p.dir
 }
 
 // Close releases resources associated with the parser
@@ -1,12 +1,21 @@
 package compiler
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/ir"
 )
 
 func TestCompileParser(t *testing.T) {
@@ -64,11 +73,11 @@ func TestCompileParser(t *testing.T) {
 
 	// Check source content
 	expectedSourceContent := []string{
-		"int parse_json(const char* input, Person* out)",
-		"strcmp(field, \"name\")",
-		"strcmp(field, \"age\")",
-		"strcmp(field, \"is_student\")",
-		"parse_and_serialize_json",
+		"int parse_json_Person(const char* input, size_t len, Person* out)",
+		"memcmp(key, \"name\", 4)",
+		"memcmp(key, \"age\", 3)",
+		"memcmp(key, \"is_student\", 10)",
+		"parse_and_serialize_json_Person",
 	}
 
 	for _, expected := range expectedSourceContent {
@@ -108,37 +117,37 @@ func TestParseJSON(t *testing.T) {
 			name:        "invalid json - missing opening brace",
 			input:       `"name": "John Doe", "age": 25}`,
 			wantErr:     true,
-			errContains: "Failed to parse JSON",
+			errContains: "parsing failed: type mismatch at line 1, column 1: expected an object, found \"name\"",
 		},
 		{
 			name:        "invalid json - missing closing brace",
 			input:       `{"name": "John Doe", "age": 25`,
 			wantErr:     true,
-			errContains: "Failed to parse JSON",
+			errContains: "parsing failed: syntax error at line 1, column 31: expected ',' or '}', found end of input",
 		},
 		{
 			name:        "invalid json - missing quotes around field name",
 			input:       `{name: "John Doe"}`,
 			wantErr:     true,
-			errContains: "Failed to parse JSON",
+			errContains: "parsing failed: syntax error at line 1, column 2: expected a key, found name",
 		},
 		{
 			name:        "invalid json - missing quotes around string value",
 			input:       `{"name": John Doe}`,
 			wantErr:     true,
-			errContains: "Failed to parse JSON",
+			errContains: "parsing failed: type mismatch at line 1, column 10 in name: expected a string, found John",
 		},
 		{
 			name:        "invalid json - invalid boolean value",
 			input:       `{"is_student": maybe}`,
 			wantErr:     true,
-			errContains: "Failed to parse JSON",
+			errContains: "parsing failed: type mismatch at line 1, column 16 in is_student: expected true or false, found maybe",
 		},
 		{
 			name:        "invalid json - invalid integer value",
 			input:       `{"age": twenty}`,
 			wantErr:     true,
-			errContains: "Failed to parse JSON",
+			errContains: "parsing failed: type mismatch at line 1, column 9 in age: expected an integer, found twenty",
 		},
 		{
 			name:  "valid json with extra fields",
@@ -294,7 +303,7 @@ func TestCompileParserErrors(t *testing.T) {
 			cStruct: analyzer.CStruct{
 				Name: "Person",
 				Fields: []analyzer.FieldInfo{
-					{Name: "name", CType: "float"},
+					{Name: "name", CType: "long double"},
 				},
 			},
 			outputDir:   t.TempDir(),
@@ -380,3 +389,1898 @@ func TestCompileParserErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestParseJSONBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:  "standard alphabet with padding",
+			input: `{"label": "x", "data": "aGVsbG8gd29ybGQ="}`,
+			want:  []byte("hello world"),
+		},
+		{
+			name:  "url-safe alphabet without padding",
+			input: `{"label": "x", "data": "-_-_"}`,
+			want:  []byte{0xfb, 0xff, 0xbf},
+		},
+		{
+			name:  "escaped slash",
+			input: `{"label": "x", "data": "\/w=="}`,
+			want:  []byte{0xff},
+		},
+		{
+			name:  "raw bytes including delimiters and NUL",
+			input: `{"label": "x", "data": "fAB8IA=="}`,
+			want:  []byte{'|', 0, '|', ' '},
+		},
+		{
+			name:  "empty string",
+			input: `{"label": "x", "data": ""}`,
+			want:  []byte{},
+		},
+		{
+			name:  "null",
+			input: `{"label": "x", "data": null}`,
+			want:  []byte{},
+		},
+		{
+			name:    "invalid character",
+			input:   `{"label": "x", "data": "aGV$bG8="}`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated quantum",
+			input:   `{"label": "x", "data": "aGVsb"}`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong padding",
+			input:   `{"label": "x", "data": "aGVsbA="}`,
+			wantErr: true,
+		},
+		{
+			name:    "data after padding",
+			input:   `{"label": "x", "data": "aA==aA=="}`,
+			wantErr: true,
+		},
+		{
+			name:    "mixed alphabets",
+			input:   `{"label": "x", "data": "+_=="}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a string",
+			input:   `{"label": "x", "data": 12}`,
+			wantErr: true,
+		},
+	}
+
+	testStruct := analyzer.CStruct{
+		Name: "Blob",
+		Fields: []analyzer.FieldInfo{
+			{Name: "data", CType: analyzer.BytesCType},
+			{Name: "label", CType: "char*"},
+		},
+	}
+
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parser.Parse(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Parse() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() unexpected error: %v", err)
+			}
+			got, ok := result["data"].([]byte)
+			if !ok {
+				t.Fatalf("data = %#v, want []byte", result["data"])
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("data = %v, want %v", got, tt.want)
+			}
+			if result["label"] != "x" {
+				t.Errorf("label = %v, want x", result["label"])
+			}
+		})
+	}
+}
+
+func TestParseJSONInlineStrings(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantCode  string
+		wantLabel string
+		wantErr   bool
+	}{
+		{
+			name:      "values within capacity",
+			input:     `{"code": "AB12", "label": "ok"}`,
+			wantCode:  "AB12",
+			wantLabel: "ok",
+		},
+		{
+			name:      "value at exact capacity",
+			input:     `{"code": "ABCDEFGH", "label": "four"}`,
+			wantCode:  "ABCDEFGH",
+			wantLabel: "four",
+		},
+		{
+			name:      "escaped quote counts as one byte",
+			input:     `{"code": "AB\"CDEFG"}`,
+			wantCode:  `AB"CDEFG`,
+			wantLabel: "",
+		},
+		{
+			name:    "rejected when too long",
+			input:   `{"code": "ABCDEFGHI"}`,
+			wantErr: true,
+		},
+		{
+			name:      "truncated when policy allows",
+			input:     `{"code": "A", "label": "truncated"}`,
+			wantCode:  "A",
+			wantLabel: "trun",
+		},
+		{
+			name:      "truncation keeps UTF-8 sequences whole",
+			input:     `{"code": "A", "label": "abcé"}`,
+			wantCode:  "A",
+			wantLabel: "abc",
+		},
+	}
+
+	testStruct := analyzer.CStruct{
+		Name: "Inline",
+		Fields: []analyzer.FieldInfo{
+			{Name: "code", CType: "char*", MaxLen: 8},
+			{Name: "label", CType: "char*", MaxLen: 4, Truncate: true},
+		},
+	}
+
+	tempDir := t.TempDir()
+	if err := CompileParser(testStruct, tempDir); err != nil {
+		t.Fatalf("CompileParser failed: %v", err)
+	}
+	headerContent, err := os.ReadFile(filepath.Join(tempDir, "Inline.h"))
+	if err != nil {
+		t.Fatalf("Failed to read header file: %v", err)
+	}
+	for _, expected := range []string{"char code[9];", "char label[5];"} {
+		if !strings.Contains(string(headerContent), expected) {
+			t.Errorf("Header file missing expected content: %s", expected)
+		}
+	}
+
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parser.Parse(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Parse() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() unexpected error: %v", err)
+			}
+			if result["code"] != tt.wantCode {
+				t.Errorf("code = %q, want %q", result["code"], tt.wantCode)
+			}
+			if result["label"] != tt.wantLabel {
+				t.Errorf("label = %q, want %q", result["label"], tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestParseJSONNested(t *testing.T) {
+	address := &analyzer.CStruct{
+		Name: "Address",
+		Fields: []analyzer.FieldInfo{
+			{Name: "zip", CType: "char*", MaxLen: 5},
+			{Name: "floor", CType: "int8_t"},
+		},
+	}
+	countElem := analyzer.FieldInfo{CType: "uint16_t"}
+	tagElem := analyzer.FieldInfo{CType: "char*", MaxLen: 3}
+	addressElem := analyzer.FieldInfo{CType: "Address", Kind: "struct", Struct: address}
+	testStruct := analyzer.CStruct{
+		Name: "Order",
+		Fields: []analyzer.FieldInfo{
+			{Name: "order-id", CName: "order_id", CType: "int64_t"},
+			{Name: "total", CType: "double"},
+			{Name: "weight", CType: "float"},
+			{Name: "ship_to", CType: "Address", Kind: "struct", Struct: address},
+			{Name: "counts", CType: "uint16_t", Kind: "array", Elem: &countElem, Len: 3},
+			{Name: "tags", CType: "char*", Kind: "array", Elem: &tagElem, Len: 2},
+			{Name: "stops", CType: "Address", Kind: "array", Elem: &addressElem, Len: 2},
+		},
+	}
+
+	tempDir := t.TempDir()
+	if err := CompileParser(testStruct, tempDir); err != nil {
+		t.Fatalf("CompileParser failed: %v", err)
+	}
+	headerContent, err := os.ReadFile(filepath.Join(tempDir, "Order.h"))
+	if err != nil {
+		t.Fatalf("Failed to read header file: %v", err)
+	}
+	header := string(headerContent)
+	for _, expected := range []string{
+		"char zip[6];",
+		"int8_t floor;",
+		"} Address;",
+		"int64_t order_id;",
+		"Address ship_to;",
+		"uint16_t counts[3];",
+		"char tags[2][4];",
+		"Address stops[2];",
+	} {
+		if !strings.Contains(header, expected) {
+			t.Errorf("Header file missing expected content: %s", expected)
+		}
+	}
+	if strings.Index(header, "} Address;") > strings.Index(header, "} Order;") {
+		t.Error("Address must be declared before Order")
+	}
+
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	input := `{"order-id": 9007199254740993, "total": 12.5, "weight": 0.25,
+		"ship_to": {"zip": "95112", "floor": -2, "unknown": [1, {"a": "}"}]},
+		"counts": [1, 2, 65535], "tags": ["a", "xyz"],
+		"stops": [{"zip": "1"}, {"floor": 3, "zip": "2"}]}`
+	result, err := parser.Parse(input)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"order-id": "9007199254740993",
+		"total":    "12.5",
+		"weight":   "0.25",
+		"ship_to":  map[string]interface{}{"zip": "95112", "floor": "-2"},
+		"counts":   []interface{}{"1", "2", "65535"},
+		"tags":     []interface{}{"a", "xyz"},
+		"stops": []interface{}{
+			map[string]interface{}{"zip": "1", "floor": "0"},
+			map[string]interface{}{"zip": "2", "floor": "3"},
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Parse() = %v, want %v", result, expected)
+	}
+
+	for _, invalid := range []string{
+		`{"counts": [1, 2]}`,
+		`{"counts": [1, 2, 3, 4]}`,
+		`{"counts": [1, 2, 65536]}`,
+		`{"counts": [1, 2, -1]}`,
+		`{"ship_to": {"floor": 128}}`,
+		`{"order-id": 9223372036854775808}`,
+		`{"weight": 1e39}`,
+		`{"total": 0x10}`,
+		`{"tags": ["abcd", "a"]}`,
+		`{"ship_to": "95112"}`,
+		`{"stops": [{"zip": "1"}, {"zip": "2"}`,
+	} {
+		if _, err := parser.Parse(invalid); err == nil {
+			t.Errorf("Parse(%s) succeeded, want error", invalid)
+		}
+	}
+}
+
+func TestParseJSONNullable(t *testing.T) {
+	address := &analyzer.CStruct{
+		Name:   "Stop",
+		Fields: []analyzer.FieldInfo{{Name: "zip", CType: "char*"}},
+	}
+	scoreElem := analyzer.FieldInfo{CType: "int", Rules: analyzer.Rules{Nullable: true}}
+	testStruct := analyzer.CStruct{
+		Name: "Visit",
+		Fields: []analyzer.FieldInfo{
+			{Name: "name", CType: "char*", Rules: analyzer.Rules{Required: true, Nullable: true}},
+			{Name: "code", CType: "char*", MaxLen: 4, Rules: analyzer.Rules{Nullable: true}},
+			{Name: "count", CType: "int"},
+			{Name: "stop", CType: "Stop", Kind: "struct", Struct: address, Rules: analyzer.Rules{Nullable: true}},
+			{Name: "scores", CType: "int", Kind: "array", Elem: &scoreElem, Len: 2, Rules: analyzer.Rules{Nullable: true}},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	// A repeated key set to null drops the value before it
+	result, present, err := parser.ParseWithPresence(`{"name": "a", "name": null, "code": null,
+		"stop": {"zip": "1"}, "stop": null, "scores": [null, 7]}`)
+	if err != nil {
+		t.Fatalf("ParseWithPresence() unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"name":   "",
+		"code":   "",
+		"count":  "0",
+		"stop":   map[string]interface{}{"zip": ""},
+		"scores": []interface{}{"0", "7"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("ParseWithPresence() = %v, want %v", result, expected)
+	}
+	if !present["name"] || !present["stop"] || present["stop.zip"] {
+		t.Errorf("present = %v", present)
+	}
+	if _, err := parser.Parse(`{"name": "a", "scores": null}`); err != nil {
+		t.Errorf("Parse() of a null array unexpected error: %v", err)
+	}
+
+	for _, invalid := range []string{
+		`{"name": "a", "count": null}`,
+		`{"name": nul}`,
+		`{"name": nullx}`,
+		`{"count": 1}`,
+	} {
+		if _, err := parser.Parse(invalid); err == nil {
+			t.Errorf("Parse(%s) succeeded, want error", invalid)
+		}
+	}
+}
+
+func TestParseJSONSlices(t *testing.T) {
+	tag := &analyzer.CStruct{
+		Name:   "Tag",
+		Fields: []analyzer.FieldInfo{{Name: "name", CType: "char*", Rules: analyzer.Rules{Required: true}}},
+	}
+	tagElem := analyzer.FieldInfo{CType: "Tag", Kind: "struct", Struct: tag}
+	item := &analyzer.CStruct{
+		Name: "Item",
+		Fields: []analyzer.FieldInfo{
+			{Name: "sku", CType: "char*", MaxLen: 4, Rules: analyzer.Rules{Required: true}},
+			{Name: "tags", CType: "Tag*", Kind: "slice", Elem: &tagElem},
+		},
+	}
+	intElem := analyzer.FieldInfo{CType: "int64_t"}
+	stringElem := analyzer.FieldInfo{CType: "char*"}
+	codeElem := analyzer.FieldInfo{CType: "char*", MaxLen: 2}
+	itemElem := analyzer.FieldInfo{CType: "Item", Kind: "struct", Struct: item}
+	pairElem := analyzer.FieldInfo{CType: "int", Kind: "array", Elem: &analyzer.FieldInfo{CType: "int"}, Len: 2}
+	testStruct := analyzer.CStruct{
+		Name: "Cart",
+		Fields: []analyzer.FieldInfo{
+			{Name: "ids", CType: "int64_t*", Kind: "slice", Elem: &intElem},
+			{Name: "notes", CType: "char**", Kind: "slice", Elem: &stringElem, Rules: analyzer.Rules{Nullable: true}},
+			{Name: "codes", CType: "char**", Kind: "slice", Elem: &codeElem},
+			{Name: "items", CType: "Item*", Kind: "slice", Elem: &itemElem},
+			{Name: "pairs", CType: "int*", Kind: "slice", Elem: &pairElem},
+		},
+	}
+
+	tempDir := t.TempDir()
+	if err := CompileParser(testStruct, tempDir); err != nil {
+		t.Fatalf("CompileParser failed: %v", err)
+	}
+	headerContent, err := os.ReadFile(filepath.Join(tempDir, "Cart.h"))
+	if err != nil {
+		t.Fatalf("Failed to read header file: %v", err)
+	}
+	for _, expected := range []string{
+		"int64_t *ids;", "size_t ids_len;",
+		"char* *notes;",
+		"char (*codes)[3];",
+		"Item *items;", "size_t items_len;",
+		"int (*pairs)[2];",
+	} {
+		if !strings.Contains(string(headerContent), expected) {
+			t.Errorf("Header file missing expected content: %s", expected)
+		}
+	}
+
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	// Enough ids to grow the slice several times
+	var ids []string
+	var want []interface{}
+	for i := 0; i < 40; i++ {
+		ids = append(ids, fmt.Sprint(i*1000003))
+		want = append(want, fmt.Sprint(i*1000003))
+	}
+	input := `{"ids": [1, 2], "ids": [` + strings.Join(ids, ", ") + `],
+		"notes": ["a", "", "\u00e9"], "codes": [],
+		"items": [{"sku": "ab", "tags": [{"name": "x"}, {"name": "y"}]}, {"sku": "c", "tags": []}],
+		"pairs": [[1, 2], [3, 4], [5, 6]]}`
+	result, present, err := parser.ParseWithPresence(input)
+	if err != nil {
+		t.Fatalf("ParseWithPresence() unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"ids":   want,
+		"notes": []interface{}{"a", "", "é"},
+		"codes": []interface{}{},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "ab", "tags": []interface{}{
+				map[string]interface{}{"name": "x"},
+				map[string]interface{}{"name": "y"},
+			}},
+			map[string]interface{}{"sku": "c", "tags": []interface{}{}},
+		},
+		"pairs": []interface{}{
+			[]interface{}{"1", "2"}, []interface{}{"3", "4"}, []interface{}{"5", "6"},
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("ParseWithPresence() = %v, want %v", result, expected)
+	}
+	if !present["items"] || !present["codes"] || !present["items[0].tags[1].name"] {
+		t.Errorf("present = %v", present)
+	}
+
+	result, err = parser.Parse(`{"notes": null, "items": [{"sku": "a", "tags": [{"name": "x"}]}], "items": []}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if notes, items := result["notes"], result["items"]; !reflect.DeepEqual(notes, []interface{}{}) || !reflect.DeepEqual(items, []interface{}{}) {
+		t.Errorf("Parse() = %v, want empty notes and items", result)
+	}
+
+	tests := []struct {
+		input string
+		kind  error
+		path  string
+	}{
+		{`{"ids": [1, "2"]}`, ErrType, "ids[1]"},
+		{`{"ids": {}}`, ErrType, "ids"},
+		{`{"ids": null}`, ErrType, "ids"},
+		{`{"ids": [1, 2}`, ErrSyntax, "ids"},
+		{`{"codes": ["abc"]}`, ErrOverflow, "codes[0]"},
+		{`{"items": [{"sku": "a"}, {"sku": "b", "tags": [{"name": "x"}, {}]}]}`, ErrMissingRequired, "items[1].tags[1].name"},
+		{`{"pairs": [[1, 2], [3]]}`, ErrType, "pairs[1]"},
+	}
+	for _, p := range []*CompiledParser{parser, parser.Isolated()} {
+		for _, tt := range tests {
+			_, err := p.Parse(tt.input)
+			var pe *ParseError
+			if !errors.As(err, &pe) || !errors.Is(err, tt.kind) || pe.Path != tt.path {
+				t.Errorf("Parse(%s) error = %v, want %v in %s", tt.input, err, tt.kind, tt.path)
+			}
+		}
+	}
+}
+
+func TestParseJSONRules(t *testing.T) {
+	f := func(x float64) *float64 { return &x }
+	tagElem := analyzer.FieldInfo{CType: "char*", Rules: analyzer.Rules{Enum: []string{`"a"`, `"b"`}}}
+	testStruct := analyzer.CStruct{
+		Name: "Course",
+		Fields: []analyzer.FieldInfo{
+			{Name: "level", CType: "char*", Rules: analyzer.Rules{Nullable: true, Enum: []string{`"intro"`, `"50%"`, `"caf\u00e9 \"q\""`}}},
+			{Name: "code", CType: "char*", MaxLen: 8, Rules: analyzer.Rules{MaxLength: 3}},
+			{Name: "title", CType: "char*", Rules: analyzer.Rules{MaxLength: 4}},
+			{Name: "credits", CType: "uint8_t", Rules: analyzer.Rules{Minimum: f(1), Maximum: f(6)}},
+			{Name: "offset", CType: "int", Rules: analyzer.Rules{Minimum: f(-5.5), Maximum: f(10)}},
+			{Name: "gpa", CType: "double", Rules: analyzer.Rules{Minimum: f(0), Maximum: f(4)}},
+			{Name: "ratio", CType: "float", Rules: analyzer.Rules{Enum: []string{"0.5", "1.5", `"x"`}}},
+			{Name: "open", CType: "bool", Rules: analyzer.Rules{Enum: []string{"true"}}},
+			{Name: "id", CType: "uint64_t", Rules: analyzer.Rules{Enum: []string{"18446744073709551615", "1"}}},
+			{Name: "floor", CType: "int64_t", Rules: analyzer.Rules{Enum: []string{"-9223372036854775808", "2.0"}}},
+			{Name: "tags", CType: "char**", Kind: "slice", Elem: &tagElem},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	for _, valid := range []string{
+		`{"level": "intro", "code": "éé", "title": "ñame", "credits": 6, "offset": -5, "gpa": 4,
+			"ratio": 1.5, "open": true, "id": 18446744073709551615, "floor": -9223372036854775808, "tags": ["b", "a"]}`,
+		`{"level": "50%", "code": "abc", "credits": 1, "offset": 10, "gpa": 0, "ratio": 0.5, "id": 1, "floor": 2}`,
+		`{"level": "café \"q\"", "level": null}`,
+	} {
+		if _, err := parser.Parse(valid); err != nil {
+			t.Errorf("Parse(%s) unexpected error: %v", valid, err)
+		}
+	}
+
+	tests := []struct {
+		input    string
+		kind     error
+		path     string
+		expected string
+	}{
+		{`{"level": "advanced"}`, ErrNotAllowed, "level", `one of "intro", "50%", "caf\u00e9 \"q\""`},
+		{`{"code": "abcd"}`, ErrOverflow, "code", "a string of at most 3 characters"},
+		{`{"title": "ñames"}`, ErrOverflow, "title", "a string of at most 4 characters"},
+		{`{"credits": 0}`, ErrOverflow, "credits", "an integer from 1 to 6"},
+		{`{"credits": 7}`, ErrOverflow, "credits", "an integer from 0 to 6"},
+		{`{"offset": -6}`, ErrOverflow, "offset", "an integer from -5 to 10"},
+		{`{"gpa": 4.01}`, ErrOverflow, "gpa", "a number at least 0 and at most 4"},
+		{`{"ratio": 1}`, ErrNotAllowed, "ratio", `one of 0.5, 1.5, "x"`},
+		{`{"open": false}`, ErrNotAllowed, "open", "true"},
+		{`{"id": 2}`, ErrNotAllowed, "id", "one of 18446744073709551615, 1"},
+		{`{"floor": 1}`, ErrNotAllowed, "floor", "one of -9223372036854775808, 2.0"},
+		{`{"tags": ["a", "c"]}`, ErrNotAllowed, "tags[1]", `one of "a", "b"`},
+	}
+	for _, tt := range tests {
+		_, err := parser.Parse(tt.input)
+		var pe *ParseError
+		if !errors.As(err, &pe) || !errors.Is(err, tt.kind) || pe.Path != tt.path || pe.Expected != tt.expected {
+			t.Errorf("Parse(%s) error = %v, want %v in %s: expected %s", tt.input, err, tt.kind, tt.path, tt.expected)
+			continue
+		}
+		// The error is at the start of the value
+		if at := strings.Index(tt.input, ": ") + 2; pe.Offset != int64(at) && tt.path != "tags[1]" {
+			t.Errorf("Parse(%s) error at byte %d, want %d", tt.input, pe.Offset, at)
+		}
+	}
+}
+
+func TestCompileParserNestedErrors(t *testing.T) {
+	self := &analyzer.CStruct{Name: "Node"}
+	self.Fields = []analyzer.FieldInfo{{Name: "next", CType: "Node", Kind: "struct", Struct: self}}
+	intElem := analyzer.FieldInfo{CType: "int"}
+	bytesElem := analyzer.FieldInfo{CType: analyzer.BytesCType, Kind: "slice"}
+	intSlice := analyzer.FieldInfo{CType: "int*", Kind: "slice", Elem: &intElem}
+	one, half, inf := 1.0, 0.5, math.Inf(1)
+
+	tests := []struct {
+		name        string
+		cStruct     analyzer.CStruct
+		errContains string
+	}{
+		{"self-containing struct", *self, "struct Node contains itself"},
+		{"missing nested struct", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "b", CType: "B", Kind: "struct"},
+		}}, "struct field b has no nested struct"},
+		{"conflicting nested structs", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "b", CType: "B", Kind: "struct", Struct: &analyzer.CStruct{Name: "B", Fields: []analyzer.FieldInfo{{Name: "x", CType: "int"}}}},
+			{Name: "c", CType: "B", Kind: "struct", Struct: &analyzer.CStruct{Name: "B", Fields: []analyzer.FieldInfo{{Name: "y", CType: "int"}}}},
+		}}, "two different structs are named B"},
+		{"array without length", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "xs", CType: "int", Kind: "array", Elem: &intElem},
+		}}, "needs an element type and a positive length"},
+		{"array of bytes", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "xs", CType: analyzer.BytesCType, Kind: "array", Elem: &bytesElem, Len: 2},
+		}}, "arrays of binary values are not supported"},
+		{"slice without elements", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "xs", CType: "int*", Kind: "slice"},
+		}}, "slice field xs needs an element type"},
+		{"slice of slices", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "xs", CType: "int*", Kind: "slice", Elem: &intSlice},
+		}}, "slices of slices and of binary values are not supported"},
+		{"slice of bytes", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "xs", CType: "uint8_t**", Kind: "slice", Elem: &bytesElem},
+		}}, "slices of slices and of binary values are not supported"},
+		{"array of slices", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "xs", CType: "int*", Kind: "array", Elem: &intSlice, Len: 2},
+		}}, "arrays of slices are not supported"},
+		{"key with a quote", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: `a"b`, CName: "ab", CType: "int"},
+		}}, "invalid field name"},
+		{"invalid member name", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a-b", CName: "a-b", CType: "int"},
+		}}, "invalid C member name"},
+		{"enum of an object", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "b", CType: "B", Kind: "struct", Struct: &analyzer.CStruct{Name: "B", Fields: []analyzer.FieldInfo{{Name: "x", CType: "int"}}},
+				Rules: analyzer.Rules{Enum: []string{"{}"}}},
+		}}, "enum applies only to strings, numbers and booleans"},
+		{"enum of another type", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: "uint8_t", Rules: analyzer.Rules{Enum: []string{`"1"`, "256", "1.5"}}},
+		}}, "no value of its enum is a uint8_t"},
+		{"minimum of a string", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: "char*", Rules: analyzer.Rules{Minimum: &one}},
+		}}, "minimum and maximum apply only to numbers"},
+		{"infinite maximum", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: "double", Rules: analyzer.Rules{Maximum: &inf}},
+		}}, "must be finite"},
+		{"empty range", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: "int8_t", Rules: analyzer.Rules{Minimum: &one, Maximum: &half}},
+		}}, "no int8_t lies between its minimum and maximum"},
+		{"maxLength of bytes", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: analyzer.BytesCType, Kind: "slice", Rules: analyzer.Rules{MaxLength: 4}},
+		}}, "maxLength applies only to strings"},
+		{"duplicate member name", analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: "int"},
+			{Name: "b", CName: "a", CType: "int"},
+		}}, "duplicate C member name: a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CompileParser(tt.cStruct, t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("CompileParser() error = %v, want error containing %q", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestCompileAndBuildSchema(t *testing.T) {
+	address := &analyzer.CStruct{
+		Name: "Address",
+		Fields: []analyzer.FieldInfo{
+			{Name: "zip", CType: "char*", MaxLen: 5},
+			{Name: "floor", CType: "int8_t"},
+		},
+	}
+	testStruct := analyzer.CStruct{
+		Name: "Account",
+		Fields: []analyzer.FieldInfo{
+			{Name: "active", CType: "bool"},
+			{Name: "id", CType: "int64_t"},
+			{Name: "level", CType: "uint8_t"},
+			{Name: "balance", CType: "double"},
+			{Name: "owner", CType: "char*"},
+			{Name: "home", CType: "Address", Kind: "struct", Struct: address},
+		},
+	}
+	schema, err := ir.Lower(testStruct)
+	if err != nil {
+		t.Fatalf("Lower failed: %v", err)
+	}
+	passes := []ir.Pass{ir.EliminateDeadFields([]string{"active", "id", "balance", "owner", "home.zip"}), ir.ReorderFields, ir.SelectDispatch}
+	if err := ir.Optimize(schema, passes...); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+
+	tempDir := t.TempDir()
+	if err := CompileSchema(schema, tempDir); err != nil {
+		t.Fatalf("CompileSchema failed: %v", err)
+	}
+	headerContent, err := os.ReadFile(filepath.Join(tempDir, "Account.h"))
+	if err != nil {
+		t.Fatalf("Failed to read header file: %v", err)
+	}
+	header := string(headerContent)
+	if strings.Contains(header, "level") || strings.Contains(header, "floor") {
+		t.Error("Header declares eliminated fields")
+	}
+	if strings.Index(header, "int64_t id;") > strings.Index(header, "bool active;") {
+		t.Error("Header members are not ordered by alignment")
+	}
+	cContent, err := os.ReadFile(filepath.Join(tempDir, "Account.c"))
+	if err != nil {
+		t.Fatalf("Failed to read C file: %v", err)
+	}
+	if !strings.Contains(string(cContent), "switch (key_len)") {
+		t.Error("Account should dispatch on key length")
+	}
+
+	parser, err := CompileAndBuildSchema(schema)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	result, err := parser.Parse(`{"level": 3, "owner": "ada", "id": 12, "active": true,
+		"home": {"floor": 2, "zip": "95112"}, "balance": 1.5, "extra": [1]}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"active":  true,
+		"id":      "12",
+		"balance": "1.5",
+		"owner":   "ada",
+		"home":    map[string]interface{}{"zip": "95112"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Parse() = %v, want %v", result, expected)
+	}
+	if _, err := parser.Parse(`{"id": 9223372036854775808}`); err == nil {
+		t.Error("Parse() accepted an out of range id")
+	}
+}
+
+// TestGenerateCCodeUniqueLocals compiles the code for fields that share types,
+// and the runtime, with warnings as errors, so a redeclared or shadowed local
+// fails the build.
+func TestGenerateCCodeUniqueLocals(t *testing.T) {
+	row := analyzer.FieldInfo{CType: "int"}
+	grid := analyzer.FieldInfo{CType: "int", Kind: "array", Elem: &row, Len: 2}
+	stop := &analyzer.CStruct{Name: "Stop", Fields: []analyzer.FieldInfo{
+		{Name: "ids", CType: "int*", Kind: "slice", Elem: &row},
+		{Name: "legs", CType: "int*", Kind: "slice", Elem: &row},
+	}}
+	stopElem := analyzer.FieldInfo{CType: "Stop", Kind: "struct", Struct: stop}
+	route := &analyzer.CStruct{Name: "Route", Fields: []analyzer.FieldInfo{{Name: "stops", CType: "Stop*", Kind: "slice", Elem: &stopElem}}}
+	routeElem := analyzer.FieldInfo{CType: "Route", Kind: "struct", Struct: route}
+	testStruct := analyzer.CStruct{
+		Name: "Pair",
+		Fields: []analyzer.FieldInfo{
+			{Name: "a", CType: "int"},
+			{Name: "b", CType: "int"},
+			{Name: "x", CType: "double"},
+			{Name: "y", CType: "float"},
+			{Name: "p", CType: analyzer.BytesCType, Kind: "slice"},
+			{Name: "q", CType: analyzer.BytesCType, Kind: "slice"},
+			{Name: "grid", CType: "int", Kind: "array", Elem: &grid, Len: 2},
+			{Name: "stops", CType: "Stop*", Kind: "slice", Elem: &stopElem},
+			{Name: "routes", CType: "Route*", Kind: "slice", Elem: &routeElem},
+			{Name: "trip", CType: "Route", Kind: "struct", Struct: route},
+		},
+	}
+	tempDir := t.TempDir()
+	if err := CompileParser(testStruct, tempDir); err != nil {
+		t.Fatalf("CompileParser failed: %v", err)
+	}
+	for _, name := range []string{"Pair", "jsonrt"} {
+		cmd := exec.Command("gcc", "-Wall", "-Wextra", "-Wshadow", "-Werror", "-c", "-o", filepath.Join(tempDir, name+".o"), filepath.Join(tempDir, name+".c"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s.c does not compile cleanly: %v\n%s", name, err, out)
+		}
+	}
+}
+
+// TestParseJSONKeyTrie parses an object large enough for trie dispatch, with
+// keys that share lengths and prefixes, so each must be told apart by the
+// bytes where it differs.
+func TestParseJSONKeyTrie(t *testing.T) {
+	testStruct := analyzer.CStruct{
+		Name: "Settings",
+		Fields: []analyzer.FieldInfo{
+			{Name: "cat", CType: "int"},
+			{Name: "car", CType: "int"},
+			{Name: "cab", CType: "int"},
+			{Name: "item1", CType: "int"},
+			{Name: "item2", CType: "int"},
+			{Name: "größe", CName: "groesse", CType: "int"},
+			{Name: "c", CType: "int"},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]interface{}
+	}{
+		{
+			name:  "every key",
+			input: `{"cab": 3, "car": 2, "cat": 1, "item2": 5, "item1": 4, "größe": 6, "c": 7}`,
+			want:  map[string]interface{}{"cat": "1", "car": "2", "cab": "3", "item1": "4", "item2": "5", "größe": "6", "c": "7"},
+		},
+		{
+			name:  "near misses are unknown keys",
+			input: `{"cax": 9, "item3": 9, "itemx": 9, "xat": 9, "ca": 9, "cats": 9, "größf": 9, "car": 2}`,
+			want:  map[string]interface{}{"cat": "0", "car": "2", "cab": "0", "item1": "0", "item2": "0", "größe": "0", "c": "0"},
+		},
+		{
+			name:  "escaped keys match once decoded",
+			input: `{"cat": 9, "ca\"t": 9, "cat": 1, "c\u0061b": 3}`,
+			want:  map[string]interface{}{"cat": "1", "car": "0", "cab": "3", "item1": "0", "item2": "0", "größe": "0", "c": "0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parser.Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.want) {
+				t.Errorf("Parse() = %v, want %v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONKeyLength(t *testing.T) {
+	testStruct := analyzer.CStruct{
+		Name: "Sizes",
+		Fields: []analyzer.FieldInfo{
+			{Name: "s", CType: "int"},
+			{Name: "md", CType: "int"},
+			{Name: "lrg", CType: "int"},
+			{Name: "huge", CType: "int"},
+			{Name: "giant", CType: "int"},
+		},
+	}
+	code, err := GenerateCCode(testStruct)
+	if err != nil {
+		t.Fatalf("GenerateCCode failed: %v", err)
+	}
+	if !strings.Contains(code, "switch (key_len)") || strings.Contains(code, "switch ((unsigned char)key[") {
+		t.Error("keys of distinct lengths should switch on the length alone")
+	}
+
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+	result, err := parser.Parse(`{"giant": 5, "x": 9, "s": 1, "lrg": 3, "mdx": 9, "huge": 4, "md": 2}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	want := map[string]interface{}{"s": "1", "md": "2", "lrg": "3", "huge": "4", "giant": "5"}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Parse() = %v, want %v", result, want)
+	}
+}
+
+func TestKeyOrderStats(t *testing.T) {
+	testStruct := analyzer.CStruct{
+		Name: "Person",
+		Fields: []analyzer.FieldInfo{
+			{Name: "name", CType: "char*"},
+			{Name: "age", CType: "int"},
+			{Name: "is_student", CType: "bool"},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	if rate := parser.KeyOrderStats().HitRate(); rate != 0 {
+		t.Errorf("HitRate() before parsing = %v, want 0", rate)
+	}
+	if _, err := parser.Parse(`{"name": "ada", "age": 36, "is_student": false}`); err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if got, want := parser.KeyOrderStats(), (KeyOrderStats{Hits: 3}); got != want {
+		t.Errorf("KeyOrderStats() after declared order = %+v, want %+v", got, want)
+	}
+	// Every key is out of place; the parser still finds each one
+	result, err := parser.Parse(`{"is_student": true, "age": 20, "name": "bob"}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if result["name"] != "bob" || result["age"] != "20" || result["is_student"] != true {
+		t.Errorf("Parse() = %v", result)
+	}
+	if got, want := parser.KeyOrderStats(), (KeyOrderStats{Hits: 3, Misses: 3}); got != want {
+		t.Errorf("KeyOrderStats() after reversed order = %+v, want %+v", got, want)
+	}
+	if rate := parser.KeyOrderStats().HitRate(); rate != 0.5 {
+		t.Errorf("HitRate() = %v, want 0.5", rate)
+	}
+
+	// A parser profiled on the reversed order expects it
+	schema, err := LowerStruct(testStruct)
+	if err != nil {
+		t.Fatalf("LowerStruct failed: %v", err)
+	}
+	if err := ir.Optimize(schema, ir.ProfileKeyOrder([]string{`{"is_student": true, "age": 20, "name": "bob"}`}), ir.SelectDispatch); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	profiled, err := CompileAndBuildSchema(schema)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer profiled.Close()
+	if _, err := profiled.Parse(`{"is_student": true, "age": 20, "name": "bob"}`); err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if got, want := profiled.KeyOrderStats(), (KeyOrderStats{Hits: 3}); got != want {
+		t.Errorf("profiled KeyOrderStats() = %+v, want %+v", got, want)
+	}
+}
+
+// TestRuntimeSharedAcrossParsers builds two parsers into the same directory
+// and checks that they share one runtime object, compiled once from the
+// build's own copy of the runtime, named for its source and removed with the
+// last of them.
+func TestRuntimeSharedAcrossParsers(t *testing.T) {
+	opts := Options{OutputDir: t.TempDir()}
+	// A stale runtime left in the output directory is not compiled
+	if err := os.WriteFile(filepath.Join(opts.OutputDir, "jsonrt.c"), []byte("#error stale runtime\n"), 0644); err != nil {
+		t.Fatalf("Failed to write stale runtime: %v", err)
+	}
+	first, err := CompileAndBuildWith(analyzer.CStruct{Name: "First", Fields: []analyzer.FieldInfo{{Name: "a", CType: "char*"}}}, opts)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	objects, _ := filepath.Glob(filepath.Join(opts.OutputDir, "jsonrt_*.o"))
+	if len(objects) != 1 {
+		t.Fatalf("runtime objects = %q, want one", objects)
+	}
+	object := objects[0]
+	if !strings.Contains(filepath.Base(object), "_"+runtimeHash()+"_") {
+		t.Errorf("runtime object %s is not named for the runtime source", filepath.Base(object))
+	}
+	before, err := os.Stat(object)
+	if err != nil {
+		t.Fatalf("runtime object missing: %v", err)
+	}
+	if mode := before.Mode().Perm(); mode != 0644 {
+		t.Errorf("runtime object mode = %v, want %v", mode, os.FileMode(0644))
+	}
+
+	second, err := CompileAndBuildWith(analyzer.CStruct{Name: "Second", Fields: []analyzer.FieldInfo{{Name: "b", CType: "char*"}}}, opts)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	after, err := os.Stat(object)
+	if err != nil {
+		t.Fatalf("runtime object missing: %v", err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Error("runtime was compiled again for the second parser")
+	}
+
+	source, err := os.ReadFile(filepath.Join(second.Dir(), "Second.c"))
+	if err != nil {
+		t.Fatalf("Failed to read C file: %v", err)
+	}
+	if strings.Contains(string(source), "int jsonrt_parse_string(") || !strings.Contains(string(source), `#include "jsonrt.h"`) {
+		t.Error("Second.c should include the runtime rather than define it")
+	}
+	for _, p := range []*CompiledParser{first, second} {
+		if _, err := p.Parse(`{"a": "x\"y", "b": "z"}`); err != nil {
+			t.Errorf("Parse() unexpected error: %v", err)
+		}
+	}
+
+	first.Close()
+	if _, err := os.Stat(object); err != nil {
+		t.Errorf("runtime object removed while a parser links it: %v", err)
+	}
+	second.Close()
+	if _, err := os.Stat(object); !os.IsNotExist(err) {
+		t.Errorf("runtime object left after the last parser closed: %v", err)
+	}
+
+	// The compiler's environment may change how it compiles
+	if (&buildConfig{env: []string{"CPATH=/opt/include"}}).fingerprint() == (&buildConfig{}).fingerprint() {
+		t.Error("fingerprint ignores the compiler's environment")
+	}
+}
+
+// TestBuildModule builds structs that share a nested struct into one module
+// and parses each through its handle.
+func TestBuildModule(t *testing.T) {
+	address := &analyzer.CStruct{
+		Name:   "Address",
+		Fields: []analyzer.FieldInfo{{Name: "zip", CType: "char*"}},
+	}
+	structs := []analyzer.CStruct{
+		{Name: "Student", Fields: []analyzer.FieldInfo{
+			{Name: "name", CType: "char*"},
+			{Name: "home", CType: "Address", Kind: "struct", Struct: address},
+		}},
+		{Name: "Course", Fields: []analyzer.FieldInfo{
+			{Name: "code", CType: "int"},
+			{Name: "room", CType: "Address", Kind: "struct", Struct: address},
+		}},
+	}
+	m, err := BuildModule(structs)
+	if err != nil {
+		t.Fatalf("BuildModule failed: %v", err)
+	}
+	defer m.Close()
+
+	if got := m.Types(); !reflect.DeepEqual(got, []string{"Course", "Student"}) {
+		t.Errorf("Types() = %v, want [Course Student]", got)
+	}
+	student, err := m.Parser("Student")
+	if err != nil {
+		t.Fatalf("Parser(Student) failed: %v", err)
+	}
+	course, err := m.Parser("Course")
+	if err != nil {
+		t.Fatalf("Parser(Course) failed: %v", err)
+	}
+	if student.pool != course.pool {
+		t.Error("parsers of one module should share its workers")
+	}
+
+	result, err := student.Parse(`{"name": "ada", "home": {"zip": "95112"}}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if want := map[string]interface{}{"name": "ada", "home": map[string]interface{}{"zip": "95112"}}; !reflect.DeepEqual(result, want) {
+		t.Errorf("Student Parse() = %v, want %v", result, want)
+	}
+	result, err = course.Parse(`{"code": 152, "room": {"zip": "95192"}}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if want := map[string]interface{}{"code": "152", "room": map[string]interface{}{"zip": "95192"}}; !reflect.DeepEqual(result, want) {
+		t.Errorf("Course Parse() = %v, want %v", result, want)
+	}
+	// Closing a handle leaves the module usable
+	student.Close()
+	if _, err := student.Parse(`{"name": "bob"}`); err != nil {
+		t.Errorf("Parse() after closing the handle: %v", err)
+	}
+
+	if _, err := m.Parser("Room"); err == nil || !strings.Contains(err.Error(), "module has no parser for Room") {
+		t.Errorf("Parser(Room) error = %v, want module has no parser for Room", err)
+	}
+	if _, err := BuildModule(append(structs, structs[0])); err == nil || !strings.Contains(err.Error(), "duplicate struct Student") {
+		t.Errorf("BuildModule() error = %v, want duplicate struct Student", err)
+	}
+	if _, err := BuildModule(nil); err == nil {
+		t.Error("BuildModule() of no structs should fail")
+	}
+}
+
+// TestParseInProcess checks that the loaded parser agrees with the isolated
+// one, is safe for concurrent use, and counts key order per call.
+func TestParseInProcess(t *testing.T) {
+	if !inProcessSupported {
+		t.Skip("in-process parsers require cgo")
+	}
+	testStruct := analyzer.CStruct{
+		Name: "Blob",
+		Fields: []analyzer.FieldInfo{
+			{Name: "name", CType: "char*"},
+			{Name: "size", CType: "uint32_t"},
+			{Name: "data", CType: analyzer.BytesCType, Kind: "slice"},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	if parser.lib == nil {
+		t.Fatal("parser was not loaded in-process")
+	}
+
+	input := `{"name": "ada", "size": 3, "data": "AHwA"}`
+	want, err := parser.Isolated().Parse(input)
+	if err != nil {
+		t.Fatalf("isolated Parse() unexpected error: %v", err)
+	}
+	got, err := parser.Parse(input)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) || !bytes.Equal(got["data"].([]byte), []byte{0, '|', 0}) {
+		t.Errorf("Parse() = %v, isolated Parse() = %v", got, want)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, err := parser.Parse(input); err != nil {
+					t.Errorf("concurrent Parse() unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := parser.KeyOrderStats(), (KeyOrderStats{Hits: 3 * 201}); got != want {
+		t.Errorf("KeyOrderStats() = %+v, want %+v", got, want)
+	}
+
+	if _, err := parser.Parse(`{"name": 1}`); !errors.Is(err, ErrType) {
+		t.Errorf("Parse() error = %v, want ErrType", err)
+	}
+	parser.Close()
+	if _, err := parser.Parse(input); err == nil || !strings.Contains(err.Error(), "parser is closed") {
+		t.Errorf("Parse() after Close error = %v, want parser is closed", err)
+	}
+}
+
+// TestWorkerPool parses concurrently on isolated workers, and checks that a
+// crashed worker is replaced.
+func TestWorkerPool(t *testing.T) {
+	parser, err := CompileAndBuild(analyzer.CStruct{
+		Name: "Job",
+		Fields: []analyzer.FieldInfo{
+			{Name: "id", CType: "int"},
+			{Name: "tag", CType: "char*"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	isolated := parser.Isolated()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				result, err := isolated.Parse(fmt.Sprintf(`{"id": %d, "tag": "t%d"}`, i*10+j, j))
+				if err != nil {
+					t.Errorf("Parse() unexpected error: %v", err)
+					return
+				}
+				if result["id"] != fmt.Sprint(i*10+j) || result["tag"] != fmt.Sprintf("t%d", j) {
+					t.Errorf("Parse() = %v, want id %d and tag t%d", result, i*10+j, j)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	pool := isolated.pool
+	if n := len(pool.idle); n == 0 || n > cap(pool.slots) {
+		t.Errorf("pool has %d idle workers, want 1 to %d", n, cap(pool.slots))
+	}
+	if got, want := isolated.KeyOrderStats(), (KeyOrderStats{Hits: 320}); got != want {
+		t.Errorf("KeyOrderStats() = %+v, want %+v", got, want)
+	}
+	if _, err := isolated.Parse(`{"id": "x"}`); !errors.Is(err, ErrType) {
+		t.Errorf("Parse() error = %v, want ErrType", err)
+	}
+
+	// Crash every idle worker; the next request restarts one
+	for _, w := range pool.idle {
+		w.cmd.Process.Kill()
+	}
+	if result, err := isolated.Parse(`{"id": 1}`); err != nil || result["id"] != "1" {
+		t.Errorf("Parse() after a crash = %v, %v", result, err)
+	}
+
+	unknown := &CompiledParser{pool: pool, typeName: "Nope", root: isolated.root}
+	if _, err := unknown.Parse(`{}`); err == nil || !strings.Contains(err.Error(), "no parser for Nope") {
+		t.Errorf("Parse() error = %v, want no parser for Nope", err)
+	}
+
+	parser.Close()
+	if _, err := isolated.Parse(`{"id": 1}`); err == nil || !strings.Contains(err.Error(), "parser is closed") {
+		t.Errorf("Parse() after Close error = %v, want parser is closed", err)
+	}
+	if len(pool.idle) != 0 {
+		t.Errorf("Close left %d workers running", len(pool.idle))
+	}
+}
+
+// TestResultEncoding checks that values holding the bytes the old
+// pipe-delimited output split on, and leading and trailing spaces, come back
+// intact, along with which keys the input held.
+func TestResultEncoding(t *testing.T) {
+	address := &analyzer.CStruct{
+		Name: "Place",
+		Fields: []analyzer.FieldInfo{
+			{Name: "street", CType: "char*"},
+			{Name: "zip", CType: "char*", MaxLen: 8},
+		},
+	}
+	placeElem := analyzer.FieldInfo{CType: "Place", Kind: "struct", Struct: address}
+	testStruct := analyzer.CStruct{
+		Name: "Letter",
+		Fields: []analyzer.FieldInfo{
+			{Name: "subject", CType: "char*"},
+			{Name: "body", CType: "char*"},
+			{Name: "urgent", CType: "bool"},
+			{Name: "weight", CType: "float"},
+			{Name: "stamp", CType: analyzer.BytesCType, Kind: "slice"},
+			{Name: "to", CType: "Place", Kind: "struct", Struct: address},
+			{Name: "via", CType: "Place", Kind: "array", Elem: &placeElem, Len: 2},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	input := `{"subject": "a|b||", "body": "  SUCCESS|padded  ", "stamp": "fHw=",
+		"to": {"zip": " |1| "}, "via": [{"street": "|"}, {}]}`
+	want := map[string]interface{}{
+		"subject": "a|b||",
+		"body":    "  SUCCESS|padded  ",
+		"urgent":  false,
+		"weight":  "0",
+		"stamp":   []byte("||"),
+		"to":      map[string]interface{}{"street": "", "zip": " |1| "},
+		"via": []interface{}{
+			map[string]interface{}{"street": "|", "zip": ""},
+			map[string]interface{}{"street": "", "zip": ""},
+		},
+	}
+	wantPresent := map[string]bool{
+		"subject": true, "body": true, "stamp": true, "to": true, "to.zip": true,
+		"via": true, "via[0].street": true,
+	}
+	for name, p := range map[string]*CompiledParser{"in-process": parser, "isolated": parser.Isolated()} {
+		got, present, err := p.ParseWithPresence(input)
+		if err != nil {
+			t.Fatalf("%s ParseWithPresence() unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s ParseWithPresence() = %v, want %v", name, got, want)
+		}
+		if !reflect.DeepEqual(present, wantPresent) {
+			t.Errorf("%s ParseWithPresence() present = %v, want %v", name, present, wantPresent)
+		}
+	}
+
+	// Malformed output is rejected rather than misread
+	for _, tc := range []struct {
+		name string
+		out  []byte
+		want string
+	}{
+		{"no header", []byte("SUCCESS|a"), "malformed parser result"},
+		{"future version", []byte("JR\x02"), "unsupported parser result version 2"},
+		{"truncated", []byte("JR\x01\x08\x00\x00\x00\x07\x01\x00\x00"), "parser result is truncated at subject"},
+		{"wrong tag", []byte("JR\x01\x08\x00\x00\x00\x07\x02"), "parser result has tag 2 for subject, want 1"},
+		{"wrong field count", []byte("JR\x01\x08\x00\x00\x00\x02"), "parser result has 2 fields for the root object, want 7"},
+	} {
+		if _, err := decodeResult(tc.out, parser.root, nil); err == nil || err.Error() != tc.want {
+			t.Errorf("decodeResult(%s) error = %v, want %s", tc.name, err, tc.want)
+		}
+	}
+}
+
+// TestAdversarialInputs runs hostile documents against a field of every
+// supported type: values and keys far longer than any buffer the parser
+// could hold on the stack, numbers of any length, runs of escapes, deep
+// nesting and truncated input. Each must be parsed or rejected, in-process
+// and isolated, without crashing the parser.
+func TestAdversarialInputs(t *testing.T) {
+	point := &analyzer.CStruct{
+		Name:   "Point",
+		Fields: []analyzer.FieldInfo{{Name: "label", CType: "char*"}, {Name: "x", CType: "int"}},
+	}
+	intElem := analyzer.FieldInfo{CType: "int"}
+	fields := []analyzer.FieldInfo{
+		{Name: "f_string", CType: "char*"},
+		{Name: "f_inline", CType: "char*", MaxLen: 4},
+		{Name: "f_truncated", CType: "char*", MaxLen: 4, Truncate: true},
+		{Name: "f_bytes", CType: analyzer.BytesCType, Kind: "slice"},
+		{Name: "f_bool", CType: "bool"},
+		{Name: "f_float", CType: "float"},
+		{Name: "f_double", CType: "double"},
+		{Name: "f_nested", CType: "Point", Kind: "struct", Struct: point},
+		{Name: "f_array", CType: "int", Kind: "array", Elem: &intElem, Len: 2},
+	}
+	for cType := range cTypeRanges {
+		fields = append(fields, analyzer.FieldInfo{Name: "f_" + strings.ReplaceAll(cType, " ", "_"), CType: cType})
+	}
+	parser, err := CompileAndBuild(analyzer.CStruct{Name: "Hostile", Fields: fields})
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	long := strings.Repeat("x", 1<<20)
+	digits := strings.Repeat("9", 10000)
+	payloads := []string{
+		`"` + long + `"`,
+		`"` + strings.Repeat(`\\`, 5000) + `"`,
+		`"` + strings.Repeat(`\"`, 5000) + `"`,
+		`"` + strings.Repeat(`\`, 5001) + `"`,
+		`"abc\`,
+		`"abc`,
+		`"`,
+		digits,
+		"-" + digits,
+		"0." + digits,
+		"1e-99999",
+		"1e99999",
+		"-",
+		"tru",
+		strings.Repeat("[", 100000),
+		strings.Repeat("[", 10000) + strings.Repeat("]", 10000),
+		`{"label": "` + long + `", "x": ` + digits + `}`,
+		`{"label": "` + long + `", "` + long + `": [` + long + `]}`,
+		`[` + digits + `, 1]`,
+		``,
+	}
+	var docs []string
+	for _, field := range fields {
+		for _, payload := range payloads {
+			docs = append(docs, fmt.Sprintf(`{"%s": %s}`, field.Name, payload))
+		}
+	}
+	docs = append(docs,
+		`{"`+long+`": 1, "f_string": "ok"}`,
+		`{"`+strings.Repeat(`\"`, 5000)+`": 1}`,
+		`{"f_string": "ok", "`+long,
+	)
+	valid := `{"f_string": "a", "f_inline": "b", "f_bytes": "AA==", "f_nested": {"label": "c", "x": 1}, "f_array": [1, 2]}`
+	for i := range valid {
+		docs = append(docs, valid[:i])
+	}
+
+	for name, p := range map[string]*CompiledParser{"in-process": parser, "isolated": parser.Isolated()} {
+		for _, doc := range docs {
+			p.Parse(doc)
+		}
+		// The parser survived, and still parses
+		if _, err := p.Parse(valid); err != nil {
+			t.Fatalf("%s Parse() after adversarial inputs unexpected error: %v", name, err)
+		}
+
+		tests := []struct {
+			input   string
+			key     string
+			want    interface{}
+			wantErr bool
+		}{
+			{input: `{"f_string": "` + long + `"}`, key: "f_string", want: long},
+			{input: `{"f_string": "` + strings.Repeat(`\\`, 5000) + `"}`, key: "f_string", want: strings.Repeat(`\`, 5000)},
+			{input: `{"f_string": "` + strings.Repeat(`\"`, 5000) + `"}`, key: "f_string", want: strings.Repeat(`"`, 5000)},
+			{input: `{"f_inline": "` + long + `"}`, wantErr: true},
+			{input: `{"f_truncated": "` + long + `"}`, key: "f_truncated", want: "xxxx"},
+			{input: `{"` + long + `": "` + long + `", "f_string": "ok"}`, key: "f_string", want: "ok"},
+			{input: `{"f_double": 0.` + digits + `}`, key: "f_double", want: "1"},
+			{input: `{"f_double": 1e-99999}`, key: "f_double", want: "0"},
+			{input: `{"f_double": 1e99999}`, wantErr: true},
+			{input: `{"f_int64_t": ` + digits + `}`, wantErr: true},
+			{input: `{"f_int64_t": -` + digits + `}`, wantErr: true},
+			{input: `{"f_uint64_t": ` + digits + `}`, wantErr: true},
+			{input: `{"f_int64_t": -9223372036854775808}`, key: "f_int64_t", want: "-9223372036854775808"},
+			{input: `{"f_uint64_t": 18446744073709551615}`, key: "f_uint64_t", want: "18446744073709551615"},
+			{input: `{"f_uint64_t": 18446744073709551616}`, wantErr: true},
+		}
+		for _, tt := range tests {
+			result, err := p.Parse(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("%s Parse(%.40s...) succeeded, want error", name, tt.input)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s Parse(%.40s...) unexpected error: %v", name, tt.input, err)
+			} else if !reflect.DeepEqual(result[tt.key], tt.want) {
+				t.Errorf("%s Parse(%.40s...)[%s] = %.40v..., want %.40v...", name, tt.input, tt.key, result[tt.key], tt.want)
+			}
+		}
+	}
+}
+
+// TestParseLargeDocuments parses documents beyond the argument size limit from
+// files, readers and the module executable's stdin.
+func TestParseLargeDocuments(t *testing.T) {
+	testStruct := analyzer.CStruct{
+		Name: "Archive",
+		Fields: []analyzer.FieldInfo{
+			{Name: "body", CType: "char*"},
+			{Name: "count", CType: "int"},
+		},
+	}
+	parser, err := CompileAndBuild(testStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	body := strings.Repeat("lorem ipsum ", 1<<20) // 12MB
+	doc := fmt.Sprintf(`{"body": "%s", "count": 7}`, body)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "large.json")
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A document filling its last page exactly, which the mapping must still
+	// terminate
+	pagePath := filepath.Join(dir, "page.json")
+	pageDoc := fmt.Sprintf(`{"count": 7, "body": "%s"}`, strings.Repeat("p", os.Getpagesize()-24))
+	if err := os.WriteFile(pagePath, []byte(pageDoc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range map[string]*CompiledParser{"in-process": parser, "isolated": parser.Isolated()} {
+		result, err := p.ParseFile(path)
+		if err != nil {
+			t.Fatalf("%s ParseFile() unexpected error: %v", name, err)
+		}
+		if result["body"] != body || result["count"] != "7" {
+			t.Errorf("%s ParseFile() returned a body of %d bytes and count %v", name, len(result["body"].(string)), result["count"])
+		}
+		if result, err := p.ParseFile(pagePath); err != nil || len(result["body"].(string)) != os.Getpagesize()-24 {
+			t.Errorf("%s ParseFile(page.json) = %v, %v", name, len(result["body"].(string)), err)
+		}
+		result, err = p.ParseReader(strings.NewReader(doc))
+		if err != nil {
+			t.Fatalf("%s ParseReader() unexpected error: %v", name, err)
+		}
+		if result["body"] != body {
+			t.Errorf("%s ParseReader() returned a body of %d bytes", name, len(result["body"].(string)))
+		}
+		var parseErr *ParseError
+		if _, err := p.ParseReader(strings.NewReader("{\n  \"count\": x}")); !errors.As(err, &parseErr) || parseErr.Line != 2 {
+			t.Errorf("%s ParseReader(invalid) error = %v, want a ParseError on line 2", name, err)
+		}
+
+		if _, err := p.ParseFile(filepath.Join(dir, "missing.json")); err == nil || !os.IsNotExist(err) {
+			t.Errorf("%s ParseFile(missing.json) error = %v, want not exist", name, err)
+		}
+		if _, err := p.ParseFile(dir); err == nil || !strings.Contains(err.Error(), "failed to map") {
+			t.Errorf("%s ParseFile(dir) error = %v, want failed to map", name, err)
+		}
+	}
+
+	// The executable's one-shot mode reads the document from stdin given "-"
+	cmd := exec.Command(parser.pool.execPath, "Archive", "-")
+	cmd.Stdin = strings.NewReader(doc)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("parser Archive - failed: %v", err)
+	}
+	if result, err := decodeResult(out, parser.root, nil); err != nil || result["body"] != body {
+		t.Errorf("parser Archive - decoded error = %v", err)
+	}
+}
+
+// TestParseErrors checks the kind, location, path and description of the
+// errors of rejected documents, in-process, isolated and from files.
+func TestParseErrors(t *testing.T) {
+	stop := &analyzer.CStruct{
+		Name: "Stop",
+		Fields: []analyzer.FieldInfo{
+			{Name: "zip", CType: "char*", MaxLen: 5},
+			{Name: "lat", CType: "float"},
+		},
+	}
+	stopElem := analyzer.FieldInfo{CType: "Stop", Kind: "struct", Struct: stop}
+	schema, err := ir.Lower(analyzer.CStruct{
+		Name: "Trip",
+		Fields: []analyzer.FieldInfo{
+			{Name: "name", CType: "char*", Rules: analyzer.Rules{Required: true}},
+			{Name: "count", CType: "uint8_t"},
+			{Name: "stops", CType: "Stop", Kind: "array", Elem: &stopElem, Len: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Lower failed: %v", err)
+	}
+	if err := ir.Optimize(schema, append([]ir.Pass{ir.RejectUnknownKeys}, ir.DefaultPasses...)...); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	parser, err := CompileAndBuildSchema(schema)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		input    string
+		at       string // The text the error is at, or "" for the end of input
+		kind     error
+		line     int
+		path     string
+		expected string
+		found    string
+	}{
+		{`{"name": "a", "stops": [{"zip": "1"}, {"zip": 95112}]}`, `95112`, ErrType, 1, "stops[1].zip", "a string", "95112"},
+		{"{\"name\": \"a\",\n \"count\": 300}", `300`, ErrOverflow, 2, "count", "an integer from 0 to 255", "300"},
+		{`{"name": "a", "stops": [{"lat": 1e300}]}`, `1e300`, ErrOverflow, 1, "stops[0].lat", "a number in the range of float", "1e300"},
+		{`{"name": "a", "extra": 1}`, `"extra"`, ErrUnknownField, 1, "", "a key of Trip", `"extra"`},
+		{`{"count": 1}`, `}`, ErrMissingRequired, 1, "name", `key "name"`, "'}'"},
+		{`{"name": "a", "count" 1}`, `1}`, ErrSyntax, 1, "", "':'", "1"},
+		{`{"name": "a", "stops": [{}, {}, {}]}`, `{}]`, ErrType, 1, "stops", "an array of 2 elements", "'{'"},
+		{`{"name": "a`, "", ErrSyntax, 1, "name", `'"'`, "end of input"},
+		{`{"name": "` + long + `", "count": -1}`, `-1`, ErrOverflow, 1, "count", "an integer from 0 to 255", "-1"},
+	}
+	dir := t.TempDir()
+	for name, p := range map[string]*CompiledParser{"in-process": parser, "isolated": parser.Isolated()} {
+		for i, tt := range tests {
+			path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+			if err := os.WriteFile(path, []byte(tt.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, parseErr := p.Parse(tt.input)
+			_, fileErr := p.ParseFile(path)
+			for _, err := range []error{parseErr, fileErr} {
+				var pe *ParseError
+				if !errors.As(err, &pe) {
+					t.Errorf("%s Parse(%s) error = %v, want a *ParseError", name, tt.input, err)
+					continue
+				}
+				offset := strings.LastIndex(tt.input, tt.at)
+				if tt.at == "" {
+					offset = len(tt.input)
+				}
+				column := offset - strings.LastIndex(tt.input[:offset], "\n")
+				if !errors.Is(err, tt.kind) || pe.Offset != int64(offset) || pe.Line != tt.line || pe.Column != column ||
+					pe.Path != tt.path || pe.Expected != tt.expected || pe.Found != tt.found {
+					t.Errorf("%s Parse(%s) error = %+v, want %v at byte %d, line %d, column %d in %q: expected %s, found %s",
+						name, tt.input, pe, tt.kind, offset, tt.line, column, tt.path, tt.expected, tt.found)
+				}
+
+				// The caret is under the text the error is at
+				lines := strings.Split(pe.Snippet(), "\n")
+				if caret := strings.Index(lines[len(lines)-1], "^"); len(lines) != 2 || caret > len(lines[0]) || !strings.HasPrefix(lines[0][caret:], tt.at) {
+					t.Errorf("%s Parse(%s) snippet:\n%s", name, tt.input, pe.Snippet())
+				}
+			}
+		}
+	}
+
+	_, err = parser.Parse("{\"name\": \"a\",\n \"count\": 300}")
+	var pe *ParseError
+	errors.As(err, &pe)
+	if got, want := pe.Snippet(), "2 |  \"count\": 300}\n  |           ^"; got != want {
+		t.Errorf("Snippet() =\n%s\nwant\n%s", got, want)
+	}
+	if got, want := err.Error(), "parsing failed: value out of range at line 2, column 11 in count: expected an integer from 0 to 255, found 300"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	_, err = parser.Parse(`{"name": "` + long + `", "count": -1}`)
+	errors.As(err, &pe)
+	if snippet := pe.Snippet(); !strings.HasPrefix(snippet, "1 | ..."+long[:28]+`", "count": -1}`) {
+		t.Errorf("Snippet() of a long line =\n%s", snippet)
+	}
+}
+
+// TestStrictSyntax checks that parsers accept exactly RFC 8259's object
+// syntax, and the relaxed syntax when built with ir.LenientSyntax.
+func TestStrictSyntax(t *testing.T) {
+	build := func(name string, passes ...ir.Pass) *CompiledParser {
+		schema, err := ir.Lower(analyzer.CStruct{
+			Name: name,
+			Fields: []analyzer.FieldInfo{
+				{Name: "a", CType: "int"},
+				{Name: "b", CType: "bool"},
+				{Name: "d", CType: "double"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Lower failed: %v", err)
+		}
+		if err := ir.Optimize(schema, append(passes, ir.DefaultPasses...)...); err != nil {
+			t.Fatalf("Optimize failed: %v", err)
+		}
+		parser, err := CompileAndBuildSchema(schema)
+		if err != nil {
+			t.Fatalf("Failed to compile parser: %v", err)
+		}
+		return parser
+	}
+	strict := build("Flags")
+	defer strict.Close()
+	lenient := build("LenientFlags", ir.LenientSyntax)
+	defer lenient.Close()
+
+	deep := strings.Repeat("[", 100000) + strings.Repeat("]", 100000)
+	tests := []struct {
+		input     string
+		strictErr error // nil if the strict parser accepts the input
+		lenient   bool  // Whether the lenient parser accepts it
+	}{
+		{"\r\n\t {\"a\": 1}\r\n ", nil, true},
+		{`{}`, nil, true},
+		{`{ "a" : 1 , "b" : true }`, nil, true},
+		{`{"x": [1, {"y": [true, null, "]}"]}, -0.5e+3], "a": 1}`, nil, true},
+		{`{"x": ` + deep + `, "a": 1}`, nil, true},
+		{`{,,"a":1,,}`, ErrSyntax, true},
+		{`{"a":1 "b":true}`, ErrSyntax, true},
+		{`{"a":1,}`, ErrSyntax, true},
+		{`{"a":1} x`, ErrSyntax, true},
+		{`{"a":1}{}`, ErrSyntax, true},
+		{"{\"a\":1}\x00garbage", ErrSyntax, true},
+		{"{\"a\":1}\x00", ErrSyntax, true},
+		{`{"x": [1,, 2], "a": 1}`, ErrSyntax, true},
+		{`{"x": {"y" 1}, "a": 1}`, ErrSyntax, true},
+		{`{"x": 1., "a": 1}`, ErrSyntax, true},
+		{`{"x": tru, "a": 1}`, ErrSyntax, true},
+		{`{"x": [1}, "a": 1}`, ErrSyntax, true},
+		{`{"x": ` + strings.Repeat("[", 100000) + `}`, ErrSyntax, false},
+		{`{"b": trueish}`, ErrType, false},
+		{`{"b": true1}`, ErrType, false},
+		{`{"a": 01}`, ErrSyntax, false},
+		{`{"a": +1}`, ErrType, false},
+		{`{"d": 1.}`, ErrSyntax, false},
+		{`{"d": .5}`, ErrType, false},
+		{`{"d": 1e}`, ErrSyntax, false},
+		{`{"a": 1`, ErrSyntax, false},
+		{`{"a" 1}`, ErrSyntax, false},
+	}
+	for _, tt := range tests {
+		for name, p := range map[string]*CompiledParser{"in-process": strict, "isolated": strict.Isolated()} {
+			_, err := p.Parse(tt.input)
+			if tt.strictErr == nil && err != nil {
+				t.Errorf("%s strict Parse(%.60s) unexpected error: %v", name, tt.input, err)
+			} else if tt.strictErr != nil && !errors.Is(err, tt.strictErr) {
+				t.Errorf("%s strict Parse(%.60s) error = %v, want %v", name, tt.input, err, tt.strictErr)
+			}
+		}
+		if _, err := lenient.Parse(tt.input); (err == nil) != tt.lenient {
+			t.Errorf("lenient Parse(%.60s) error = %v, want accepted %t", tt.input, err, tt.lenient)
+		}
+	}
+
+	result, err := lenient.Parse(`{,"a": 1,, "b": true,} trailing`)
+	if err != nil || result["a"] != "1" || result["b"] != true {
+		t.Errorf("lenient Parse() = %v, %v", result, err)
+	}
+	var pe *ParseError
+	if _, err := strict.Parse(`{"a": 1} x`); !errors.As(err, &pe) || pe.Expected != "end of input" || pe.Found != "x" {
+		t.Errorf("strict Parse() error = %v, want expected end of input, found x", err)
+	}
+}
+
+// TestStringDecoding checks escape decoding, UTF-8 validation and its
+// replacement mode, against encoding/json, and escape-aware key matching.
+func TestStringDecoding(t *testing.T) {
+	build := func(name string, passes ...ir.Pass) *CompiledParser {
+		schema, err := ir.Lower(analyzer.CStruct{
+			Name: name,
+			Fields: []analyzer.FieldInfo{
+				{Name: "s", CType: "char*"},
+				{Name: "initials", CType: "char*", MaxLen: 7, Truncate: true},
+				{Name: "naïve", CName: "naive", CType: "int"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Lower failed: %v", err)
+		}
+		if err := ir.Optimize(schema, append(passes, ir.DefaultPasses...)...); err != nil {
+			t.Fatalf("Optimize failed: %v", err)
+		}
+		parser, err := CompileAndBuildSchema(schema)
+		if err != nil {
+			t.Fatalf("Failed to compile parser: %v", err)
+		}
+		return parser
+	}
+	strict := build("Text")
+	defer strict.Close()
+	replacing := build("ReplacingText", ir.ReplaceInvalidUTF8)
+	defer replacing.Close()
+
+	// String literals both modes decode as encoding/json does
+	valid := []string{
+		`"plain"`,
+		`"a\nb\t\"\\\/\b\f\r"`,
+		`"é中😀\u001f"`,
+		`"é中😀"`,
+		`"😀"`,
+		`""`,
+	}
+	// Literals the strict parser rejects and the replacing one decodes as
+	// encoding/json does
+	invalid := []string{
+		`"\ud83d"`,
+		`"\ude00x"`,
+		`"\ud83dA"`,
+		"\"a\xffb\"",
+		"\"\xc0\xaf\"",
+		"\"\xed\xa0\x80\"",
+		"\"\xf4\x90\x80\x80\"",
+		"\"caf\xc3\"",
+	}
+	// Literals both reject
+	malformed := []string{"\"a\x01b\"", "\"a\tb\"", `"\q"`, `"\u12"`, `"\u12G4"`, `"\`, `"\u00`}
+
+	for name, p := range map[string]*CompiledParser{"strict": strict, "replacing": replacing, "isolated": strict.Isolated()} {
+		check := func(lit string, wantOK bool) {
+			var want string
+			if err := json.Unmarshal([]byte(lit), &want); err != nil && wantOK {
+				t.Fatalf("json.Unmarshal(%q) failed: %v", lit, err)
+			}
+			result, err := p.Parse(`{"s": ` + lit + `}`)
+			if !wantOK {
+				if !errors.Is(err, ErrSyntax) {
+					t.Errorf("%s Parse(%q) error = %v, want ErrSyntax", name, lit, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("%s Parse(%q) unexpected error: %v", name, lit, err)
+			} else if result["s"] != want {
+				t.Errorf("%s Parse(%q) = %q, want %q", name, lit, result["s"], want)
+			}
+		}
+		for _, lit := range valid {
+			check(lit, true)
+		}
+		for _, lit := range invalid {
+			check(lit, p == replacing)
+		}
+		for _, lit := range malformed {
+			check(lit, false)
+		}
+
+		// Keys match their fields however they are escaped
+		result, err := p.Parse(`{"\u0073": "k", "na\u00efve": 1, "initials": "\u00e9\u00e9\u00e9\u00e9"}`)
+		if err != nil || result["s"] != "k" || result["naïve"] != "1" || result["initials"] != "ééé" {
+			t.Errorf("%s Parse() with escaped keys = %q, %v", name, result, err)
+		}
+		if result, err := p.Parse(`{"naïve": 2, "s\"": 1, "x": "\n"}`); err != nil || result["naïve"] != "2" || result["s"] != "" {
+			t.Errorf("%s Parse() with raw UTF-8 keys = %q, %v", name, result, err)
+		}
+		if _, err := p.Parse(`{"s": "a\u0000b"}`); !errors.Is(err, ErrType) {
+			t.Errorf("%s Parse() of a NUL error = %v, want ErrType", name, err)
+		}
+		// Strings in the values of unknown keys are checked too
+		if _, err := p.Parse(`{"x": ["\q"]}`); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s Parse() of a bad escape in an unknown value error = %v, want ErrSyntax", name, err)
+		}
+		_, err = p.Parse("{\"\xff\": 1}")
+		if (err == nil) != (p == replacing) {
+			t.Errorf("%s Parse() of an invalid UTF-8 key error = %v", name, err)
+		}
+	}
+
+	var pe *ParseError
+	if _, err := strict.Parse(`{"s": "ab\q"}`); !errors.As(err, &pe) || pe.Offset != 9 || pe.Path != "s" || pe.Expected != "an escape sequence" {
+		t.Errorf("Parse() error = %+v, want an escape sequence at byte 9 of s", err)
+	}
+}
+
+// TestBuildOptions builds parsers with debug and release options into their
+// own directories, and checks the toolchain they report, the artifacts they
+// keep and the options that are rejected.
+func TestBuildOptions(t *testing.T) {
+	toolchain, err := DetectToolchain("")
+	if err != nil {
+		t.Fatalf("DetectToolchain() failed: %v", err)
+	}
+	if toolchain.Path == "" || toolchain.Version == "" || toolchain.Family == "" {
+		t.Errorf("DetectToolchain() = %+v, want a path, family and version", toolchain)
+	}
+	if _, err := DetectToolchain("no-such-cc"); err == nil {
+		t.Error("DetectToolchain() of a missing compiler should fail")
+	}
+
+	cStruct := analyzer.CStruct{Name: "Build", Fields: []analyzer.FieldInfo{{Name: "n", CType: "int"}}}
+	debugDir := t.TempDir()
+	debug, err := CompileAndBuildWith(cStruct, Options{
+		Debug:         true,
+		CFlags:        []string{"-DJSONRT_TEST=1"},
+		LDFlags:       []string{"-lm"},
+		KeepArtifacts: true,
+		OutputDir:     debugDir,
+		Env:           []string{"CFLAGS=-Wall"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile debug parser: %v", err)
+	}
+	if got := debug.Toolchain(); got.Path != toolchain.Path || debug.Isolated().Toolchain() != got {
+		t.Errorf("Toolchain() = %+v, want %+v", got, toolchain)
+	}
+	if result, err := debug.Parse(`{"n": 7}`); err != nil || result["n"] != "7" {
+		t.Errorf("debug Parse() = %v, %v", result, err)
+	}
+	debugDir = debug.Dir()
+	debug.Close()
+	for _, name := range []string{"Build.c", "Build.h", "Build.o", "parser_Build"} {
+		if _, err := os.Stat(filepath.Join(debugDir, name)); err != nil {
+			t.Errorf("kept artifact %s missing: %v", name, err)
+		}
+	}
+	if out, err := exec.Command("objdump", "-h", filepath.Join(debugDir, "parser_Build")).Output(); err == nil && !bytes.Contains(out, []byte(".debug_info")) {
+		t.Error("debug parser has no debug symbols")
+	}
+
+	releaseDir := t.TempDir()
+	release, err := CompileAndBuildWith(cStruct, Options{OptLevel: "3", OutputDir: releaseDir})
+	if err != nil {
+		t.Fatalf("Failed to compile release parser: %v", err)
+	}
+	if result, err := release.Isolated().Parse(`{"n": 8}`); err != nil || result["n"] != "8" {
+		t.Errorf("release Parse() = %v, %v", result, err)
+	}
+	if dir := release.Dir(); filepath.Dir(dir) != releaseDir {
+		t.Errorf("Dir() = %s, want a directory in %s", dir, releaseDir)
+	}
+	release.Close()
+	if _, err := os.Stat(release.Dir()); !os.IsNotExist(err) {
+		t.Errorf("release build left after Close: %v", err)
+	}
+
+	for name, opts := range map[string]Options{
+		"optimization level": {OptLevel: "9"},
+		"missing compiler":   {CC: "no-such-cc"},
+		"compiler from env":  {Env: []string{"CC=no-such-cc"}},
+		"compiler flag":      {CFlags: []string{"-fno-such-flag"}},
+		"linker flag":        {LDFlags: []string{"-lno-such-library"}},
+	} {
+		opts.OutputDir = t.TempDir()
+		if p, err := CompileAndBuildWith(cStruct, opts); err == nil {
+			p.Close()
+			t.Errorf("CompileAndBuildWith() with a bad %s should fail", name)
+		}
+	}
+}
+
+// TestBuildIsolation builds parsers of different structs with the same name,
+// and of the same struct, concurrently, and checks that each build keeps its
+// own directory, that identical builds are shared until the last is closed,
+// and that parsers do not depend on the working directory.
+func TestBuildIsolation(t *testing.T) {
+	student := func(field, cType string) analyzer.CStruct {
+		return analyzer.CStruct{Name: "Student", Fields: []analyzer.FieldInfo{{Name: field, CType: cType}}}
+	}
+	structs := []analyzer.CStruct{student("name", "char*"), student("age", "int"), student("name", "char*"), student("age", "int")}
+	wants := []map[string]interface{}{{"name": "ann"}, {"age": "20"}}
+	parsers := make([]*CompiledParser, len(structs))
+	errs := make([]error, len(structs))
+	var wg sync.WaitGroup
+	for i, cStruct := range structs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parsers[i], errs[i] = CompileAndBuild(cStruct)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to compile parser %d: %v", i, err)
+		}
+		defer parsers[i].Close()
+	}
+	if parsers[0].Dir() != parsers[2].Dir() || parsers[1].Dir() != parsers[3].Dir() || parsers[0].Dir() == parsers[1].Dir() {
+		t.Errorf("Dir() = %q, want identical structs to share a build and others not", []string{parsers[0].Dir(), parsers[1].Dir(), parsers[2].Dir(), parsers[3].Dir()})
+	}
+	check := func(i int) {
+		t.Helper()
+		for _, p := range []*CompiledParser{parsers[i], parsers[i].Isolated()} {
+			if result, err := p.Parse(`{"name": "ann", "age": 20}`); err != nil || !reflect.DeepEqual(result, wants[i%2]) {
+				t.Errorf("parser %d Parse() = %v, %v, want %v", i, result, err, wants[i%2])
+			}
+		}
+	}
+	for i := range parsers {
+		check(i)
+	}
+
+	// Closing a parser, even twice, leaves a shared build to the other
+	parsers[0].Close()
+	parsers[0].Close()
+	check(2)
+	check(1)
+	if _, err := os.Stat(parsers[2].Dir()); err != nil {
+		t.Errorf("shared build removed while in use: %v", err)
+	}
+	parsers[2].Close()
+	if _, err := os.Stat(parsers[2].Dir()); !os.IsNotExist(err) {
+		t.Errorf("build left after its last parser was closed: %v", err)
+	}
+	check(3)
+
+	// A relative output directory is resolved when building, so workers
+	// started after the working directory changes still find the executable
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	relative, err := CompileAndBuildWith(student("name", "char*"), Options{OutputDir: "builds"})
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer relative.Close()
+	if !filepath.IsAbs(relative.Dir()) {
+		t.Errorf("Dir() = %s, want an absolute path", relative.Dir())
+	}
+	if result, err := relative.Isolated().Parse(`{"name": "ann"}`); err != nil || !reflect.DeepEqual(result, wants[0]) {
+		t.Errorf("Parse() after changing directory = %v, %v", result, err)
+	}
+}
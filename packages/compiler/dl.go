@@ -0,0 +1,171 @@
+//go:build cgo
+
+package compiler
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+typedef char* (*parse_fn)(const char* input, size_t len, size_t* out_len);
+typedef void (*free_fn)(char* str);
+typedef void (*counts_fn)(unsigned long long* hits, unsigned long long* misses);
+typedef char* (*take_error_fn)(size_t* len);
+typedef const char* (*map_fn)(const char* path, size_t* size);
+typedef void (*unmap_fn)(const char* data, size_t size);
+
+// Call a parser and collect the key-order counts of the same call, and the
+// error if it rejected the input, which the runtime keeps per thread
+static char* call_parse(void* parse, void* counts, void* take_error, const char* input, size_t len,
+                        size_t* out_len, unsigned long long* hits, unsigned long long* misses, int* rejected) {
+    char* out = ((parse_fn)parse)(input, len, out_len);
+    ((counts_fn)counts)(hits, misses);
+    *rejected = out == NULL;
+    if (*rejected) out = ((take_error_fn)take_error)(out_len);
+    return out;
+}
+
+static void call_free(void* free_serialized, char* str) {
+    ((free_fn)free_serialized)(str);
+}
+
+static const char* call_map(void* map, const char* path, size_t* size) {
+    return ((map_fn)map)(path, size);
+}
+
+static void call_unmap(void* unmap, const char* data, size_t size) {
+    ((unmap_fn)unmap)(data, size);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+// inProcessSupported reports whether parsers can be loaded into the process.
+const inProcessSupported = true
+
+// library is a module's shared library, loaded with dlopen.
+type library struct {
+	mu     sync.RWMutex // Held for reading by calls, and for writing by close
+	handle unsafe.Pointer
+	free   unsafe.Pointer
+	counts unsafe.Pointer
+	errors unsafe.Pointer // jsonrt_take_error
+	mmap   unsafe.Pointer // jsonrt_map_file
+	munmap unsafe.Pointer // jsonrt_unmap_file
+}
+
+// openLibrary loads the shared library at path. Its symbols stay local to
+// it, so the runtimes of several modules do not clash.
+func openLibrary(path string) (*library, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	cPath := C.CString(abs)
+	defer C.free(unsafe.Pointer(cPath))
+	handle := C.dlopen(cPath, C.RTLD_NOW|C.RTLD_LOCAL)
+	if handle == nil {
+		return nil, fmt.Errorf("failed to load %s: %s", path, C.GoString(C.dlerror()))
+	}
+	l := &library{handle: handle}
+	for _, sym := range []struct {
+		name string
+		addr *unsafe.Pointer
+	}{
+		{"free_serialized", &l.free},
+		{"jsonrt_take_key_order_counts", &l.counts},
+		{"jsonrt_take_error", &l.errors},
+		{"jsonrt_map_file", &l.mmap},
+		{"jsonrt_unmap_file", &l.munmap},
+	} {
+		if *sym.addr, err = l.symbol(sym.name); err != nil {
+			l.close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// symbol returns the address of the named function.
+func (l *library) symbol(name string) (unsafe.Pointer, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	sym := C.dlsym(l.handle, cName)
+	if sym == nil {
+		return nil, fmt.Errorf("symbol %s not found", name)
+	}
+	return sym, nil
+}
+
+// call runs the parse_and_serialize_json entry point at parse on input and
+// returns a copy of its output, or ok false and the encoded error if the
+// input was rejected.
+func (l *library) call(parse unsafe.Pointer, input string) (out []byte, ok bool, stats KeyOrderStats, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.handle == nil {
+		return nil, false, stats, fmt.Errorf("parser is closed")
+	}
+
+	// The parser reads the document, and the NUL after it, straight from Go
+	// memory
+	buf := make([]byte, len(input)+1)
+	copy(buf, input)
+	out, ok, stats = l.run(parse, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(input)))
+	return out, ok, stats, nil
+}
+
+// callFile is call for the document in the file at path, which the parser
+// reads where it is mapped, without a copy.
+func (l *library) callFile(parse unsafe.Pointer, path string) (out []byte, ok bool, stats KeyOrderStats, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.handle == nil {
+		return nil, false, stats, fmt.Errorf("parser is closed")
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var size C.size_t
+	data := C.call_map(l.mmap, cPath, &size)
+	if data == nil {
+		return nil, false, stats, fmt.Errorf("failed to map %s", path)
+	}
+	defer C.call_unmap(l.munmap, data, size)
+	out, ok, stats = l.run(parse, data, size)
+	return out, ok, stats, nil
+}
+
+// run calls parse on the n bytes of a document at input, which a NUL follows.
+// The caller holds l.mu. out is nil if the document was rejected and its
+// error could not be allocated.
+func (l *library) run(parse unsafe.Pointer, input *C.char, n C.size_t) (out []byte, ok bool, stats KeyOrderStats) {
+	var outLen C.size_t
+	var hits, misses C.ulonglong
+	var rejected C.int
+	result := C.call_parse(parse, l.counts, l.errors, input, n, &outLen, &hits, &misses, &rejected)
+	stats = KeyOrderStats{Hits: uint64(hits), Misses: uint64(misses)}
+	if result == nil {
+		return nil, false, stats
+	}
+	// Copied without C.GoBytes, whose int length would cut results over 2GB
+	out = append([]byte{}, unsafe.Slice((*byte)(unsafe.Pointer(result)), int(outLen))...)
+	C.call_free(l.free, result)
+	return out, rejected == 0, stats
+}
+
+// close unloads the library once no call is running.
+func (l *library) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.handle != nil {
+		C.dlclose(l.handle)
+		l.handle = nil
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !cgo
+
+package compiler
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// inProcessSupported reports whether parsers can be loaded into the process.
+// Without cgo every parser runs in a child process.
+const inProcessSupported = false
+
+type library struct{}
+
+func openLibrary(path string) (*library, error) {
+	return nil, fmt.Errorf("loading %s requires cgo", path)
+}
+
+func (l *library) symbol(name string) (unsafe.Pointer, error) {
+	return nil, fmt.Errorf("symbol %s not found", name)
+}
+
+func (l *library) call(parse unsafe.Pointer, input string) ([]byte, bool, KeyOrderStats, error) {
+	return nil, false, KeyOrderStats{}, fmt.Errorf("parser is closed")
+}
+
+func (l *library) callFile(parse unsafe.Pointer, path string) ([]byte, bool, KeyOrderStats, error) {
+	return nil, false, KeyOrderStats{}, fmt.Errorf("parser is closed")
+}
+
+func (l *library) close() {}
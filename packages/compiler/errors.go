@@ -0,0 +1,225 @@
+package compiler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// The kinds of parse error, which a *ParseError wraps, so errors.Is tells
+// them apart.
+var (
+	ErrSyntax          = errors.New("syntax error")
+	ErrType            = errors.New("type mismatch")
+	ErrOverflow        = errors.New("value out of range")
+	ErrUnknownField    = errors.New("unknown field")
+	ErrMissingRequired = errors.New("missing required field")
+	ErrNotAllowed      = errors.New("value not allowed")
+)
+
+// The error encoding jsonrt_take_error writes, as jsonrt.h describes it, and
+// its codes in the order of the sentinels above, from 1. errorMemory is the
+// code of a document whose result could not be allocated, which comes before
+// that of ErrNotAllowed.
+const (
+	errorMagic   = "JE"
+	errorVersion = 1
+	errorMemory  = 6
+)
+
+var errorKinds = []error{ErrSyntax, ErrType, ErrOverflow, ErrUnknownField, ErrMissingRequired, nil, ErrNotAllowed}
+
+// snippetContext is the number of bytes of the line either side of an error
+// that Snippet shows.
+const snippetContext = 40
+
+// ParseError describes why the generated parser rejected a document.
+type ParseError struct {
+	Err    error // One of ErrSyntax, ErrType, ErrOverflow, ErrUnknownField, ErrMissingRequired and ErrNotAllowed
+	Offset int64 // Byte offset in the document the parser stopped at
+	// Line and Column locate Offset, from 1; Column counts bytes
+	Line, Column int
+	// Path is the value being parsed, e.g. "stops[1].zip", or the missing
+	// field. It is empty for the root object itself.
+	Path string
+	// Expected describes what the parser expected at Offset, e.g. "',' or
+	// '}'", and Found what the document held there, e.g. "'x'", "\"abc\"" or
+	// "end of input".
+	Expected string
+	Found    string
+
+	// The text of the line around Offset, for Snippet, and whether it
+	// continues beyond them
+	before, after      string
+	clipped, continued bool
+}
+
+func (e *ParseError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "parsing failed: %v at line %d, column %d", e.Err, e.Line, e.Column)
+	if e.Path != "" {
+		fmt.Fprintf(&b, " in %s", e.Path)
+	}
+	fmt.Fprintf(&b, ": expected %s, found %s", e.Expected, e.Found)
+	return b.String()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Snippet renders the line of the document the error is on, windowed around
+// it if long, with a caret under the byte the parser stopped at:
+//
+//	3 | {"stops": [{"zip": 1}, {"zip": tru}]}
+//	  |                                 ^
+func (e *ParseError) Snippet() string {
+	text := e.before + e.after
+	prefix := ""
+	if e.clipped {
+		prefix = "..."
+	}
+	if e.continued {
+		text += "..."
+	}
+	number := fmt.Sprint(e.Line)
+	// Tabs are kept in the padding so the caret lines up however they render
+	var pad strings.Builder
+	for _, r := range prefix + e.before {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	return fmt.Sprintf("%s | %s%s\n%s | %s^", number, prefix, text, strings.Repeat(" ", len(number)), pad.String())
+}
+
+// parseError returns the error describing a rejected document, decoded from
+// the parser's encoded error and located in input, a document or a file path
+// as kind says.
+func parseError(kind byte, input string, encoded []byte) error {
+	if len(encoded) == 0 {
+		return fmt.Errorf("parsing failed: out of memory")
+	}
+	if len(encoded) < len(errorMagic)+10 || string(encoded[:len(errorMagic)]) != errorMagic {
+		return fmt.Errorf("malformed parser error")
+	}
+	if version := encoded[len(errorMagic)]; version != errorVersion {
+		return fmt.Errorf("unsupported parser error version %d", version)
+	}
+	code := int(encoded[len(errorMagic)+1])
+	offset := binary.BigEndian.Uint64(encoded[len(errorMagic)+2:])
+	rest := encoded[len(errorMagic)+10:]
+	var fields [2]string // The description and the path
+	for i := range fields {
+		if len(rest) < 4 || uint64(len(rest)-4) < uint64(binary.BigEndian.Uint32(rest)) {
+			return fmt.Errorf("parser error is truncated")
+		}
+		n := int(binary.BigEndian.Uint32(rest))
+		fields[i] = string(rest[4 : 4+n])
+		rest = rest[4+n:]
+	}
+	if code == errorMemory {
+		return fmt.Errorf("parsing failed: out of %s", fields[0])
+	}
+	if code < 1 || code > len(errorKinds) {
+		return fmt.Errorf("parser error has unknown code %d", code)
+	}
+
+	e := &ParseError{
+		Err:      errorKinds[code-1],
+		Offset:   int64(offset),
+		Path:     fields[1],
+		Expected: fields[0],
+	}
+	if kind == requestFile {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("%v (reopening %s: %v)", e, input, err)
+		}
+		defer f.Close()
+		e.locate(f)
+	} else {
+		e.locate(strings.NewReader(input))
+	}
+	return e
+}
+
+// locate reads the document up to and past the error's offset, setting its
+// line, column, the token found there and the text Snippet shows.
+func (e *ParseError) locate(r io.Reader) {
+	br := bufio.NewReader(r)
+	e.Line, e.Column = 1, 1
+	var line []byte // The end of the line so far, up to twice snippetContext
+	for i := int64(0); i < e.Offset; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		if c == '\n' {
+			e.Line++
+			e.Column = 1
+			line = line[:0]
+			e.clipped = false
+			continue
+		}
+		e.Column++
+		if line = append(line, c); len(line) > 2*snippetContext {
+			line = append(line[:0], line[len(line)-snippetContext:]...)
+			e.clipped = true
+		}
+	}
+	if len(line) > snippetContext {
+		line = line[len(line)-snippetContext:]
+		e.clipped = true
+	}
+	// Drop the tail of a character the window cut
+	for e.clipped && len(line) > 0 && !utf8.RuneStart(line[0]) {
+		line = line[1:]
+	}
+	e.before = strings.ToValidUTF8(string(line), "\uFFFD")
+
+	rest, _ := br.Peek(snippetContext + 1)
+	e.Found = describeToken(strings.ToValidUTF8(string(rest), "\uFFFD"))
+	if n := strings.IndexAny(string(rest), "\r\n"); n >= 0 {
+		rest = rest[:n]
+	} else if len(rest) > snippetContext {
+		rest = rest[:snippetContext]
+		e.continued = true
+	}
+	e.after = strings.ToValidUTF8(string(rest), "\uFFFD")
+}
+
+// describeToken describes the token text starts with: a string, a run of
+// letters and digits, a single character, or the end of input.
+func describeToken(text string) string {
+	if text == "" {
+		return "end of input"
+	}
+	switch c := text[0]; {
+	case c == '"':
+		if n := strings.IndexByte(text[1:], '"'); n >= 0 && n < 20 {
+			return text[:n+2]
+		}
+		if len(text) > 20 {
+			return text[:20] + "..."
+		}
+		return text
+	case c == '-' || c == '+' || c == '.' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		n := strings.IndexFunc(text, func(r rune) bool {
+			return !(r == '-' || r == '+' || r == '.' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z')
+		})
+		if n < 0 {
+			n = len(text)
+		}
+		return text[:n]
+	}
+	r, _ := utf8.DecodeRuneInString(text)
+	return fmt.Sprintf("%q", r)
+}
@@ -1,58 +1,837 @@
 package compiler
 
 import (
-	"bytes"
 	"fmt"
-	"text/template"
+	"strings"
 
 	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/compiler/cgen"
+	"github.com/arifali123/152compiler2/packages/ir"
 )
 
-// GenerateCCode generates C code for the given struct.
+// GenerateCCode generates C code for the given struct, lowering it to the IR
+// and applying ir.DefaultPasses.
 func GenerateCCode(cStruct analyzer.CStruct) (string, error) {
-	// Create the header file content
-	header := generateCHeader(cStruct)
-
-	// Prepare the data for the parser template
-	data := struct {
-		Header     string
-		StructName string
-		Fields     []analyzer.FieldInfo
-	}{
-		Header:     fmt.Sprintf("%s.h", cStruct.Name),
-		StructName: cStruct.Name,
-		Fields:     cStruct.Fields,
-	}
-
-	// Parse the parser template
-	tmpl, err := template.New("parser").Parse(ParserTemplate)
+	schema, err := lower(cStruct)
 	if err != nil {
 		return "", err
 	}
+	return GenerateFromIR(schema)
+}
 
-	// Execute the template
-	var parserBuffer bytes.Buffer
-	err = tmpl.Execute(&parserBuffer, data)
+// lower converts a validated struct to the IR and applies the default passes.
+func lower(cStruct analyzer.CStruct) (*ir.Schema, error) {
+	schema, err := ir.Lower(cStruct)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if err := ir.Optimize(schema, ir.DefaultPasses...); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// GenerateFromIR generates C code for a schema that passes may have
+// rewritten. The header declares each object in its Layout order, and the
+// parser dispatches keys as each object's Dispatch selects.
+func GenerateFromIR(schema *ir.Schema) (string, error) {
+	header := generateCHeader(schema)
+	source := generateCSource(schema)
+	return fmt.Sprintf("%s\n%s", header, source), nil
+}
+
+// generateCHeader creates a C header file declaring every object of the
+// schema, nested objects first.
+func generateCHeader(schema *ir.Schema) *cgen.File {
+	file := &cgen.File{
+		Guard:    schema.Root.Name + "_H",
+		Includes: []string{"<stdint.h>", "<stdbool.h>", "<stddef.h>"},
+	}
+	for _, o := range schema.Objects {
+		typedef := &cgen.Typedef{Name: o.Name}
+		for _, field := range o.Layout {
+			typedef.Members = append(typedef.Members, declaration(field))
+			if field.Value.Kind == ir.KindBytes || field.Value.Kind == ir.KindSlice {
+				// Decoded binary data is not NUL-terminated, and a slice holds
+				// as many elements as the input did, so carry the length
+				typedef.Members = append(typedef.Members, fmt.Sprintf("size_t %s_len", field.Member))
+			}
+		}
+		file.Decls = append(file.Decls, typedef)
+	}
+	root := schema.Root.Name
+	file.Decls = append(file.Decls, cgen.Prototype(parseJSONSignature(root)), cgen.Prototype(serializeJSONSignature(root)))
+	return file
+}
+
+// rootRejected returns the condition under which the document at ptr is
+// rejected: its root object fails to parse into out, or, unless its syntax is
+// lenient, something other than whitespace follows it before the end of the
+// input, NUL bytes included.
+func rootRejected(root *ir.Object, ptr, out, present string) string {
+	cond := fmt.Sprintf("parse_object_%s(&%s, %s, %s) != 0", root.Name, ptr, out, present)
+	if !root.Lenient {
+		cond += fmt.Sprintf(" || jsonrt_parse_end(%s) != 0", ptr)
+	}
+	return cond
+}
+
+// parseJSONSignature and serializeJSONSignature return the signatures of the
+// entry points of the parser for root. They are named after it, so the
+// parsers of several structs can be linked together.
+func parseJSONSignature(root string) string {
+	return fmt.Sprintf("int parse_json_%s(const char* input, size_t len, %s* out)", root, root)
+}
+
+func serializeJSONSignature(root string) string {
+	return fmt.Sprintf("char* parse_and_serialize_json_%s(const char* input, size_t len, size_t* out_len)", root)
+}
+
+// generateModuleMain creates the main program of a module. With --worker it
+// serves framed requests as workerSource describes; otherwise it parses its
+// second argument, or stdin if that is "-", as the struct its first argument
+// names and writes the encoded result to stdout, or why it was rejected to
+// stderr.
+func generateModuleMain(roots []string) *cgen.File {
+	file := &cgen.File{Includes: []string{"<stdio.h>", "<stdint.h>", "<stdlib.h>", "<string.h>", fmt.Sprintf("\"%s.h\"", runtimeName)}}
+	entries := make([]string, len(roots))
+	for i, root := range roots {
+		file.Decls = append(file.Decls, cgen.Prototype(serializeJSONSignature(root)))
+		entries[i] = fmt.Sprintf("    {\"%s\", parse_and_serialize_json_%s},", root, root)
+	}
+	file.Decls = append(file.Decls, cgen.Raw(fmt.Sprintf(`// The parser of each struct in the module, by name
+static const struct {
+    const char* name;
+    char* (*parse)(const char* input, size_t len, size_t* out_len);
+} parsers[] = {
+%s
+};`, strings.Join(entries, "\n"))))
+
+	find := cgen.NewFunc("Return the index of the parser for the named struct, or -1",
+		"static int find_parser(const char* name)", "name")
+	i, loop := find.Body.ForRange("i", len(roots))
+	loop.If(fmt.Sprintf("strcmp(name, parsers[%s].name) == 0", i)).Return("(int)" + i)
+	find.Body.Return("-1")
+	file.Decls = append(file.Decls, find, cgen.Raw(workerSource), cgen.Raw(readStdinSource), cgen.Raw(printErrorSource))
+
+	main := cgen.NewFunc("", "int main(int argc, char* argv[])", "argc", "argv")
+	body := main.Body
+	body.If(`argc == 2 && strcmp(argv[1], "--worker") == 0`).Return("serve()")
+	usage := body.If("argc != 3")
+	usage.Line(`fprintf(stderr, "Usage: %%s --worker | <type> <json_string> | <type> - (JSON on stdin)\n", argv[0]);`)
+	usage.Return("1")
+	index := body.Declare("int", "index", "find_parser(argv[1])")
+	unknown := body.If(index + " < 0")
+	unknown.Line(`fprintf(stderr, "Unknown type %%s\n", argv[1]);`)
+	unknown.Return("1")
+	input := body.Declare("char*", "input", "argv[2]")
+	size := body.Declare("size_t", "size", "strlen(argv[2])")
+	stdin := body.If(`strcmp(argv[2], "-") == 0`)
+	stdin.Line("%s = read_stdin(&%s);", input, size)
+	unread := stdin.If(input + " == NULL")
+	unread.Line(`fprintf(stderr, "Failed to read stdin\n");`)
+	unread.Return("1")
+	n := body.Declare("size_t", "len", "0")
+	result := body.Declare("char*", "result", fmt.Sprintf("parsers[%s].parse(%s, %s, &%s)", index, input, size, n))
+	body.If(input+" != argv[2]").Line("free(%s);", input)
+	failed := body.If(result + " == NULL")
+	failed.Line("print_error();")
+	failed.Return("1")
+	body.Line("fwrite(%s, 1, %s, stdout);  // The result is binary, as jsonrt.h describes", result, n)
+	body.Line("free_serialized(%s);", result)
+	body.Return("0")
+
+	file.Decls = append(file.Decls, main)
+	return file
+}
+
+// declaration returns the C declaration of a struct member, e.g. "int age",
+// "char code[9]", "Address homes[2]" or "int* scores".
+func declaration(field *ir.Field) string {
+	decl, value := declarator(field.Member, field.Value)
+	if value.Kind == ir.KindInlineString {
+		// Fixed-capacity strings live inline, leaving room for the NUL
+		return fmt.Sprintf("char %s[%d]", decl, value.MaxLen+1)
+	}
+	return fmt.Sprintf("%s %s", value.CType, decl)
+}
+
+// declarator returns the C declarator of name for a value of type v, with
+// a pointer for a slice and the dimensions of each array, and the type of the
+// elements it declares.
+func declarator(name string, v ir.Value) (string, ir.Value) {
+	if v.Kind == ir.KindSlice {
+		name = "*" + name
+		v = *v.Elem
+		if v.Kind == ir.KindArray || v.Kind == ir.KindInlineString {
+			name = "(" + name + ")"
+		}
+	}
+	for v.Kind == ir.KindArray {
+		name += fmt.Sprintf("[%d]", v.Len)
+		v = *v.Elem
+	}
+	return name, v
+}
+
+// generateCSource creates the parser: a presence record, an object parser
+// and a serializer for each object, nested objects first, and the
+// parse_json_<Name> and parse_and_serialize_json_<Name> entry points. The
+// helpers they call are in the shared jsonrt runtime.
+func generateCSource(schema *ir.Schema) *cgen.File {
+	root := schema.Root.Name
+	file := &cgen.File{
+		Includes: []string{
+			"<string.h>", "<stdbool.h>", "<stdlib.h>", "<stdio.h>", "<stdint.h>",
+			"<limits.h>", "<math.h>", fmt.Sprintf("\"%s.h\"", runtimeName), fmt.Sprintf("\"%s.h\"", root),
+		},
 	}
+	for _, o := range schema.Objects {
+		file.Decls = append(file.Decls, presenceStruct(o))
+		if len(o.KeyOrder) > 0 {
+			file.Decls = append(file.Decls, keyTables(o))
+		}
+		file.Decls = append(file.Decls, keyIndex(o), objectParser(o), objectSerializer(o), objectRelease(o))
+		if presenceHeap(ir.Value{Kind: ir.KindObject, Object: o}) {
+			file.Decls = append(file.Decls, objectPresenceRelease(o))
+		}
+	}
+	rootValue := ir.Value{Kind: ir.KindObject, CType: root, Object: schema.Root}
+
+	parseJSON := cgen.NewFunc(`Parse the len bytes of JSON at input, which a NUL follows, into the C
+struct, which is zeroed first. If the input is rejected, the members
+allocated for it are freed, it is left zeroed, and jsonrt_take_error
+describes why.`,
+		parseJSONSignature(root), "input", "len", "out")
+	body := parseJSON.Body
+	body.Line("jsonrt_begin(input, len);")
+	body.Line("memset(out, 0, sizeof(*out));")
+	ptr := body.Declare("const char*", "ptr", "jsonrt_skip_whitespace(input)")
+	present := body.Declare(presenceName(root), "present", "")
+	body.Line("memset(&%s, 0, sizeof(%s));", present, present)
+	rejected := body.If(rootRejected(schema.Root, ptr, "out", "&"+present))
+	releasePresence(rejected, "(*out)", present, rootValue)
+	rejected.Line("release_%s(out);", root)
+	rejected.Line("memset(out, 0, sizeof(*out));")
+	rejected.Return("-1")
+	releasePresence(body, "(*out)", present, rootValue)
+	body.Return("0")
+
+	encode := cgen.NewFunc("Encode the result: the header, then the root object",
+		fmt.Sprintf("static void serialize_result_%s(jsonrt_buf* b, %s* v, const %s* present)", root, root, presenceName(root)),
+		"b", "v", "present")
+	encode.Body.Line("jsonrt_put_header(b);")
+	encode.Body.Line("jsonrt_put_object(b, true, %d);", len(schema.Root.Fields))
+	encode.Body.Line("serialize_%s(b, v, present);", root)
+
+	serializeJSON := cgen.NewFunc(`Parse the len bytes of JSON at input, which a NUL follows, and return
+its values in the binary result encoding jsonrt.h describes, which Go
+decodes, in a buffer of exactly the size they need. out_len receives its
+length. A rejected document returns NULL, and jsonrt_take_error
+describes why.`,
+		serializeJSONSignature(root), "input", "len", "out_len")
+	body = serializeJSON.Body
+	body.Line("jsonrt_begin(input, len);")
+	out := body.Declare(root, "out", "")
+	body.Line("memset(&%s, 0, sizeof(%s));  // Initialize struct to zero", out, root)
+	present = body.Declare(presenceName(root), "present", "")
+	body.Line("memset(&%s, 0, sizeof(%s));", present, present)
+	ptr = body.Declare("const char*", "ptr", "jsonrt_skip_whitespace(input)")
+	rejected = body.If(rootRejected(schema.Root, ptr, "&"+out, "&"+present))
+	releasePresence(rejected, out, present, rootValue)
+	rejected.Line("release_%s(&%s);", root, out)
+	rejected.Return("NULL")
+	body.Comment("Measure the result, then encode it into a buffer of that size")
+	size := body.Declare("jsonrt_buf", "size", "{0}")
+	body.Line("%s.measure = true;", size)
+	body.Line("serialize_result_%s(&%s, &%s, &%s);", root, size, out, present)
+	buf := body.Declare("jsonrt_buf", "b", "{0}")
+	encoded := body.If(fmt.Sprintf("!%s.failed && jsonrt_buf_alloc(&%s, %s.len)", size, buf, size))
+	encoded.Line("serialize_result_%s(&%s, &%s, &%s);", root, buf, out, present)
+	releasePresence(body, out, present, rootValue)
+	body.Line("release_%s(&%s);", root, out)
+	failed := body.If(fmt.Sprintf("%s.data == NULL || %s.failed || %s.failed", buf, size, buf))
+	failed.Line(`jsonrt_fail(NULL, JSONRT_ERR_MEMORY, "memory for the result");`)
+	failed.Line("free(%s.data);", buf)
+	failed.Return("NULL")
+	body.Line("*out_len = %s.len;", buf)
+	body.Return(buf + ".data")
+
+	file.Decls = append(file.Decls, parseJSON, encode, serializeJSON)
+	return file
+}
+
+// presenceName returns the name of the presence record of the object called
+// name.
+func presenceName(name string) string {
+	return name + "_presence"
+}
 
-	// Combine header and parser code
-	fullCode := fmt.Sprintf("%s\n%s", header, parserBuffer.String())
-	return fullCode, nil
+// presenceStruct declares <Name>_presence, which records the keys of a <Name>
+// the input held: bit i of keys is set once Fields[i] is parsed. Each nested
+// object has its own record, in a member named in_<member>, so the
+// serializer can tell an absent field from one holding its zero value; the
+// records of a slice's objects are allocated along with its elements.
+func presenceStruct(o *ir.Object) *cgen.Typedef {
+	typedef := &cgen.Typedef{
+		Name:    presenceName(o.Name),
+		Members: []string{fmt.Sprintf("uint8_t keys[%d]", (len(o.Fields)+7)/8)},
+	}
+	for _, field := range o.Fields {
+		decl, value := declarator("in_"+field.Member, field.Value)
+		if value.Kind == ir.KindObject {
+			typedef.Members = append(typedef.Members, fmt.Sprintf("%s %s", presenceName(value.CType), decl))
+		}
+	}
+	return typedef
+}
+
+// presenceBit returns the byte of a presence record's keys, and the mask in
+// it, of the field at index i of Fields.
+func presenceBit(i int) (int, string) {
+	return i / 8, fmt.Sprintf("0x%02x", 1<<(i%8))
 }
 
-// generateCHeader creates a C header file for the struct.
-func generateCHeader(cStruct analyzer.CStruct) string {
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("#ifndef %s_H\n", cStruct.Name))
-	buffer.WriteString(fmt.Sprintf("#define %s_H\n\n", cStruct.Name))
-	buffer.WriteString("#include <stdint.h>\n#include <stdbool.h>\n\n")
-	buffer.WriteString(fmt.Sprintf("typedef struct {\n"))
-	for _, field := range cStruct.Fields {
-		buffer.WriteString(fmt.Sprintf("    %s %s;\n", field.CType, field.Name))
+// objectParser generates parse_object_<Name>, which parses a JSON object into
+// the struct, records the keys it held in the presence record, and advances
+// *pp past its closing brace. Its first local, ptr, is the input cursor every
+// value parser advances. A rejected object records the error, with the path
+// of the value that failed within it.
+func objectParser(o *ir.Object) *cgen.Func {
+	fn := cgen.NewFunc(fmt.Sprintf("Parse a JSON object into a %s, advancing *pp past its closing brace", o.Name),
+		fmt.Sprintf("static int parse_object_%s(const char** pp, %s* out, %s* present)", o.Name, o.Name, presenceName(o.Name)),
+		"pp", "out", "present")
+	body := fn.Body
+	body.Declare("const char*", "ptr", "*pp")
+	expected := body.Declare("int", "expected", "0")
+
+	body.Comment("Parse opening brace")
+	fail(body, "*ptr != '{'", "JSONRT_ERR_TYPE", `"an object"`, nil)
+	var members *cgen.Block
+	var more string
+	if o.Lenient {
+		body.Line("ptr++;")
+		members = body.While("*ptr != '}' && *ptr != '\\0'")
+		members.Comment("Skip whitespace and commas")
+		members.While(separator).Line("ptr++;")
+		members.Comment("Check for end of object")
+		members.If("*ptr == '}'").Break()
+	} else {
+		body.Line("ptr = jsonrt_skip_whitespace(ptr + 1);")
+		body.Comment("Members are separated by exactly one comma, which jsonrt_next skips")
+		more = body.Declare("int", "more", "*ptr != '}'")
+		members = body.For("", more+" == 1", fmt.Sprintf("%s = jsonrt_next(&ptr, '}')", more))
+	}
+
+	members.Comment("Expecting a string (field name)")
+	if o.Lenient {
+		fail(members, "*ptr != '\"'", "JSONRT_ERR_SYNTAX", `"a key or '}'"`, nil)
+	} else {
+		fail(members, "*ptr != '\"'", "JSONRT_ERR_SYNTAX", `"a key"`, nil)
+	}
+	members.Line("ptr++;")
+	members.Comment("Find the end of the field name. A plain ASCII key is matched in place, without copying")
+	key := members.Declare("const char*", "key", "ptr")
+	decode := members.Declare("bool", "key_decode", "false")
+	fail(members, fmt.Sprintf("jsonrt_scan_key(&ptr, %t, &%s) != 0", o.ReplaceInvalidUTF8, decode), "", "", nil)
+	keyLen := members.Declare("size_t", "key_len", fmt.Sprintf("(size_t)(ptr - %s)", key))
+	members.Line("ptr++; // Skip closing quote")
+
+	members.Comment("Expecting colon")
+	members.Line("ptr = jsonrt_skip_whitespace(ptr);")
+	fail(members, "*ptr != ':'", "JSONRT_ERR_SYNTAX", `"':'"`, nil)
+	members.Line("ptr = jsonrt_skip_whitespace(ptr + 1);")
+
+	members.Comment("Decode a key holding escapes or other characters, so it matches its field name")
+	name := members.Declare("const char*", "name", key)
+	nameLen := members.Declare("size_t", "name_len", keyLen)
+	decoded := members.Declare("char*", "decoded", "NULL")
+	decodeKey := members.If(decode)
+	fail(decodeKey, fmt.Sprintf("jsonrt_decode_key(%s, %t, &%s, &%s) != 0", key, o.ReplaceInvalidUTF8, decoded, nameLen), "", "", nil)
+	decodeKey.Line("%s = %s;", name, decoded)
+
+	members.Comment("Handle different types")
+	field := members.Declare("int", "field", "-1")
+	if len(o.KeyOrder) > 0 {
+		members.Comment("Speculate that keys arrive in order, which takes a single comparison")
+		hit, miss := members.IfElse(fmt.Sprintf("%s < %d && %s == key_lens_%s[%s] && memcmp(%s, keys_%s[%s], %s) == 0",
+			expected, len(o.KeyOrder), nameLen, o.Name, expected, name, o.Name, expected, nameLen))
+		hit.Line("%s = %s;", field, expected)
+		hit.Line("jsonrt_key_order_hits++;")
+		miss.Line("jsonrt_key_order_misses++;")
+		miss.Line("%s = key_index_%s(%s, %s);", field, o.Name, name, nameLen)
+	}
+	var dropped string
+	if o.RejectUnknown && len(o.Dropped) > 0 {
+		conds := make([]string, len(o.Dropped))
+		for i, k := range o.Dropped {
+			conds[i] = fmt.Sprintf("(%s == %d && memcmp(%s, \"%s\", %d) == 0)", nameLen, len(k), name, k, len(k))
+		}
+		members.Comment("Whether the key is of an eliminated field")
+		dropped = members.Declare("bool", "dropped", fmt.Sprintf("%s < 0 && (%s)", field, strings.Join(conds, " || ")))
+	}
+	members.Line("free(%s);", decoded)
+	declared := make(map[*ir.Field]int)
+	for i, f := range o.Fields {
+		declared[f] = i
+	}
+	fields := members.Switch(field)
+	for i, f := range o.KeyOrder {
+		// Braced, as a case label cannot precede a declaration
+		c := fields.Case(fmt.Sprint(i)).Scope()
+		parseValue(c, "out->"+f.Member, "present->in_"+f.Member, f.Value, o.ReplaceInvalidUTF8, []string{fmt.Sprintf(`jsonrt_error_key("%s");`, f.Key)})
+		index, mask := presenceBit(declared[f])
+		c.Line("present->keys[%d] |= %s;", index, mask)
+		c.Line("%s = %d;", expected, i+1)
+		c.Continue()
+	}
+
+	skipValue := func(b *cgen.Block) {
+		if o.Lenient {
+			b.Line("jsonrt_skip_value(&ptr);")
+		} else {
+			fail(b, fmt.Sprintf("jsonrt_skip_valid_value(&ptr, %t) != 0", o.ReplaceInvalidUTF8), "", "", nil)
+		}
 	}
-	buffer.WriteString(fmt.Sprintf("} %s;\n\n", cStruct.Name))
-	buffer.WriteString(fmt.Sprintf("#endif // %s_H\n", cStruct.Name))
-	return buffer.String()
+	if o.RejectUnknown {
+		if dropped != "" {
+			members.Comment("Skip the keys of eliminated fields")
+			skip := members.If(dropped)
+			skipValue(skip)
+			skip.Continue()
+		}
+		members.Comment("Reject unknown keys")
+		members.Line(`jsonrt_fail(%s - 1, JSONRT_ERR_UNKNOWN_FIELD, "a key of %s");`, key, o.Name)
+		members.Return("-1")
+	} else {
+		members.Comment("Skip unknown field value")
+		skipValue(members)
+	}
+
+	body.Comment("Parse closing brace")
+	if o.Lenient {
+		body.While(separator).Line("ptr++;")
+		fail(body, "*ptr != '}'", "JSONRT_ERR_SYNTAX", `"',' or '}'"`, nil)
+	} else {
+		body.If(more + " < 0").Return("-1")
+	}
+	for i, f := range o.Fields {
+		if !f.Constraints.Required {
+			continue
+		}
+		index, mask := presenceBit(i)
+		fail(body, fmt.Sprintf("(present->keys[%d] & %s) == 0", index, mask), "JSONRT_ERR_MISSING_REQUIRED",
+			fmt.Sprintf(`"key \"%s\""`, strings.ReplaceAll(f.Key, "%", "%%")), []string{fmt.Sprintf(`jsonrt_error_key("%s");`, f.Key)})
+	}
+	body.Line("*pp = ptr + 1;")
+	body.Return("0")
+	return fn
+}
+
+// fail emits a check that returns -1 when cond holds. With a code, it first
+// records the error at ptr, expected being the C string literal, and any
+// printf arguments, describing what the parser expected there; the runtime's
+// value parsers record their own. The unwind statements then add the value
+// being parsed to the front of the error's path.
+func fail(b *cgen.Block, cond, code, expected string, unwind []string) {
+	failAt(b, cond, "ptr", code, expected, unwind)
+}
+
+// failAt is fail with the error recorded at the C pointer at, such as the
+// start of a value already parsed.
+func failAt(b *cgen.Block, cond, at, code, expected string, unwind []string) {
+	failed := b.If(cond)
+	if code != "" {
+		failed.Line("jsonrt_fail(%s, %s, %s);", at, code, expected)
+	}
+	for _, line := range unwind {
+		failed.Line("%s", line)
+	}
+	failed.Return("-1")
+}
+
+// keyTables declares the keys of o, and their lengths, in KeyOrder, for the
+// parser's speculative check of the next key.
+func keyTables(o *ir.Object) cgen.Raw {
+	keys := make([]string, len(o.KeyOrder))
+	lens := make([]string, len(o.KeyOrder))
+	for i, field := range o.KeyOrder {
+		keys[i] = fmt.Sprintf("\"%s\"", field.Key)
+		lens[i] = fmt.Sprint(len(field.Key))
+	}
+	return cgen.Raw(fmt.Sprintf(`// Keys of %s in the order the parser expects them
+static const char* const keys_%s[] = {%s};
+static const size_t key_lens_%s[] = {%s};`, o.Name, o.Name, strings.Join(keys, ", "), o.Name, strings.Join(lens, ", ")))
+}
+
+// keyIndex generates key_index_<Name>, which returns the KeyOrder index of
+// the field whose key is the key_len bytes at key, or -1, dispatching as the
+// object's Dispatch selects.
+func keyIndex(o *ir.Object) *cgen.Func {
+	fn := cgen.NewFunc(fmt.Sprintf("Find the field of %s a key names, or return -1", o.Name),
+		fmt.Sprintf("static int key_index_%s(const char* key, size_t key_len)", o.Name), "key", "key_len")
+	index := make(map[*ir.Field]int)
+	for i, field := range o.KeyOrder {
+		index[field] = i
+	}
+	match := func(b *cgen.Block, cond string, field *ir.Field) {
+		b.If(cond).Return(fmt.Sprint(index[field]))
+	}
+	compare := func(field *ir.Field) string {
+		return fmt.Sprintf("memcmp(key, \"%s\", %d) == 0", field.Key, len(field.Key))
+	}
+
+	b := fn.Body
+	if o.Dispatch == ir.DispatchLinear {
+		for _, field := range o.Fields {
+			match(b, fmt.Sprintf("key_len == %d && %s", len(field.Key), compare(field)), field)
+		}
+		b.Return("-1")
+		return fn
+	}
+
+	b.Comment("Only keys of the same length can match, so switch on it first")
+	lengths := b.Switch("key_len")
+	for _, group := range o.KeysByLength() {
+		c := lengths.Case(fmt.Sprint(group.Len))
+		if o.Dispatch == ir.DispatchTrie {
+			dispatchTrie(c, ir.KeyTrie(group.Fields), match, compare)
+		} else {
+			for _, field := range group.Fields {
+				match(c, compare(field), field)
+			}
+		}
+		c.Break()
+	}
+	b.Return("-1")
+	return fn
+}
+
+// dispatchTrie emits a switch for each inner node of a key trie, on the byte
+// at its position, and a full comparison at each leaf.
+func dispatchTrie(b *cgen.Block, node *ir.TrieNode, match func(*cgen.Block, string, *ir.Field), compare func(*ir.Field) string) {
+	if node.Field != nil {
+		match(b, compare(node.Field), node.Field)
+		return
+	}
+	bytes := b.Switch(fmt.Sprintf("(unsigned char)key[%d]", node.Pos))
+	for _, branch := range node.Branches {
+		c := bytes.Case(charLiteral(branch.Byte))
+		dispatchTrie(c, branch.Node, match, compare)
+		c.Break()
+	}
+}
+
+// charLiteral returns a C case label for a byte: a character literal when it
+// is printable, and its value otherwise.
+func charLiteral(b byte) string {
+	if b >= ' ' && b <= '~' && b != '\'' && b != '\\' {
+		return fmt.Sprintf("'%c'", b)
+	}
+	return fmt.Sprint(b)
+}
+
+// separator matches the whitespace and commas skipped between object members.
+const separator = "*ptr && (*ptr == ' ' || *ptr == '\\n' || *ptr == '\\t' || *ptr == '\\r' || *ptr == ',')"
+
+// parseValue emits the statements parsing one value at ptr into target. present
+// is the presence record of the objects the value holds, and replace whether
+// invalid UTF-8 in strings becomes U+FFFD. On failure they run unwind, which
+// adds the value to the error's path, and return -1. A nullable value takes
+// null as its zero value, as encoding/json leaves a field it cannot set to
+// null, and its key still counts as present; its validation rules apply only
+// to the values it holds otherwise.
+func parseValue(b *cgen.Block, target, present string, v ir.Value, replace bool, unwind []string) {
+	if v.Nullable && v.Kind != ir.KindBytes { // Binary values always accept null
+		null, value := b.IfElse("jsonrt_parse_null(&ptr)")
+		resetValue(null, target, present, v)
+		b = value
+	}
+	start, number := "ptr", ""
+	if v.Kind == ir.KindFloat || hasRules(v) {
+		start = b.Declare("const char*", "start", "ptr")
+	}
+	switch v.Kind {
+	case ir.KindObject:
+		fail(b, fmt.Sprintf("parse_object_%s(&ptr, &%s, &%s) != 0", v.CType, target, present), "", "", unwind)
+	case ir.KindArray:
+		shape := fmt.Sprintf(`"an array of %d elements"`, v.Len)
+		fail(b, "*ptr != '['", "JSONRT_ERR_TYPE", shape, unwind)
+		b.Line("ptr = jsonrt_skip_whitespace(ptr + 1);")
+		i := b.Declare("size_t", "i", "0")
+		loop := b.If("*ptr != ']'").For("", "", "")
+		loop.Comment("More elements than the array holds")
+		fail(loop, fmt.Sprintf("%s == %d", i, v.Len), "JSONRT_ERR_TYPE", shape, unwind)
+		elem := append([]string{fmt.Sprintf("jsonrt_error_index(%s);", i)}, unwind...)
+		parseValue(loop, fmt.Sprintf("%s[%s]", target, i), fmt.Sprintf("%s[%s]", present, i), *v.Elem, replace, elem)
+		loop.Line("%s++;", i)
+		loop.Line("ptr = jsonrt_skip_whitespace(ptr);")
+		loop.If("*ptr == ']'").Break()
+		fail(loop, "*ptr != ','", "JSONRT_ERR_SYNTAX", `"',' or ']'"`, unwind)
+		loop.Line("ptr = jsonrt_skip_whitespace(ptr + 1);")
+		b.Comment("Fewer elements than the array holds")
+		fail(b, fmt.Sprintf("%s != %d", i, v.Len), "JSONRT_ERR_TYPE", shape, unwind)
+		b.Line("ptr++;")
+	case ir.KindSlice:
+		fail(b, "*ptr != '['", "JSONRT_ERR_TYPE", `"an array"`, unwind)
+		b.Comment("Drop the elements of a repeated key")
+		releasePresence(b, target, present, v)
+		releaseValue(b, target, v)
+		b.Line("ptr = jsonrt_skip_whitespace(ptr + 1);")
+		capacity := b.Declare("size_t", "cap", "0")
+		loop := b.If("*ptr != ']'").For("", "", "")
+		grow := loop.If(fmt.Sprintf("%s_len == %s", target, capacity))
+		grow.Line("%s = %s == 0 ? 4 : %s * 2;", capacity, capacity, capacity)
+		elems := grow.Declare("void*", "elems", fmt.Sprintf("jsonrt_grow(%s, %s_len, %s, sizeof(*%s))", target, target, capacity, target))
+		fail(grow, elems+" == NULL", "JSONRT_ERR_MEMORY", fmt.Sprintf(`"memory for %%zu elements", %s`, capacity), unwind)
+		grow.Line("%s = %s;", target, elems)
+		if holdsObjects(*v.Elem) {
+			records := grow.Declare("void*", "records", fmt.Sprintf("jsonrt_grow(%s, %s_len, %s, sizeof(*%s))", present, target, capacity, present))
+			fail(grow, records+" == NULL", "JSONRT_ERR_MEMORY", fmt.Sprintf(`"memory for %%zu elements", %s`, capacity), unwind)
+			grow.Line("%s = %s;", present, records)
+		}
+		loop.Comment("Count the element before parsing it, so a rejected one is released")
+		i := loop.Declare("size_t", "i", target+"_len++")
+		elem := append([]string{fmt.Sprintf("jsonrt_error_index(%s);", i)}, unwind...)
+		parseValue(loop, fmt.Sprintf("%s[%s]", target, i), fmt.Sprintf("%s[%s]", present, i), *v.Elem, replace, elem)
+		loop.Line("ptr = jsonrt_skip_whitespace(ptr);")
+		loop.If("*ptr == ']'").Break()
+		fail(loop, "*ptr != ','", "JSONRT_ERR_SYNTAX", `"',' or ']'"`, unwind)
+		loop.Line("ptr = jsonrt_skip_whitespace(ptr + 1);")
+		b.Line("ptr++;")
+	case ir.KindInlineString:
+		b.Comment("Copy straight into the inline buffer; no heap allocation")
+		fail(b, fmt.Sprintf("jsonrt_parse_inline_string(&ptr, %s, %d, %t, %t) != 0", target, v.MaxLen, v.Truncate, replace), "", "", unwind)
+	case ir.KindString:
+		b.Line("free(%s);  // Drop the value of a repeated key", target)
+		b.Line("%s = NULL;", target)
+		fail(b, fmt.Sprintf("jsonrt_parse_string(&ptr, &%s, %t) != 0", target, replace), "", "", unwind)
+	case ir.KindBool:
+		fail(b, fmt.Sprintf("jsonrt_parse_bool(&ptr, &%s) != 0", target), "", "", unwind)
+	case ir.KindBytes:
+		b.Line("free(%s);  // Drop the value of a repeated key", target)
+		b.Line("%s = NULL;", target)
+		b.Line("%s_len = 0;", target)
+		fail(b, fmt.Sprintf("jsonrt_parse_bytes(&ptr, &%s, &%s_len) != 0", target, target), "", "", unwind)
+	case ir.KindInt:
+		lo, hi, _ := intBounds(v.CType, v.Minimum, v.Maximum)
+		number = b.Declare("long long", "number", "")
+		fail(b, fmt.Sprintf("jsonrt_parse_integer(&ptr, %s, %s, &%s) != 0", intLiteral(v.CType, lo), intLiteral(v.CType, hi), number), "", "", unwind)
+		b.Line("%s = (%s)%s;", target, v.CType, number)
+	case ir.KindUint:
+		_, hi, _ := intBounds(v.CType, v.Minimum, v.Maximum)
+		number = b.Declare("unsigned long long", "number", "")
+		fail(b, fmt.Sprintf("jsonrt_parse_unsigned(&ptr, %s, &%s) != 0", intLiteral(v.CType, hi), number), "", "", unwind)
+		b.Line("%s = (%s)%s;", target, v.CType, number)
+	case ir.KindFloat:
+		number = b.Declare("double", "number", "")
+		fail(b, fmt.Sprintf("jsonrt_parse_number(&ptr, &%s) != 0", number), "", "", unwind)
+		b.Line("%s = (%s)%s;", target, v.CType, number)
+		b.Comment("Out of range for the type")
+		failAt(b, fmt.Sprintf("!isfinite(%s)", target), start, "JSONRT_ERR_OVERFLOW",
+			fmt.Sprintf(`"a number in the range of %s"`, v.CType), unwind)
+	}
+	if hasRules(v) {
+		checkRules(b, target, number, start, v, unwind)
+	}
+}
+
+// objectSerializer generates serialize_<Name>, which encodes the fields of
+// the struct in declaration order, each marked present if its key was in the
+// input. The caller writes the object's own tag and field count.
+func objectSerializer(o *ir.Object) *cgen.Func {
+	fn := cgen.NewFunc(fmt.Sprintf("Encode the fields of a %s to b", o.Name),
+		fmt.Sprintf("static void serialize_%s(jsonrt_buf* b, const %s* v, const %s* present)", o.Name, o.Name, presenceName(o.Name)),
+		"b", "v", "present")
+	for i, field := range o.Fields {
+		index, mask := presenceBit(i)
+		serializeValue(fn.Body, "v->"+field.Member, "present->in_"+field.Member,
+			fmt.Sprintf("(present->keys[%d] & %s) != 0", index, mask), field.Value)
+	}
+	return fn
+}
+
+// serializeValue emits the statements encoding one value to the buffer b.
+// isPresent is the C condition under which its key was in the input, and
+// present the presence record of the objects it holds. Array elements are
+// present along with their array or slice.
+func serializeValue(b *cgen.Block, target, present, isPresent string, v ir.Value) {
+	switch v.Kind {
+	case ir.KindObject:
+		b.Line("jsonrt_put_object(b, %s, %d);", isPresent, len(v.Object.Fields))
+		b.Line("serialize_%s(b, &%s, &%s);", v.CType, target, present)
+	case ir.KindArray:
+		b.Line("jsonrt_put_array(b, %s, %d);", isPresent, v.Len)
+		i, loop := b.ForRange("i", v.Len)
+		serializeValue(loop, fmt.Sprintf("%s[%s]", target, i), fmt.Sprintf("%s[%s]", present, i), isPresent, *v.Elem)
+	case ir.KindSlice:
+		b.Line("jsonrt_put_array(b, %s, %s_len);", isPresent, target)
+		i, loop := b.ForEach("i", target+"_len")
+		serializeValue(loop, fmt.Sprintf("%s[%s]", target, i), fmt.Sprintf("%s[%s]", present, i), isPresent, *v.Elem)
+	case ir.KindInlineString:
+		b.Line("jsonrt_put_string(b, %s, %s, strlen(%s));", isPresent, target, target)
+	case ir.KindString:
+		b.Line("jsonrt_put_string(b, %s, %s, %s != NULL ? strlen(%s) : 0);", isPresent, target, target, target)
+	case ir.KindBool:
+		b.Line("jsonrt_put_bool(b, %s, %s);", isPresent, target)
+	case ir.KindBytes:
+		b.Line("jsonrt_put_bytes(b, %s, %s, %s_len);", isPresent, target, target)
+	case ir.KindInt:
+		b.Line("jsonrt_put_int(b, %s, (long long)%s);", isPresent, target)
+	case ir.KindUint:
+		b.Line("jsonrt_put_uint(b, %s, (unsigned long long)%s);", isPresent, target)
+	case ir.KindFloat:
+		if v.CType == "float" {
+			b.Line("jsonrt_put_float(b, %s, %s);", isPresent, target)
+		} else {
+			b.Line("jsonrt_put_double(b, %s, %s);", isPresent, target)
+		}
+	}
+}
+
+// objectRelease generates release_<Name>, which frees the heap-allocated
+// members of the struct, and of the objects nested in it.
+func objectRelease(o *ir.Object) *cgen.Func {
+	fn := cgen.NewFunc(fmt.Sprintf("Free the heap-allocated members of a %s", o.Name),
+		fmt.Sprintf("static void release_%s(%s* v)", o.Name, o.Name), "v")
+	for _, field := range o.Fields {
+		releaseValue(fn.Body, "v->"+field.Member, field.Value)
+	}
+	return fn
+}
+
+// releaseValue emits the statements freeing what one value holds.
+func releaseValue(b *cgen.Block, target string, v ir.Value) {
+	switch v.Kind {
+	case ir.KindObject:
+		b.Line("release_%s(&%s);", v.CType, target)
+	case ir.KindArray:
+		if holdsHeap(*v.Elem) {
+			i, loop := b.ForRange("i", v.Len)
+			releaseValue(loop, fmt.Sprintf("%s[%s]", target, i), *v.Elem)
+		}
+	case ir.KindSlice:
+		if holdsHeap(*v.Elem) {
+			i, loop := b.ForEach("i", target+"_len")
+			releaseValue(loop, fmt.Sprintf("%s[%s]", target, i), *v.Elem)
+		}
+		b.Line("free(%s);", target)
+		b.Line("%s = NULL;", target)
+		b.Line("%s_len = 0;", target)
+	case ir.KindString, ir.KindBytes:
+		b.Line("free(%s);", target)
+		b.Line("%s = NULL;", target)
+	}
+}
+
+// objectPresenceRelease generates release_presence_<Name>, which frees the
+// presence records allocated for the slices of objects in the struct, and in
+// the objects nested in it. It reads their lengths, so it runs before
+// release_<Name>.
+func objectPresenceRelease(o *ir.Object) *cgen.Func {
+	fn := cgen.NewFunc(fmt.Sprintf("Free the presence records of the slices of objects in a %s", o.Name),
+		fmt.Sprintf("static void release_presence_%s(const %s* v, %s* present)", o.Name, o.Name, presenceName(o.Name)),
+		"v", "present")
+	lengths := false
+	for _, field := range o.Fields {
+		releasePresence(fn.Body, "v->"+field.Member, "present->in_"+field.Member, field.Value)
+		value := field.Value
+		if presenceHeap(value) && (value.Kind != ir.KindSlice || presenceHeap(*value.Elem)) {
+			lengths = true
+		}
+	}
+	if !lengths {
+		fn.Body.Line("(void)v;  // Each slice's records are freed whole")
+	}
+	return fn
+}
+
+// releasePresence emits the statements freeing the presence records that
+// the slices of objects in one value allocated, present being its own.
+func releasePresence(b *cgen.Block, target, present string, v ir.Value) {
+	if !presenceHeap(v) {
+		return
+	}
+	switch v.Kind {
+	case ir.KindObject:
+		b.Line("release_presence_%s(&%s, &%s);", v.CType, target, present)
+	case ir.KindArray:
+		i, loop := b.ForRange("i", v.Len)
+		releasePresence(loop, fmt.Sprintf("%s[%s]", target, i), fmt.Sprintf("%s[%s]", present, i), *v.Elem)
+	case ir.KindSlice:
+		if presenceHeap(*v.Elem) {
+			i, loop := b.ForEach("i", target+"_len")
+			releasePresence(loop, fmt.Sprintf("%s[%s]", target, i), fmt.Sprintf("%s[%s]", present, i), *v.Elem)
+		}
+		b.Line("free(%s);", present)
+		b.Line("%s = NULL;", present)
+	}
+}
+
+// resetValue emits the statements returning a value, and the presence
+// record of the objects it holds, to zero, freeing what it held.
+func resetValue(b *cgen.Block, target, present string, v ir.Value) {
+	releasePresence(b, target, present, v)
+	releaseValue(b, target, v)
+	b.Line("memset(&%s, 0, sizeof(%s));", target, target)
+	elem := v
+	for elem.Kind == ir.KindArray {
+		elem = *elem.Elem
+	}
+	if elem.Kind == ir.KindObject {
+		b.Line("memset(&%s, 0, sizeof(%s));", present, present)
+	}
+}
+
+// holdsHeap reports whether a value of type v may hold heap-allocated memory.
+func holdsHeap(v ir.Value) bool {
+	switch v.Kind {
+	case ir.KindObject, ir.KindString, ir.KindBytes, ir.KindSlice:
+		return true
+	case ir.KindArray:
+		return holdsHeap(*v.Elem)
+	}
+	return false
+}
+
+// presenceHeap reports whether the presence record of a value of type v may
+// hold heap-allocated records, those of a slice of objects.
+func presenceHeap(v ir.Value) bool {
+	switch v.Kind {
+	case ir.KindSlice:
+		return holdsObjects(*v.Elem)
+	case ir.KindArray:
+		return presenceHeap(*v.Elem)
+	case ir.KindObject:
+		for _, field := range v.Object.Fields {
+			if presenceHeap(field.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holdsObjects reports whether a value of type v is an object, or an array of
+// them, and so has a presence record.
+func holdsObjects(v ir.Value) bool {
+	for v.Kind == ir.KindArray {
+		v = *v.Elem
+	}
+	return v.Kind == ir.KindObject
+}
+
+// cTypeRanges holds the limits.h/stdint.h bounds checked when parsing each
+// integer type, unless its minimum or maximum narrows them.
+var cTypeRanges = map[string]string{
+	"int":          "INT_MIN, INT_MAX",
+	"int8_t":       "INT8_MIN, INT8_MAX",
+	"int16_t":      "INT16_MIN, INT16_MAX",
+	"int32_t":      "INT32_MIN, INT32_MAX",
+	"int64_t":      "INT64_MIN, INT64_MAX",
+	"unsigned int": "UINT_MAX",
+	"uint8_t":      "UINT8_MAX",
+	"uint16_t":     "UINT16_MAX",
+	"uint32_t":     "UINT32_MAX",
+	"uint64_t":     "UINT64_MAX",
 }
@@ -0,0 +1,312 @@
+package compiler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/ir"
+)
+
+// Module is the parsers of several structs, built together into one shared
+// library, which is loaded into the process when cgo is available, and one
+// executable that worker processes run to parse documents isolated. Each
+// struct's entry points are named after it, e.g. parse_json_Student, so the
+// generated sources link side by side.
+type Module struct {
+	build   *moduleBuild
+	parsers map[string]*CompiledParser
+	close   sync.Once
+}
+
+// moduleBuild is the directory, workers and library of a build. Each build
+// has a directory of its own, so builds of structs with the same name never
+// share files. Modules built from the same sources with the same options in
+// one process share a build, which is removed when the last is closed.
+type moduleBuild struct {
+	key       string
+	dir       string
+	keep      bool
+	toolchain Toolchain
+	pool      *workerPool
+	lib       *library       // nil without cgo
+	runtime   *runtimeObject // Held until the build is removed
+
+	// ready is closed once the build is done, and err set if it failed
+	ready chan struct{}
+	err   error
+	refs  int // Guarded by buildsMu
+}
+
+// Builds in progress or in use, by key
+var (
+	buildsMu sync.Mutex
+	builds   = make(map[string]*moduleBuild)
+)
+
+// BuildModule generates a parser for each struct, applying ir.DefaultPasses,
+// and builds them all once, into a single module.
+func BuildModule(cStructs []analyzer.CStruct) (*Module, error) {
+	return BuildModuleWith(cStructs, Options{})
+}
+
+// BuildModuleWith is BuildModule, built as opts says.
+func BuildModuleWith(cStructs []analyzer.CStruct, opts Options) (*Module, error) {
+	schemas := make([]*ir.Schema, 0, len(cStructs))
+	for _, cStruct := range cStructs {
+		if err := validateStruct(cStruct); err != nil {
+			return nil, fmt.Errorf("invalid struct %s: %v", cStruct.Name, err)
+		}
+		schema, err := lower(cStruct)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate C code for %s: %v", cStruct.Name, err)
+		}
+		schemas = append(schemas, schema)
+	}
+	return BuildModuleSchemasWith(schemas, opts)
+}
+
+// BuildModuleSchemas is BuildModule for schemas the caller has already run
+// passes over.
+func BuildModuleSchemas(schemas []*ir.Schema) (*Module, error) {
+	return BuildModuleSchemasWith(schemas, Options{})
+}
+
+// BuildModuleSchemasWith is BuildModuleSchemas, built as opts says. It is
+// safe to call concurrently.
+func BuildModuleSchemasWith(schemas []*ir.Schema, opts Options) (*Module, error) {
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("module has no structs")
+	}
+	roots := make([]string, len(schemas))
+	seen := make(map[string]bool)
+	for i, schema := range schemas {
+		name := schema.Root.Name
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate struct %s", name)
+		}
+		seen[name] = true
+		roots[i] = name
+	}
+
+	config, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	key, err := buildKey(schemas, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for an identical build if there is one, and make it otherwise
+	buildsMu.Lock()
+	build, ok := builds[key]
+	if ok {
+		build.refs++
+		buildsMu.Unlock()
+		<-build.ready
+	} else {
+		build = &moduleBuild{key: key, keep: config.keep, toolchain: config.toolchain, ready: make(chan struct{}), refs: 1}
+		builds[key] = build
+		buildsMu.Unlock()
+		build.err = build.make(schemas, roots, config)
+		if build.err != nil {
+			buildsMu.Lock()
+			delete(builds, key)
+			buildsMu.Unlock()
+		}
+		close(build.ready)
+	}
+	if build.err != nil {
+		return nil, build.err
+	}
+
+	m := &Module{build: build, parsers: make(map[string]*CompiledParser)}
+	for _, schema := range schemas {
+		p := &CompiledParser{pool: build.pool, typeName: schema.Root.Name, root: schema.Root, lib: build.lib, toolchain: build.toolchain, dir: build.dir}
+		if build.lib != nil {
+			if p.parse, err = build.lib.symbol("parse_and_serialize_json_" + schema.Root.Name); err != nil {
+				m.Close()
+				return nil, err
+			}
+		}
+		m.parsers[schema.Root.Name] = p
+	}
+	return m, nil
+}
+
+// buildKey identifies a build by the C code of its structs, in order, and
+// everything that decides how it is compiled.
+func buildKey(schemas []*ir.Schema, config *buildConfig) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%t\x00", config.fingerprint(), strings.Join(config.ldflags, "\x00"), config.outputDir, config.keep)
+	for _, schema := range schemas {
+		cCode, err := GenerateFromIR(schema)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate C code: %v", err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%s", schema.Root.Name, len(cCode), cCode)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+// make generates and compiles the module in a new directory under the
+// output directory, starts its workers' pool and loads its library.
+func (b *moduleBuild) make(schemas []*ir.Schema, roots []string, config *buildConfig) error {
+	if err := os.MkdirAll(config.outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	name := moduleName(roots)
+	outputDir, err := os.MkdirTemp(config.outputDir, name+"_*")
+	if err != nil {
+		return fmt.Errorf("failed to create build directory: %v", err)
+	}
+	b.dir = outputDir
+	if err := b.compile(schemas, roots, name, config); err != nil {
+		b.remove()
+		return err
+	}
+	if inProcessSupported {
+		if b.lib, err = openLibrary(filepath.Join(outputDir, fmt.Sprintf("libparser_%s.so", name))); err != nil {
+			b.pool.close()
+			b.remove()
+			return err
+		}
+	}
+	return nil
+}
+
+// compile writes the C code of every struct and the main program to the
+// build's directory and builds them.
+func (b *moduleBuild) compile(schemas []*ir.Schema, roots []string, name string, config *buildConfig) error {
+	outputDir := b.dir
+	for _, schema := range schemas {
+		if err := CompileSchema(schema, outputDir); err != nil {
+			return err
+		}
+	}
+	mainFile := filepath.Join(outputDir, fmt.Sprintf("main_%s.c", name))
+	if err := os.WriteFile(mainFile, []byte(generateModuleMain(roots).String()), 0644); err != nil {
+		return fmt.Errorf("failed to write main_%s.c: %v", name, err)
+	}
+
+	// Compile each struct once, position-independent, and link the objects,
+	// with the runtime object the builds of this process share,
+	// into both the program and a shared library
+	var err error
+	if b.runtime, err = buildRuntime(config, outputDir); err != nil {
+		return err
+	}
+	var objects []string
+	for _, root := range roots {
+		object := filepath.Join(outputDir, fmt.Sprintf("%s.o", root))
+		if err := config.compile(object, filepath.Join(outputDir, fmt.Sprintf("%s.c", root))); err != nil {
+			return err
+		}
+		objects = append(objects, object)
+	}
+	objects = append(objects, b.runtime.path)
+
+	outPath := filepath.Join(outputDir, fmt.Sprintf("parser_%s", name))
+	if err := config.link(outPath, nil, append([]string{mainFile}, objects...)...); err != nil {
+		return err
+	}
+	// The library's path is unique to the build, as dlopen would return an
+	// earlier build still loaded from the same path. -Bsymbolic binds the
+	// library's calls to its own runtime, whatever else the process has
+	// loaded.
+	libPath := filepath.Join(outputDir, fmt.Sprintf("libparser_%s.so", name))
+	if err := config.link(libPath, []string{"-shared", "-Wl,-Bsymbolic"}, objects...); err != nil {
+		return err
+	}
+	b.pool = newWorkerPool(outPath)
+	return nil
+}
+
+// release drops a module's reference to the build, and unloads it, stops its
+// workers and removes its directory, unless kept, once none are left.
+func (b *moduleBuild) release() {
+	buildsMu.Lock()
+	b.refs--
+	last := b.refs == 0
+	if last {
+		delete(builds, b.key)
+	}
+	buildsMu.Unlock()
+	if !last {
+		return
+	}
+	b.pool.close()
+	if b.lib != nil {
+		b.lib.close()
+	}
+	if !b.keep {
+		b.remove()
+	}
+}
+
+// remove removes the build's directory, and releases its runtime object.
+func (b *moduleBuild) remove() {
+	slog.Info("Removing Build", slog.String("dir", b.dir))
+	os.RemoveAll(b.dir)
+	if b.runtime != nil {
+		b.runtime.release()
+	}
+}
+
+// moduleName names the files of a module: after its struct if it has one,
+// and after a hash of the struct names otherwise.
+func moduleName(roots []string) string {
+	if len(roots) == 1 {
+		return roots[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(roots, ",")))
+	return fmt.Sprintf("module_%08x", h.Sum32())
+}
+
+// Parser returns the parser of the struct called name. It stays usable until
+// the module is closed; closing the parser itself does nothing.
+func (m *Module) Parser(name string) (*CompiledParser, error) {
+	p, ok := m.parsers[name]
+	if !ok {
+		return nil, fmt.Errorf("module has no parser for %s", name)
+	}
+	return p, nil
+}
+
+// Toolchain returns the C compiler the module was built with.
+func (m *Module) Toolchain() Toolchain {
+	return m.build.toolchain
+}
+
+// Dir returns the directory the module was built in, which holds its
+// generated sources and binaries.
+func (m *Module) Dir() string {
+	return m.build.dir
+}
+
+// Types returns the names of the module's structs, sorted.
+func (m *Module) Types() []string {
+	names := make([]string, 0, len(m.parsers))
+	for name := range m.parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close releases the module's build. Once no other module built from the same
+// sources uses it, it is unloaded, once running calls return, its workers are
+// stopped and its files removed. Closing a module again does nothing.
+func (m *Module) Close() {
+	m.close.Do(m.build.release)
+}
@@ -0,0 +1,205 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/arifali123/152compiler2/packages/ir"
+)
+
+// The result encoding parse_and_serialize_json writes, as jsonrt.h describes
+// it: a header, then tagged, length-prefixed values with no delimiters.
+const (
+	resultMagic   = "JR"
+	resultVersion = 1
+	resultPresent = 0x80 // Set on the tag of a value whose key was in the input
+
+	tagString = 1
+	tagInt    = 2
+	tagUint   = 3
+	tagFloat  = 4
+	tagDouble = 5
+	tagBool   = 6
+	tagBytes  = 7
+	tagObject = 8
+	tagArray  = 9
+)
+
+// resultTag returns the tag the C side writes for a value of type v.
+func resultTag(v ir.Value) byte {
+	switch v.Kind {
+	case ir.KindString, ir.KindInlineString:
+		return tagString
+	case ir.KindInt:
+		return tagInt
+	case ir.KindUint:
+		return tagUint
+	case ir.KindFloat:
+		if v.CType == "float" {
+			return tagFloat
+		}
+		return tagDouble
+	case ir.KindBool:
+		return tagBool
+	case ir.KindBytes:
+		return tagBytes
+	case ir.KindObject:
+		return tagObject
+	default:
+		return tagArray
+	}
+}
+
+// decodeResult decodes the parser output for the object root. Nested structs
+// become maps, and arrays and slices become slices; numbers are kept as
+// strings, as the caller can parse them if needed. If present is not nil, the
+// path of every field whose key was in the input is added to it.
+func decodeResult(out []byte, root *ir.Object, present map[string]bool) (map[string]interface{}, error) {
+	if len(out) < len(resultMagic)+1 || string(out[:len(resultMagic)]) != resultMagic {
+		return nil, fmt.Errorf("malformed parser result")
+	}
+	if version := out[len(resultMagic)]; version != resultVersion {
+		return nil, fmt.Errorf("unsupported parser result version %d", version)
+	}
+	d := &resultDecoder{data: out[len(resultMagic)+1:], present: present}
+	value, _, err := d.value("", ir.Value{Kind: ir.KindObject, CType: root.Name, Object: root})
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) > 0 {
+		return nil, fmt.Errorf("parser result has %d trailing bytes", len(d.data))
+	}
+	return value.(map[string]interface{}), nil
+}
+
+// resultDecoder reads values from the rest of the parser output.
+type resultDecoder struct {
+	data    []byte
+	present map[string]bool
+}
+
+// take consumes the next n bytes of the output.
+func (d *resultDecoder) take(n int, path string) ([]byte, error) {
+	if n > len(d.data) {
+		return nil, fmt.Errorf("parser result is truncated at %s", describePath(path))
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+// length consumes a 4-byte length.
+func (d *resultDecoder) length(path string) (int, error) {
+	b, err := d.take(4, path)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// value decodes the value at path, of type v, and reports whether its key was
+// in the input.
+func (d *resultDecoder) value(path string, v ir.Value) (value interface{}, present bool, err error) {
+	b, err := d.take(1, path)
+	if err != nil {
+		return nil, false, err
+	}
+	tag, present := b[0]&^resultPresent, b[0]&resultPresent != 0
+	if want := resultTag(v); tag != want {
+		return nil, false, fmt.Errorf("parser result has tag %d for %s, want %d", tag, describePath(path), want)
+	}
+
+	switch v.Kind {
+	case ir.KindObject:
+		n, err := d.length(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if n != len(v.Object.Fields) {
+			return nil, false, fmt.Errorf("parser result has %d fields for %s, want %d", n, describePath(path), len(v.Object.Fields))
+		}
+		fields := make(map[string]interface{}, n)
+		for _, field := range v.Object.Fields {
+			fieldPath := field.Key
+			if path != "" {
+				fieldPath = path + "." + field.Key
+			}
+			value, fieldPresent, err := d.value(fieldPath, field.Value)
+			if err != nil {
+				return nil, false, err
+			}
+			fields[field.Key] = value
+			if fieldPresent && d.present != nil {
+				d.present[fieldPath] = true
+			}
+		}
+		return fields, present, nil
+	case ir.KindArray, ir.KindSlice:
+		n, err := d.length(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if v.Kind == ir.KindArray && n != v.Len {
+			return nil, false, fmt.Errorf("parser result has %d elements for %s, want %d", n, describePath(path), v.Len)
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], _, err = d.value(fmt.Sprintf("%s[%d]", path, i), *v.Elem); err != nil {
+				return nil, false, err
+			}
+		}
+		return elems, present, nil
+	case ir.KindString, ir.KindInlineString, ir.KindBytes:
+		n, err := d.length(path)
+		if err != nil {
+			return nil, false, err
+		}
+		data, err := d.take(n, path)
+		if err != nil {
+			return nil, false, err
+		}
+		if v.Kind == ir.KindBytes {
+			return append([]byte{}, data...), present, nil
+		}
+		return string(data), present, nil
+	case ir.KindBool:
+		data, err := d.take(1, path)
+		if err != nil {
+			return nil, false, err
+		}
+		return data[0] != 0, present, nil
+	case ir.KindFloat:
+		if tag == tagFloat {
+			data, err := d.take(4, path)
+			if err != nil {
+				return nil, false, err
+			}
+			f := math.Float32frombits(binary.BigEndian.Uint32(data))
+			return strconv.FormatFloat(float64(f), 'g', -1, 32), present, nil
+		}
+	}
+
+	data, err := d.take(8, path)
+	if err != nil {
+		return nil, false, err
+	}
+	bits := binary.BigEndian.Uint64(data)
+	switch v.Kind {
+	case ir.KindInt:
+		return strconv.FormatInt(int64(bits), 10), present, nil
+	case ir.KindUint:
+		return strconv.FormatUint(bits, 10), present, nil
+	default:
+		return strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64), present, nil
+	}
+}
+
+// describePath names a value in decoding errors.
+func describePath(path string) string {
+	if path == "" {
+		return "the root object"
+	}
+	return path
+}
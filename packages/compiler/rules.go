@@ -0,0 +1,243 @@
+package compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/compiler/cgen"
+	"github.com/arifali123/152compiler2/packages/ir"
+)
+
+// intBits holds the width of each integer type, and whether it is signed.
+var intBits = map[string]struct {
+	bits   uint
+	signed bool
+}{
+	"int": {32, true}, "int8_t": {8, true}, "int16_t": {16, true}, "int32_t": {32, true}, "int64_t": {64, true},
+	"unsigned int": {32, false}, "uint8_t": {8, false}, "uint16_t": {16, false}, "uint32_t": {32, false}, "uint64_t": {64, false},
+}
+
+// validateRules checks that the parser can enforce the validation rules of
+// the field called name, or of an array element. A pattern is not checked,
+// only published by jsonschema.Export.
+func validateRules(name string, field analyzer.FieldInfo) error {
+	rules, cType := field.Rules, field.CType
+	scalar := field.Kind != "struct" && field.Kind != "array" && field.Kind != "slice" && field.Struct == nil
+	_, isInt := intBits[cType]
+	isNumber := scalar && (isInt || cType == "float" || cType == "double")
+	if (rules.Minimum != nil || rules.Maximum != nil) && !isNumber {
+		return fmt.Errorf("field %s: minimum and maximum apply only to numbers", name)
+	}
+	for _, bound := range []*float64{rules.Minimum, rules.Maximum} {
+		if bound != nil && (math.IsNaN(*bound) || math.IsInf(*bound, 0)) {
+			return fmt.Errorf("field %s: minimum and maximum must be finite", name)
+		}
+	}
+	if isInt {
+		if _, _, err := intBounds(cType, rules.Minimum, rules.Maximum); err != nil {
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+	}
+	if rules.MaxLength < 0 || rules.MaxLength > 0 && !(scalar && cType == "char*") {
+		return fmt.Errorf("field %s: maxLength applies only to strings, and must not be negative", name)
+	}
+	if len(rules.Enum) > 0 {
+		if !scalar || cType == analyzer.BytesCType {
+			return fmt.Errorf("field %s: enum applies only to strings, numbers and booleans", name)
+		}
+		if len(enumValues(cType, rules.Enum)) == 0 {
+			return fmt.Errorf("field %s: no value of its enum is a %s", name, cType)
+		}
+	}
+	return nil
+}
+
+// intRange returns the smallest and largest values of the integer type cType.
+func intRange(cType string) (lo, hi *big.Int) {
+	t := intBits[cType]
+	if t.signed {
+		hi = new(big.Int).Lsh(big.NewInt(1), t.bits-1)
+		lo = new(big.Int).Neg(hi)
+	} else {
+		hi = new(big.Int).Lsh(big.NewInt(1), t.bits)
+		lo = new(big.Int)
+	}
+	return lo, hi.Sub(hi, big.NewInt(1))
+}
+
+// intBounds returns the range a value of the integer type cType must lie in:
+// that of the type, narrowed by the optional minimum and maximum.
+func intBounds(cType string, minimum, maximum *float64) (lo, hi *big.Int, err error) {
+	lo, hi = intRange(cType)
+	if minimum != nil {
+		// The least integer at or above the minimum
+		f := new(big.Float).SetFloat64(*minimum)
+		m, _ := f.Int(nil)
+		if f.Cmp(new(big.Float).SetInt(m)) > 0 {
+			m.Add(m, big.NewInt(1))
+		}
+		if m.Cmp(lo) > 0 {
+			lo = m
+		}
+	}
+	if maximum != nil {
+		// The greatest integer at or below the maximum
+		f := new(big.Float).SetFloat64(*maximum)
+		m, _ := f.Int(nil)
+		if f.Cmp(new(big.Float).SetInt(m)) < 0 {
+			m.Sub(m, big.NewInt(1))
+		}
+		if m.Cmp(hi) < 0 {
+			hi = m
+		}
+	}
+	if lo.Cmp(hi) > 0 {
+		return nil, nil, fmt.Errorf("no %s lies between its minimum and maximum", cType)
+	}
+	return lo, hi, nil
+}
+
+// intLiteral returns n, a value of the integer type cType, as a C constant.
+// The type's own bounds are named, as the least int64_t has no literal.
+func intLiteral(cType string, n *big.Int) string {
+	lo, hi := intRange(cType)
+	bounds := strings.Split(cTypeRanges[cType], ", ")
+	switch {
+	case n.Cmp(hi) == 0:
+		return bounds[len(bounds)-1]
+	case n.Cmp(lo) == 0 && intBits[cType].signed:
+		return bounds[0]
+	case intBits[cType].signed:
+		return n.String() + "LL"
+	}
+	return n.String() + "ULL"
+}
+
+// enumValues returns the values of enum, JSON literals, that a value of C
+// type cType can hold, as C constants; the others can never match.
+func enumValues(cType string, enum []string) []string {
+	var values []string
+	for _, literal := range enum {
+		switch _, isInt := intBits[cType]; {
+		case cType == "char*":
+			var s string
+			if json.Unmarshal([]byte(literal), &s) == nil {
+				values = append(values, stringLiteral(s))
+			}
+		case cType == "bool":
+			if literal == "true" || literal == "false" {
+				values = append(values, literal)
+			}
+		case cType == "float" || cType == "double":
+			if f, err := strconv.ParseFloat(literal, 64); err == nil && json.Valid([]byte(literal)) {
+				values = append(values, fmt.Sprintf("(%s)%s", cType, strconv.FormatFloat(f, 'g', -1, 64)))
+			}
+		case isInt:
+			f, _, err := big.ParseFloat(literal, 10, 256, big.ToNearestEven)
+			if err != nil || !f.IsInt() || !json.Valid([]byte(literal)) {
+				continue
+			}
+			n, _ := f.Int(nil)
+			if lo, hi := intRange(cType); n.Cmp(lo) >= 0 && n.Cmp(hi) <= 0 {
+				values = append(values, intLiteral(cType, n))
+			}
+		}
+	}
+	return values
+}
+
+// stringLiteral returns s as a C string literal. Bytes other than printable
+// ASCII are written as octal escapes, which never run into the next byte.
+func stringLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= ' ' && c <= '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// checkRules emits the checks of the validation rules of a value parsed from
+// start into target. number is the local holding a parsed number before its
+// conversion to the C type, and the range of integers is checked as they are
+// parsed, by intBounds.
+func checkRules(b *cgen.Block, target, number, start string, v ir.Value, unwind []string) {
+	switch v.Kind {
+	case ir.KindUint:
+		lo, hi, _ := intBounds(v.CType, v.Minimum, v.Maximum)
+		if lo.Sign() > 0 {
+			failAt(b, fmt.Sprintf("%s < %s", number, intLiteral(v.CType, lo)), start, "JSONRT_ERR_OVERFLOW",
+				fmt.Sprintf(`"an integer from %s to %s"`, lo, hi), unwind)
+		}
+	case ir.KindFloat:
+		var conds, limits []string
+		if v.Minimum != nil {
+			conds = append(conds, fmt.Sprintf("%s < %s", number, strconv.FormatFloat(*v.Minimum, 'g', -1, 64)))
+			limits = append(limits, "at least "+strconv.FormatFloat(*v.Minimum, 'g', -1, 64))
+		}
+		if v.Maximum != nil {
+			conds = append(conds, fmt.Sprintf("%s > %s", number, strconv.FormatFloat(*v.Maximum, 'g', -1, 64)))
+			limits = append(limits, "at most "+strconv.FormatFloat(*v.Maximum, 'g', -1, 64))
+		}
+		if len(conds) > 0 {
+			failAt(b, strings.Join(conds, " || "), start, "JSONRT_ERR_OVERFLOW",
+				fmt.Sprintf(`"a number %s"`, strings.Join(limits, " and ")), unwind)
+		}
+	case ir.KindString, ir.KindInlineString:
+		if v.MaxLength > 0 {
+			failAt(b, fmt.Sprintf("jsonrt_utf8_len(%s) > %d", target, v.MaxLength), start, "JSONRT_ERR_OVERFLOW",
+				fmt.Sprintf(`"a string of at most %d characters"`, v.MaxLength), unwind)
+		}
+	}
+
+	values := enumValues(v.CType, v.Enum)
+	if len(values) == 0 {
+		return
+	}
+	var conds []string
+	for _, value := range values {
+		switch v.Kind {
+		case ir.KindString, ir.KindInlineString:
+			conds = append(conds, fmt.Sprintf("strcmp(%s, %s) != 0", target, value))
+		case ir.KindInt, ir.KindUint:
+			conds = append(conds, fmt.Sprintf("%s != %s", number, value))
+		default:
+			conds = append(conds, fmt.Sprintf("%s != %s", target, value))
+		}
+	}
+	expected := "one of " + strings.Join(v.Enum, ", ")
+	if len(v.Enum) == 1 {
+		expected = v.Enum[0]
+	}
+	failAt(b, strings.Join(conds, " && "), start, "JSONRT_ERR_NOT_ALLOWED",
+		stringLiteral(strings.ReplaceAll(expected, "%", "%%")), unwind)
+}
+
+// hasRules reports whether a value of type v has validation rules checked
+// after it is parsed.
+func hasRules(v ir.Value) bool {
+	switch v.Kind {
+	case ir.KindUint:
+		lo, _, _ := intBounds(v.CType, v.Minimum, v.Maximum)
+		return lo.Sign() > 0 || len(v.Enum) > 0
+	case ir.KindFloat:
+		return v.Minimum != nil || v.Maximum != nil || len(v.Enum) > 0
+	case ir.KindString, ir.KindInlineString:
+		return v.MaxLength > 0 || len(v.Enum) > 0
+	}
+	return len(v.Enum) > 0
+}
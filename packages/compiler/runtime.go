@@ -0,0 +1,1259 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The jsonrt runtime holds the helpers every generated parser calls: string
+// and key decoding with UTF-8 validation, number, bool and base64 value
+// parsers, whitespace and unknown-value skipping, the growable output buffer
+// and the result encoding written to it, and the key-order counters. It is
+// written next to the generated files and compiled once per build, so each
+// <Name>.c holds only the code specific to its struct.
+const (
+	runtimeName = "jsonrt"
+
+	// runtimeHeader is jsonrt.h, which every generated source includes.
+	runtimeHeader = `#ifndef JSONRT_H
+#define JSONRT_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+
+// Output buffer for parse_and_serialize_json, which encodes its result twice:
+// once with measure set, which only counts the length, and once into a buffer
+// jsonrt_buf_alloc sized exactly. failed is set if the result would not fit,
+// after which appends are ignored.
+typedef struct {
+    char* data;
+    size_t len;
+    size_t cap;
+    bool measure;
+    bool failed;
+} jsonrt_buf;
+
+bool jsonrt_buf_alloc(jsonrt_buf* b, size_t cap);
+void jsonrt_append(jsonrt_buf* b, const char* data, size_t n);
+void free_serialized(char* str);
+
+// Result encoding. parse_and_serialize_json writes a header, the bytes 'J'
+// 'R' and JSONRT_RESULT_VERSION, then the root object. Each value is a tag,
+// with JSONRT_PRESENT set if its key was in the input, and a big-endian
+// payload: a 4-byte length and the raw bytes for strings and bytes, 8 bytes
+// for integers, the IEEE bits of floats in 4 bytes and of doubles in 8, 1
+// byte for bools, and a 4-byte count of the values that follow for objects
+// and arrays. Nothing is delimited, so values may hold any byte.
+#define JSONRT_RESULT_VERSION 1
+#define JSONRT_PRESENT 0x80
+enum {
+    JSONRT_TAG_STRING = 1,
+    JSONRT_TAG_INT = 2,
+    JSONRT_TAG_UINT = 3,
+    JSONRT_TAG_FLOAT = 4,
+    JSONRT_TAG_DOUBLE = 5,
+    JSONRT_TAG_BOOL = 6,
+    JSONRT_TAG_BYTES = 7,
+    JSONRT_TAG_OBJECT = 8,
+    JSONRT_TAG_ARRAY = 9,
+};
+
+void jsonrt_put_header(jsonrt_buf* b);
+void jsonrt_put_string(jsonrt_buf* b, bool present, const char* s, size_t n);
+void jsonrt_put_bytes(jsonrt_buf* b, bool present, const uint8_t* data, size_t n);
+void jsonrt_put_int(jsonrt_buf* b, bool present, long long v);
+void jsonrt_put_uint(jsonrt_buf* b, bool present, unsigned long long v);
+void jsonrt_put_float(jsonrt_buf* b, bool present, float v);
+void jsonrt_put_double(jsonrt_buf* b, bool present, double v);
+void jsonrt_put_bool(jsonrt_buf* b, bool present, bool v);
+void jsonrt_put_object(jsonrt_buf* b, bool present, size_t fields);
+void jsonrt_put_array(jsonrt_buf* b, bool present, size_t len);
+
+// Counts of keys found by the speculative key-order check, and of keys that
+// needed full dispatch. They are per thread, so parsers loaded in-process may
+// run concurrently.
+extern _Thread_local unsigned long long jsonrt_key_order_hits;
+extern _Thread_local unsigned long long jsonrt_key_order_misses;
+void jsonrt_take_key_order_counts(unsigned long long* hits, unsigned long long* misses);
+
+// Parse errors. The entry points call jsonrt_begin with the document and its
+// length, which jsonrt_parse_end checks the root ends at, and a
+// parser that rejects it calls jsonrt_fail where it stopped, with a code and
+// a printf-style description of what it expected there; only the first
+// failure is kept. As the parsers return, each adds the value it was parsing
+// to the front of the error's path, with jsonrt_error_key or
+// jsonrt_error_index. jsonrt_take_error returns the error of the thread's
+// last document: 'J' 'E' and JSONRT_ERROR_VERSION, the code, the byte offset
+// as 8 big-endian bytes, then the description and the path, e.g.
+// "stops[1].zip", each a 4-byte length and the bytes. Free it with
+// free_serialized.
+#define JSONRT_ERROR_VERSION 1
+enum {
+    JSONRT_ERR_SYNTAX = 1,
+    JSONRT_ERR_TYPE = 2,
+    JSONRT_ERR_OVERFLOW = 3,
+    JSONRT_ERR_UNKNOWN_FIELD = 4,
+    JSONRT_ERR_MISSING_REQUIRED = 5,
+    JSONRT_ERR_MEMORY = 6,
+    JSONRT_ERR_NOT_ALLOWED = 7,
+};
+
+void jsonrt_begin(const char* input, size_t len);
+int jsonrt_fail(const char* at, int code, const char* expected, ...);
+void jsonrt_error_key(const char* key);
+void jsonrt_error_index(size_t i);
+char* jsonrt_take_error(size_t* len);
+
+// Map a file read-only, followed by a NUL byte, so a document of any size can
+// be parsed in place. The file must not shrink while it is mapped.
+const char* jsonrt_map_file(const char* path, size_t* size);
+void jsonrt_unmap_file(const char* data, size_t size);
+
+// Scanning. The value parsers below return 0 and advance *pp past the value,
+// or return -1 if it is malformed or out of range. None of them holds a
+// fixed-size buffer, so keys and values may be of any length. Numbers and
+// literals are read as RFC 8259 spells them.
+const char* jsonrt_skip_whitespace(const char* ptr);
+int jsonrt_next(const char** pp, char close);
+int jsonrt_parse_end(const char* ptr);
+void jsonrt_skip_value(const char** pp);
+int jsonrt_skip_valid_value(const char** pp, bool replace);
+int jsonrt_scan_key(const char** pp, bool replace, bool* decode);
+int jsonrt_decode_key(const char* key, bool replace, char** out, size_t* len);
+
+int jsonrt_parse_string(const char** pp, char** out, bool replace);
+int jsonrt_parse_inline_string(const char** pp, char* out, size_t max_len, bool truncate, bool replace);
+int jsonrt_parse_integer(const char** pp, long long min, long long max, long long* out);
+int jsonrt_parse_unsigned(const char** pp, unsigned long long max, unsigned long long* out);
+int jsonrt_parse_number(const char** pp, double* out);
+int jsonrt_parse_bool(const char** pp, bool* out);
+bool jsonrt_parse_null(const char** pp);
+int jsonrt_parse_bytes(const char** pp, uint8_t** out, size_t* out_len);
+
+// The length of the UTF-8 string s in characters, which maxLength bounds.
+size_t jsonrt_utf8_len(const char* s);
+
+// Grow the malloc'd array data, which holds len elements of size bytes, to
+// cap elements, the new ones zeroed. Returns the array, or NULL, leaving data
+// as it was, if there is not enough memory. Slices grow this way.
+void* jsonrt_grow(void* data, size_t len, size_t cap, size_t size);
+
+#endif // JSONRT_H
+`
+
+	// runtimeSource is jsonrt.c.
+	runtimeSource = `#include <ctype.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/mman.h>
+#include <sys/stat.h>
+#include <unistd.h>
+#include "jsonrt.h"
+
+_Thread_local unsigned long long jsonrt_key_order_hits = 0;
+_Thread_local unsigned long long jsonrt_key_order_misses = 0;
+
+// Return the key-order counts of this thread since the last call, and reset
+// them
+void jsonrt_take_key_order_counts(unsigned long long* hits, unsigned long long* misses) {
+    *hits = jsonrt_key_order_hits;
+    *misses = jsonrt_key_order_misses;
+    jsonrt_key_order_hits = 0;
+    jsonrt_key_order_misses = 0;
+}
+
+// Map the file at path, or return NULL. The file is mapped over an anonymous
+// mapping one byte longer, which supplies the terminating NUL even when the
+// file ends on a page boundary.
+const char* jsonrt_map_file(const char* path, size_t* size) {
+    int fd = open(path, O_RDONLY);
+    if (fd < 0) return NULL;
+    struct stat st;
+    if (fstat(fd, &st) != 0 || !S_ISREG(st.st_mode)) {
+        close(fd);
+        return NULL;
+    }
+    size_t n = (size_t)st.st_size;
+    char* data = (char*)mmap(NULL, n + 1, PROT_READ, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+    if (data == MAP_FAILED) {
+        close(fd);
+        return NULL;
+    }
+    if (n > 0 && mmap(data, n, PROT_READ, MAP_PRIVATE | MAP_FIXED, fd, 0) == MAP_FAILED) {
+        munmap(data, n + 1);
+        close(fd);
+        return NULL;
+    }
+    close(fd);
+    *size = n;
+    return data;
+}
+
+void jsonrt_unmap_file(const char* data, size_t size) {
+    munmap((void*)data, size + 1);
+}
+
+// Allocate the buffer to hold exactly cap bytes
+bool jsonrt_buf_alloc(jsonrt_buf* b, size_t cap) {
+    b->data = (char*)malloc(cap > 0 ? cap : 1);
+    b->cap = cap;
+    return b->data != NULL;
+}
+
+// Append n bytes to the buffer, or only count them when measuring
+void jsonrt_append(jsonrt_buf* b, const char* data, size_t n) {
+    if (b->failed) return;
+    if (n > (b->measure ? SIZE_MAX : b->cap) - b->len) {
+        b->failed = true;
+        return;
+    }
+    if (!b->measure) memcpy(b->data + b->len, data, n);
+    b->len += n;
+}
+
+// Free the serialized string after use
+void free_serialized(char* str) {
+    if (str != NULL) {
+        free(str);
+    }
+}
+
+// Append the n low bytes of v, most significant first
+static void put_be(jsonrt_buf* b, uint64_t v, int n) {
+    char bytes[8];
+    for (int i = 0; i < n; i++) bytes[i] = (char)(v >> (8 * (n - 1 - i)));
+    jsonrt_append(b, bytes, (size_t)n);
+}
+
+// Append a value's tag, marking it present if its key was in the input
+static void put_tag(jsonrt_buf* b, int tag, bool present) {
+    char t = (char)(present ? tag | JSONRT_PRESENT : tag);
+    jsonrt_append(b, &t, 1);
+}
+
+// Append a 4-byte length, failing the buffer if n does not fit
+static void put_len(jsonrt_buf* b, size_t n) {
+    if (n > UINT32_MAX) {
+        b->failed = true;
+        return;
+    }
+    put_be(b, n, 4);
+}
+
+void jsonrt_put_header(jsonrt_buf* b) {
+    char header[3] = {'J', 'R', JSONRT_RESULT_VERSION};
+    jsonrt_append(b, header, sizeof(header));
+}
+
+void jsonrt_put_string(jsonrt_buf* b, bool present, const char* s, size_t n) {
+    put_tag(b, JSONRT_TAG_STRING, present);
+    put_len(b, n);
+    if (n > 0) jsonrt_append(b, s, n);
+}
+
+void jsonrt_put_bytes(jsonrt_buf* b, bool present, const uint8_t* data, size_t n) {
+    put_tag(b, JSONRT_TAG_BYTES, present);
+    put_len(b, n);
+    if (n > 0) jsonrt_append(b, (const char*)data, n);
+}
+
+void jsonrt_put_int(jsonrt_buf* b, bool present, long long v) {
+    put_tag(b, JSONRT_TAG_INT, present);
+    put_be(b, (uint64_t)v, 8);
+}
+
+void jsonrt_put_uint(jsonrt_buf* b, bool present, unsigned long long v) {
+    put_tag(b, JSONRT_TAG_UINT, present);
+    put_be(b, (uint64_t)v, 8);
+}
+
+void jsonrt_put_float(jsonrt_buf* b, bool present, float v) {
+    uint32_t bits;
+    memcpy(&bits, &v, sizeof(bits));
+    put_tag(b, JSONRT_TAG_FLOAT, present);
+    put_be(b, bits, 4);
+}
+
+void jsonrt_put_double(jsonrt_buf* b, bool present, double v) {
+    uint64_t bits;
+    memcpy(&bits, &v, sizeof(bits));
+    put_tag(b, JSONRT_TAG_DOUBLE, present);
+    put_be(b, bits, 8);
+}
+
+void jsonrt_put_bool(jsonrt_buf* b, bool present, bool v) {
+    put_tag(b, JSONRT_TAG_BOOL, present);
+    put_be(b, v ? 1 : 0, 1);
+}
+
+void jsonrt_put_object(jsonrt_buf* b, bool present, size_t fields) {
+    put_tag(b, JSONRT_TAG_OBJECT, present);
+    put_len(b, fields);
+}
+
+void jsonrt_put_array(jsonrt_buf* b, bool present, size_t len) {
+    put_tag(b, JSONRT_TAG_ARRAY, present);
+    put_len(b, len);
+}
+
+// The error of the document this thread is parsing
+static _Thread_local struct {
+    const char* input;
+    const char* end;  // input + its length, where a NUL follows
+    int code;
+    size_t offset;
+    char* expected;
+    char* path;
+    size_t path_len;
+} error_state;
+
+// Start parsing the len bytes at input, dropping the error of the previous
+// document
+void jsonrt_begin(const char* input, size_t len) {
+    free(error_state.expected);
+    free(error_state.path);
+    memset(&error_state, 0, sizeof(error_state));
+    error_state.input = input;
+    error_state.end = input != NULL ? input + len : NULL;
+}
+
+// Record that the document was rejected at at, unless an error is already
+// recorded, and return -1
+int jsonrt_fail(const char* at, int code, const char* expected, ...) {
+    if (error_state.code != 0) return -1;
+    error_state.code = code;
+    error_state.offset = at != NULL && error_state.input != NULL ? (size_t)(at - error_state.input) : 0;
+    va_list args;
+    va_start(args, expected);
+    int n = vsnprintf(NULL, 0, expected, args);
+    va_end(args);
+    if (n >= 0 && (error_state.expected = (char*)malloc((size_t)n + 1)) != NULL) {
+        va_start(args, expected);
+        vsnprintf(error_state.expected, (size_t)n + 1, expected, args);
+        va_end(args);
+    }
+    return -1;
+}
+
+// Add n bytes to the front of the error's path
+static void prepend_path(const char* s, size_t n) {
+    char* path = (char*)realloc(error_state.path, error_state.path_len + n + 1);
+    if (path == NULL) return;
+    memmove(path + n, path, error_state.path_len);
+    memcpy(path, s, n);
+    error_state.path = path;
+    error_state.path_len += n;
+    path[error_state.path_len] = '\0';
+}
+
+void jsonrt_error_key(const char* key) {
+    if (error_state.path_len > 0 && error_state.path[0] != '[') prepend_path(".", 1);
+    prepend_path(key, strlen(key));
+}
+
+void jsonrt_error_index(size_t i) {
+    char digits[24];  // Enough for any 64-bit value, brackets and NUL
+    int n = snprintf(digits, sizeof(digits), "[%zu]", i);
+    if (error_state.path_len > 0 && error_state.path[0] != '[') prepend_path(".", 1);
+    prepend_path(digits, (size_t)n);
+}
+
+static void encode_error(jsonrt_buf* b) {
+    char header[4] = {'J', 'E', JSONRT_ERROR_VERSION, (char)error_state.code};
+    jsonrt_append(b, header, sizeof(header));
+    put_be(b, error_state.offset, 8);
+    const char* expected = error_state.expected != NULL ? error_state.expected : "";
+    put_len(b, strlen(expected));
+    jsonrt_append(b, expected, strlen(expected));
+    put_len(b, error_state.path_len);
+    if (error_state.path_len > 0) jsonrt_append(b, error_state.path, error_state.path_len);
+}
+
+// Return the encoded error of the last document, or NULL if it cannot be
+// allocated
+char* jsonrt_take_error(size_t* len) {
+    jsonrt_buf size = {0};
+    size.measure = true;
+    encode_error(&size);
+    jsonrt_buf b = {0};
+    *len = 0;
+    if (!jsonrt_buf_alloc(&b, size.len)) return NULL;
+    encode_error(&b);
+    jsonrt_begin(NULL, 0);
+    *len = b.len;
+    return b.data;
+}
+
+// Return the first non-whitespace character at or after ptr
+const char* jsonrt_skip_whitespace(const char* ptr) {
+    while (*ptr == ' ' || *ptr == '\n' || *ptr == '\t' || *ptr == '\r') ptr++;
+    return ptr;
+}
+
+// Skip the whitespace after a member or element, then the ',' separating it
+// from the next one and the whitespace after that. Returns 1 if another
+// follows, 0 with *pp at close if its container ends, or -1 if neither does.
+int jsonrt_next(const char** pp, char close) {
+    const char* ptr = jsonrt_skip_whitespace(*pp);
+    if (*ptr == close) {
+        *pp = ptr;
+        return 0;
+    }
+    if (*ptr != ',') return jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "',' or '%c'", close);
+    *pp = jsonrt_skip_whitespace(ptr + 1);
+    return 1;
+}
+
+// Check that nothing but whitespace follows the root object, which ends at
+// ptr, up to the end of the input. A NUL byte before the end is not its end.
+int jsonrt_parse_end(const char* ptr) {
+    ptr = jsonrt_skip_whitespace(ptr);
+    if (ptr != error_state.end) return jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "end of input");
+    return 0;
+}
+
+// Skip the value of an unknown field, stopping at the ',' or closing bracket
+// that follows it. Brackets inside strings are not counted, and nothing else
+// is checked; jsonrt_skip_valid_value checks the value's grammar.
+void jsonrt_skip_value(const char** pp) {
+    const char* ptr = *pp;
+    size_t depth = 0;
+    bool in_string = false;
+    while (*ptr != '\0') {
+        if (in_string) {
+            if (*ptr == '\\' && ptr[1] != '\0') ptr++;  // Skip the escaped character
+            else if (*ptr == '"') in_string = false;
+        } else {
+            if (*ptr == '"') in_string = true;
+            if (*ptr == '{' || *ptr == '[') depth++;
+            if (*ptr == '}' || *ptr == ']') {
+                if (depth == 0) break;
+                depth--;
+            }
+            if (*ptr == ',' && depth == 0) break;
+        }
+        ptr++;
+    }
+    *pp = ptr;
+}
+
+// Shrink a truncated length so it does not end inside a UTF-8 sequence
+static size_t utf8_boundary(const char* s, size_t len) {
+    size_t start = len;
+    while (start > 0 && ((unsigned char)s[start - 1] & 0xC0) == 0x80) start--;
+    if (start == 0) return len;
+    unsigned char lead = (unsigned char)s[start - 1];
+    size_t need = lead >= 0xF0 ? 4 : lead >= 0xE0 ? 3 : lead >= 0xC0 ? 2 : 1;
+    return (len - (start - 1) < need) ? start - 1 : len;
+}
+
+// Map a base64 character to its 6-bit value. alphabet records whether the
+// standard (+/) or URL-safe (-_) alphabet is in use so the two cannot be mixed.
+static int base64_value(char c, int* alphabet) {
+    if (c >= 'A' && c <= 'Z') return c - 'A';
+    if (c >= 'a' && c <= 'z') return c - 'a' + 26;
+    if (c >= '0' && c <= '9') return c - '0' + 52;
+    if (c == '+' || c == '/') {
+        if (*alphabet == 2) return -1;
+        *alphabet = 1;
+        return c == '+' ? 62 : 63;
+    }
+    if (c == '-' || c == '_') {
+        if (*alphabet == 1) return -1;
+        *alphabet = 2;
+        return c == '-' ? 62 : 63;
+    }
+    return -1;
+}
+
+// Decode standard or URL-safe base64 (padding optional) into a malloc'd buffer.
+// The input is the raw contents of a JSON string, so "\/" is accepted as '/'.
+static int base64_decode(const char* src, size_t len, uint8_t** out, size_t* out_len) {
+    uint8_t* buf = (uint8_t*)malloc(len / 4 * 3 + 3);
+    if (buf == NULL) return -1;
+
+    int alphabet = 0;
+    uint32_t acc = 0;
+    size_t n = 0, chars = 0, pad = 0;
+    for (size_t i = 0; i < len; i++) {
+        char c = src[i];
+        if (c == '\\' && i + 1 < len && src[i + 1] == '/') {
+            c = '/';
+            i++;
+        }
+        if (c == '=') {
+            pad++;
+            continue;
+        }
+        int v = base64_value(c, &alphabet);
+        if (v < 0 || pad > 0) goto fail;  // Invalid character or data after padding
+        acc = (acc << 6) | (uint32_t)v;
+        chars++;
+        if (chars % 4 == 0) {
+            buf[n++] = (uint8_t)(acc >> 16);
+            buf[n++] = (uint8_t)(acc >> 8);
+            buf[n++] = (uint8_t)acc;
+            acc = 0;
+        }
+    }
+
+    // Flush the final partial quantum; padding, if present, must complete it
+    switch (chars % 4) {
+    case 0:
+        if (pad != 0) goto fail;
+        break;
+    case 1:
+        goto fail;
+    case 2:
+        if (pad != 0 && pad != 2) goto fail;
+        buf[n++] = (uint8_t)(acc >> 4);
+        break;
+    case 3:
+        if (pad != 0 && pad != 1) goto fail;
+        buf[n++] = (uint8_t)(acc >> 10);
+        buf[n++] = (uint8_t)(acc >> 2);
+        break;
+    }
+
+    *out = buf;
+    *out_len = n;
+    return 0;
+
+fail:
+    free(buf);
+    return -1;
+}
+
+// Append the UTF-8 encoding of the code point c to the n bytes of out, which
+// holds cap, and return the new length
+static size_t put_utf8(char* out, size_t n, size_t cap, uint32_t c) {
+    unsigned char b[4];
+    size_t len;
+    if (c < 0x80) {
+        b[0] = (unsigned char)c;
+        len = 1;
+    } else if (c < 0x800) {
+        b[0] = (unsigned char)(0xC0 | (c >> 6));
+        b[1] = (unsigned char)(0x80 | (c & 0x3F));
+        len = 2;
+    } else if (c < 0x10000) {
+        b[0] = (unsigned char)(0xE0 | (c >> 12));
+        b[1] = (unsigned char)(0x80 | ((c >> 6) & 0x3F));
+        b[2] = (unsigned char)(0x80 | (c & 0x3F));
+        len = 3;
+    } else {
+        b[0] = (unsigned char)(0xF0 | (c >> 18));
+        b[1] = (unsigned char)(0x80 | ((c >> 12) & 0x3F));
+        b[2] = (unsigned char)(0x80 | ((c >> 6) & 0x3F));
+        b[3] = (unsigned char)(0x80 | (c & 0x3F));
+        len = 4;
+    }
+    for (size_t i = 0; i < len; i++) {
+        if (n + i < cap) out[n + i] = (char)b[i];
+    }
+    return n + len;
+}
+
+// Read the 4 hex digits of a \u escape at ptr, or return -1. It stops at the
+// first other character, so it never reads past the end of the input.
+static long hex4(const char* ptr) {
+    long v = 0;
+    for (int i = 0; i < 4; i++) {
+        char c = ptr[i];
+        int d;
+        if (c >= '0' && c <= '9') d = c - '0';
+        else if (c >= 'a' && c <= 'f') d = c - 'a' + 10;
+        else if (c >= 'A' && c <= 'F') d = c - 'A' + 10;
+        else return -1;
+        v = v * 16 + d;
+    }
+    return v;
+}
+
+// Return the length of the well-formed UTF-8 sequence at s, or 0 if it is
+// not one: overlong forms, surrogates and code points past U+10FFFF are not
+static size_t utf8_sequence(const unsigned char* s) {
+    unsigned char lo = 0x80, hi = 0xBF;
+    size_t n;
+    if (s[0] < 0x80) return 1;
+    if (s[0] >= 0xC2 && s[0] <= 0xDF) {
+        n = 2;
+    } else if (s[0] >= 0xE0 && s[0] <= 0xEF) {
+        n = 3;
+        if (s[0] == 0xE0) lo = 0xA0;
+        if (s[0] == 0xED) hi = 0x9F;
+    } else if (s[0] >= 0xF0 && s[0] <= 0xF4) {
+        n = 4;
+        if (s[0] == 0xF0) lo = 0x90;
+        if (s[0] == 0xF4) hi = 0x8F;
+    } else {
+        return 0;
+    }
+    if (s[1] < lo || s[1] > hi) return 0;
+    for (size_t i = 2; i < n; i++) {
+        if ((s[i] & 0xC0) != 0x80) return 0;
+    }
+    return n;
+}
+
+// Scan the string at ptr, which is past its opening quote, up to its closing
+// quote, decoding its escapes, surrogate pairs included, and writing the
+// first cap bytes of its UTF-8 value to out. Returns the closing quote, with
+// the length of the whole value in *len. Raw control characters, unknown
+// escapes, invalid UTF-8 and unpaired surrogates are rejected, returning NULL;
+// with replace, the last two become U+FFFD, as encoding/json decodes them.
+static const char* scan_string(const char* ptr, char* out, size_t cap, size_t* len, bool replace) {
+    size_t n = 0;
+    for (;;) {
+        unsigned char c = (unsigned char)*ptr;
+        if (c == '"') break;
+        if (c == '\0') {
+            jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "'\"'");
+            return NULL;
+        }
+        if (c < 0x20) {
+            jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "an escape sequence for control character 0x%02x", c);
+            return NULL;
+        }
+        if (c != '\\') {
+            size_t seq = utf8_sequence((const unsigned char*)ptr);
+            if (seq == 0) {
+                if (!replace) {
+                    jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "valid UTF-8");
+                    return NULL;
+                }
+                n = put_utf8(out, n, cap, 0xFFFD);
+                ptr++;
+                continue;
+            }
+            for (size_t i = 0; i < seq; i++, n++) {
+                if (n < cap) out[n] = ptr[i];
+            }
+            ptr += seq;
+            continue;
+        }
+
+        uint32_t code;
+        switch (ptr[1]) {
+        case '"': case '\\': case '/': code = (uint32_t)ptr[1]; break;
+        case 'b': code = '\b'; break;
+        case 'f': code = '\f'; break;
+        case 'n': code = '\n'; break;
+        case 'r': code = '\r'; break;
+        case 't': code = '\t'; break;
+        case 'u': {
+            long unit = hex4(ptr + 2);
+            if (unit < 0) {
+                jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "4 hex digits after \\u");
+                return NULL;
+            }
+            code = (uint32_t)unit;
+            if (unit >= 0xD800 && unit <= 0xDFFF) {
+                long low = unit <= 0xDBFF && ptr[6] == '\\' && ptr[7] == 'u' ? hex4(ptr + 8) : -1;
+                if (low >= 0xDC00 && low <= 0xDFFF) {
+                    code = 0x10000 + (((uint32_t)unit - 0xD800) << 10) + ((uint32_t)low - 0xDC00);
+                    ptr += 6;
+                } else if (replace) {
+                    code = 0xFFFD;
+                } else {
+                    jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "a surrogate pair");
+                    return NULL;
+                }
+            }
+            ptr += 4;
+            break;
+        }
+        default:
+            jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "an escape sequence");
+            return NULL;
+        }
+        n = put_utf8(out, n, cap, code);
+        ptr += 2;
+    }
+    *len = n;
+    return ptr;
+}
+
+// Check that a value scan_string decoded into out holds no NUL, which would
+// end it early as a C string
+static int check_nul(const char* at, const char* out, size_t len) {
+    if (memchr(out, '\0', len) != NULL) return jsonrt_fail(at, JSONRT_ERR_TYPE, "a string without \\u0000");
+    return 0;
+}
+
+// Parse a JSON string into a malloc'd value of exactly its length
+int jsonrt_parse_string(const char** pp, char** out, bool replace) {
+    const char* ptr = *pp;
+    if (*ptr != '"') return jsonrt_fail(ptr, JSONRT_ERR_TYPE, "a string");
+    ptr++;
+    size_t len;
+    const char* end = scan_string(ptr, NULL, 0, &len, replace);
+    if (end == NULL) return -1;
+    char* value = (char*)malloc(len + 1);
+    if (value == NULL) return jsonrt_fail(*pp, JSONRT_ERR_MEMORY, "memory for a string of %zu bytes", len);
+    scan_string(ptr, value, len, &len, replace);
+    value[len] = '\0';
+    if (check_nul(*pp, value, len) != 0) {
+        free(value);
+        return -1;
+    }
+    *out = value;
+    *pp = end + 1;
+    return 0;
+}
+
+// Parse a JSON string into a char[max_len + 1] buffer. Longer values are
+// rejected, or cut at a UTF-8 boundary when truncate is set.
+int jsonrt_parse_inline_string(const char** pp, char* out, size_t max_len, bool truncate, bool replace) {
+    const char* ptr = *pp;
+    if (*ptr != '"') return jsonrt_fail(ptr, JSONRT_ERR_TYPE, "a string");
+    size_t len;
+    const char* end = scan_string(ptr + 1, out, max_len, &len, replace);
+    if (end == NULL) return -1;
+    if (len > max_len) {
+        if (!truncate) return jsonrt_fail(ptr, JSONRT_ERR_OVERFLOW, "a string of at most %zu bytes", max_len);
+        len = utf8_boundary(out, max_len);
+    }
+    if (check_nul(ptr, out, len) != 0) return -1;
+    out[len] = '\0';
+    *pp = end + 1;
+    return 0;
+}
+
+// Find the closing quote of the key at *pp, which is past its opening quote,
+// checking the key as scan_string does. Plain ASCII keys are matched where
+// they are; *decode is set for any other key, which jsonrt_decode_key must
+// decode before it is matched.
+int jsonrt_scan_key(const char** pp, bool replace, bool* decode) {
+    const char* ptr = *pp;
+    while ((unsigned char)*ptr >= 0x20 && (unsigned char)*ptr < 0x80 && *ptr != '"' && *ptr != '\\') ptr++;
+    *decode = *ptr != '"';
+    if (*decode) {
+        size_t len;
+        if ((ptr = scan_string(*pp, NULL, 0, &len, replace)) == NULL) return -1;
+    }
+    *pp = ptr;
+    return 0;
+}
+
+// Decode the key at key, which is past its opening quote, into a malloc'd
+// buffer, with its length in *len
+int jsonrt_decode_key(const char* key, bool replace, char** out, size_t* len) {
+    if (scan_string(key, NULL, 0, len, replace) == NULL) return -1;
+    char* name = (char*)malloc(*len + 1);
+    if (name == NULL) return jsonrt_fail(key, JSONRT_ERR_MEMORY, "memory for a key of %zu bytes", *len);
+    scan_string(key, name, *len, len, replace);
+    *out = name;
+    return 0;
+}
+
+// Return the end of the number at ptr, as RFC 8259 spells numbers: no leading
+// zeros or '+', and digits on both sides of a '.'. Returns NULL if there is
+// no such number.
+static const char* number_end(const char* ptr) {
+    if (*ptr == '-') ptr++;
+    if (*ptr == '0') {
+        ptr++;
+    } else if (*ptr >= '1' && *ptr <= '9') {
+        while (*ptr >= '0' && *ptr <= '9') ptr++;
+    } else {
+        return NULL;
+    }
+    if (*ptr == '.') {
+        ptr++;
+        if (*ptr < '0' || *ptr > '9') return NULL;
+        while (*ptr >= '0' && *ptr <= '9') ptr++;
+    }
+    if (*ptr == 'e' || *ptr == 'E') {
+        ptr++;
+        if (*ptr == '+' || *ptr == '-') ptr++;
+        if (*ptr < '0' || *ptr > '9') return NULL;
+        while (*ptr >= '0' && *ptr <= '9') ptr++;
+    }
+    return ptr;
+}
+
+// Check for the literal word at ptr, which must not run on into a longer word
+static bool literal(const char* ptr, const char* word) {
+    size_t n = strlen(word);
+    return strncmp(ptr, word, n) == 0 && !isalnum((unsigned char)ptr[n]) && ptr[n] != '_';
+}
+
+// Check that an integer ends where strtoll or strtoull stopped, rather than
+// going on with a fraction or exponent
+static bool integer_ends(const char* end) {
+    return *end != '.' && *end != 'e' && *end != 'E';
+}
+
+// Parse a JSON integer within [min, max]
+int jsonrt_parse_integer(const char** pp, long long min, long long max, long long* out) {
+    const char* ptr = *pp;
+    if (*ptr == '-') ptr++;
+    if (*ptr < '0' || *ptr > '9') return jsonrt_fail(*pp, JSONRT_ERR_TYPE, "an integer");
+    char* end;
+    errno = 0;
+    long long number = strtoll(*pp, &end, 10);
+    if (!integer_ends(end)) return jsonrt_fail(*pp, JSONRT_ERR_TYPE, "an integer");
+    if (number_end(*pp) != end) return jsonrt_fail(*pp, JSONRT_ERR_SYNTAX, "an integer without leading zeros");
+    if (errno == ERANGE || number < min || number > max) {
+        return jsonrt_fail(*pp, JSONRT_ERR_OVERFLOW, "an integer from %lld to %lld", min, max);
+    }
+    *out = number;
+    *pp = end;
+    return 0;
+}
+
+// Parse a non-negative JSON integer no greater than max
+int jsonrt_parse_unsigned(const char** pp, unsigned long long max, unsigned long long* out) {
+    const char* ptr = *pp;
+    if (*ptr == '-' && ptr[1] >= '0' && ptr[1] <= '9') {
+        return jsonrt_fail(ptr, JSONRT_ERR_OVERFLOW, "an integer from 0 to %llu", max);
+    }
+    if (*ptr < '0' || *ptr > '9') return jsonrt_fail(ptr, JSONRT_ERR_TYPE, "an integer");
+    char* end;
+    errno = 0;
+    unsigned long long number = strtoull(ptr, &end, 10);
+    if (!integer_ends(end)) return jsonrt_fail(ptr, JSONRT_ERR_TYPE, "an integer");
+    if (number_end(ptr) != end) return jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "an integer without leading zeros");
+    if (errno == ERANGE || number > max) {
+        return jsonrt_fail(ptr, JSONRT_ERR_OVERFLOW, "an integer from 0 to %llu", max);
+    }
+    *out = number;
+    *pp = end;
+    return 0;
+}
+
+// Parse a JSON number
+int jsonrt_parse_number(const char** pp, double* out) {
+    const char* ptr = *pp;
+    if (*ptr == '-') ptr++;
+    if (*ptr < '0' || *ptr > '9') return jsonrt_fail(*pp, JSONRT_ERR_TYPE, "a number");
+    if (ptr[0] == '0' && (ptr[1] == 'x' || ptr[1] == 'X')) {
+        return jsonrt_fail(*pp, JSONRT_ERR_SYNTAX, "a decimal number");  // strtod would read hex
+    }
+    char* end;
+    errno = 0;
+    double number = strtod(*pp, &end);
+    if (number_end(*pp) != end) return jsonrt_fail(*pp, JSONRT_ERR_SYNTAX, "a JSON number");
+    if (errno == ERANGE && (number > 1 || number < -1)) return jsonrt_fail(*pp, JSONRT_ERR_OVERFLOW, "a finite number");
+    *out = number;
+    *pp = end;
+    return 0;
+}
+
+int jsonrt_parse_bool(const char** pp, bool* out) {
+    if (literal(*pp, "true")) {
+        *out = true;
+        *pp += 4;
+    } else if (literal(*pp, "false")) {
+        *out = false;
+        *pp += 5;
+    } else {
+        return jsonrt_fail(*pp, JSONRT_ERR_TYPE, "true or false");
+    }
+    return 0;
+}
+
+// Skip the null at *pp and return true, or return false if there is none
+bool jsonrt_parse_null(const char** pp) {
+    if (!literal(*pp, "null")) return false;
+    *pp += 4;
+    return true;
+}
+
+size_t jsonrt_utf8_len(const char* s) {
+    size_t n = 0;
+    for (; *s != '\0'; s++) {
+        if (((unsigned char)*s & 0xC0) != 0x80) n++; // Not a continuation byte
+    }
+    return n;
+}
+
+void* jsonrt_grow(void* data, size_t len, size_t cap, size_t size) {
+    if (cap > SIZE_MAX / size) return NULL;
+    char* grown = (char*)realloc(data, cap * size);
+    if (grown == NULL) return NULL;
+    memset(grown + len * size, 0, (cap - len) * size);
+    return grown;
+}
+
+// Parse a base64 JSON string, or null, into a malloc'd buffer
+int jsonrt_parse_bytes(const char** pp, uint8_t** out, size_t* out_len) {
+    const char* ptr = *pp;
+    if (literal(ptr, "null")) {
+        *pp = ptr + 4;
+        return 0;
+    }
+    if (*ptr != '"') return jsonrt_fail(ptr, JSONRT_ERR_TYPE, "a base64 string");
+    ptr++;
+    const char* start = ptr;
+    while (*ptr != '\0' && *ptr != '"') ptr++;
+    if (*ptr != '"') return jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "'\"'");
+    if (base64_decode(start, (size_t)(ptr - start), out, out_len) != 0) {
+        return jsonrt_fail(*pp, JSONRT_ERR_TYPE, "a base64 string");
+    }
+    *pp = ptr + 1;
+    return 0;
+}
+
+// Skip a key, the ':' after it and the whitespace around them, returning the
+// value that follows, or NULL if there is no key
+static const char* skip_key(const char* ptr, bool replace) {
+    if (*ptr != '"') {
+        jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "a key");
+        return NULL;
+    }
+    size_t len;
+    const char* end = scan_string(ptr + 1, NULL, 0, &len, replace);
+    if (end == NULL) return NULL;
+    ptr = jsonrt_skip_whitespace(end + 1);
+    if (*ptr != ':') {
+        jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "':'");
+        return NULL;
+    }
+    return jsonrt_skip_whitespace(ptr + 1);
+}
+
+// Skip the value of an unknown field as jsonrt_skip_value does, checking that
+// it is well-formed. The closing brackets of the containers it is inside are
+// kept on a stack on the heap, so its depth is bounded by memory alone.
+int jsonrt_skip_valid_value(const char** pp, bool replace) {
+    const char* ptr = *pp;
+    char* close = NULL;
+    size_t depth = 0, cap = 0;
+    int result = -1;
+    for (;;) {
+        if (*ptr == '{' || *ptr == '[') {
+            if (depth == cap) {
+                size_t grown = cap == 0 ? 64 : cap * 2;
+                char* stack = (char*)realloc(close, grown);
+                if (stack == NULL) {
+                    jsonrt_fail(ptr, JSONRT_ERR_MEMORY, "memory for %zu nested values", grown);
+                    goto done;
+                }
+                close = stack;
+                cap = grown;
+            }
+            close[depth++] = *ptr == '{' ? '}' : ']';
+            ptr = jsonrt_skip_whitespace(ptr + 1);
+            if (*ptr != close[depth - 1]) {
+                // The first member or element
+                if (close[depth - 1] == '}' && (ptr = skip_key(ptr, replace)) == NULL) goto done;
+                continue;
+            }
+            depth--;
+            ptr++;
+        } else if (*ptr == '"') {
+            size_t len;
+            const char* end = scan_string(ptr + 1, NULL, 0, &len, replace);
+            if (end == NULL) goto done;
+            ptr = end + 1;
+        } else if (*ptr == '-' || (*ptr >= '0' && *ptr <= '9')) {
+            const char* end = number_end(ptr);
+            if (end == NULL) {
+                jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "a JSON number");
+                goto done;
+            }
+            ptr = end;
+        } else if (literal(ptr, "true") || literal(ptr, "null")) {
+            ptr += 4;
+        } else if (literal(ptr, "false")) {
+            ptr += 5;
+        } else {
+            jsonrt_fail(ptr, JSONRT_ERR_SYNTAX, "a value");
+            goto done;
+        }
+
+        // Close the containers the value ends, up to one with another member
+        // or element
+        for (;;) {
+            if (depth == 0) {
+                result = 0;
+                goto done;
+            }
+            int more = jsonrt_next(&ptr, close[depth - 1]);
+            if (more < 0) goto done;
+            if (more == 1) break;
+            depth--;
+            ptr++;
+        }
+        if (close[depth - 1] == '}' && (ptr = skip_key(ptr, replace)) == NULL) goto done;
+    }
+
+done:
+    free(close);
+    if (result == 0) *pp = ptr;
+    return result;
+}
+`
+)
+
+// workerSource is the framed protocol a module's executable serves with
+// --worker, reading requests until stdin is closed. A request is a kind byte,
+// 'd' for a document sent inline and 'f' for the path of a file to map, then
+// a type name and the document or path, each a 4-byte big-endian length
+// followed by the bytes. A response is a status byte (0 parsed, 1 rejected, 2
+// unknown type, 3 unreadable file), the key-order hits and misses as 8-byte
+// big-endian counts, and the result, or the error of a rejected document, as
+// a 4-byte length and the bytes.
+const workerSource = `// Read n bytes from stdin, or return 0 at the end of input
+static int read_full(void* buf, size_t n) {
+    return fread(buf, 1, n, stdin) == n;
+}
+
+static int read_u32(uint32_t* v) {
+    unsigned char b[4];
+    if (!read_full(b, 4)) return 0;
+    *v = ((uint32_t)b[0] << 24) | ((uint32_t)b[1] << 16) | ((uint32_t)b[2] << 8) | (uint32_t)b[3];
+    return 1;
+}
+
+// Read a length-prefixed field into a malloc'd, NUL-terminated buffer, with
+// its length in *n
+static char* read_field(size_t* n) {
+    uint32_t len;
+    if (!read_u32(&len)) return NULL;
+    char* buf = (char*)malloc((size_t)len + 1);
+    if (buf == NULL) return NULL;
+    if (!read_full(buf, len)) {
+        free(buf);
+        return NULL;
+    }
+    buf[len] = '\0';
+    *n = len;
+    return buf;
+}
+
+static void write_be(uint64_t v, int n) {
+    unsigned char b[8];
+    for (int i = 0; i < n; i++) b[i] = (unsigned char)(v >> (8 * (n - 1 - i)));
+    fwrite(b, 1, (size_t)n, stdout);
+}
+
+// Serve framed requests until stdin is closed
+static int serve(void) {
+    for (;;) {
+        char kind;
+        if (!read_full(&kind, 1)) return 0;
+        size_t name_len = 0, field_len = 0;
+        char* name = read_field(&name_len);
+        char* field = name == NULL ? NULL : read_field(&field_len);
+        if (field == NULL || (kind != 'd' && kind != 'f')) {
+            free(name);
+            free(field);
+            return 1;
+        }
+        int status = 0;
+        int index = find_parser(name);
+        size_t len = 0, size = field_len;
+        const char* doc = kind == 'f' ? jsonrt_map_file(field, &size) : field;
+        char* result = NULL;
+        if (index < 0) {
+            status = 2;
+        } else if (doc == NULL) {
+            status = 3;
+        } else {
+            result = parsers[index].parse(doc, size, &len);
+            if (result == NULL) {
+                status = 1;
+                result = jsonrt_take_error(&len);
+            }
+        }
+        if (kind == 'f' && doc != NULL) jsonrt_unmap_file(doc, size);
+        unsigned long long hits, misses;
+        jsonrt_take_key_order_counts(&hits, &misses);
+        fputc(status, stdout);
+        write_be(hits, 8);
+        write_be(misses, 8);
+        write_be(len, 4);
+        if (result != NULL) fwrite(result, 1, len, stdout);
+        fflush(stdout);
+        free_serialized(result);
+        free(name);
+        free(field);
+    }
+}`
+
+// readStdinSource reads the document of a module's one-shot mode from stdin,
+// when its argument is "-", as documents of any size cannot be passed in argv.
+const readStdinSource = `// Read all of stdin into a malloc'd, NUL-terminated buffer, with its length
+// in *size, or return NULL
+static char* read_stdin(size_t* size) {
+    size_t len = 0, cap = 65536;
+    char* buf = (char*)malloc(cap);
+    if (buf == NULL) return NULL;
+    for (;;) {
+        len += fread(buf + len, 1, cap - len - 1, stdin);
+        if (len < cap - 1) break;
+        char* grown = (char*)realloc(buf, cap * 2);
+        if (grown == NULL) {
+            free(buf);
+            return NULL;
+        }
+        buf = grown;
+        cap *= 2;
+    }
+    if (ferror(stdin)) {
+        free(buf);
+        return NULL;
+    }
+    buf[len] = '\0';
+    *size = len;
+    return buf;
+}`
+
+// printErrorSource reports why a module's one-shot mode rejected its
+// document, decoding the error jsonrt_take_error returns.
+const printErrorSource = `// Print the error of the rejected document to stderr
+static void print_error(void) {
+    static const char* const kinds[] = {"", "syntax error", "type error", "value out of range",
+                                        "unknown field", "missing required field", "out of memory"};
+    size_t len = 0;
+    unsigned char* err = (unsigned char*)jsonrt_take_error(&len);
+    if (err == NULL || len < 16) {
+        fprintf(stderr, "Failed to parse JSON\n");
+        free_serialized((char*)err);
+        return;
+    }
+    unsigned long long offset = 0;
+    for (int i = 4; i < 12; i++) offset = (offset << 8) | err[i];
+    const unsigned char* expected = err + 16;
+    uint32_t expected_len = ((uint32_t)err[12] << 24) | ((uint32_t)err[13] << 16) | ((uint32_t)err[14] << 8) | err[15];
+    const unsigned char* path = expected + expected_len + 4;
+    uint32_t path_len = ((uint32_t)path[-4] << 24) | ((uint32_t)path[-3] << 16) | ((uint32_t)path[-2] << 8) | path[-1];
+    fprintf(stderr, "Failed to parse JSON: %s at byte %llu", err[3] < 7 ? kinds[err[3]] : "error", offset);
+    if (path_len > 0) fprintf(stderr, " in %.*s", (int)path_len, (const char*)path);
+    fprintf(stderr, ": expected %.*s\n", (int)expected_len, (const char*)expected);
+    free_serialized((char*)err);
+}`
+
+// runtimeMu serializes writing and compiling the runtime, which parsers built
+// into the same directory share. Other processes may share the directory, so
+// files are written and compiled under temporary names and renamed into
+// place.
+var runtimeMu sync.Mutex
+
+// writeRuntime writes jsonrt.h and jsonrt.c to outputDir, leaving files that
+// already hold the same source untouched so their object stays current.
+func writeRuntime(outputDir string) error {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	return writeRuntimeLocked(outputDir)
+}
+
+func writeRuntimeLocked(outputDir string) error {
+	for ext, source := range map[string]string{".h": runtimeHeader, ".c": runtimeSource} {
+		path := filepath.Join(outputDir, runtimeName+ext)
+		if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, []byte(source)) {
+			continue
+		}
+		if err := replaceFile(path, func(tmp string) error { return os.WriteFile(tmp, []byte(source), 0644) }); err != nil {
+			return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// replaceFile has write create a file at a temporary path next to path, and
+// renames it to path once it has. The file is made readable by everyone, as
+// the temporary file is created private.
+func replaceFile(path string, write func(tmp string) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	tmp := f.Name()
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// runtimeHash identifies the runtime source, so an object compiled from an
+// older runtime is never linked with parsers generated for a newer one.
+func runtimeHash() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s", runtimeHeader, runtimeSource)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// runtimeObject is a compiled runtime, which the builds of this process that
+// link it share. It is removed once none of them holds it.
+type runtimeObject struct {
+	key  string
+	path string
+	refs int // Guarded by runtimeMu
+}
+
+// runtimeObjects are the runtime objects in use, by output directory,
+// fingerprint and runtime hash
+var runtimeObjects = make(map[string]*runtimeObject)
+
+// buildRuntime compiles the runtime written to sourceDir into b's output
+// directory, position-independent so both executables and shared libraries
+// can link it, unless a build of this process holds one compiled from the
+// same runtime source with the same toolchain, flags and environment, and
+// returns it held. Each process compiles objects of its own, named
+// jsonrt_<fingerprint>_<runtime hash>_<random>.o, so one never removes an
+// object another is about to link.
+func buildRuntime(b *buildConfig, sourceDir string) (*runtimeObject, error) {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	if err := writeRuntimeLocked(sourceDir); err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("%s_%s_%s_", runtimeName, b.fingerprint(), runtimeHash())
+	key := filepath.Join(b.outputDir, prefix)
+	if object, ok := runtimeObjects[key]; ok {
+		object.refs++
+		return object, nil
+	}
+	f, err := os.CreateTemp(b.outputDir, prefix+"*.o")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create runtime object: %v", err)
+	}
+	f.Close()
+	source := filepath.Join(sourceDir, runtimeName+".c")
+	if err := b.compile(f.Name(), source); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("runtime %v", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	object := &runtimeObject{key: key, path: f.Name(), refs: 1}
+	runtimeObjects[key] = object
+	return object, nil
+}
+
+// release drops a build's hold on the object, and removes it with the last.
+func (o *runtimeObject) release() {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	if o.refs--; o.refs > 0 {
+		return
+	}
+	delete(runtimeObjects, o.key)
+	os.Remove(o.path)
+}
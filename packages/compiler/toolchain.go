@@ -0,0 +1,230 @@
+package compiler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Options configures how a parser is built. The zero value builds with the
+// compiler $CC names, or the first of gcc, clang and cc found, at -O2, in the
+// user's cache directory.
+type Options struct {
+	// CC is the C compiler, e.g. "gcc", "clang" or a path. Empty uses $CC,
+	// then the first of gcc, clang and cc on the PATH.
+	CC string
+	// CFlags are passed to every compile after the flags below, and LDFlags
+	// to every link after the objects, so they may name libraries. Both are
+	// appended to the words of $CFLAGS and $LDFLAGS.
+	CFlags  []string
+	LDFlags []string
+	// OptLevel is the -O level: "0", "1", "2", "3", "s", "z", "g" or "fast".
+	// Empty means "2", or "0" when Debug is set.
+	OptLevel string
+	// March is passed as -march, e.g. "native"; empty leaves it out.
+	March string
+	// Debug compiles with debug symbols (-g).
+	Debug bool
+	// KeepArtifacts leaves the generated sources, objects and binaries of
+	// the build, in the directory Dir reports, and the runtime object it
+	// links, when the parser is closed.
+	KeepArtifacts bool
+	// OutputDir holds a directory of its own for each build, and the
+	// runtime objects the builds of a process share, each removed with the
+	// last build that links it. Empty means jsonparser in the user's cache
+	// directory, or in the temporary directory if there is none. A relative
+	// path is resolved when the parser is built.
+	OutputDir string
+	// Env holds "KEY=value" entries added to the compiler's environment. CC,
+	// CFLAGS and LDFLAGS set here take precedence over the process's.
+	Env []string
+}
+
+// optLevels are the values Options.OptLevel accepts.
+var optLevels = map[string]bool{"0": true, "1": true, "2": true, "3": true, "s": true, "z": true, "g": true, "fast": true}
+
+// defaultCompilers are tried in order when neither Options.CC nor $CC names
+// a compiler.
+var defaultCompilers = []string{"gcc", "clang", "cc"}
+
+// Toolchain describes the C compiler a parser is built with.
+type Toolchain struct {
+	CC      string // The compiler as named, e.g. "gcc"
+	Path    string // The executable it resolved to
+	Family  string // "gcc" or "clang", or "cc" if the compiler is neither
+	Version string // The version number it reports, e.g. "12.2.0", if found
+	Banner  string // The first line of its --version output
+}
+
+func (t Toolchain) String() string {
+	return fmt.Sprintf("%s %s (%s)", t.Family, t.Version, t.Path)
+}
+
+// Toolchains already detected, by executable path
+var (
+	toolchainsMu sync.Mutex
+	toolchains   = make(map[string]Toolchain)
+)
+
+// DetectToolchain finds the C compiler cc names, or the default compiler
+// Options would use if cc is empty, and reports its family and version.
+func DetectToolchain(cc string) (Toolchain, error) {
+	return detectToolchain(cc, nil)
+}
+
+// detectToolchain is DetectToolchain with env holding the entries of
+// Options.Env.
+func detectToolchain(cc string, env []string) (Toolchain, error) {
+	if cc == "" {
+		cc = lookupEnv(env, "CC")
+	}
+	var path string
+	var err error
+	if cc != "" {
+		if path, err = exec.LookPath(cc); err != nil {
+			return Toolchain{}, fmt.Errorf("C compiler %s not found: %v", cc, err)
+		}
+	} else {
+		for _, name := range defaultCompilers {
+			if path, err = exec.LookPath(name); err == nil {
+				cc = name
+				break
+			}
+		}
+		if cc == "" {
+			return Toolchain{}, fmt.Errorf("no C compiler found; tried %s", strings.Join(defaultCompilers, ", "))
+		}
+	}
+
+	toolchainsMu.Lock()
+	defer toolchainsMu.Unlock()
+	if t, ok := toolchains[path]; ok {
+		t.CC = cc
+		return t, nil
+	}
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return Toolchain{}, fmt.Errorf("failed to run %s --version: %v", cc, err)
+	}
+	t := Toolchain{CC: cc, Path: path, Family: "cc"}
+	t.Banner, _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+	switch banner := strings.ToLower(t.Banner); {
+	case strings.Contains(banner, "clang"):
+		t.Family = "clang"
+	case strings.Contains(banner, "gcc") || strings.Contains(string(out), "Free Software Foundation"):
+		t.Family = "gcc"
+	}
+	// The version is the last word of the banner that starts with a digit
+	// and holds a dot, e.g. "12.2.0" in "gcc (Debian 12.2.0-14) 12.2.0"
+	for _, word := range strings.Fields(t.Banner) {
+		if word[0] >= '0' && word[0] <= '9' && strings.Contains(word, ".") {
+			t.Version = word
+		}
+	}
+	toolchains[path] = t
+	return t, nil
+}
+
+// lookupEnv returns the last value env sets for key, or the process's.
+func lookupEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(env[i], key+"="); ok {
+			return value
+		}
+	}
+	return os.Getenv(key)
+}
+
+// buildConfig is Options resolved: the toolchain, and the flags every compile
+// and link passes.
+type buildConfig struct {
+	toolchain Toolchain
+	cflags    []string
+	ldflags   []string
+	env       []string
+	outputDir string
+	keep      bool
+}
+
+// resolve checks the options, detects the toolchain and fills in defaults.
+func (o Options) resolve() (*buildConfig, error) {
+	level := o.OptLevel
+	if level == "" {
+		level = "2"
+		if o.Debug {
+			level = "0"
+		}
+	}
+	if !optLevels[level] {
+		return nil, fmt.Errorf("invalid optimization level %q", o.OptLevel)
+	}
+	toolchain, err := detectToolchain(o.CC, o.Env)
+	if err != nil {
+		return nil, err
+	}
+	b := &buildConfig{
+		toolchain: toolchain,
+		cflags:    []string{"-O" + level},
+		outputDir: o.OutputDir,
+		keep:      o.KeepArtifacts,
+	}
+	if o.March != "" {
+		b.cflags = append(b.cflags, "-march="+o.March)
+	}
+	if o.Debug {
+		b.cflags = append(b.cflags, "-g")
+	}
+	b.cflags = append(append(b.cflags, strings.Fields(lookupEnv(o.Env, "CFLAGS"))...), o.CFlags...)
+	b.ldflags = append(strings.Fields(lookupEnv(o.Env, "LDFLAGS")), o.LDFlags...)
+	if len(o.Env) > 0 {
+		b.env = append(os.Environ(), o.Env...)
+	}
+	if b.outputDir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			base = os.TempDir()
+		}
+		b.outputDir = filepath.Join(base, "jsonparser")
+	}
+	if b.outputDir, err = filepath.Abs(b.outputDir); err != nil {
+		return nil, fmt.Errorf("failed to resolve output directory: %v", err)
+	}
+	return b, nil
+}
+
+// compile compiles source to a position-independent object.
+func (b *buildConfig) compile(object, source string) error {
+	args := append([]string{"-c", "-fPIC"}, b.cflags...)
+	return b.run(append(args, "-o", object, source)...)
+}
+
+// link compiles and links inputs, sources and objects, into out, passing
+// extra flags such as -shared first.
+func (b *buildConfig) link(out string, extra []string, inputs ...string) error {
+	args := append(append(append([]string{}, extra...), b.cflags...), "-o", out)
+	args = append(append(args, inputs...), b.ldflags...)
+	return b.run(args...)
+}
+
+// run runs the C compiler.
+func (b *buildConfig) run(args ...string) error {
+	cmd := exec.Command(b.toolchain.Path, args...)
+	cmd.Env = b.env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("compilation failed: %v\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// fingerprint identifies the compiler, compile flags and the compiler's
+// environment, which may change what it includes or how it compiles, so
+// objects built differently are kept apart.
+func (b *buildConfig) fingerprint() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s\x00%q\x00%q", b.toolchain.Path, b.toolchain.Banner, b.cflags, b.env)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
@@ -0,0 +1,184 @@
+package compiler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+// Worker request kinds and response statuses, as workerSource reads and
+// writes them.
+const (
+	requestDocument = 'd' // The document is sent inline
+	requestFile     = 'f' // The worker maps the file at the path sent
+
+	workerParsed      = 0
+	workerRejected    = 1
+	workerUnknownType = 2
+	workerUnreadable  = 3
+)
+
+// worker is a module executable serving framed requests with --worker.
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startWorker(execPath string) (*worker, error) {
+	cmd := exec.Command(execPath, "--worker")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start parser worker: %v", err)
+	}
+	return &worker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// parse sends one request, of kind requestDocument or requestFile, and reads
+// its response. An error means the worker can no longer be used.
+func (w *worker) parse(kind byte, typeName, input string) (status byte, out []byte, stats KeyOrderStats, err error) {
+	req := make([]byte, 0, 9+len(typeName)+len(input))
+	req = append(req, kind)
+	req = binary.BigEndian.AppendUint32(req, uint32(len(typeName)))
+	req = append(req, typeName...)
+	req = binary.BigEndian.AppendUint32(req, uint32(len(input)))
+	req = append(req, input...)
+	if _, err := w.stdin.Write(req); err != nil {
+		return 0, nil, stats, err
+	}
+
+	var header [21]byte
+	if _, err := io.ReadFull(w.stdout, header[:]); err != nil {
+		return 0, nil, stats, err
+	}
+	stats.Hits = binary.BigEndian.Uint64(header[1:9])
+	stats.Misses = binary.BigEndian.Uint64(header[9:17])
+	out = make([]byte, binary.BigEndian.Uint32(header[17:21]))
+	if _, err := io.ReadFull(w.stdout, out); err != nil {
+		return 0, nil, stats, err
+	}
+	return header[0], out, stats, nil
+}
+
+// stop closes the worker's stdin, which ends it, and waits for it to exit.
+func (w *worker) stop() {
+	w.stdin.Close()
+	w.cmd.Wait()
+}
+
+// kill ends a worker that may be stuck or have crashed.
+func (w *worker) kill() {
+	w.cmd.Process.Kill()
+	w.stdin.Close()
+	w.cmd.Wait()
+}
+
+// workerPool runs a module's documents on up to GOMAXPROCS long-lived
+// workers, one request at a time each, so concurrent Parse calls are spread
+// across them. Workers start on demand, and a worker that fails is replaced.
+type workerPool struct {
+	execPath string
+	slots    chan struct{} // One per running request
+
+	mu     sync.Mutex
+	idle   []*worker
+	closed bool
+}
+
+func newWorkerPool(execPath string) *workerPool {
+	return &workerPool{execPath: execPath, slots: make(chan struct{}, runtime.GOMAXPROCS(0))}
+}
+
+// parse parses input, a document or the path of a file holding one as kind
+// says, as the struct typeName on a worker. A rejected document returns ok
+// false and its encoded error. The request is retried once on a
+// newly started worker if the first one fails, as it may have crashed on an
+// earlier document.
+func (wp *workerPool) parse(kind byte, typeName, input string) (out []byte, ok bool, stats KeyOrderStats, err error) {
+	if uint64(len(input)) > math.MaxUint32 {
+		return nil, false, stats, fmt.Errorf("document of %d bytes is too large to send to a worker", len(input))
+	}
+	wp.slots <- struct{}{}
+	defer func() { <-wp.slots }()
+
+	for attempt := 0; ; attempt++ {
+		w, err := wp.get(attempt > 0)
+		if err != nil {
+			return nil, false, stats, err
+		}
+		status, out, stats, err := w.parse(kind, typeName, input)
+		if err != nil {
+			w.kill()
+			if attempt == 0 {
+				continue
+			}
+			return nil, false, stats, fmt.Errorf("parser worker failed: %v", err)
+		}
+		wp.put(w)
+		switch status {
+		case workerParsed:
+			return out, true, stats, nil
+		case workerRejected:
+			return out, false, stats, nil
+		case workerUnknownType:
+			return nil, false, stats, fmt.Errorf("parser worker has no parser for %s", typeName)
+		case workerUnreadable:
+			return nil, false, stats, fmt.Errorf("failed to map %s", input)
+		}
+		return nil, false, stats, fmt.Errorf("parser worker sent status %d", status)
+	}
+}
+
+// get returns an idle worker, or starts one, as it always does when fresh
+// is set.
+func (wp *workerPool) get(fresh bool) (*worker, error) {
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		return nil, fmt.Errorf("parser is closed")
+	}
+	if n := len(wp.idle); n > 0 && !fresh {
+		w := wp.idle[n-1]
+		wp.idle = wp.idle[:n-1]
+		wp.mu.Unlock()
+		return w, nil
+	}
+	wp.mu.Unlock()
+	return startWorker(wp.execPath)
+}
+
+// put returns a worker to the pool, or stops it if the pool was closed.
+func (wp *workerPool) put(w *worker) {
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		w.stop()
+		return
+	}
+	wp.idle = append(wp.idle, w)
+	wp.mu.Unlock()
+}
+
+// close stops the idle workers; busy ones stop when their request completes.
+func (wp *workerPool) close() {
+	wp.mu.Lock()
+	idle := wp.idle
+	wp.idle = nil
+	wp.closed = true
+	wp.mu.Unlock()
+	for _, w := range idle {
+		w.stop()
+	}
+}
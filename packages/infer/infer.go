@@ -0,0 +1,513 @@
+// Package infer derives a struct schema from sample JSON documents. Samples
+// are tokenized with the lexer package and merged key by key: integers widen
+// to floats, keys missing from some objects become optional, keys seen with
+// null become nullable, and nested objects and arrays are merged recursively.
+package infer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/lexer"
+)
+
+// JSON value types as reported in KeyStats.Types.
+const (
+	TypeNull   = "null"
+	TypeBool   = "boolean"
+	TypeInt    = "integer"
+	TypeFloat  = "number"
+	TypeString = "string"
+	TypeObject = "object"
+	TypeArray  = "array"
+)
+
+// Inferrer accumulates observations from sample documents.
+type Inferrer struct {
+	root *node
+	docs int
+}
+
+// node records everything observed at one key path.
+type node struct {
+	path    string
+	present int            // Times the key appeared in its parent object
+	types   map[string]int // Observed value types
+	min     int64          // Integer range, for choosing the C type
+	max     int64
+
+	// Objects
+	keys   []string
+	fields map[string]*node
+
+	// Arrays
+	elem           *node
+	minLen, maxLen int // Element counts, for choosing a fixed length
+}
+
+func newNode(path string) *node {
+	return &node{path: path, types: make(map[string]int), min: math.MaxInt64, max: math.MinInt64, minLen: math.MaxInt, maxLen: -1}
+}
+
+// New returns an empty Inferrer.
+func New() *Inferrer {
+	return &Inferrer{root: newNode("")}
+}
+
+// Documents returns the number of documents added so far.
+func (inf *Inferrer) Documents() int {
+	return inf.docs
+}
+
+// Add merges every top-level document in input. The documents may be
+// separated by any whitespace, so NDJSON works as is. Each must be an object.
+func (inf *Inferrer) Add(input string) error {
+	p := &parser{lex: lexer.NewLexer(input)}
+	p.next()
+	for p.tok.Type != lexer.TokenEOF {
+		if p.tok.Type != lexer.TokenLeftBrace {
+			return fmt.Errorf("document %d: expected an object, got %s", inf.docs+1, p.describe())
+		}
+		// Parse into a scratch tree first so a malformed document leaves no trace
+		scratch := newNode("")
+		if err := p.value(scratch); err != nil {
+			return fmt.Errorf("document %d: %v", inf.docs+1, err)
+		}
+		inf.root.merge(scratch)
+		inf.docs++
+	}
+	return nil
+}
+
+// AddReader reads all of r and merges its documents with Add.
+func (inf *Inferrer) AddReader(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return inf.Add(string(data))
+}
+
+// parser walks lexer tokens with one token of lookahead.
+type parser struct {
+	lex *lexer.Lexer
+	tok lexer.Token
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.NextToken()
+}
+
+func (p *parser) describe() string {
+	switch p.tok.Type {
+	case lexer.TokenEOF:
+		return "end of input"
+	case lexer.TokenIllegal:
+		return fmt.Sprintf("invalid token %q", p.tok.Literal)
+	}
+	return fmt.Sprintf("%q", p.tok.Literal)
+}
+
+func (p *parser) expect(typ lexer.TokenType) error {
+	if p.tok.Type != typ {
+		return fmt.Errorf("expected %s, got %s", typ, p.describe())
+	}
+	p.next()
+	return nil
+}
+
+// value records the value at the current token into n.
+func (p *parser) value(n *node) error {
+	n.present++
+	switch p.tok.Type {
+	case lexer.TokenNull:
+		n.types[TypeNull]++
+	case lexer.TokenTrue, lexer.TokenFalse:
+		n.types[TypeBool]++
+	case lexer.TokenString:
+		if _, err := decodeString(p.tok.Literal); err != nil {
+			return fmt.Errorf("%s: invalid string: %v", displayPath(n.path), err)
+		}
+		n.types[TypeString]++
+	case lexer.TokenNumber:
+		if err := n.number(p.tok.Literal); err != nil {
+			return err
+		}
+	case lexer.TokenLeftBrace:
+		n.types[TypeObject]++
+		p.next()
+		return p.object(n)
+	case lexer.TokenLeftBracket:
+		n.types[TypeArray]++
+		p.next()
+		return p.array(n)
+	default:
+		return fmt.Errorf("%s: unexpected %s", displayPath(n.path), p.describe())
+	}
+	p.next()
+	return nil
+}
+
+// object parses the members of an object whose '{' has been consumed.
+func (p *parser) object(n *node) error {
+	seen := make(map[string]bool)
+	for first := true; p.tok.Type != lexer.TokenRightBrace; first = false {
+		if !first {
+			if err := p.expect(lexer.TokenComma); err != nil {
+				return err
+			}
+		}
+		if p.tok.Type != lexer.TokenString {
+			return fmt.Errorf("%s: expected a key, got %s", displayPath(n.path), p.describe())
+		}
+		key, err := decodeString(p.tok.Literal)
+		if err != nil {
+			return fmt.Errorf("%s: invalid key: %v", displayPath(n.path), err)
+		}
+		p.next()
+		if err := p.expect(lexer.TokenColon); err != nil {
+			return err
+		}
+		child := n.field(key)
+		if seen[key] {
+			return fmt.Errorf("%s: duplicate key", displayPath(child.path))
+		}
+		seen[key] = true
+		if err := p.value(child); err != nil {
+			return err
+		}
+	}
+	p.next()
+	return nil
+}
+
+// array parses the elements of an array whose '[' has been consumed.
+func (p *parser) array(n *node) error {
+	if n.elem == nil {
+		n.elem = newNode(n.path + "[]")
+	}
+	count := 0
+	for first := true; p.tok.Type != lexer.TokenRightBracket; first = false {
+		if !first {
+			if err := p.expect(lexer.TokenComma); err != nil {
+				return err
+			}
+		}
+		if err := p.value(n.elem); err != nil {
+			return err
+		}
+		count++
+	}
+	n.minLen, n.maxLen = min(n.minLen, count), max(n.maxLen, count)
+	p.next()
+	return nil
+}
+
+// number classifies a number literal as an integer or a float.
+func (n *node) number(literal string) error {
+	if _, err := strconv.ParseFloat(literal, 64); err != nil {
+		return fmt.Errorf("%s: invalid number %q", displayPath(n.path), literal)
+	}
+	if !strings.ContainsAny(literal, ".eE") {
+		if v, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			n.types[TypeInt]++
+			n.min, n.max = min(n.min, v), max(n.max, v)
+			return nil
+		}
+	}
+	// Fractions, exponents and integers beyond int64 are floats
+	n.types[TypeFloat]++
+	return nil
+}
+
+// field returns the child node for key, creating it in first-seen order.
+func (n *node) field(key string) *node {
+	if n.fields == nil {
+		n.fields = make(map[string]*node)
+	}
+	child, ok := n.fields[key]
+	if !ok {
+		path := key
+		if n.path != "" {
+			path = n.path + "." + key
+		}
+		child = newNode(path)
+		n.fields[key] = child
+		n.keys = append(n.keys, key)
+	}
+	return child
+}
+
+// merge adds the observations in other to n.
+func (n *node) merge(other *node) {
+	n.present += other.present
+	for typ, count := range other.types {
+		n.types[typ] += count
+	}
+	n.min, n.max = min(n.min, other.min), max(n.max, other.max)
+	n.minLen, n.maxLen = min(n.minLen, other.minLen), max(n.maxLen, other.maxLen)
+	for _, key := range other.keys {
+		n.field(key).merge(other.fields[key])
+	}
+	if other.elem != nil {
+		if n.elem == nil {
+			n.elem = newNode(n.path + "[]")
+		}
+		n.elem.merge(other.elem)
+	}
+}
+
+// decodeString decodes the raw text of a string token.
+func decodeString(raw string) (string, error) {
+	var s string
+	err := json.Unmarshal([]byte(`"`+raw+`"`), &s)
+	return s, err
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return path
+}
+
+// KeyStats reports how often a key path was seen and with which types.
+type KeyStats struct {
+	Path    string         // Dotted key path; array elements are written "key[]"
+	Present int            // Values seen at this path
+	Total   int            // Parent objects (or array elements) that could have held it
+	Types   map[string]int // Count of each observed JSON type, including "null"
+}
+
+// Frequency returns the fraction of parent objects that contained the key.
+func (s KeyStats) Frequency() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Present) / float64(s.Total)
+}
+
+// Stats returns per-key statistics in document order, parents before children.
+func (inf *Inferrer) Stats() []KeyStats {
+	var stats []KeyStats
+	var walk func(n *node)
+	walk = func(n *node) {
+		objects := n.types[TypeObject]
+		for _, key := range n.keys {
+			child := n.fields[key]
+			stats = append(stats, child.stats(objects))
+			walk(child)
+		}
+		if n.elem != nil {
+			stats = append(stats, n.elem.stats(n.elem.present))
+			walk(n.elem)
+		}
+	}
+	walk(inf.root)
+	return stats
+}
+
+func (n *node) stats(total int) KeyStats {
+	types := make(map[string]int, len(n.types))
+	for typ, count := range n.types {
+		types[typ] = count
+	}
+	return KeyStats{Path: n.path, Present: n.present, Total: total, Types: types}
+}
+
+// Struct returns the inferred CStruct named name, ready for
+// compiler.CompileAndBuild. Nested objects become nested CStructs named after
+// their parent and key; keys missing from some objects are not Required, keys
+// seen with null are Nullable, and keys only ever seen with null are nullable
+// strings. Arrays of the same length in every sample become fixed arrays, and
+// arrays whose length varies slices.
+func (inf *Inferrer) Struct(name string) (analyzer.CStruct, error) {
+	if inf.docs == 0 {
+		return analyzer.CStruct{}, fmt.Errorf("no documents to infer from")
+	}
+	b := &builder{names: make(map[string]bool)}
+	cStruct, err := b.object(inf.root, inf.docs, name)
+	if err != nil {
+		return analyzer.CStruct{}, err
+	}
+	return *cStruct, nil
+}
+
+// builder converts nodes into the analyzer model and keeps struct names unique.
+type builder struct {
+	names   map[string]bool
+	structs []*analyzer.CStruct // In declaration order, root first
+}
+
+func (b *builder) uniqueName(name string) string {
+	unique := name
+	for i := 2; b.names[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	b.names[unique] = true
+	return unique
+}
+
+// object builds the struct for an object node seen objects times.
+func (b *builder) object(n *node, objects int, name string) (*analyzer.CStruct, error) {
+	cStruct := &analyzer.CStruct{Name: b.uniqueName(name)}
+	b.structs = append(b.structs, cStruct)
+
+	goNames := make(map[string]bool)
+	// Keys that are not C identifiers, e.g. "first-name", get a member name
+	members := analyzer.CFieldNames(n.keys)
+	for i, key := range n.keys {
+		child := n.fields[key]
+		field, err := b.field(child, key, cStruct.Name)
+		if err != nil {
+			return nil, err
+		}
+		if members[i] != key {
+			field.CName = members[i]
+		}
+		field.GoName = analyzer.GoFieldName(key)
+		for base, i := field.GoName, 2; goNames[field.GoName]; i++ {
+			field.GoName = fmt.Sprintf("%s%d", base, i)
+		}
+		goNames[field.GoName] = true
+		field.Rules.Required = child.present == objects
+		cStruct.Fields = append(cStruct.Fields, field)
+	}
+	return cStruct, nil
+}
+
+// field builds the FieldInfo for the values observed at n.
+func (b *builder) field(n *node, key, parent string) (analyzer.FieldInfo, error) {
+	field := analyzer.FieldInfo{Name: key, Rules: analyzer.Rules{Nullable: n.types[TypeNull] > 0}}
+
+	typ, err := n.valueType()
+	if err != nil {
+		return field, err
+	}
+	switch typ {
+	case TypeString:
+		field.CType, field.Kind = "char*", "string"
+	case TypeBool:
+		field.CType, field.Kind = "bool", "bool"
+	case TypeFloat:
+		field.CType, field.Kind = "double", "float64"
+	case TypeInt:
+		field.CType, field.Kind = "int", "int"
+		if n.min < math.MinInt32 || n.max > math.MaxInt32 {
+			field.CType, field.Kind = "int64_t", "int64"
+		}
+	case TypeObject:
+		nested, err := b.object(n, n.types[TypeObject], parent+analyzer.GoFieldName(key))
+		if err != nil {
+			return field, err
+		}
+		field.CType, field.Kind, field.Struct = nested.Name, "struct", nested
+	case TypeArray:
+		if n.elem == nil || n.elem.present == 0 {
+			return field, fmt.Errorf("%s: cannot infer the element type of arrays that were always empty", n.path)
+		}
+		elem, err := b.field(n.elem, key, parent)
+		if err != nil {
+			return field, err
+		}
+		field.Elem = &elem
+		if n.minLen == n.maxLen {
+			field.CType, field.Kind, field.Len = elem.CType, "array", n.maxLen
+		} else {
+			field.CType, field.Kind = elem.CType+"*", "slice"
+		}
+	}
+	return field, nil
+}
+
+// valueType merges the non-null types observed at n into one.
+func (n *node) valueType() (string, error) {
+	var observed []string
+	for typ := range n.types {
+		if typ != TypeNull {
+			observed = append(observed, typ)
+		}
+	}
+	sort.Strings(observed)
+
+	switch {
+	case len(observed) == 0:
+		return TypeString, nil // Only null was seen, which a nullable string takes
+	case len(observed) == 1:
+		return observed[0], nil
+	case len(observed) == 2 && observed[0] == TypeInt && observed[1] == TypeFloat:
+		return TypeFloat, nil // Integers widen to floats
+	}
+	return "", fmt.Errorf("%s: conflicting types %s", n.path, strings.Join(observed, ", "))
+}
+
+// GoSource returns formatted Go source declaring the inferred struct and its
+// nested structs in package pkg. Optional and nullable keys carry required
+// and nullable tags, so analyzing the source yields the same CStruct as
+// Struct, but for FieldInfo.Type and Offset, which Struct leaves unset, and
+// arrays with null elements: Go has no tag for those, so the elements
+// analyzed from the source are not nullable.
+func (inf *Inferrer) GoSource(pkg, name string) (string, error) {
+	if inf.docs == 0 {
+		return "", fmt.Errorf("no documents to infer from")
+	}
+	b := &builder{names: make(map[string]bool)}
+	if _, err := b.object(inf.root, inf.docs, name); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by infer from %d sample documents. DO NOT EDIT.\n\n", inf.docs)
+	fmt.Fprintf(&buf, "package %s\n", pkg)
+	for _, cStruct := range b.structs {
+		fmt.Fprintf(&buf, "\ntype %s struct {\n", cStruct.Name)
+		for _, field := range cStruct.Fields {
+			tag := fmt.Sprintf("json:%q", field.Name)
+			if field.Rules.Required {
+				tag += ` required:"true"`
+			}
+			if field.Rules.Nullable {
+				tag += ` nullable:"true"`
+			}
+			fmt.Fprintf(&buf, "\t%s %s `%s`\n", field.GoName, goType(field), tag)
+		}
+		buf.WriteString("}\n")
+	}
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("failed to format generated source: %v", err)
+	}
+	return string(source), nil
+}
+
+// goType returns the Go type expression for an inferred field.
+func goType(field analyzer.FieldInfo) string {
+	switch {
+	case field.Struct != nil:
+		return field.Struct.Name
+	case field.Elem != nil && field.Len > 0:
+		return fmt.Sprintf("[%d]%s", field.Len, goType(*field.Elem))
+	case field.Elem != nil:
+		return "[]" + goType(*field.Elem)
+	}
+	switch field.CType {
+	case "char*":
+		return "string"
+	case "bool":
+		return "bool"
+	case "double":
+		return "float64"
+	case "int64_t":
+		return "int64"
+	}
+	return "int"
+}
@@ -0,0 +1,296 @@
+package infer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/compiler"
+)
+
+const samples = `{"first_name": "John", "student_id": 1, "gpa": 3, "address": {"zip": "95112"}, "tags": ["a", "b"], "courses": [{"code": "CS152", "units": 3}]}
+{"first_name": "Jane", "student_id": 3000000000, "gpa": 3.5, "address": {"zip": "95113", "street": "1st"}, "nickname": null, "tags": ["c", null], "courses": [{"code": "CS146"}]}
+{"first_name": "Joe \"Jr\"", "student_id": 2, "gpa": null, "address": {"zip": "95114"}, "nickname": "JJ", "tags": ["d", "e"], "courses": [{"code": "CS160", "units": 4}]}
+`
+
+func TestInferStruct(t *testing.T) {
+	inf := New()
+	if err := inf.Add(samples); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if inf.Documents() != 3 {
+		t.Fatalf("expected 3 documents, got %d", inf.Documents())
+	}
+
+	cStruct, err := inf.Struct("Student")
+	if err != nil {
+		t.Fatalf("Struct failed: %v", err)
+	}
+
+	expected := []struct {
+		name     string
+		cType    string
+		required bool
+		nullable bool
+	}{
+		{"first_name", "char*", true, false},
+		{"student_id", "int64_t", true, false},
+		{"gpa", "double", true, true},
+		{"address", "StudentAddress", true, false},
+		{"tags", "char*", true, false},
+		{"courses", "StudentCourses", true, false},
+		{"nickname", "char*", false, true},
+	}
+	if len(cStruct.Fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(cStruct.Fields))
+	}
+	for i, fi := range cStruct.Fields {
+		exp := expected[i]
+		if fi.Name != exp.name || fi.CType != exp.cType || fi.Rules.Required != exp.required || fi.Rules.Nullable != exp.nullable {
+			t.Errorf("field %d - expected (%s, %s, required=%v, nullable=%v), got (%s, %s, required=%v, nullable=%v)",
+				i, exp.name, exp.cType, exp.required, exp.nullable, fi.Name, fi.CType, fi.Rules.Required, fi.Rules.Nullable)
+		}
+	}
+
+	address := cStruct.Fields[3].Struct
+	if address == nil || len(address.Fields) != 2 || !address.Fields[0].Rules.Required || address.Fields[1].Rules.Required {
+		t.Errorf("unexpected address struct: %+v", address)
+	}
+	tags := cStruct.Fields[4]
+	if tags.Kind != "array" || tags.Len != 2 || tags.Elem == nil || !tags.Elem.Rules.Nullable {
+		t.Errorf("unexpected tags field: %+v", tags)
+	}
+	courses := cStruct.Fields[5].Elem
+	if cStruct.Fields[5].Len != 1 || courses == nil || courses.Struct == nil || courses.Struct.Fields[1].Name != "units" || courses.Struct.Fields[1].Rules.Required {
+		t.Errorf("unexpected courses element: %+v", courses)
+	}
+}
+
+func TestInferStats(t *testing.T) {
+	inf := New()
+	if err := inf.Add(samples); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	stats := make(map[string]KeyStats)
+	for _, s := range inf.Stats() {
+		stats[s.Path] = s
+	}
+
+	nickname := stats["nickname"]
+	if nickname.Present != 2 || nickname.Total != 3 || nickname.Types[TypeNull] != 1 || nickname.Types[TypeString] != 1 {
+		t.Errorf("unexpected nickname stats: %+v", nickname)
+	}
+	if f := nickname.Frequency(); f < 0.66 || f > 0.67 {
+		t.Errorf("nickname frequency = %v, want 2/3", f)
+	}
+	gpa := stats["gpa"]
+	if gpa.Types[TypeInt] != 1 || gpa.Types[TypeFloat] != 1 || gpa.Types[TypeNull] != 1 {
+		t.Errorf("unexpected gpa stats: %+v", gpa)
+	}
+	units := stats["courses[].units"]
+	if units.Present != 2 || units.Total != 3 {
+		t.Errorf("unexpected courses[].units stats: %+v", units)
+	}
+	if tags := stats["tags[]"]; tags.Present != 6 || tags.Types[TypeNull] != 1 {
+		t.Errorf("unexpected tags[] stats: %+v", tags)
+	}
+}
+
+func TestInferGoSource(t *testing.T) {
+	inf := New()
+	if err := inf.Add(samples); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	source, err := inf.GoSource("models", "Student")
+	if err != nil {
+		t.Fatalf("GoSource failed: %v", err)
+	}
+
+	for _, expected := range []string{
+		"package models",
+		"type Student struct {",
+		"FirstName string `json:\"first_name\" required:\"true\"`",
+		"StudentId int64 `json:\"student_id\" required:\"true\"`",
+		"Gpa float64 `json:\"gpa\" required:\"true\" nullable:\"true\"`",
+		"Address StudentAddress `json:\"address\" required:\"true\"`",
+		"Tags [2]string `json:\"tags\" required:\"true\"`",
+		"Courses [1]StudentCourses `json:\"courses\" required:\"true\"`",
+		"Nickname string `json:\"nickname\" nullable:\"true\"`",
+		"type StudentAddress struct {",
+		"Street string `json:\"street\"`",
+		"type StudentCourses struct {",
+	} {
+		normalized := strings.Join(strings.Fields(source), " ")
+		if !strings.Contains(normalized, expected) {
+			t.Errorf("source missing expected content: %s\n%s", expected, source)
+		}
+	}
+
+	// The emitted source must analyze back to the same CStruct
+	roundTrip := New()
+	if err := roundTrip.Add(`{"first-name": "x", "count": 1, "ratio": 0.5, "note": null, "home": {"zip-code": "95112", "lines": ["a"]}, "grid": [[1, 2], [3, 4]], "visits": [{"at": 1}]}
+{"first-name": "y", "count": 2, "ratio": 1, "note": "n", "home": null, "grid": [[5, 6], [7, 8]], "visits": [{"at": 2, "by": "z"}, {"at": 3}]}`); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	roundTripSource, err := roundTrip.GoSource("models", "Visitor")
+	if err != nil {
+		t.Fatalf("GoSource failed: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "visitor.go"), []byte(roundTripSource), 0644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	fromSource, err := analyzer.AnalyzeSource(dir, "Visitor")
+	if err != nil {
+		t.Fatalf("AnalyzeSource failed: %v\n%s", err, roundTripSource)
+	}
+	inferred, err := roundTrip.Struct("Visitor")
+	if err != nil {
+		t.Fatalf("Struct failed: %v", err)
+	}
+	clearTypes(fromSource.Fields)
+	if !reflect.DeepEqual(fromSource, inferred) {
+		t.Errorf("analyzed source differs from Struct:\n%+v\n%+v\n%s", fromSource, inferred, roundTripSource)
+	}
+	if inferred.Fields[0].CName != "first_name" || inferred.Fields[4].Struct.Fields[0].CName != "zip_code" {
+		t.Errorf("expected member names for first-name and zip-code, got %+v", inferred)
+	}
+
+	// Arrays whose length varies are declared as slices
+	if !strings.Contains(strings.Join(strings.Fields(roundTripSource), " "), "Visits []VisitorVisits") {
+		t.Errorf("source missing slice field:\n%s", roundTripSource)
+	}
+}
+
+// clearTypes clears the Type and Offset of fields, which Struct leaves unset,
+// and of the fields nested in them.
+func clearTypes(fields []analyzer.FieldInfo) {
+	for i := range fields {
+		for f := &fields[i]; f != nil; f = f.Elem {
+			f.Type, f.Offset = nil, 0
+			if f.Struct != nil {
+				clearTypes(f.Struct.Fields)
+			}
+		}
+	}
+}
+
+func TestInferParse(t *testing.T) {
+	docs := []string{
+		`{"name": "a", "age": 3, "home": {"zip": "95112"}, "note": null, "tags": ["x"], "first-name": "A"}`,
+		`{"name": null, "age": 4, "home": null, "tags": [null], "first-name": "B"}`,
+		`{"name": "c", "age": null, "home": {"zip": null}, "note": null, "tags": ["y"], "first-name": "C"}`,
+	}
+	inf := New()
+	if err := inf.Add(strings.Join(docs, "\n")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	cStruct, err := inf.Struct("Sample")
+	if err != nil {
+		t.Fatalf("Struct failed: %v", err)
+	}
+	if note := cStruct.Fields[3]; note.CType != "char*" || !note.Rules.Nullable {
+		t.Errorf("a key only seen with null gave %+v, want a nullable string", note)
+	}
+	if firstName := cStruct.Fields[5]; firstName.Name != "first-name" || firstName.Member() != "first_name" {
+		t.Errorf("a hyphenated key gave %+v, want member first_name", firstName)
+	}
+	parser, err := compiler.CompileAndBuild(cStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+
+	// Every sample parses, and null leaves the zero value
+	for _, doc := range docs {
+		if _, err := parser.Parse(doc); err != nil {
+			t.Errorf("Parse(%s) unexpected error: %v", doc, err)
+		}
+	}
+	result, present, err := parser.ParseWithPresence(docs[1])
+	if err != nil {
+		t.Fatalf("ParseWithPresence() unexpected error: %v", err)
+	}
+	if result["name"] != "" || !present["name"] || result["first-name"] != "B" || !reflect.DeepEqual(result["home"], map[string]interface{}{"zip": ""}) {
+		t.Errorf("ParseWithPresence() = %v, %v", result, present)
+	}
+
+	// So does every shared sample, with its arrays and nested objects
+	student := New()
+	if err := student.Add(samples); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	cStruct, err = student.Struct("Student")
+	if err != nil {
+		t.Fatalf("Struct failed: %v", err)
+	}
+	studentParser, err := compiler.CompileAndBuild(cStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer studentParser.Close()
+	for _, doc := range strings.Split(strings.TrimSpace(samples), "\n") {
+		if _, err := studentParser.Parse(doc); err != nil {
+			t.Errorf("Parse(%s) unexpected error: %v", doc, err)
+		}
+	}
+
+	// Arrays whose length varies become slices, which hold every element
+	varying := New()
+	if err := varying.Add(`{"ids": [1]} {"ids": [2, 3]}`); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	cStruct, err = varying.Struct("Varying")
+	if err != nil {
+		t.Fatalf("Struct failed: %v", err)
+	}
+	varyingParser, err := compiler.CompileAndBuild(cStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer varyingParser.Close()
+	if result, err := varyingParser.Parse(`{"ids": [4, 5, 6]}`); err != nil || !reflect.DeepEqual(result["ids"], []interface{}{"4", "5", "6"}) {
+		t.Errorf("Parse() = %v, %v; want ids [4 5 6]", result, err)
+	}
+}
+
+func TestInferErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		errContains string
+	}{
+		{"not an object", `[1, 2]`, "expected an object"},
+		{"unterminated", `{"a": 1`, "expected ,"},
+		{"missing colon", `{"a" 1}`, "expected :"},
+		{"invalid literal", `{"a": tru}`, "invalid token"},
+		{"duplicate key", `{"a": 1, "a": 2}`, "a: duplicate key"},
+		{"conflicting types", `{"a": 1} {"a": "x"}`, "a: conflicting types integer, string"},
+		{"empty arrays", `{"a": []}`, "always empty"},
+		{"nested conflict", `{"a": [{"b": true}, {"b": 1}]}`, "a[].b: conflicting types"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inf := New()
+			err := inf.Add(tt.input)
+			if err == nil {
+				_, err = inf.Struct("Sample")
+			}
+			if err == nil {
+				t.Fatalf("expected error containing %q", tt.errContains)
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("error = %v, want error containing %q", err, tt.errContains)
+			}
+		})
+	}
+
+	if _, err := New().Struct("Empty"); err == nil {
+		t.Error("expected error for an Inferrer without documents")
+	}
+}
@@ -0,0 +1,112 @@
+package ir
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump writes a readable listing of the schema, one object at a time in
+// dependency order, for debugging passes and backends:
+//
+//	object Student (root) size 48 align 8 dispatch length
+//	  "first_name" first_name: char*, required
+//	  "home" home: Address
+//	  layout: home, first_name
+//	  key order: home, first_name
+//	  unknown keys: rejected
+func (s *Schema) Dump(w io.Writer) error {
+	_, err := io.WriteString(w, s.String())
+	return err
+}
+
+// String returns the Dump listing.
+func (s *Schema) String() string {
+	var b strings.Builder
+	for i, o := range s.Objects {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		root := ""
+		if o == s.Root {
+			root = " (root)"
+		}
+		fmt.Fprintf(&b, "object %s%s size %d align %d dispatch %s\n", o.Name, root, o.Size(), o.Align(), o.Dispatch)
+		for _, field := range o.Fields {
+			fmt.Fprintf(&b, "  %q %s: %s%s\n", field.Key, field.Member, field.Value, constraints(field))
+		}
+		if !sameOrder(o.Fields, o.Layout) {
+			members := make([]string, len(o.Layout))
+			for i, field := range o.Layout {
+				members[i] = field.Member
+			}
+			fmt.Fprintf(&b, "  layout: %s\n", strings.Join(members, ", "))
+		}
+		if !sameOrder(o.Fields, o.KeyOrder) {
+			keys := make([]string, len(o.KeyOrder))
+			for i, field := range o.KeyOrder {
+				keys[i] = field.Key
+			}
+			fmt.Fprintf(&b, "  key order: %s\n", strings.Join(keys, ", "))
+		}
+		if o.RejectUnknown {
+			fmt.Fprintf(&b, "  unknown keys: rejected\n")
+		}
+		if o.Lenient {
+			fmt.Fprintf(&b, "  syntax: lenient\n")
+		}
+		if o.ReplaceInvalidUTF8 {
+			fmt.Fprintf(&b, "  invalid UTF-8: replaced\n")
+		}
+		if len(o.Dropped) > 0 {
+			fmt.Fprintf(&b, "  dropped: %s\n", strings.Join(o.Dropped, ", "))
+		}
+	}
+	return b.String()
+}
+
+// constraints lists the field's validation constraints, with a leading comma.
+func constraints(field *Field) string {
+	var parts []string
+	c := field.Constraints
+	if c.Required {
+		parts = append(parts, "required")
+	}
+	if c.Nullable {
+		parts = append(parts, "nullable")
+	}
+	if len(c.Enum) > 0 {
+		parts = append(parts, "enum "+strings.Join(c.Enum, "|"))
+	}
+	if c.Default != "" {
+		parts = append(parts, "default "+c.Default)
+	}
+	if c.Minimum != nil {
+		parts = append(parts, fmt.Sprintf("minimum %g", *c.Minimum))
+	}
+	if c.Maximum != nil {
+		parts = append(parts, fmt.Sprintf("maximum %g", *c.Maximum))
+	}
+	if c.MaxLength > 0 {
+		parts = append(parts, fmt.Sprintf("maxLength %d", c.MaxLength))
+	}
+	if c.Pattern != "" {
+		parts = append(parts, fmt.Sprintf("pattern %q", c.Pattern))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(parts, ", ")
+}
+
+func sameOrder(a, b []*Field) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
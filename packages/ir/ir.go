@@ -0,0 +1,167 @@
+// Package ir is the typed intermediate representation between the analyzer
+// and code generation. Lower converts an analyzer.CStruct into a Schema of
+// objects, fields and values; passes such as dead-field elimination, field
+// reordering and dispatch selection rewrite the Schema, and backends generate
+// code from the result.
+package ir
+
+import (
+	"fmt"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// Kind classifies a value by how it is parsed and stored.
+type Kind int
+
+const (
+	KindString       Kind = iota // char*, strdup'd
+	KindInlineString             // char[MaxLen+1]
+	KindInt                      // Signed integer
+	KindUint                     // Unsigned integer
+	KindFloat                    // float or double
+	KindBool                     // bool
+	KindBytes                    // Base64 string decoded into uint8_t* plus a _len member
+	KindObject                   // Nested struct
+	KindArray                    // Fixed-length array
+	KindSlice                    // Variable-length array: Elem* plus a _len member
+)
+
+var kindNames = [...]string{
+	KindString:       "string",
+	KindInlineString: "inline string",
+	KindInt:          "int",
+	KindUint:         "uint",
+	KindFloat:        "float",
+	KindBool:         "bool",
+	KindBytes:        "bytes",
+	KindObject:       "object",
+	KindArray:        "array",
+	KindSlice:        "slice",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Dispatch is the strategy an object parser uses to find the field for a key.
+type Dispatch int
+
+const (
+	// DispatchLinear compares the key with each field's key in turn.
+	DispatchLinear Dispatch = iota
+	// DispatchLength switches on the key length first, then compares the key
+	// with the fields of that length.
+	DispatchLength
+	// DispatchTrie switches on the key length, then walks a decision trie
+	// over the bytes that tell the keys of that length apart, and compares
+	// the whole key once a single field remains.
+	DispatchTrie
+)
+
+func (d Dispatch) String() string {
+	switch d {
+	case DispatchLinear:
+		return "linear"
+	case DispatchLength:
+		return "length"
+	case DispatchTrie:
+		return "trie"
+	}
+	return fmt.Sprintf("Dispatch(%d)", int(d))
+}
+
+// Schema is the IR of a root struct and every struct nested in it.
+type Schema struct {
+	Root *Object
+	// Objects lists each object once, nested objects before the objects that
+	// contain them, so Root is last.
+	Objects []*Object
+}
+
+// Object is a JSON object parsed into a C struct.
+type Object struct {
+	Name string
+	// Fields are in declaration order, which is also the order values are
+	// serialized in.
+	Fields []*Field
+	// Layout holds the same fields in C member order.
+	Layout []*Field
+	// KeyOrder holds the same fields in the order the parser expects their
+	// keys to arrive in, which it checks for before dispatching.
+	KeyOrder []*Field
+	Dispatch Dispatch
+	// RejectUnknown makes the parser reject keys the object has no field for,
+	// other than the Dropped keys of fields eliminated as dead.
+	RejectUnknown bool
+	Dropped       []string
+	// Lenient relaxes the object syntax the parser accepts: commas may be
+	// repeated or trail like whitespace, and the root object may be followed
+	// by anything.
+	Lenient bool
+	// ReplaceInvalidUTF8 makes the parser decode invalid UTF-8 and unpaired
+	// surrogates in strings and keys as U+FFFD, rather than rejecting them.
+	ReplaceInvalidUTF8 bool
+}
+
+// Field is a key of an object and the C member it is stored in.
+type Field struct {
+	Key         string // JSON key
+	Member      string // C member name
+	GoName      string
+	Value       Value
+	Constraints analyzer.Rules
+}
+
+// Value is the type of a field or array element.
+type Value struct {
+	Kind  Kind
+	CType string // C type of a scalar; the struct name of an object
+	// MaxLen and Truncate apply to inline strings.
+	MaxLen   int
+	Truncate bool
+	// Len and Elem describe an array; a slice has only Elem.
+	Len  int
+	Elem *Value
+	// Object describes a nested object.
+	Object *Object
+	// Nullable accepts null, which leaves the value zero.
+	Nullable bool
+	// Enum, Minimum, Maximum and MaxLength are the validation rules the
+	// parser checks the value against, as in analyzer.Rules.
+	Enum      []string
+	Minimum   *float64
+	Maximum   *float64
+	MaxLength int
+}
+
+// String describes the value, e.g. "int64_t", "char[9]", "Address[2]" or
+// "int[]".
+func (v Value) String() string {
+	switch v.Kind {
+	case KindInlineString:
+		s := fmt.Sprintf("char[%d]", v.MaxLen+1)
+		if v.Truncate {
+			s += " truncate"
+		}
+		return s
+	case KindArray:
+		return fmt.Sprintf("%s[%d]", v.Elem, v.Len)
+	case KindSlice:
+		return fmt.Sprintf("%s[]", v.Elem)
+	}
+	return v.CType
+}
+
+// LookupField returns the field of o with the given JSON key, or nil.
+func (o *Object) LookupField(key string) *Field {
+	for _, field := range o.Fields {
+		if field.Key == key {
+			return field
+		}
+	}
+	return nil
+}
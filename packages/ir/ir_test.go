@@ -0,0 +1,320 @@
+package ir
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// student returns a struct with a nested Address used by a field and an
+// array, and members whose declaration order wastes padding.
+func student() analyzer.CStruct {
+	address := &analyzer.CStruct{
+		Name: "Address",
+		Fields: []analyzer.FieldInfo{
+			{Name: "zip", CType: "char*", MaxLen: 5},
+			{Name: "floor", CType: "int8_t"},
+		},
+	}
+	addressElem := analyzer.FieldInfo{CType: "Address", Kind: "struct", Struct: address}
+	scoreElem := analyzer.FieldInfo{CType: "uint8_t"}
+	return analyzer.CStruct{
+		Name: "Student",
+		Fields: []analyzer.FieldInfo{
+			{Name: "active", CType: "bool"},
+			{Name: "student-id", CName: "student_id", CType: "int64_t", Rules: analyzer.Rules{Required: true}},
+			{Name: "level", CType: "uint8_t"},
+			{Name: "gpa", CType: "double"},
+			{Name: "name", CType: "char*"},
+			{Name: "home", CType: "Address", Kind: "struct", Struct: address},
+			{Name: "campus", CType: "Address", Kind: "array", Elem: &addressElem, Len: 2},
+			{Name: "scores", CType: "uint8_t", Kind: "array", Elem: &scoreElem, Len: 3},
+			{Name: "photo", CType: analyzer.BytesCType, Kind: "slice"},
+		},
+	}
+}
+
+func lowerStudent(t *testing.T) *Schema {
+	t.Helper()
+	s, err := Lower(student())
+	if err != nil {
+		t.Fatalf("Lower failed: %v", err)
+	}
+	return s
+}
+
+func TestLower(t *testing.T) {
+	s := lowerStudent(t)
+	if len(s.Objects) != 2 || s.Objects[0].Name != "Address" || s.Objects[1] != s.Root {
+		t.Fatalf("Objects = %v, want Address then Student", s.Objects)
+	}
+
+	expected := []struct {
+		key, member string
+		kind        Kind
+		value       string
+	}{
+		{"active", "active", KindBool, "bool"},
+		{"student-id", "student_id", KindInt, "int64_t"},
+		{"level", "level", KindUint, "uint8_t"},
+		{"gpa", "gpa", KindFloat, "double"},
+		{"name", "name", KindString, "char*"},
+		{"home", "home", KindObject, "Address"},
+		{"campus", "campus", KindArray, "Address[2]"},
+		{"scores", "scores", KindArray, "uint8_t[3]"},
+		{"photo", "photo", KindBytes, "uint8_t*"},
+	}
+	for i, want := range expected {
+		field := s.Root.Fields[i]
+		if field.Key != want.key || field.Member != want.member || field.Value.Kind != want.kind || field.Value.String() != want.value {
+			t.Errorf("field %d = %s %s %v %s, want %+v", i, field.Key, field.Member, field.Value.Kind, field.Value, want)
+		}
+	}
+	if !s.Root.Fields[1].Constraints.Required {
+		t.Error("constraints were not carried over")
+	}
+	if s.Root.Fields[5].Value.Object != s.Root.Fields[6].Value.Elem.Object {
+		t.Error("Address should lower to one object")
+	}
+	if zip := s.Objects[0].Fields[0].Value; zip.Kind != KindInlineString || zip.String() != "char[6]" {
+		t.Errorf("zip = %v %s, want an inline char[6]", zip.Kind, zip)
+	}
+
+	elem := analyzer.FieldInfo{CType: "int"}
+	sliced, err := Lower(analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{{Name: "a", CType: "int*", Kind: "slice", Elem: &elem}}})
+	if err != nil {
+		t.Fatalf("Lower() error = %v", err)
+	}
+	if a := sliced.Root.Fields[0].Value; a.Kind != KindSlice || a.String() != "int[]" || a.Size() != 16 {
+		t.Errorf("a = %v %s of size %d, want a 16-byte int[] slice", a.Kind, a, a.Size())
+	}
+	if _, err := Lower(analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{{Name: "a", CType: "int*", Kind: "slice"}}}); err == nil || !strings.Contains(err.Error(), "slice needs an element type") {
+		t.Errorf("Lower() error = %v, want slice needs an element type", err)
+	}
+	if _, err := Lower(analyzer.CStruct{Name: "A", Fields: []analyzer.FieldInfo{{Name: "a", CType: "long double"}}}); err == nil || !strings.Contains(err.Error(), "unsupported C type") {
+		t.Errorf("Lower() error = %v, want unsupported C type", err)
+	}
+}
+
+func TestSelectDispatch(t *testing.T) {
+	s := lowerStudent(t)
+	if err := Optimize(s, SelectDispatch); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if s.Objects[0].Dispatch != DispatchLinear || s.Root.Dispatch != DispatchTrie {
+		t.Errorf("dispatch = %v, %v, want linear for Address and trie for Student", s.Objects[0].Dispatch, s.Root.Dispatch)
+	}
+
+	// Keys of distinct lengths need no trie
+	distinct, err := Lower(analyzer.CStruct{Name: "Distinct", Fields: []analyzer.FieldInfo{
+		{Name: "a", CType: "int"}, {Name: "bb", CType: "int"}, {Name: "ccc", CType: "int"},
+		{Name: "dddd", CType: "int"}, {Name: "eeeee", CType: "int"},
+	}})
+	if err != nil {
+		t.Fatalf("Lower failed: %v", err)
+	}
+	if err := Optimize(distinct, SelectDispatch); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if distinct.Root.Dispatch != DispatchLength {
+		t.Errorf("dispatch = %v, want length for keys of distinct lengths", distinct.Root.Dispatch)
+	}
+
+	var lens []int
+	for _, group := range s.Root.KeysByLength() {
+		lens = append(lens, group.Len)
+		for _, field := range group.Fields {
+			if len(field.Key) != group.Len {
+				t.Errorf("key %s is in the group of length %d", field.Key, group.Len)
+			}
+		}
+	}
+	want := []int{3, 4, 5, 6, 10}
+	if len(lens) != len(want) {
+		t.Fatalf("group lengths = %v, want %v", lens, want)
+	}
+	for i := range want {
+		if lens[i] != want[i] {
+			t.Errorf("group lengths = %v, want %v", lens, want)
+			break
+		}
+	}
+}
+
+func TestKeyTrie(t *testing.T) {
+	var fields []*Field
+	for _, key := range []string{"cat", "car", "cab", "dog"} {
+		fields = append(fields, &Field{Key: key})
+	}
+	root := KeyTrie(fields)
+	if root.Pos != 2 || len(root.Branches) != 4 {
+		t.Fatalf("root tests position %d with %d branches, want 2 with 4", root.Pos, len(root.Branches))
+	}
+	var got []string
+	for i, branch := range root.Branches {
+		if i > 0 && root.Branches[i-1].Byte >= branch.Byte {
+			t.Errorf("branches are not sorted: %q before %q", root.Branches[i-1].Byte, branch.Byte)
+		}
+		if branch.Node.Field == nil {
+			t.Fatalf("branch %q is not a leaf", branch.Byte)
+		}
+		got = append(got, branch.Node.Field.Key)
+	}
+	if want := "cab dog car cat"; strings.Join(got, " ") != want {
+		t.Errorf("leaves = %v, want %s", got, want)
+	}
+
+	// Keys differing only late are split where they differ
+	root = KeyTrie([]*Field{{Key: "ab1"}, {Key: "ab2"}})
+	if root.Pos != 2 || root.Branches[0].Node.Field.Key != "ab1" {
+		t.Errorf("trie of ab1, ab2 tests position %d, want 2", root.Pos)
+	}
+	if leaf := KeyTrie(fields[:1]); leaf.Field != fields[0] || leaf.Branches != nil {
+		t.Errorf("trie of one key is not a leaf")
+	}
+}
+
+func TestReorderFields(t *testing.T) {
+	s := lowerStudent(t)
+	before := s.Root.Size()
+	if err := Optimize(s, ReorderFields); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	after := s.Root.Size()
+	if after >= before {
+		t.Errorf("size after reordering = %d, want less than %d", after, before)
+	}
+	for i := 1; i < len(s.Root.Layout); i++ {
+		if s.Root.Layout[i-1].Value.Align() < s.Root.Layout[i].Value.Align() {
+			t.Errorf("layout is not in decreasing alignment at %s", s.Root.Layout[i].Member)
+		}
+	}
+	if s.Root.Fields[0].Key != "active" {
+		t.Error("reordering must not change declaration order")
+	}
+}
+
+func TestEliminateDeadFields(t *testing.T) {
+	s := lowerStudent(t)
+	if err := Optimize(s, EliminateDeadFields([]string{"student-id", "home.zip", "scores"})); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	var keys []string
+	for _, field := range s.Root.Fields {
+		keys = append(keys, field.Key)
+	}
+	if got := strings.Join(keys, ","); got != "student-id,home,scores" {
+		t.Errorf("live fields = %s, want student-id,home,scores", got)
+	}
+	if len(s.Root.Layout) != 3 {
+		t.Errorf("layout has %d fields, want 3", len(s.Root.Layout))
+	}
+	if len(s.Root.KeyOrder) != 3 {
+		t.Errorf("key order has %d fields, want 3", len(s.Root.KeyOrder))
+	}
+	address := s.Root.Fields[1].Value.Object
+	if len(address.Fields) != 1 || address.Fields[0].Key != "zip" {
+		t.Errorf("Address fields = %v, want zip", address.Fields)
+	}
+	if got := strings.Join(address.Dropped, ","); got != "floor" {
+		t.Errorf("Address dropped keys = %s, want floor", got)
+	}
+
+	// Dropping every use of a nested object drops the object
+	s = lowerStudent(t)
+	if err := Optimize(s, EliminateDeadFields([]string{"name"})); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if len(s.Objects) != 1 || s.Objects[0] != s.Root {
+		t.Errorf("Objects = %v, want only Student", s.Objects)
+	}
+
+	// A path naming an object keeps all of its fields
+	s = lowerStudent(t)
+	if err := Optimize(s, EliminateDeadFields([]string{"campus"})); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if len(s.Objects[0].Fields) != 2 {
+		t.Errorf("Address has %d fields, want 2", len(s.Objects[0].Fields))
+	}
+
+	for _, tt := range []struct {
+		live        []string
+		errContains string
+	}{
+		{[]string{"missing"}, "Student has no field missing"},
+		{[]string{"home.missing"}, "Address has no field missing"},
+		{[]string{"name.first"}, "field name is not an object"},
+		{nil, "no fields of Student are live"},
+	} {
+		err := Optimize(lowerStudent(t), EliminateDeadFields(tt.live))
+		if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+			t.Errorf("EliminateDeadFields(%v) error = %v, want error containing %q", tt.live, err, tt.errContains)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	s := lowerStudent(t)
+	if err := Optimize(s, SelectDispatch, ReorderFields, RejectUnknownKeys, LenientSyntax, ReplaceInvalidUTF8); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	dump := s.String()
+	for _, expected := range []string{
+		"object Address size 7 align 1 dispatch linear\n",
+		"object Student (root) size ",
+		"dispatch trie\n",
+		`  "student-id" student_id: int64_t, required` + "\n",
+		`  "campus" campus: Address[2]` + "\n",
+		`  "zip" zip: char[6]` + "\n",
+		"  layout: student_id, gpa, name, photo, active, level, home, campus, scores\n",
+		"  unknown keys: rejected\n",
+		"  syntax: lenient\n",
+		"  invalid UTF-8: replaced\n",
+	} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("dump missing %q:\n%s", expected, dump)
+		}
+	}
+	if strings.Index(dump, "object Address") > strings.Index(dump, "object Student") {
+		t.Error("nested objects must be dumped first")
+	}
+}
+
+func keyOrder(o *Object) string {
+	keys := make([]string, len(o.KeyOrder))
+	for i, field := range o.KeyOrder {
+		keys[i] = field.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestProfileKeyOrder(t *testing.T) {
+	s := lowerStudent(t)
+	samples := []string{
+		`{"name": "ada", "extra": 1, "gpa": 3.5, "home": {"floor": 2, "zip": "95112"}, "active": true}`,
+		`{"gpa": 3.9, "name": "bob", "campus": [{"floor": 1}, {"zip": "10001", "floor": 3}], "active": false}`,
+	}
+	if err := Optimize(s, ProfileKeyOrder(samples)); err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	// name and gpa both average 0.5, so they keep declaration order; fields
+	// no sample holds follow in declaration order
+	if got, want := keyOrder(s.Root), "gpa,name,home,campus,active,student-id,level,scores,photo"; got != want {
+		t.Errorf("Student key order = %s, want %s", got, want)
+	}
+	if got, want := keyOrder(s.Objects[0]), "floor,zip"; got != want {
+		t.Errorf("Address key order = %s, want %s", got, want)
+	}
+	if len(s.Root.Fields) != 9 || s.Root.Fields[0].Key != "active" {
+		t.Error("ProfileKeyOrder changed the declaration order")
+	}
+	if !strings.Contains(s.String(), "  key order: floor, zip\n") {
+		t.Errorf("dump does not list the key order:\n%s", s)
+	}
+
+	if err := Optimize(lowerStudent(t), ProfileKeyOrder([]string{`[1]`})); err == nil || !strings.Contains(err.Error(), "sample 1: Student is not a JSON object") {
+		t.Errorf("Optimize() error = %v, want sample 1: Student is not a JSON object", err)
+	}
+}
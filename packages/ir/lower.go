@@ -0,0 +1,117 @@
+package ir
+
+import (
+	"fmt"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// intTypes and uintTypes are the integer C types the analyzer produces.
+var (
+	intTypes  = map[string]bool{"int": true, "int8_t": true, "int16_t": true, "int32_t": true, "int64_t": true}
+	uintTypes = map[string]bool{"unsigned int": true, "uint8_t": true, "uint16_t": true, "uint32_t": true, "uint64_t": true}
+)
+
+// Lower converts a struct, and the structs nested in it, into a Schema. A
+// struct nested in several places becomes one Object. Fields, Layout and
+// KeyOrder are in declaration order, and every object uses linear dispatch,
+// until passes change them.
+func Lower(cStruct analyzer.CStruct) (*Schema, error) {
+	l := &lowerer{objects: make(map[string]*Object)}
+	root, err := l.object(cStruct)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{Root: root, Objects: l.order}, nil
+}
+
+type lowerer struct {
+	objects map[string]*Object
+	order   []*Object
+}
+
+func (l *lowerer) object(cStruct analyzer.CStruct) (*Object, error) {
+	if o, ok := l.objects[cStruct.Name]; ok {
+		if o.Fields == nil {
+			return nil, fmt.Errorf("struct %s contains itself", cStruct.Name)
+		}
+		return o, nil
+	}
+	o := &Object{Name: cStruct.Name}
+	l.objects[cStruct.Name] = o
+
+	fields := make([]*Field, 0, len(cStruct.Fields))
+	for _, info := range cStruct.Fields {
+		value, err := l.value(info)
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %v", cStruct.Name, info.Name, err)
+		}
+		fields = append(fields, &Field{
+			Key:         info.Name,
+			Member:      info.Member(),
+			GoName:      info.GoName,
+			Value:       value,
+			Constraints: info.Rules,
+		})
+	}
+	o.Fields = fields
+	o.Layout = append([]*Field(nil), fields...)
+	o.KeyOrder = append([]*Field(nil), fields...)
+	l.order = append(l.order, o)
+	return o, nil
+}
+
+func (l *lowerer) value(info analyzer.FieldInfo) (Value, error) {
+	value, err := l.valueType(info)
+	value.Nullable = info.Rules.Nullable
+	value.Enum, value.MaxLength = info.Rules.Enum, info.Rules.MaxLength
+	value.Minimum, value.Maximum = info.Rules.Minimum, info.Rules.Maximum
+	return value, err
+}
+
+func (l *lowerer) valueType(info analyzer.FieldInfo) (Value, error) {
+	switch {
+	case info.Kind == "struct" || info.Struct != nil:
+		if info.Struct == nil {
+			return Value{}, fmt.Errorf("struct value has no nested struct")
+		}
+		o, err := l.object(*info.Struct)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Kind: KindObject, CType: o.Name, Object: o}, nil
+	case info.Kind == "array":
+		if info.Elem == nil || info.Len <= 0 {
+			return Value{}, fmt.Errorf("array needs an element type and a positive length")
+		}
+		elem, err := l.value(*info.Elem)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Kind: KindArray, CType: elem.CType, Len: info.Len, Elem: &elem}, nil
+	case info.CType == analyzer.BytesCType:
+		return Value{Kind: KindBytes, CType: info.CType}, nil
+	case info.Kind == "slice":
+		if info.Elem == nil {
+			return Value{}, fmt.Errorf("slice needs an element type")
+		}
+		elem, err := l.value(*info.Elem)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Kind: KindSlice, CType: elem.CType, Elem: &elem}, nil
+	case info.CType == "char*" && info.MaxLen > 0:
+		return Value{Kind: KindInlineString, CType: info.CType, MaxLen: info.MaxLen, Truncate: info.Truncate}, nil
+	case info.CType == "char*":
+		return Value{Kind: KindString, CType: info.CType}, nil
+	case info.CType == "bool":
+		return Value{Kind: KindBool, CType: info.CType}, nil
+	case info.CType == "float" || info.CType == "double":
+		return Value{Kind: KindFloat, CType: info.CType}, nil
+	case intTypes[info.CType]:
+		return Value{Kind: KindInt, CType: info.CType}, nil
+	case uintTypes[info.CType]:
+		return Value{Kind: KindUint, CType: info.CType}, nil
+	}
+	return Value{}, fmt.Errorf("unsupported C type: %s", info.CType)
+}
@@ -0,0 +1,292 @@
+package ir
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pass is a named rewrite of a Schema.
+type Pass struct {
+	Name string
+	Run  func(s *Schema) error
+}
+
+// DefaultPasses are the passes GenerateCCode applies. They leave the C layout
+// untouched, so the generated struct matches the struct it was lowered from.
+var DefaultPasses = []Pass{SelectDispatch}
+
+// Optimize runs the passes over s in order.
+func Optimize(s *Schema, passes ...Pass) error {
+	for _, pass := range passes {
+		if err := pass.Run(s); err != nil {
+			return fmt.Errorf("%s: %v", pass.Name, err)
+		}
+	}
+	return nil
+}
+
+// trieDispatchMin is the number of fields from which SelectDispatch uses a
+// decision trie rather than comparing every key.
+const trieDispatchMin = 5
+
+// SelectDispatch chooses the key dispatch of each object: linear comparison
+// for small objects, and for larger ones a switch on the key length, followed
+// by a decision trie if any two keys have the same length.
+var SelectDispatch = Pass{
+	Name: "dispatch",
+	Run: func(s *Schema) error {
+		for _, o := range s.Objects {
+			o.Dispatch = DispatchLinear
+			if len(o.Fields) >= trieDispatchMin {
+				o.Dispatch = DispatchLength
+				if len(o.KeysByLength()) < len(o.Fields) {
+					o.Dispatch = DispatchTrie
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// KeyGroup is the set of fields whose keys have the same length in bytes.
+type KeyGroup struct {
+	Len    int
+	Fields []*Field
+}
+
+// KeysByLength groups the fields of o by key length, shortest first, for
+// DispatchLength and DispatchTrie.
+func (o *Object) KeysByLength() []KeyGroup {
+	var groups []KeyGroup
+	index := make(map[int]int)
+	for _, field := range o.Fields {
+		i, ok := index[len(field.Key)]
+		if !ok {
+			i = len(groups)
+			index[len(field.Key)] = i
+			groups = append(groups, KeyGroup{Len: len(field.Key)})
+		}
+		groups[i].Fields = append(groups[i].Fields, field)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Len < groups[j].Len })
+	return groups
+}
+
+// ReorderFields orders the C members of every object by decreasing alignment,
+// which minimizes padding. Serialization keeps declaration order, so only the
+// generated struct layout changes.
+var ReorderFields = Pass{
+	Name: "reorder",
+	Run: func(s *Schema) error {
+		for _, o := range s.Objects {
+			sort.SliceStable(o.Layout, func(i, j int) bool {
+				return o.Layout[i].Value.Align() > o.Layout[j].Value.Align()
+			})
+		}
+		return nil
+	},
+}
+
+// EliminateDeadFields removes the fields no live key path reaches, so their
+// keys are skipped like unknown keys and take no space in the C struct. A
+// path such as "home.zip" keeps home and the zip field of its object, and a
+// path naming an object keeps all of its fields; array elements are reached
+// through the array's key. Liveness is per object, so an object nested in
+// several places keeps the fields live through any of them.
+func EliminateDeadFields(live []string) Pass {
+	return Pass{
+		Name: "dead-fields",
+		Run: func(s *Schema) error {
+			keep := make(map[*Field]bool)
+			for _, path := range live {
+				if err := markLive(s.Root, path, keep); err != nil {
+					return err
+				}
+			}
+			for _, o := range s.Objects {
+				for _, field := range o.Fields {
+					if !keep[field] {
+						o.Dropped = append(o.Dropped, field.Key)
+					}
+				}
+				o.Fields = filterFields(o.Fields, keep)
+				o.Layout = filterFields(o.Layout, keep)
+				o.KeyOrder = filterFields(o.KeyOrder, keep)
+			}
+			if len(s.Root.Fields) == 0 {
+				return fmt.Errorf("no fields of %s are live", s.Root.Name)
+			}
+			s.Objects = reachable(s.Root)
+			return nil
+		},
+	}
+}
+
+// RejectUnknownKeys makes the parser of every object reject keys it has no
+// field for, rather than skipping their values. The keys of fields eliminated
+// as dead are still accepted, as the input may hold them.
+var RejectUnknownKeys = Pass{
+	Name: "reject-unknown",
+	Run: func(s *Schema) error {
+		for _, o := range s.Objects {
+			o.RejectUnknown = true
+		}
+		return nil
+	},
+}
+
+// LenientSyntax makes the parser of every object accept the relaxed object
+// syntax of Object.Lenient, rather than RFC 8259's.
+var LenientSyntax = Pass{
+	Name: "lenient",
+	Run: func(s *Schema) error {
+		for _, o := range s.Objects {
+			o.Lenient = true
+		}
+		return nil
+	},
+}
+
+// ReplaceInvalidUTF8 makes the parser of every object replace invalid UTF-8
+// and unpaired surrogates in strings with U+FFFD, as encoding/json does.
+var ReplaceInvalidUTF8 = Pass{
+	Name: "replace-invalid-utf8",
+	Run: func(s *Schema) error {
+		for _, o := range s.Objects {
+			o.ReplaceInvalidUTF8 = true
+		}
+		return nil
+	},
+}
+
+// markLive marks the fields along path, and everything below its last field.
+func markLive(o *Object, path string, keep map[*Field]bool) error {
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		field := o.LookupField(key)
+		if field == nil {
+			return fmt.Errorf("live path %s: %s has no field %s", path, o.Name, key)
+		}
+		keep[field] = true
+		nested := field.Value.object()
+		if i == len(keys)-1 {
+			if nested != nil {
+				markAll(nested, keep)
+			}
+			break
+		}
+		if nested == nil {
+			return fmt.Errorf("live path %s: field %s is not an object", path, key)
+		}
+		o = nested
+	}
+	return nil
+}
+
+func markAll(o *Object, keep map[*Field]bool) {
+	for _, field := range o.Fields {
+		keep[field] = true
+		if nested := field.Value.object(); nested != nil {
+			markAll(nested, keep)
+		}
+	}
+}
+
+// object returns the object a value, or the elements of an array or slice,
+// hold.
+func (v Value) object() *Object {
+	for v.Kind == KindArray || v.Kind == KindSlice {
+		v = *v.Elem
+	}
+	return v.Object
+}
+
+func filterFields(fields []*Field, keep map[*Field]bool) []*Field {
+	kept := fields[:0]
+	for _, field := range fields {
+		if keep[field] {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// reachable lists the objects reachable from root, nested objects first.
+func reachable(root *Object) []*Object {
+	var objects []*Object
+	seen := make(map[*Object]bool)
+	var visit func(o *Object)
+	visit = func(o *Object) {
+		if seen[o] {
+			return
+		}
+		seen[o] = true
+		for _, field := range o.Fields {
+			if nested := field.Value.object(); nested != nil {
+				visit(nested)
+			}
+		}
+		objects = append(objects, o)
+	}
+	visit(root)
+	return objects
+}
+
+// scalarSizes holds the LP64 size, and alignment, of each scalar C type.
+var scalarSizes = map[string]uintptr{
+	"char*": 8, "bool": 1, "float": 4, "double": 8,
+	"int": 4, "int8_t": 1, "int16_t": 2, "int32_t": 4, "int64_t": 8,
+	"unsigned int": 4, "uint8_t": 1, "uint16_t": 2, "uint32_t": 4, "uint64_t": 8,
+}
+
+// Size returns the LP64 size of the value in a C struct. Bytes and slices
+// count both the pointer and its _len member.
+func (v Value) Size() uintptr {
+	switch v.Kind {
+	case KindInlineString:
+		return uintptr(v.MaxLen + 1)
+	case KindBytes, KindSlice:
+		return 16
+	case KindArray:
+		return v.Elem.Size() * uintptr(v.Len)
+	case KindObject:
+		return v.Object.Size()
+	}
+	return scalarSizes[v.CType]
+}
+
+// Align returns the LP64 alignment of the value in a C struct.
+func (v Value) Align() uintptr {
+	switch v.Kind {
+	case KindInlineString:
+		return 1
+	case KindBytes, KindSlice:
+		return 8
+	case KindArray:
+		return v.Elem.Align()
+	case KindObject:
+		return v.Object.Align()
+	}
+	return scalarSizes[v.CType]
+}
+
+// Align returns the alignment of the object's C struct.
+func (o *Object) Align() uintptr {
+	align := uintptr(1)
+	for _, field := range o.Layout {
+		align = max(align, field.Value.Align())
+	}
+	return align
+}
+
+// Size returns the size of the object's C struct, padding included.
+func (o *Object) Size() uintptr {
+	var size uintptr
+	for _, field := range o.Layout {
+		a := field.Value.Align()
+		size = (size+a-1)/a*a + field.Value.Size()
+	}
+	a := o.Align()
+	return (size + a - 1) / a * a
+}
@@ -0,0 +1,109 @@
+package ir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ProfileKeyOrder sets the KeyOrder of each object to the order its keys
+// arrive in across sample JSON documents, so producers whose key order
+// differs from the declaration order still hit the parser's fast path. Fields
+// are ordered by their mean position among the known keys of an object;
+// fields no sample holds keep their declaration order after the others.
+func ProfileKeyOrder(samples []string) Pass {
+	return Pass{
+		Name: "key-order",
+		Run: func(s *Schema) error {
+			p := &keyProfile{positions: make(map[*Field]*meanPosition)}
+			for i, sample := range samples {
+				if err := p.object(json.RawMessage(sample), s.Root); err != nil {
+					return fmt.Errorf("sample %d: %v", i+1, err)
+				}
+			}
+			for _, o := range s.Objects {
+				sort.SliceStable(o.KeyOrder, func(i, j int) bool {
+					return p.mean(o.KeyOrder[i]) < p.mean(o.KeyOrder[j])
+				})
+			}
+			return nil
+		},
+	}
+}
+
+type meanPosition struct {
+	sum, count int
+}
+
+// keyProfile records the positions each field's key was seen at.
+type keyProfile struct {
+	positions map[*Field]*meanPosition
+}
+
+// mean returns the mean position of field, or +Inf if no sample held it.
+func (p *keyProfile) mean(field *Field) float64 {
+	pos, ok := p.positions[field]
+	if !ok {
+		return math.Inf(1)
+	}
+	return float64(pos.sum) / float64(pos.count)
+}
+
+// object records the key positions of a JSON object parsed as o, and of the
+// objects nested in it. Keys o has no field for are ignored, as they do not
+// move the parser's expectation.
+func (p *keyProfile) object(data json.RawMessage, o *Object) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("%s is not a JSON object", o.Name)
+	}
+	for pos := 0; dec.More(); {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		field := o.LookupField(tok.(string))
+		if field == nil {
+			continue
+		}
+		mp, ok := p.positions[field]
+		if !ok {
+			mp = &meanPosition{}
+			p.positions[field] = mp
+		}
+		mp.sum += pos
+		mp.count++
+		pos++
+		if err := p.value(value, field.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value records the key positions of the objects a value of type v holds.
+// Values of another JSON type are left for the parser to reject.
+func (p *keyProfile) value(data json.RawMessage, v Value) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case v.Kind == KindObject && bytes.HasPrefix(data, []byte("{")):
+		return p.object(data, v.Object)
+	case (v.Kind == KindArray || v.Kind == KindSlice) && bytes.HasPrefix(data, []byte("[")):
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return err
+		}
+		for _, elem := range elems {
+			if err := p.value(elem, *v.Elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package ir
+
+import "sort"
+
+// TrieNode is a node of the decision trie DispatchTrie walks for keys of one
+// length. An inner node switches on the byte at Pos; a leaf holds the only
+// field whose key can still match, which must then be compared in full.
+type TrieNode struct {
+	Pos      int
+	Branches []TrieBranch // Sorted by byte
+	Field    *Field       // Set at a leaf
+}
+
+// TrieBranch leads to the subtrie of keys with Byte at the node's position.
+type TrieBranch struct {
+	Byte byte
+	Node *TrieNode
+}
+
+// KeyTrie builds the decision trie over fields, whose keys must all have the
+// same length and be distinct. Each node tests the position that splits its
+// keys into the most groups, the earliest on a tie, so the trie is shallow
+// and deterministic.
+func KeyTrie(fields []*Field) *TrieNode {
+	if len(fields) == 1 {
+		return &TrieNode{Pos: -1, Field: fields[0]}
+	}
+
+	best, bestCount := 0, 0
+	for pos := 0; pos < len(fields[0].Key); pos++ {
+		seen := make(map[byte]bool)
+		for _, field := range fields {
+			seen[field.Key[pos]] = true
+		}
+		if len(seen) > bestCount {
+			best, bestCount = pos, len(seen)
+		}
+	}
+
+	groups := make(map[byte][]*Field)
+	for _, field := range fields {
+		groups[field.Key[best]] = append(groups[field.Key[best]], field)
+	}
+	node := &TrieNode{Pos: best}
+	for b, group := range groups {
+		node.Branches = append(node.Branches, TrieBranch{Byte: b, Node: KeyTrie(group)})
+	}
+	sort.Slice(node.Branches, func(i, j int) bool { return node.Branches[i].Byte < node.Branches[j].Byte })
+	return node
+}
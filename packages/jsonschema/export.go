@@ -0,0 +1,192 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// Draft is the JSON Schema dialect written by Export.
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// intRanges holds the value range of the C integer types whose bounds are
+// exactly representable in a JSON Schema number.
+var intRanges = map[string][2]float64{
+	"int":          {math.MinInt32, math.MaxInt32},
+	"int8_t":       {math.MinInt8, math.MaxInt8},
+	"int16_t":      {math.MinInt16, math.MaxInt16},
+	"int32_t":      {math.MinInt32, math.MaxInt32},
+	"unsigned int": {0, math.MaxUint32},
+	"uint8_t":      {0, math.MaxUint8},
+	"uint16_t":     {0, math.MaxUint16},
+	"uint32_t":     {0, math.MaxUint32},
+	"uint64_t":     {0, math.Inf(1)},
+}
+
+// ExportJSON returns the indented JSON Schema document for cStruct.
+func ExportJSON(cStruct analyzer.CStruct) ([]byte, error) {
+	schema, err := Export(cStruct)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// Export builds a JSON Schema document for cStruct, the same model the
+// generated C parser is built from. Each nested struct is written once under
+// $defs and referenced with $ref, with anyOf null if it is nullable. Integer
+// fields without explicit bounds get the range of their C type, so the
+// published schema rejects what the parser would overflow on. The buffer of
+// an inline string holds bytes, which maxLength, counting characters, cannot
+// express, so it is left out. Of the other validation keywords, the parser
+// checks required, enum, minimum, maximum and maxLength; pattern and default
+// document the struct's Rules for consumers, and Import rejects a pattern.
+func Export(cStruct analyzer.CStruct) (*Schema, error) {
+	exp := &exporter{defs: make(map[string]*analyzer.CStruct)}
+	root, err := exp.object(&cStruct)
+	if err != nil {
+		return nil, err
+	}
+	root.Schema = Draft
+	root.Title = cStruct.Name
+	root.Defs = exp.schemas
+	return root, nil
+}
+
+// exporter collects the $defs of nested structs by name.
+type exporter struct {
+	defs    map[string]*analyzer.CStruct
+	schemas map[string]*Schema
+}
+
+// object converts a struct into an object schema.
+func (exp *exporter) object(cStruct *analyzer.CStruct) (*Schema, error) {
+	schema := &Schema{Type: Types{"object"}, Properties: &Properties{}}
+	for _, field := range cStruct.Fields {
+		property, err := exp.field(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", cStruct.Name, field.Name, err)
+		}
+		schema.Properties.Add(field.Name, property)
+		if field.Rules.Required {
+			schema.Required = append(schema.Required, field.Name)
+		}
+	}
+	return schema, nil
+}
+
+// field converts a single field into a property schema.
+func (exp *exporter) field(field analyzer.FieldInfo) (*Schema, error) {
+	schema := &Schema{}
+	var typ string
+	switch {
+	case field.Kind == "struct" || field.Struct != nil:
+		if field.Struct == nil {
+			return nil, fmt.Errorf("struct field has no nested struct")
+		}
+		ref, err := exp.def(field.Struct)
+		if err != nil {
+			return nil, err
+		}
+		schema.Ref = ref
+		if field.Rules.Nullable {
+			// A $ref takes no type, so null is allowed alongside it
+			schema = &Schema{AnyOf: []*Schema{schema, {Type: Types{"null"}}}}
+		}
+	case field.Elem != nil:
+		items, err := exp.field(*field.Elem)
+		if err != nil {
+			return nil, fmt.Errorf("items: %v", err)
+		}
+		typ, schema.Items = "array", items
+		if field.Len > 0 {
+			schema.MinItems, schema.MaxItems = &field.Len, &field.Len
+		}
+	case field.CType == "char*":
+		typ = "string"
+	case field.CType == analyzer.BytesCType:
+		typ, schema.ContentEncoding = "string", "base64"
+	case field.CType == "bool":
+		typ = "boolean"
+	case field.CType == "float" || field.CType == "double":
+		typ = "number"
+	case isIntCType(field.CType):
+		typ = "integer"
+		if bounds, ok := intRanges[field.CType]; ok {
+			schema.Minimum = &bounds[0]
+			if !math.IsInf(bounds[1], 1) {
+				schema.Maximum = &bounds[1]
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported C type %s", field.CType)
+	}
+
+	if typ != "" {
+		schema.Type = Types{typ}
+		if field.Rules.Nullable {
+			schema.Type = Types{typ, "null"}
+		}
+	}
+	applyRules(schema, field.Rules)
+	return schema, nil
+}
+
+// def registers a nested struct under $defs and returns its reference.
+func (exp *exporter) def(cStruct *analyzer.CStruct) (string, error) {
+	ref := "#/$defs/" + cStruct.Name
+	if existing, ok := exp.defs[cStruct.Name]; ok {
+		if existing != cStruct {
+			return "", fmt.Errorf("two different structs are named %s", cStruct.Name)
+		}
+		return ref, nil
+	}
+	exp.defs[cStruct.Name] = cStruct
+
+	schema, err := exp.object(cStruct)
+	if err != nil {
+		return "", err
+	}
+	if exp.schemas == nil {
+		exp.schemas = make(map[string]*Schema)
+	}
+	exp.schemas[cStruct.Name] = schema
+	return ref, nil
+}
+
+// applyRules writes the validation keywords of rules into schema. Explicit
+// bounds replace the C type's range.
+func applyRules(schema *Schema, rules analyzer.Rules) {
+	for _, literal := range rules.Enum {
+		schema.Enum = append(schema.Enum, json.RawMessage(literal))
+	}
+	if rules.Nullable && len(schema.Enum) > 0 {
+		schema.Enum = append(schema.Enum, json.RawMessage("null"))
+	}
+	if rules.Default != "" {
+		schema.Default = json.RawMessage(rules.Default)
+	}
+	if rules.Minimum != nil {
+		schema.Minimum = rules.Minimum
+	}
+	if rules.Maximum != nil {
+		schema.Maximum = rules.Maximum
+	}
+	if rules.MaxLength > 0 {
+		maxLength := rules.MaxLength
+		schema.MaxLength = &maxLength
+	}
+	schema.Pattern = rules.Pattern
+}
+
+// isIntCType reports whether cType is a mapped integer type.
+func isIntCType(cType string) bool {
+	switch cType {
+	case "int", "int8_t", "int16_t", "int32_t", "int64_t",
+		"unsigned int", "uint8_t", "uint16_t", "uint32_t", "uint64_t":
+		return true
+	}
+	return false
+}
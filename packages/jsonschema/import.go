@@ -0,0 +1,489 @@
+// Package jsonschema converts between JSON Schema documents and the analyzer's
+// CStruct model, so parsers can be compiled from a schema and the schema that
+// drives a parser can be published.
+//
+// The supported subset of draft 2020-12 is: type (including a "null" member
+// for nullable values), properties, required, enum, items, $ref into $defs,
+// minimum, maximum and maxLength, all of which the generated parser checks,
+// and anyOf of a schema and {"type": "null"}, which makes it nullable.
+// Strings with a contentEncoding of "base64" map to []byte. A pattern is
+// rejected on import, as the parser cannot check it.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// Schema is a JSON Schema node restricted to the supported keywords.
+type Schema struct {
+	Schema          string             `json:"$schema,omitempty"`
+	ID              string             `json:"$id,omitempty"`
+	Ref             string             `json:"$ref,omitempty"`
+	Defs            map[string]*Schema `json:"$defs,omitempty"`
+	Title           string             `json:"title,omitempty"`
+	Type            Types              `json:"type,omitempty"`
+	Properties      *Properties        `json:"properties,omitempty"`
+	Required        []string           `json:"required,omitempty"`
+	Items           *Schema            `json:"items,omitempty"`
+	AnyOf           []*Schema          `json:"anyOf,omitempty"`
+	Enum            []json.RawMessage  `json:"enum,omitempty"`
+	Default         json.RawMessage    `json:"default,omitempty"`
+	Minimum         *float64           `json:"minimum,omitempty"`
+	Maximum         *float64           `json:"maximum,omitempty"`
+	MaxLength       *int               `json:"maxLength,omitempty"`
+	Pattern         string             `json:"pattern,omitempty"`
+	ContentEncoding string             `json:"contentEncoding,omitempty"`
+	MinItems        *int               `json:"minItems,omitempty"`
+	MaxItems        *int               `json:"maxItems,omitempty"`
+}
+
+// Types is the "type" keyword, which may be a single name or a list.
+type Types []string
+
+// UnmarshalJSON accepts both "string" and ["string", "null"].
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*t = list
+	return nil
+}
+
+// MarshalJSON writes a single type as a plain string.
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// Properties is the "properties" keyword. Unlike a map it keeps the document
+// order, which becomes the field order of the generated struct.
+type Properties struct {
+	Names   []string
+	Schemas map[string]*Schema
+}
+
+// Add appends a property, replacing any existing one with the same name.
+func (p *Properties) Add(name string, schema *Schema) {
+	if p.Schemas == nil {
+		p.Schemas = make(map[string]*Schema)
+	}
+	if _, ok := p.Schemas[name]; !ok {
+		p.Names = append(p.Names, name)
+	}
+	p.Schemas[name] = schema
+}
+
+// UnmarshalJSON decodes the properties object in document order.
+func (p *Properties) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return errors.New("properties must be an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var schema Schema
+		if err := dec.Decode(&schema); err != nil {
+			return fmt.Errorf("property %s: %v", tok, err)
+		}
+		p.Add(tok.(string), &schema)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the properties object in order.
+func (p Properties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range p.Names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(p.Schemas[name])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// ImportFile reads a JSON Schema file and converts it with Import.
+func ImportFile(path, name string) (analyzer.CStruct, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("failed to read schema: %v", err)
+	}
+	return Import(data, name)
+}
+
+// Import converts a JSON Schema document describing an object into a CStruct.
+// The root struct is called name, or the schema's title when name is empty.
+// Nested objects become nested CStructs named after their $defs entry, or
+// after the parent struct and field for inline objects.
+func Import(data []byte, name string) (analyzer.CStruct, error) {
+	var root Schema
+	if err := json.Unmarshal(data, &root); err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("invalid schema: %v", err)
+	}
+	if name == "" {
+		name = analyzer.GoFieldName(root.Title)
+		if root.Title == "" {
+			return analyzer.CStruct{}, errors.New("schema has no title; a struct name is required")
+		}
+	}
+
+	imp := &importer{
+		root:      &root,
+		defs:      make(map[string]*analyzer.CStruct),
+		resolving: make(map[string]bool),
+	}
+	node, err := imp.deref(&root)
+	if err != nil {
+		return analyzer.CStruct{}, err
+	}
+	if !node.hasType("object") {
+		return analyzer.CStruct{}, errors.New("root schema must be an object")
+	}
+	cStruct, err := imp.object(node, name)
+	if err != nil {
+		return analyzer.CStruct{}, err
+	}
+	return *cStruct, nil
+}
+
+// importer carries the document being converted and the $defs already built,
+// so that every reference to a definition shares one CStruct.
+type importer struct {
+	root      *Schema
+	defs      map[string]*analyzer.CStruct
+	resolving map[string]bool
+}
+
+// object converts an object schema into a CStruct.
+func (imp *importer) object(s *Schema, name string) (*analyzer.CStruct, error) {
+	cStruct := &analyzer.CStruct{Name: name}
+	if s.Properties == nil {
+		return cStruct, nil
+	}
+
+	required := make(map[string]bool)
+	for _, key := range s.Required {
+		required[key] = true
+	}
+
+	// Keys that are not C identifiers, e.g. "first-name", get a member name
+	members := analyzer.CFieldNames(s.Properties.Names)
+	for i, key := range s.Properties.Names {
+		field, err := imp.field(s.Properties.Schemas[key], key, name)
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %v", key, err)
+		}
+		field.Rules.Required = required[key]
+		if members[i] != key {
+			field.CName = members[i]
+		}
+		cStruct.Fields = append(cStruct.Fields, field)
+	}
+	return cStruct, nil
+}
+
+// field converts a property (or array item) schema into a FieldInfo. parent
+// names the enclosing struct and is used to name inline nested objects.
+func (imp *importer) field(s *Schema, key, parent string) (analyzer.FieldInfo, error) {
+	field := analyzer.FieldInfo{Name: key, GoName: analyzer.GoFieldName(key)}
+	anyNull := false
+	if len(s.AnyOf) > 0 {
+		// A nullable $ref is written as anyOf it and null
+		inner, ok := s.orNull()
+		if !ok {
+			return field, errors.New("anyOf is only supported with two schemas, one of them {\"type\": \"null\"}")
+		}
+		s, anyNull = inner, true
+	}
+
+	// A reference names the nested struct after its definition
+	structName := parent + field.GoName
+	if s.Ref != "" {
+		structName = analyzer.GoFieldName(refName(s.Ref))
+	}
+	node, err := imp.deref(s)
+	if err != nil {
+		return field, err
+	}
+
+	typ, nullable, err := node.valueType()
+	if err != nil {
+		return field, err
+	}
+	field.Rules.Nullable = nullable || anyNull
+	if err := node.rules(&field.Rules); err != nil {
+		return field, err
+	}
+
+	switch typ {
+	case "string":
+		field.CType, field.Kind = "char*", "string"
+		if node.ContentEncoding == "base64" {
+			field.CType, field.Kind = analyzer.BytesCType, "slice"
+		}
+	case "integer":
+		// JSON Schema integers are unbounded, so only a minimum and maximum
+		// that both fit narrow one to a C int
+		field.CType, field.Kind = "int64_t", "int64"
+		if fitsInt32(node.Minimum) && fitsInt32(node.Maximum) {
+			field.CType, field.Kind = "int", "int"
+		}
+	case "number":
+		field.CType, field.Kind = "double", "float64"
+	case "boolean":
+		field.CType, field.Kind = "bool", "bool"
+	case "object":
+		nested, err := imp.objectOrDef(s, node, structName)
+		if err != nil {
+			return field, err
+		}
+		field.CType, field.Kind, field.Struct = nested.Name, "struct", nested
+	case "array":
+		if node.Items == nil {
+			return field, errors.New("array schema must declare items")
+		}
+		elem, err := imp.field(node.Items, key, parent)
+		if err != nil {
+			return field, fmt.Errorf("items: %v", err)
+		}
+		field.Elem = &elem
+		field.CType, field.Kind = elem.CType+"*", "slice"
+		if node.MinItems != nil && node.MaxItems != nil && *node.MinItems == *node.MaxItems && *node.MaxItems > 0 {
+			// An exact item count maps to a fixed C array
+			field.CType, field.Kind, field.Len = elem.CType, "array", *node.MaxItems
+		}
+	default:
+		return field, fmt.Errorf("unsupported schema type %q", typ)
+	}
+	return field, nil
+}
+
+// objectOrDef converts a nested object, reusing the CStruct for a $defs entry.
+func (imp *importer) objectOrDef(s, node *Schema, name string) (*analyzer.CStruct, error) {
+	if s.Ref == "" {
+		return imp.object(node, name)
+	}
+	if cStruct, ok := imp.defs[s.Ref]; ok {
+		return cStruct, nil
+	}
+	if imp.resolving[s.Ref] {
+		return nil, fmt.Errorf("recursive reference %s", s.Ref)
+	}
+	imp.resolving[s.Ref] = true
+	defer delete(imp.resolving, s.Ref)
+
+	cStruct, err := imp.object(node, name)
+	if err != nil {
+		return nil, err
+	}
+	imp.defs[s.Ref] = cStruct
+	return cStruct, nil
+}
+
+// deref follows a local $ref into the root's $defs.
+func (imp *importer) deref(s *Schema) (*Schema, error) {
+	for seen := 0; s.Ref != ""; seen++ {
+		if seen > len(imp.root.Defs) {
+			return nil, fmt.Errorf("circular reference %s", s.Ref)
+		}
+		name := refName(s.Ref)
+		if !strings.HasPrefix(s.Ref, "#/$defs/") || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("unsupported reference %s: only #/$defs/<name> is supported", s.Ref)
+		}
+		def, ok := imp.root.Defs[name]
+		if !ok {
+			return nil, fmt.Errorf("undefined reference %s", s.Ref)
+		}
+		s = def
+	}
+	return s, nil
+}
+
+// refName returns the last path segment of a reference.
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// orNull returns the schema of anyOf other than {"type": "null"}, if it has
+// two schemas and one of them is that.
+func (s *Schema) orNull() (*Schema, bool) {
+	if len(s.AnyOf) != 2 {
+		return nil, false
+	}
+	for i, alt := range s.AnyOf {
+		if len(alt.Type) == 1 && alt.Type[0] == "null" {
+			return s.AnyOf[1-i], true
+		}
+	}
+	return nil, false
+}
+
+// hasType reports whether the schema allows the given type.
+func (s *Schema) hasType(typ string) bool {
+	for _, t := range s.Type {
+		if t == typ {
+			return true
+		}
+	}
+	return len(s.Type) == 0 && typ == "object" && s.Properties != nil
+}
+
+// valueType returns the single non-null type of a schema and whether null is
+// also allowed. Without a type keyword the type is taken from properties,
+// items or the enum values.
+func (s *Schema) valueType() (typ string, nullable bool, err error) {
+	for _, t := range s.Type {
+		switch {
+		case t == "null":
+			nullable = true
+		case typ != "":
+			return "", false, fmt.Errorf("union type %v is not supported", []string(s.Type))
+		default:
+			typ = t
+		}
+	}
+	if typ != "" {
+		return typ, nullable, nil
+	}
+
+	switch {
+	case len(s.Type) > 0:
+		return "", false, errors.New("null-only type is not supported")
+	case s.Properties != nil:
+		return "object", false, nil
+	case s.Items != nil:
+		return "array", false, nil
+	case len(s.Enum) > 0:
+		return enumType(s.Enum)
+	}
+	return "", false, errors.New("schema has no type")
+}
+
+// enumType infers the type of an enum without a type keyword.
+func enumType(values []json.RawMessage) (typ string, nullable bool, err error) {
+	for _, raw := range values {
+		var t string
+		switch v := jsonValue(raw).(type) {
+		case nil:
+			nullable = true
+			continue
+		case string:
+			t = "string"
+		case bool:
+			t = "boolean"
+		case json.Number:
+			t = "number"
+			if !strings.ContainsAny(v.String(), ".eE") {
+				t = "integer"
+			}
+		default:
+			return "", false, errors.New("enum values must be scalars")
+		}
+		switch {
+		case typ == "" || typ == t:
+			typ = t
+		case typ == "integer" && t == "number", typ == "number" && t == "integer":
+			typ = "number"
+		default:
+			return "", false, errors.New("enum values must share one type")
+		}
+	}
+	if typ == "" {
+		return "", false, errors.New("enum has no non-null values")
+	}
+	return typ, nullable, nil
+}
+
+// rules copies the validation keywords into r.
+func (s *Schema) rules(r *analyzer.Rules) error {
+	for _, value := range s.Enum {
+		literal, err := compactLiteral(value)
+		if err != nil {
+			return fmt.Errorf("enum: %v", err)
+		}
+		if literal == "null" {
+			r.Nullable = true
+			continue
+		}
+		r.Enum = append(r.Enum, literal)
+	}
+	if len(s.Default) > 0 {
+		literal, err := compactLiteral(s.Default)
+		if err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+		r.Default = literal
+	}
+	r.Minimum, r.Maximum = s.Minimum, s.Maximum
+	if s.MaxLength != nil {
+		if *s.MaxLength < 0 {
+			return errors.New("maxLength must not be negative")
+		}
+		r.MaxLength = *s.MaxLength
+	}
+	if s.Pattern != "" {
+		// Rather than import a rule the parser would silently not check
+		return errors.New("pattern is not supported, as generated parsers cannot check it")
+	}
+	return nil
+}
+
+// compactLiteral normalizes a scalar JSON value to its compact literal form.
+func compactLiteral(raw json.RawMessage) (string, error) {
+	switch jsonValue(raw).(type) {
+	case nil, string, bool, json.Number:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	return "", errors.New("only scalar values are supported")
+}
+
+// jsonValue decodes raw with numbers kept as json.Number. Invalid input
+// decodes to a struct{} so that it matches no scalar case.
+func jsonValue(raw json.RawMessage) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return struct{}{}
+	}
+	return v
+}
+
+// fitsInt32 reports whether an optional bound is set and fits in a C int.
+func fitsInt32(bound *float64) bool {
+	return bound != nil && *bound >= -2147483648 && *bound <= 2147483647
+}
@@ -0,0 +1,375 @@
+package jsonschema
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+	"github.com/arifali123/152compiler2/packages/compiler"
+)
+
+const studentSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "student",
+	"type": "object",
+	"properties": {
+		"first_name": {"type": "string", "maxLength": 32},
+		"student_id": {"type": "integer", "minimum": 1, "maximum": 99999},
+		"gpa": {"type": ["number", "null"], "minimum": 0, "maximum": 4.0},
+		"enrolled": {"type": "boolean", "default": true},
+		"level": {"enum": ["freshman", "sophomore", null]},
+		"photo": {"type": "string", "contentEncoding": "base64"},
+		"home": {"$ref": "#/$defs/address"},
+		"campus": {"anyOf": [{"$ref": "#/$defs/address"}, {"type": "null"}]},
+		"advisor": {
+			"type": "object",
+			"properties": {"name": {"type": "string"}},
+			"required": ["name"]
+		},
+		"scores": {"type": "array", "items": {"type": "integer"}},
+		"rgb": {"type": "array", "items": {"type": "integer"}, "minItems": 3, "maxItems": 3},
+		"big": {"type": "integer", "maximum": 10000000000}
+	},
+	"required": ["first_name", "student_id"],
+	"$defs": {
+		"address": {
+			"type": "object",
+			"properties": {
+				"street": {"type": "string"},
+				"zip": {"type": "string", "maxLength": 5}
+			}
+		}
+	}
+}`
+
+func TestImport(t *testing.T) {
+	cStruct, err := Import([]byte(studentSchema), "")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if cStruct.Name != "Student" {
+		t.Errorf("expected struct name Student, got %q", cStruct.Name)
+	}
+
+	expected := []struct {
+		name  string
+		cType string
+		kind  string
+	}{
+		{"first_name", "char*", "string"},
+		{"student_id", "int", "int"},
+		{"gpa", "double", "float64"},
+		{"enrolled", "bool", "bool"},
+		{"level", "char*", "string"},
+		{"photo", analyzer.BytesCType, "slice"},
+		{"home", "Address", "struct"},
+		{"campus", "Address", "struct"},
+		{"advisor", "StudentAdvisor", "struct"},
+		{"scores", "int64_t*", "slice"},
+		{"rgb", "int64_t", "array"},
+		{"big", "int64_t", "int64"},
+	}
+	if len(cStruct.Fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(cStruct.Fields))
+	}
+	fields := make(map[string]analyzer.FieldInfo)
+	for i, fi := range cStruct.Fields {
+		exp := expected[i]
+		if fi.Name != exp.name || fi.CType != exp.cType || fi.Kind != exp.kind {
+			t.Errorf("field %d - expected (%s, %s, %s), got (%s, %s, %s)",
+				i, exp.name, exp.cType, exp.kind, fi.Name, fi.CType, fi.Kind)
+		}
+		fields[fi.Name] = fi
+	}
+
+	t.Run("rules", func(t *testing.T) {
+		first := fields["first_name"].Rules
+		if !first.Required || first.MaxLength != 32 {
+			t.Errorf("first_name rules = %+v", first)
+		}
+		id := fields["student_id"].Rules
+		if !id.Required || id.Minimum == nil || *id.Minimum != 1 || id.Maximum == nil || *id.Maximum != 99999 {
+			t.Errorf("student_id rules = %+v", id)
+		}
+		if gpa := fields["gpa"].Rules; !gpa.Nullable || gpa.Required {
+			t.Errorf("gpa rules = %+v", gpa)
+		}
+		if enrolled := fields["enrolled"].Rules; enrolled.Default != "true" {
+			t.Errorf("enrolled default = %q, want true", enrolled.Default)
+		}
+		level := fields["level"].Rules
+		if !reflect.DeepEqual(level.Enum, []string{`"freshman"`, `"sophomore"`}) || !level.Nullable {
+			t.Errorf("level rules = %+v", level)
+		}
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		home, campus := fields["home"], fields["campus"]
+		if home.Struct == nil || home.Struct != campus.Struct {
+			t.Fatalf("expected $defs references to share one CStruct")
+		}
+		if home.Rules.Nullable || !campus.Rules.Nullable {
+			t.Errorf("expected only campus, anyOf its reference and null, to be nullable")
+		}
+		if len(home.Struct.Fields) != 2 || home.Struct.Fields[1].Rules.MaxLength != 5 {
+			t.Errorf("unexpected Address fields: %+v", home.Struct.Fields)
+		}
+		advisor := fields["advisor"].Struct
+		if advisor == nil || len(advisor.Fields) != 1 || !advisor.Fields[0].Rules.Required {
+			t.Errorf("unexpected advisor struct: %+v", advisor)
+		}
+	})
+
+	t.Run("arrays", func(t *testing.T) {
+		scores := fields["scores"]
+		if scores.Elem == nil || scores.Elem.CType != "int64_t" || scores.Len != 0 {
+			t.Errorf("unexpected scores field: %+v", scores)
+		}
+		if rgb := fields["rgb"]; rgb.Elem == nil || rgb.Len != 3 {
+			t.Errorf("unexpected rgb field: %+v", rgb)
+		}
+	})
+}
+
+func TestImportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "student.json")
+	if err := os.WriteFile(path, []byte(studentSchema), 0644); err != nil {
+		t.Fatalf("failed to write schema: %v", err)
+	}
+	cStruct, err := ImportFile(path, "Pupil")
+	if err != nil {
+		t.Fatalf("ImportFile failed: %v", err)
+	}
+	if cStruct.Name != "Pupil" {
+		t.Errorf("expected struct name Pupil, got %q", cStruct.Name)
+	}
+	if cStruct.Fields[8].CType != "PupilAdvisor" {
+		t.Errorf("expected inline object named after the root, got %q", cStruct.Fields[8].CType)
+	}
+}
+
+func TestImportMemberNames(t *testing.T) {
+	schema := `{"title": "contact", "properties": {
+		"first-name": {"type": "string"},
+		"first_name": {"type": "string"},
+		"2fa": {"type": "boolean"},
+		"default": {"type": "integer"}
+	}, "required": ["first-name"]}`
+	cStruct, err := Import([]byte(schema), "")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	want := []string{"first_name2", "first_name", "f2fa", "default_"}
+	for i, field := range cStruct.Fields {
+		if field.Member() != want[i] {
+			t.Errorf("field %s has member %q, want %q", field.Name, field.Member(), want[i])
+		}
+	}
+
+	parser, err := compiler.CompileAndBuild(cStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+	result, err := parser.Parse(`{"first-name": "Ada", "first_name": "A.", "2fa": true, "default": 3}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if result["first-name"] != "Ada" || result["first_name"] != "A." || result["2fa"] != true || result["default"] != "3" {
+		t.Errorf("Parse() = %v", result)
+	}
+}
+
+func TestImportArrays(t *testing.T) {
+	schema := `{"title": "route", "properties": {
+		"stops": {"type": "array", "items": {
+			"type": "object",
+			"properties": {"name": {"type": "string"}, "legs": {"type": "array", "items": {"type": "integer"}}},
+			"required": ["name"]
+		}},
+		"tags": {"type": ["array", "null"], "items": {"type": "string"}},
+		"origin": {"type": "array", "items": {"type": "number"}, "minItems": 2, "maxItems": 2}
+	}}`
+	cStruct, err := Import([]byte(schema), "")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	parser, err := compiler.CompileAndBuild(cStruct)
+	if err != nil {
+		t.Fatalf("Failed to compile parser: %v", err)
+	}
+	defer parser.Close()
+	result, err := parser.Parse(`{"stops": [{"name": "a", "legs": [1, 2, 3]}, {"name": "b", "legs": []}],
+		"tags": null, "origin": [1.5, -2]}`)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"stops": []interface{}{
+			map[string]interface{}{"name": "a", "legs": []interface{}{"1", "2", "3"}},
+			map[string]interface{}{"name": "b", "legs": []interface{}{}},
+		},
+		"tags":   []interface{}{},
+		"origin": []interface{}{"1.5", "-2"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Parse() = %v, want %v", result, expected)
+	}
+	if _, err := parser.Parse(`{"stops": [{"legs": []}]}`); err == nil {
+		t.Error("Parse() of a stop without a name succeeded, want error")
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		schema      string
+		errContains string
+	}{
+		{"invalid json", `{"type": `, "invalid schema"},
+		{"no title", `{"type": "object"}`, "a struct name is required"},
+		{"root not object", `{"title": "x", "type": "string"}`, "root schema must be an object"},
+		{"union type", `{"title": "x", "properties": {"a": {"type": ["string", "integer"]}}}`, "union type"},
+		{"no type", `{"title": "x", "properties": {"a": {}}}`, "schema has no type"},
+		{"null type", `{"title": "x", "properties": {"a": {"type": "null"}}}`, "null-only type"},
+		{"array without items", `{"title": "x", "properties": {"a": {"type": "array"}}}`, "must declare items"},
+		{"undefined ref", `{"title": "x", "properties": {"a": {"$ref": "#/$defs/missing"}}}`, "undefined reference"},
+		{"remote ref", `{"title": "x", "properties": {"a": {"$ref": "other.json"}}}`, "unsupported reference"},
+		{"recursive ref", `{"title": "x", "properties": {"a": {"$ref": "#/$defs/node"}},
+			"$defs": {"node": {"type": "object", "properties": {"next": {"$ref": "#/$defs/node"}}}}}`, "recursive reference"},
+		{"anyOf", `{"title": "x", "properties": {"a": {"anyOf": [{"type": "string"}, {"type": "integer"}]}}}`, "anyOf is only supported"},
+		{"mixed enum", `{"title": "x", "properties": {"a": {"enum": ["a", 1]}}}`, "share one type"},
+		{"pattern", `{"title": "x", "properties": {"a": {"type": "string", "pattern": "^[A-Z]"}}}`, "pattern is not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Import([]byte(tt.schema), "")
+			if err == nil {
+				t.Fatalf("Import() error = nil, want error containing %q", tt.errContains)
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Import() error = %v, want error containing %q", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	original, err := Import([]byte(studentSchema), "")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	data, err := ExportJSON(original)
+	if err != nil {
+		t.Fatalf("ExportJSON failed: %v", err)
+	}
+	roundTrip, err := Import(data, "")
+	if err != nil {
+		t.Fatalf("re-Import failed: %v\n%s", err, data)
+	}
+
+	var compare func(path string, a, b []analyzer.FieldInfo)
+	compare = func(path string, a, b []analyzer.FieldInfo) {
+		if len(a) != len(b) {
+			t.Fatalf("%s: expected %d fields, got %d", path, len(a), len(b))
+		}
+		for i := range a {
+			x, y := a[i], b[i]
+			if x.Name != y.Name || x.CType != y.CType || x.Kind != y.Kind || x.Len != y.Len ||
+				x.Rules.Required != y.Rules.Required || x.Rules.Nullable != y.Rules.Nullable ||
+				!reflect.DeepEqual(x.Rules.Enum, y.Rules.Enum) || x.Rules.Pattern != y.Rules.Pattern ||
+				x.Rules.MaxLength != y.Rules.MaxLength || x.Rules.Default != y.Rules.Default {
+				t.Errorf("%s.%s: expected %+v, got %+v", path, x.Name, x, y)
+			}
+			if x.Struct != nil {
+				compare(path+"."+x.Name, x.Struct.Fields, y.Struct.Fields)
+			}
+		}
+	}
+	compare(original.Name, original.Fields, roundTrip.Fields)
+}
+
+func TestExport(t *testing.T) {
+	type Course struct {
+		Title    string  `json:"title" required:"true" pattern:"^[A-Z]"`
+		Credits  uint8   `json:"credits" maximum:"6"`
+		Level    string  `json:"level" enum:"intro,advanced" default:"intro"`
+		Grade    float64 `json:"grade" nullable:"true"`
+		Syllabus []byte  `json:"syllabus"`
+		Code     string  `json:"code" maxlen:"8"`
+		Room     string  `json:"room" maxlen:"4,truncate"`
+	}
+
+	fieldInfos, err := analyzer.AnalyzeStruct(reflect.TypeOf(Course{}))
+	if err != nil {
+		t.Fatalf("AnalyzeStruct failed: %v", err)
+	}
+	address := &analyzer.CStruct{Name: "Address", Fields: []analyzer.FieldInfo{{Name: "street", CType: "char*"}}}
+	fieldInfos = append(fieldInfos,
+		analyzer.FieldInfo{Name: "home", CType: "Address", Kind: "struct", Struct: address},
+		analyzer.FieldInfo{Name: "office", CType: "Address", Kind: "struct", Struct: address, Rules: analyzer.Rules{Nullable: true}},
+	)
+
+	data, err := ExportJSON(analyzer.CStruct{Name: "Course", Fields: fieldInfos})
+	if err != nil {
+		t.Fatalf("ExportJSON failed: %v", err)
+	}
+	for _, expected := range []string{
+		`"$schema": "https://json-schema.org/draft/2020-12/schema"`,
+		`"title": "Course"`,
+		`"required": [
+    "title"
+  ]`,
+		`"pattern": "^[A-Z]"`,
+		`"minimum": 0,
+      "maximum": 6`,
+		`"enum": [
+        "intro",
+        "advanced"
+      ]`,
+		`"default": "intro"`,
+		`"type": [
+        "number",
+        "null"
+      ]`,
+		`"contentEncoding": "base64"`,
+		`"code": {
+      "type": "string"
+    }`,
+		`"room": {
+      "type": "string"
+    }`,
+		`"$ref": "#/$defs/Address"`,
+		`"office": {
+      "anyOf": [
+        {
+          "$ref": "#/$defs/Address"
+        },
+        {
+          "type": "null"
+        }
+      ]
+    }`,
+		`"$defs": {
+    "Address": {`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("schema missing expected content: %s\n%s", expected, data)
+		}
+	}
+
+	t.Run("conflicting struct names", func(t *testing.T) {
+		other := &analyzer.CStruct{Name: "Address", Fields: []analyzer.FieldInfo{{Name: "zip", CType: "char*"}}}
+		_, err := Export(analyzer.CStruct{Name: "Course", Fields: []analyzer.FieldInfo{
+			{Name: "home", CType: "Address", Kind: "struct", Struct: address},
+			{Name: "office", CType: "Address", Kind: "struct", Struct: other},
+		}})
+		if err == nil || !strings.Contains(err.Error(), "two different structs are named Address") {
+			t.Errorf("Export() error = %v, want conflicting name error", err)
+		}
+	})
+}
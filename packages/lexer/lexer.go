@@ -136,11 +136,19 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
-// readString reads a string literal.
+// readString reads a string literal. Escape sequences are skipped over, not
+// decoded, so the literal is the raw text between the quotes.
 func (l *Lexer) readString() (string, error) {
 	position := l.position + 1 // skip opening quote
 	for {
 		l.readChar()
+		if l.ch == '\\' {
+			l.readChar() // the escaped character cannot end the string
+			if l.ch == 0 {
+				return "", ErrUnterminatedString
+			}
+			continue
+		}
 		if l.ch == '"' {
 			break
 		}
@@ -168,6 +176,15 @@ func (l *Lexer) readNumber() string {
 			l.readChar()
 		}
 	}
+	if l.ch == 'e' || l.ch == 'E' {
+		l.readChar()
+		if l.ch == '+' || l.ch == '-' {
+			l.readChar()
+		}
+		for isDigit(l.ch) {
+			l.readChar()
+		}
+	}
 	return l.input[position:l.position]
 }
 
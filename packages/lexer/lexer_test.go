@@ -121,6 +121,9 @@ func TestLexer_Numbers(t *testing.T) {
 		{"-3.14", "-3.14"},
 		{"0.123", "0.123"},
 		{"-0.123", "-0.123"},
+		{"1e10", "1e10"},
+		{"-2.5E-3", "-2.5E-3"},
+		{"6.02e+23", "6.02e+23"},
 	}
 
 	for i, tt := range tests {
@@ -141,3 +144,23 @@ func TestLexerError_Error(t *testing.T) {
 		t.Errorf("expected error message %q, got %q", "test error message", err.Error())
 	}
 }
+
+func TestLexer_Strings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Token
+	}{
+		{`"plain"`, Token{Type: TokenString, Literal: "plain"}},
+		{`"say \"hi\""`, Token{Type: TokenString, Literal: `say \"hi\"`}},
+		{`"back\\"`, Token{Type: TokenString, Literal: `back\\`}},
+		{`"tab\tand \u00e9"`, Token{Type: TokenString, Literal: `tab\tand \u00e9`}},
+		{`"dangling\`, Token{Type: TokenIllegal, Literal: "unterminated string"}},
+	}
+
+	for i, tt := range tests {
+		tok := NewLexer(tt.input).NextToken()
+		if tok != tt.expected {
+			t.Errorf("test case %d - expected (%v, %q), got (%v, %q)", i, tt.expected.Type, tt.expected.Literal, tok.Type, tok.Literal)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// Builder assembles a CStruct programmatically, for schemas that come from
+// neither a Go type nor a document:
+//
+//	b := schema.NewBuilder("Student")
+//	b.String("first_name").Required()
+//	b.Int("student_id").Min(1)
+//	b.InlineString("code", 8)
+//	b.Object("home", address)
+//	student, err := b.Build()
+//
+// Errors are collected and reported by Build. Keys that are not C
+// identifiers, such as "first-name", are given a member name in CName.
+type Builder struct {
+	cStruct analyzer.CStruct
+	errs    []error
+}
+
+// FieldBuilder sets options on a field added to a Builder, even after more
+// fields are added.
+type FieldBuilder struct {
+	index int
+	b     *Builder
+}
+
+// NewBuilder starts a struct with the given C name.
+func NewBuilder(name string) *Builder {
+	return &Builder{cStruct: analyzer.CStruct{Name: name}}
+}
+
+// Field adds a field with an explicit C type. The Go name is derived from the
+// JSON key.
+func (b *Builder) Field(name, cType string) *FieldBuilder {
+	return b.add(Scalar(cType), name)
+}
+
+// String adds a heap-allocated string field.
+func (b *Builder) String(name string) *FieldBuilder { return b.Field(name, "char*") }
+
+// Int adds a C int field.
+func (b *Builder) Int(name string) *FieldBuilder { return b.Field(name, "int") }
+
+// Int64 adds an int64_t field.
+func (b *Builder) Int64(name string) *FieldBuilder { return b.Field(name, "int64_t") }
+
+// Float adds a double field.
+func (b *Builder) Float(name string) *FieldBuilder { return b.Field(name, "double") }
+
+// Bool adds a bool field.
+func (b *Builder) Bool(name string) *FieldBuilder { return b.Field(name, "bool") }
+
+// Bytes adds a base64-encoded binary field.
+func (b *Builder) Bytes(name string) *FieldBuilder { return b.Field(name, analyzer.BytesCType) }
+
+// InlineString adds a string stored inline as char[maxLen+1].
+func (b *Builder) InlineString(name string, maxLen int) *FieldBuilder {
+	return b.String(name).MaxLen(maxLen, false)
+}
+
+// Object adds a nested struct field.
+func (b *Builder) Object(name string, nested *analyzer.CStruct) *FieldBuilder {
+	if nested == nil {
+		b.errs = append(b.errs, fmt.Errorf("field %s: nil nested struct", name))
+		nested = &analyzer.CStruct{}
+	}
+	return b.add(Nested(nested), name)
+}
+
+// Slice adds a variable-length array of elem.
+func (b *Builder) Slice(name string, elem analyzer.FieldInfo) *FieldBuilder {
+	return b.add(analyzer.FieldInfo{CType: elem.CType + "*", Kind: "slice", Elem: &elem}, name)
+}
+
+// Array adds a fixed-length array of n elements.
+func (b *Builder) Array(name string, elem analyzer.FieldInfo, n int) *FieldBuilder {
+	if n <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("field %s: array length must be positive", name))
+	}
+	return b.add(analyzer.FieldInfo{CType: elem.CType, Kind: "array", Elem: &elem, Len: n}, name)
+}
+
+func (b *Builder) add(field analyzer.FieldInfo, name string) *FieldBuilder {
+	field.Name = name
+	field.GoName = analyzer.GoFieldName(name)
+	b.cStruct.Fields = append(b.cStruct.Fields, field)
+	return &FieldBuilder{index: len(b.cStruct.Fields) - 1, b: b}
+}
+
+// Build returns the struct, or every problem found while building it. Later
+// Builder calls do not affect a returned struct.
+func (b *Builder) Build() (analyzer.CStruct, error) {
+	errs := append([]error(nil), b.errs...)
+	if b.cStruct.Name == "" {
+		errs = append(errs, errors.New("empty struct name"))
+	}
+	names := make(map[string]bool)
+	for _, field := range b.cStruct.Fields {
+		switch {
+		case field.Name == "":
+			errs = append(errs, errors.New("empty field name"))
+		case names[field.Name]:
+			errs = append(errs, fmt.Errorf("duplicate field name: %s", field.Name))
+		}
+		names[field.Name] = true
+	}
+	if err := errors.Join(errs...); err != nil {
+		return analyzer.CStruct{}, err
+	}
+
+	cStruct := b.cStruct
+	cStruct.Fields = append([]analyzer.FieldInfo(nil), b.cStruct.Fields...)
+	analyzer.AssignMembers(cStruct.Fields)
+	return cStruct, nil
+}
+
+// Scalar describes a value of the given C type, for use as a Slice or Array
+// element. Kind is filled in for the C types in analyzer.TypeMapping.
+func Scalar(cType string) analyzer.FieldInfo {
+	field := analyzer.FieldInfo{CType: cType}
+	for kind, mapped := range analyzer.TypeMapping {
+		if mapped == cType {
+			field.Kind = kind.String()
+		}
+	}
+	if cType == analyzer.BytesCType {
+		field.Kind = reflect.Slice.String()
+	}
+	return field
+}
+
+// Nested describes a nested struct value, for use as a Slice or Array element.
+func Nested(nested *analyzer.CStruct) analyzer.FieldInfo {
+	return analyzer.FieldInfo{CType: nested.Name, Kind: "struct", Struct: nested}
+}
+
+// field returns the field, looked up through the Builder as appending moves
+// its fields.
+func (f *FieldBuilder) field() *analyzer.FieldInfo {
+	return &f.b.cStruct.Fields[f.index]
+}
+
+// GoName overrides the Go field name.
+func (f *FieldBuilder) GoName(name string) *FieldBuilder {
+	f.field().GoName = name
+	return f
+}
+
+// MaxLen stores a string inline with room for maxLen bytes.
+func (f *FieldBuilder) MaxLen(maxLen int, truncate bool) *FieldBuilder {
+	field := f.field()
+	if field.CType != "char*" || maxLen <= 0 {
+		f.b.errs = append(f.b.errs, fmt.Errorf("field %s: maxlen needs a string field and a positive length", field.Name))
+	}
+	field.MaxLen, field.Truncate = maxLen, truncate
+	return f
+}
+
+// Required marks the key as mandatory.
+func (f *FieldBuilder) Required() *FieldBuilder {
+	f.field().Rules.Required = true
+	return f
+}
+
+// Nullable accepts null as a value.
+func (f *FieldBuilder) Nullable() *FieldBuilder {
+	f.field().Rules.Nullable = true
+	return f
+}
+
+// Enum restricts the value to the given JSON literals, e.g. `"red"` or `3`.
+func (f *FieldBuilder) Enum(literals ...string) *FieldBuilder {
+	rules := &f.field().Rules
+	rules.Enum = append(rules.Enum, literals...)
+	return f
+}
+
+// Default sets the default value as a JSON literal.
+func (f *FieldBuilder) Default(literal string) *FieldBuilder {
+	f.field().Rules.Default = literal
+	return f
+}
+
+// Min sets the inclusive minimum of a numeric field.
+func (f *FieldBuilder) Min(v float64) *FieldBuilder {
+	f.field().Rules.Minimum = &v
+	return f
+}
+
+// Max sets the inclusive maximum of a numeric field.
+func (f *FieldBuilder) Max(v float64) *FieldBuilder {
+	f.field().Rules.Maximum = &v
+	return f
+}
+
+// MaxLength limits a string to n characters.
+func (f *FieldBuilder) MaxLength(n int) *FieldBuilder {
+	f.field().Rules.MaxLength = n
+	return f
+}
+
+// Pattern requires a string to match the regular expression.
+func (f *FieldBuilder) Pattern(pattern string) *FieldBuilder {
+	f.field().Rules.Pattern = pattern
+	return f
+}
@@ -0,0 +1,296 @@
+// Package schema saves and loads CStruct trees in a portable, versioned JSON
+// format. Unlike analyzer.CStruct, a schema file does not depend on a Go type
+// being linked into the program, so it can be reviewed, diffed, checked into a
+// repository and used to drive generation on any machine.
+//
+// A file lists every struct once, root first, and nested struct fields refer
+// to other structs by name:
+//
+//	{
+//	  "version": 1,
+//	  "root": "Student",
+//	  "structs": [
+//	    {"name": "Student", "fields": [
+//	      {"name": "first_name", "goName": "FirstName", "cType": "char*", "kind": "string"},
+//	      {"name": "home", "cType": "Address", "kind": "struct", "struct": "Address"}
+//	    ]},
+//	    {"name": "Address", "fields": [...]}
+//	  ]
+//	}
+//
+// Output is deterministic: marshaling the same CStruct always yields the same
+// bytes. FieldInfo.Type is not stored and is nil after loading.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+// Version is the schema file format version written by Marshal. Unmarshal
+// rejects files with a newer version.
+const Version = 1
+
+// File is the on-disk representation of a CStruct tree.
+type File struct {
+	Version int      `json:"version"`
+	Root    string   `json:"root"`
+	Structs []Struct `json:"structs"`
+}
+
+// Struct is one struct of the tree.
+type Struct struct {
+	Name   string  `json:"name"`
+	Fields []Field `json:"fields"`
+}
+
+// Field mirrors analyzer.FieldInfo. Nested structs are referenced by name.
+type Field struct {
+	Name     string  `json:"name"`
+	GoName   string  `json:"goName,omitempty"`
+	CName    string  `json:"cName,omitempty"`
+	CType    string  `json:"cType"`
+	Kind     string  `json:"kind,omitempty"`
+	Offset   uintptr `json:"offset,omitempty"`
+	MaxLen   int     `json:"maxLen,omitempty"`
+	Truncate bool    `json:"truncate,omitempty"`
+	Struct   string  `json:"struct,omitempty"`
+	Elem     *Field  `json:"elem,omitempty"`
+	Len      int     `json:"len,omitempty"`
+	Rules    *Rules  `json:"rules,omitempty"`
+}
+
+// Rules mirrors analyzer.Rules, omitting unset constraints.
+type Rules struct {
+	Required  bool     `json:"required,omitempty"`
+	Nullable  bool     `json:"nullable,omitempty"`
+	Enum      []string `json:"enum,omitempty"`
+	Default   string   `json:"default,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	MaxLength int      `json:"maxLength,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+}
+
+// Save writes cStruct to path in the schema file format.
+func Save(path string, cStruct analyzer.CStruct) error {
+	data, err := Marshal(cStruct)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write schema file: %v", err)
+	}
+	return nil
+}
+
+// Load reads a schema file written by Save.
+func Load(path string) (analyzer.CStruct, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("failed to read schema file: %v", err)
+	}
+	cStruct, err := Unmarshal(data)
+	if err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return cStruct, nil
+}
+
+// Marshal encodes cStruct as an indented schema file.
+func Marshal(cStruct analyzer.CStruct) ([]byte, error) {
+	file, err := NewFile(cStruct)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewFile flattens cStruct into a File. Structs are listed in the order they
+// are first reached from the root, and each distinct name appears once.
+func NewFile(cStruct analyzer.CStruct) (*File, error) {
+	file := &File{Version: Version, Root: cStruct.Name}
+	seen := make(map[string]*analyzer.CStruct)
+
+	var add func(s *analyzer.CStruct) error
+	add = func(s *analyzer.CStruct) error {
+		if existing, ok := seen[s.Name]; ok {
+			if existing != s {
+				return fmt.Errorf("two different structs are named %s", s.Name)
+			}
+			return nil
+		}
+		seen[s.Name] = s
+
+		index := len(file.Structs)
+		file.Structs = append(file.Structs, Struct{Name: s.Name, Fields: []Field{}})
+		var nested []*analyzer.CStruct
+		for _, fi := range s.Fields {
+			field, structs := newField(fi)
+			file.Structs[index].Fields = append(file.Structs[index].Fields, field)
+			nested = append(nested, structs...)
+		}
+		for _, n := range nested {
+			if err := add(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := add(&cStruct); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// newField converts a FieldInfo and returns the nested structs it references.
+func newField(fi analyzer.FieldInfo) (Field, []*analyzer.CStruct) {
+	field := Field{
+		Name:     fi.Name,
+		GoName:   fi.GoName,
+		CName:    fi.CName,
+		CType:    fi.CType,
+		Kind:     fi.Kind,
+		Offset:   fi.Offset,
+		MaxLen:   fi.MaxLen,
+		Truncate: fi.Truncate,
+		Len:      fi.Len,
+	}
+	if !isZeroRules(fi.Rules) {
+		rules := Rules(fi.Rules)
+		field.Rules = &rules
+	}
+
+	var nested []*analyzer.CStruct
+	if fi.Struct != nil {
+		field.Struct = fi.Struct.Name
+		nested = append(nested, fi.Struct)
+	}
+	if fi.Elem != nil {
+		elem, structs := newField(*fi.Elem)
+		field.Elem = &elem
+		nested = append(nested, structs...)
+	}
+	return field, nested
+}
+
+func isZeroRules(r analyzer.Rules) bool {
+	return !r.Required && !r.Nullable && len(r.Enum) == 0 && r.Default == "" &&
+		r.Minimum == nil && r.Maximum == nil && r.MaxLength == 0 && r.Pattern == ""
+}
+
+// Unmarshal decodes a schema file into the root CStruct. References to the
+// same struct name share one *CStruct.
+func Unmarshal(data []byte) (analyzer.CStruct, error) {
+	var file File
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return analyzer.CStruct{}, fmt.Errorf("invalid schema file: %v", err)
+	}
+	return file.CStruct()
+}
+
+// CStruct rebuilds the CStruct tree described by the file.
+func (f *File) CStruct() (analyzer.CStruct, error) {
+	switch {
+	case f.Version == 0:
+		return analyzer.CStruct{}, errors.New("schema file has no version")
+	case f.Version > Version:
+		return analyzer.CStruct{}, fmt.Errorf("schema file version %d is newer than supported version %d", f.Version, Version)
+	}
+
+	structs := make(map[string]*Struct)
+	for i := range f.Structs {
+		s := &f.Structs[i]
+		if _, ok := structs[s.Name]; ok {
+			return analyzer.CStruct{}, fmt.Errorf("duplicate struct %s", s.Name)
+		}
+		structs[s.Name] = s
+	}
+
+	l := &loader{structs: structs, built: make(map[string]*analyzer.CStruct), building: make(map[string]bool)}
+	root, err := l.build(f.Root)
+	if err != nil {
+		return analyzer.CStruct{}, err
+	}
+	return *root, nil
+}
+
+// loader builds each named struct once and rejects self-containing structs,
+// which have no C layout.
+type loader struct {
+	structs  map[string]*Struct
+	built    map[string]*analyzer.CStruct
+	building map[string]bool
+}
+
+func (l *loader) build(name string) (*analyzer.CStruct, error) {
+	if cStruct, ok := l.built[name]; ok {
+		return cStruct, nil
+	}
+	s, ok := l.structs[name]
+	if !ok {
+		return nil, fmt.Errorf("undefined struct %s", name)
+	}
+	if l.building[name] {
+		return nil, fmt.Errorf("struct %s contains itself", name)
+	}
+	l.building[name] = true
+	defer delete(l.building, name)
+
+	cStruct := &analyzer.CStruct{Name: s.Name}
+	for _, field := range s.Fields {
+		fi, err := l.field(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", s.Name, field.Name, err)
+		}
+		cStruct.Fields = append(cStruct.Fields, fi)
+	}
+	l.built[name] = cStruct
+	return cStruct, nil
+}
+
+func (l *loader) field(field Field) (analyzer.FieldInfo, error) {
+	fi := analyzer.FieldInfo{
+		Name:     field.Name,
+		GoName:   field.GoName,
+		CName:    field.CName,
+		CType:    field.CType,
+		Kind:     field.Kind,
+		Offset:   field.Offset,
+		MaxLen:   field.MaxLen,
+		Truncate: field.Truncate,
+		Len:      field.Len,
+	}
+	if field.Rules != nil {
+		fi.Rules = analyzer.Rules(*field.Rules)
+	}
+	if field.Struct != "" {
+		nested, err := l.build(field.Struct)
+		if err != nil {
+			return fi, err
+		}
+		fi.Struct = nested
+	}
+	if field.Elem != nil {
+		elem, err := l.field(*field.Elem)
+		if err != nil {
+			return fi, fmt.Errorf("elem: %v", err)
+		}
+		fi.Elem = &elem
+	}
+	return fi, nil
+}
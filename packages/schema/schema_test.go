@@ -0,0 +1,239 @@
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arifali123/152compiler2/packages/analyzer"
+)
+
+type Student struct {
+	FirstName string `json:"first_name" required:"true"`
+	StudentID int    `json:"student_id" minimum:"1" maximum:"99999"`
+	Grade     string `json:"grade" enum:"A,B,C" default:"A"`
+	Code      string `json:"code" maxlen:"8,truncate"`
+	Photo     []byte `json:"photo" nullable:"true"`
+}
+
+// nestedStudent builds a tree with a struct shared by a field and a slice
+// element, and a fixed array.
+func nestedStudent(t *testing.T) analyzer.CStruct {
+	t.Helper()
+	address := NewBuilder("Address")
+	address.String("street")
+	address.InlineString("zip", 10)
+	addressStruct, err := address.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	b := NewBuilder("Student")
+	b.String("first_name").Required()
+	b.Int("student_id").Min(1).Max(99999)
+	b.String("grade").Enum(`"A"`, `"B"`, `"C"`).Default(`"A"`)
+	b.Bytes("photo").Nullable()
+	b.Object("home", &addressStruct)
+	b.Slice("previous", Nested(&addressStruct))
+	b.Array("scores", Scalar("int"), 3).GoName("Scores")
+	cStruct, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	return cStruct
+}
+
+// normalize clears the reflect.Type fields, which are not stored in a schema
+// file, so trees can be compared with reflect.DeepEqual.
+func normalize(cStruct *analyzer.CStruct) {
+	for i := range cStruct.Fields {
+		normalizeField(&cStruct.Fields[i])
+	}
+}
+
+func normalizeField(fi *analyzer.FieldInfo) {
+	fi.Type = nil
+	if fi.Struct != nil {
+		normalize(fi.Struct)
+	}
+	if fi.Elem != nil {
+		normalizeField(fi.Elem)
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	nested := nestedStudent(t)
+	fieldInfos, err := analyzer.AnalyzeStruct(reflect.TypeOf(Student{}))
+	if err != nil {
+		t.Fatalf("AnalyzeStruct failed: %v", err)
+	}
+	analyzed := analyzer.CStruct{Name: "Student", Fields: fieldInfos}
+
+	for _, cStruct := range []analyzer.CStruct{nested, analyzed} {
+		path := filepath.Join(t.TempDir(), "student.cstruct.json")
+		if err := Save(path, cStruct); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		loaded, err := Load(path)
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+
+		normalize(&cStruct)
+		if !reflect.DeepEqual(cStruct, loaded) {
+			t.Errorf("round trip mismatch:\nwant %+v\ngot  %+v", cStruct, loaded)
+		}
+	}
+
+	loaded, err := Unmarshal(mustMarshal(t, nested))
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if loaded.Fields[4].Struct != loaded.Fields[5].Elem.Struct {
+		t.Error("expected both Address references to share one *CStruct")
+	}
+}
+
+func mustMarshal(t *testing.T, cStruct analyzer.CStruct) []byte {
+	t.Helper()
+	data, err := Marshal(cStruct)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	return data
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	first := mustMarshal(t, nestedStudent(t))
+	loaded, err := Unmarshal(first)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if second := mustMarshal(t, loaded); !bytes.Equal(first, second) {
+		t.Errorf("re-marshaled output differs:\n%s\n---\n%s", first, second)
+	}
+
+	for _, expected := range []string{
+		`"version": 1`,
+		`"root": "Student"`,
+		`"struct": "Address"`,
+		`"maxLen": 10`,
+		`"enum": [`,
+		`"len": 3`,
+	} {
+		if !strings.Contains(string(first), expected) {
+			t.Errorf("output missing %s:\n%s", expected, first)
+		}
+	}
+	if strings.Count(string(first), `"name": "Address"`) != 1 {
+		t.Errorf("expected Address to be listed once:\n%s", first)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		errContains string
+	}{
+		{"not json", `{`, "invalid schema file"},
+		{"unknown key", `{"version": 1, "root": "A", "structs": [], "extra": 1}`, "unknown field"},
+		{"no version", `{"root": "A", "structs": [{"name": "A", "fields": []}]}`, "no version"},
+		{"newer version", `{"version": 99, "root": "A", "structs": []}`, "newer than supported"},
+		{"undefined root", `{"version": 1, "root": "A", "structs": []}`, "undefined struct A"},
+		{"duplicate struct", `{"version": 1, "root": "A", "structs": [{"name": "A", "fields": []}, {"name": "A", "fields": []}]}`, "duplicate struct A"},
+		{"undefined nested", `{"version": 1, "root": "A", "structs": [{"name": "A", "fields": [{"name": "b", "cType": "B", "kind": "struct", "struct": "B"}]}]}`, "A.b: undefined struct B"},
+		{"self containing", `{"version": 1, "root": "A", "structs": [{"name": "A", "fields": [{"name": "a", "cType": "A", "kind": "struct", "struct": "A"}]}]}`, "struct A contains itself"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unmarshal([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("expected error containing %q", tt.errContains)
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("error = %v, want error containing %q", err, tt.errContains)
+			}
+		})
+	}
+
+	a := &analyzer.CStruct{Name: "Same"}
+	b := &analyzer.CStruct{Name: "Same"}
+	root := analyzer.CStruct{Name: "Root", Fields: []analyzer.FieldInfo{Nested(a), Nested(b)}}
+	root.Fields[0].Name, root.Fields[1].Name = "a", "b"
+	if _, err := Marshal(root); err == nil || !strings.Contains(err.Error(), "two different structs are named Same") {
+		t.Errorf("expected name conflict error, got %v", err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder("Student")
+	b.String("first_name").Required()
+	b.Int("student_id").Min(1).Max(99999)
+	b.String("grade").Enum(`"A"`, `"B"`, `"C"`).Default(`"A"`)
+	b.String("code").MaxLen(8, true)
+	b.Bytes("photo").GoName("Photo").Nullable()
+	built, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	fieldInfos, err := analyzer.AnalyzeStruct(reflect.TypeOf(Student{}))
+	if err != nil {
+		t.Fatalf("AnalyzeStruct failed: %v", err)
+	}
+	// The builder has no Go layout, so compare everything but offsets
+	for i := range fieldInfos {
+		fieldInfos[i].Type = nil
+		fieldInfos[i].Offset = 0
+	}
+	fieldInfos[1].GoName = "StudentId"
+	if !reflect.DeepEqual(fieldInfos, built.Fields) {
+		t.Errorf("builder mismatch:\nwant %+v\ngot  %+v", fieldInfos, built.Fields)
+	}
+}
+
+func TestBuilderHeldFields(t *testing.T) {
+	b := NewBuilder("Sample")
+	first := b.String("first-name")
+	for i := 0; i < 8; i++ {
+		b.Int(fmt.Sprintf("n%d", i))
+	}
+	first.Required()
+	built, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if field := built.Fields[0]; !field.Rules.Required || field.CName != "first_name" {
+		t.Errorf("expected first-name required and stored as first_name, got %+v", field)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	b := NewBuilder("")
+	b.Int("a")
+	b.Int("a")
+	b.Int("count").MaxLen(4, false)
+	b.Array("empty", Scalar("int"), 0)
+	b.Object("nested", nil)
+
+	_, err := b.Build()
+	if err == nil {
+		t.Fatal("expected Build to fail")
+	}
+	for _, expected := range []string{
+		"empty struct name",
+		"duplicate field name: a",
+		"field count: maxlen needs a string field",
+		"field empty: array length must be positive",
+		"field nested: nil nested struct",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error missing %q: %v", expected, err)
+		}
+	}
+}